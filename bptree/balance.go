@@ -9,7 +9,7 @@ import (
 	"github.com/timtadh/fs2/fmap"
 )
 
-func (a *internal) balance(v *Varchar, b *internal) error {
+func (a *internal) balance(v *Varchar, cmp Comparator, b *internal) error {
 	if b.meta.keyCount != 0 {
 		return errors.Errorf("b was not empty")
 	}
@@ -24,17 +24,21 @@ func (a *internal) balance(v *Varchar, b *internal) error {
 		fmap.MemClr(a.key(j))
 		*b.ptr(i) = *a.ptr(j)
 		*a.ptr(j) = 0
+		if a.counted() {
+			*b.count(i) = *a.count(j)
+			*a.count(j) = 0
+		}
 	}
 	b.meta.keyCount = a.meta.keyCount - uint16(m)
 	a.meta.keyCount = uint16(m)
 	/*
-		err = checkOrder(v, a)
+		err = checkOrder(v, cmp, a)
 		if err != nil {
 			log.Println("balance point", m)
 			log.Println(a)
 			return err
 		}
-		err = checkOrder(v, b)
+		err = checkOrder(v, cmp, b)
 		if err != nil {
 			log.Println("balance point", m)
 			log.Println(b)
@@ -44,7 +48,7 @@ func (a *internal) balance(v *Varchar, b *internal) error {
 	return nil
 }
 
-func (a *leaf) balance(v *Varchar, b *leaf) error {
+func (a *leaf) balance(v *Varchar, cmp Comparator, b *leaf) error {
 	if b.meta.keyCount != 0 {
 		return errors.Errorf("b was not empty")
 	}
@@ -61,13 +65,13 @@ func (a *leaf) balance(v *Varchar, b *leaf) error {
 		return err
 	}
 	/*
-		err = checkOrder(v, a)
+		err = checkOrder(v, cmp, a)
 		if err != nil {
 			log.Println("balance point", m)
 			log.Println(a)
 			return err
 		}
-		err = checkOrder(v, b)
+		err = checkOrder(v, cmp, b)
 		if err != nil {
 			log.Println("balance point", m)
 			log.Println(b)
@@ -78,6 +82,13 @@ func (a *leaf) balance(v *Varchar, b *leaf) error {
 }
 
 func (a *leaf) balanceAt(b *leaf, m int) error {
+	if a.compressed() {
+		// with the same prefix the key slots can be copied as they are
+		err := b.reprefix(a.prefix())
+		if err != nil {
+			return err
+		}
+	}
 	var lim int = int(a.meta.keyCount) - m
 	for i := 0; i < lim; i++ {
 		j := m + i
@@ -88,6 +99,13 @@ func (a *leaf) balanceAt(b *leaf, m int) error {
 	}
 	b.meta.keyCount = a.meta.keyCount - uint16(m)
 	a.meta.keyCount = uint16(m)
+	if a.compressed() {
+		err := a.tighten()
+		if err != nil {
+			return err
+		}
+		return b.tighten()
+	}
 	return nil
 }
 
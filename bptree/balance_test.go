@@ -49,23 +49,23 @@ func TestBalanceInternal(x *testing.T) {
 		for i := 0; i < cap(kps); i++ {
 			kp := make_kp()
 			kps = append(kps, kp)
-			t.assert_nil(n.putKP(bpt.varchar, kp.key, kp.ptr))
-			t.assert("could not find key in internal", n._has(bpt.varchar, kp.key))
-			t.assert_ptr(kp.ptr)(n.findPtr(bpt.varchar, kp.key))
+			t.assert_nil(n.putKP(bpt.varchar, bpt.cmp, kp.key, kp.ptr))
+			t.assert("could not find key in internal", n._has(bpt.varchar, bpt.cmp, kp.key))
+			t.assert_ptr(kp.ptr)(n.findPtr(bpt.varchar, bpt.cmp, kp.key))
 		}
 		for _, kp := range kps {
-			t.assert("could not find key in internal", n._has(bpt.varchar, kp.key))
-			t.assert_ptr(kp.ptr)(n.findPtr(bpt.varchar, kp.key))
+			t.assert("could not find key in internal", n._has(bpt.varchar, bpt.cmp, kp.key))
+			t.assert_ptr(kp.ptr)(n.findPtr(bpt.varchar, bpt.cmp, kp.key))
 		}
 		b, err := newInternal(0, make([]byte, SIZE), 8)
 		t.assert_nil(err)
-		t.assert_nil(n.balance(bpt.varchar, b))
+		t.assert_nil(n.balance(bpt.varchar, bpt.cmp, b))
 		for _, kp := range kps {
-			t.assert("could not find key in internal", n._has(bpt.varchar, kp.key) || b._has(bpt.varchar, kp.key))
-			if n._has(bpt.varchar, kp.key) {
-				t.assert_ptr(kp.ptr)(n.findPtr(bpt.varchar, kp.key))
+			t.assert("could not find key in internal", n._has(bpt.varchar, bpt.cmp, kp.key) || b._has(bpt.varchar, bpt.cmp, kp.key))
+			if n._has(bpt.varchar, bpt.cmp, kp.key) {
+				t.assert_ptr(kp.ptr)(n.findPtr(bpt.varchar, bpt.cmp, kp.key))
 			} else {
-				t.assert_ptr(kp.ptr)(b.findPtr(bpt.varchar, kp.key))
+				t.assert_ptr(kp.ptr)(b.findPtr(bpt.varchar, bpt.cmp, kp.key))
 			}
 		}
 		for i := 0; i < n.keyCount(); i++ {
@@ -102,23 +102,23 @@ func TestBalanceLeaf(x *testing.T) {
 				break
 			}
 			kvs = append(kvs, kv)
-			t.assert_nil(n.putKV(bpt.varchar, kv.key, kv.value))
-			t.assert("could not find key in leaf", n._has(bpt.varchar, kv.key))
-			t.assert_value(kv.value)(n.firstValue(bpt.varchar, kv.key))
+			t.assert_nil(n.putKV(bpt.varchar, bpt.cmp, kv.key, kv.value))
+			t.assert("could not find key in leaf", n._has(bpt.varchar, bpt.cmp, kv.key))
+			t.assert_value(kv.value)(n.firstValue(bpt.varchar, bpt.cmp, kv.key))
 		}
 		for _, kv := range kvs {
-			t.assert("could not find key in leaf", n._has(bpt.varchar, kv.key))
-			t.assert_value(kv.value)(n.firstValue(bpt.varchar, kv.key))
+			t.assert("could not find key in leaf", n._has(bpt.varchar, bpt.cmp, kv.key))
+			t.assert_value(kv.value)(n.firstValue(bpt.varchar, bpt.cmp, kv.key))
 		}
 		b, err := newLeaf(0, make([]byte, SIZE), 8, 8)
 		t.assert_nil(err)
-		t.assert_nil(n.balance(bpt.varchar, b))
+		t.assert_nil(n.balance(bpt.varchar, bpt.cmp, b))
 		for _, kv := range kvs {
-			t.assert("could not find key in leaf", n._has(bpt.varchar, kv.key) || b._has(bpt.varchar, kv.key))
-			if n._has(bpt.varchar, kv.key) {
-				t.assert_value(kv.value)(n.firstValue(bpt.varchar, kv.key))
+			t.assert("could not find key in leaf", n._has(bpt.varchar, bpt.cmp, kv.key) || b._has(bpt.varchar, bpt.cmp, kv.key))
+			if n._has(bpt.varchar, bpt.cmp, kv.key) {
+				t.assert_value(kv.value)(n.firstValue(bpt.varchar, bpt.cmp, kv.key))
 			} else {
-				t.assert_value(kv.value)(b.firstValue(bpt.varchar, kv.key))
+				t.assert_value(kv.value)(b.firstValue(bpt.varchar, bpt.cmp, kv.key))
 			}
 		}
 		for i := 0; i < n.keyCount(); i++ {
@@ -162,17 +162,17 @@ func TestBalancePureLeaf(x *testing.T) {
 				break
 			}
 			kvs = append(kvs, kv)
-			t.assert_nil(n.putKV(bpt.varchar, kv.key, kv.value))
-			t.assert("could not find key in leaf", n._has(bpt.varchar, kv.key))
+			t.assert_nil(n.putKV(bpt.varchar, bpt.cmp, kv.key, kv.value))
+			t.assert("could not find key in leaf", n._has(bpt.varchar, bpt.cmp, kv.key))
 		}
 		for _, kv := range kvs {
-			t.assert("could not find key in leaf", n._has(bpt.varchar, kv.key))
+			t.assert("could not find key in leaf", n._has(bpt.varchar, bpt.cmp, kv.key))
 		}
 		b, err := newLeaf(0, make([]byte, SIZE), 8, 8)
 		t.assert_nil(err)
-		t.assert_nil(n.balance(bpt.varchar, b))
+		t.assert_nil(n.balance(bpt.varchar, bpt.cmp, b))
 		for _, kv := range kvs {
-			t.assert("could not find key in leaf", n._has(bpt.varchar, kv.key) || b._has(bpt.varchar, kv.key))
+			t.assert("could not find key in leaf", n._has(bpt.varchar, bpt.cmp, kv.key) || b._has(bpt.varchar, bpt.cmp, kv.key))
 		}
 		for i := 0; i < n.keyCount(); i++ {
 			if b.meta.keyCount > 0 {
@@ -0,0 +1,320 @@
+package bptree
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+import (
+	"github.com/timtadh/fs2/consts"
+	"github.com/timtadh/fs2/errors"
+	"github.com/timtadh/fs2/slice"
+)
+
+// A key/value pair for AddBatch.
+type Pair struct {
+	Key   []byte
+	Value []byte
+}
+
+// The pairs of a batch which were not added, by their index in the
+// batch. Every other pair was added.
+type BatchError struct {
+	Errors map[int]error
+}
+
+func (e *BatchError) Error() string {
+	first := -1
+	for i := range e.Errors {
+		if first < 0 || i < first {
+			first = i
+		}
+	}
+	return fmt.Sprintf("%d pairs of the batch were not added, pair %d: %v", len(e.Errors), first, e.Errors[first])
+}
+
+// A WriteBatch collects pairs to add to a tree together (see AddBatch).
+// The keys and values are copied as they are added so the caller may
+// reuse its buffers. The zero value is an empty batch.
+type WriteBatch struct {
+	pairs []Pair
+}
+
+// Add the pair to the batch.
+func (b *WriteBatch) Add(key, value []byte) {
+	k := make([]byte, len(key))
+	copy(k, key)
+	v := make([]byte, len(value))
+	copy(v, value)
+	b.pairs = append(b.pairs, Pair{Key: k, Value: v})
+}
+
+// How many pairs are in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.pairs)
+}
+
+// Empty the batch so it can be used again.
+func (b *WriteBatch) Reset() {
+	b.pairs = b.pairs[:0]
+}
+
+// Add the pairs of the batch to the tree, see AddBatch.
+func (self *BpTree) WriteBatch(b *WriteBatch) error {
+	return self.AddBatch(b.pairs)
+}
+
+// Add all of the pairs to the tree (as Add does, but with one call).
+// The pairs are sorted (pairs with the same key keep their order) and
+// added leaf by leaf: the tree is descended once for each leaf the batch
+// touches and every pair which belongs in the leaf is put straight into
+// it. Pairs which split the leaf, go into a pure run or change the first
+// key of the leaf are added with a full descent. The meta data is written
+// once at the end.
+//
+// A pair with a key or value of the wrong size (or a key which is
+// already in a tree with UniqueKeys) is not added, the rest of the batch
+// is. The pairs which were not added are reported in a *BatchError.
+// Any other error stops the batch part way through.
+func (self *BpTree) AddBatch(pairs []Pair) error {
+	self.lock()
+	defer self.unlock()
+	return self._addBatch(pairs)
+}
+
+func (self *BpTree) _addBatch(pairs []Pair) error {
+	if self.bf.ReadOnly() {
+		return errors.Errorf("Cannot add to a tree in a read only file")
+	}
+	order := make([]int, len(pairs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		c := self.cmp(pairs[order[i]].Key, pairs[order[j]].Key)
+		return c < 0 || (c == 0 && order[i] < order[j])
+	})
+	failed := make(map[int]error)
+	b := &batch{bpt: self}
+	for _, i := range order {
+		itemErr, err := b.add(pairs[i].Key, pairs[i].Value)
+		if err != nil {
+			return err
+		} else if itemErr != nil {
+			failed[i] = itemErr
+		}
+	}
+	err := b.flush()
+	if err != nil {
+		return err
+	}
+	err = self.writeMeta()
+	if err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return &BatchError{Errors: failed}
+	}
+	return nil
+}
+
+// The state of an AddBatch: the leaf the last pair was put in, the path
+// to it and the first key of the next leaf (nil if it is the last).
+type batch struct {
+	bpt   *BpTree
+	leaf  uint64
+	path  []batchStep
+	hi    []byte
+	added uint64 // the pairs put in the leaf which the counts lack
+}
+
+// The child i of the internal node n.
+type batchStep struct {
+	n uint64
+	i int
+}
+
+// Add a pair. A problem with the pair itself is returned as the
+// itemErr, err is for everything else.
+func (b *batch) add(key, value []byte) (itemErr, err error) {
+	bpt := b.bpt
+	if len(key) != int(bpt.meta.keySize) && bpt.meta.flags&consts.VARCHAR_KEYS == 0 {
+		return errors.Errorf("Key was not the correct size got, %v, expected, %v", len(key), bpt.meta.keySize), nil
+	}
+	value, itemErr = bpt.checkValue(value)
+	if itemErr != nil {
+		return itemErr, nil
+	}
+	if b.leaf == 0 || (b.hi != nil && bpt.cmp(key, b.hi) >= 0) {
+		err = b.flush()
+		if err != nil {
+			return nil, err
+		}
+		err = b.descend(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	done, has, err := b.put(key, value)
+	if err != nil {
+		return nil, err
+	} else if has {
+		if bpt.meta.flags&consts.VARCHAR_VALS != 0 {
+			// checkValue stored the value for nothing
+			err = bpt.varchar.Deref(*slice.AsUint64(&value))
+			if err != nil {
+				return nil, err
+			}
+		}
+		return errors.Errorf("The key is already in the tree (it has unique keys), use Put to replace its value"), nil
+	} else if done {
+		bpt.meta.itemCount++
+		b.added++
+		return nil, nil
+	}
+	err = b.flush()
+	if err != nil {
+		return nil, err
+	}
+	var put putFunc
+	if bpt.meta.flags&consts.UNIQUE_KEYS != 0 {
+		// put found the key is not in the tree
+		put = func(old []byte, has bool) (bool, error) { return !has, nil }
+	}
+	cntDelta, root, err := bpt.add(bpt.meta.root, key, value, put)
+	if err != nil {
+		return nil, err
+	}
+	bpt.meta.itemCount += cntDelta
+	bpt.meta.root = root
+	// the tree may have changed shape
+	b.leaf = 0
+	return nil, nil
+}
+
+// Find the leaf the key belongs in.
+func (b *batch) descend(key []byte) error {
+	bpt := b.bpt
+	b.path = b.path[:0]
+	b.hi = nil
+	for a := bpt.meta.root; ; {
+		var kid uint64
+		err := bpt.do(
+			a,
+			func(n *internal) error {
+				i, has, err := find(bpt.varchar, bpt.cmp, n, key)
+				if err != nil {
+					return err
+				}
+				if !has && i > 0 {
+					i--
+				}
+				kid = *n.ptr(i)
+				b.path = append(b.path, batchStep{n: a, i: i})
+				if i+1 >= int(n.meta.keyCount) {
+					// the bound from further up holds
+					return nil
+				}
+				return n.doKeyAt(bpt.varchar, i+1, func(k []byte) error {
+					b.hi = make([]byte, len(k))
+					copy(b.hi, k)
+					return nil
+				})
+			},
+			func(n *leaf) error { return nil },
+		)
+		if err != nil {
+			return err
+		} else if kid == 0 {
+			b.leaf = a
+			return nil
+		}
+		a = kid
+	}
+}
+
+// Put the pair straight into the leaf if it fits (see fits). Has is
+// true if the tree has unique keys and already has the key.
+func (b *batch) put(key, value []byte) (done, has bool, err error) {
+	bpt := b.bpt
+	varchar := bpt.meta.flags&consts.VARCHAR_KEYS != 0
+	var fast bool
+	err = bpt.doLeaf(b.leaf, func(n *leaf) (err error) {
+		var i int
+		i, fast, has, err = b.fits(n, key)
+		if err != nil || !fast || varchar {
+			return err
+		}
+		done = true
+		return n.doPutKV(bpt.varchar, bpt.cmp, i, key, value)
+	})
+	if err != nil || done || !fast {
+		return done, has, err
+	}
+	// the varchar key is stored first as storing it may grow the file
+	vkey, err := bpt.newVarcharKey(b.leaf, key)
+	if err != nil {
+		return false, false, err
+	}
+	err = bpt.doLeaf(b.leaf, func(n *leaf) error {
+		return n.put(bpt.varchar, bpt.cmp, vkey, key, value)
+	})
+	if err != nil {
+		return false, false, err
+	}
+	return true, false, nil
+}
+
+// Can the key be put straight into the leaf? It can if the leaf has more
+// than one key, the key is not before its first key and it fits. Has is
+// true if the tree has unique keys and already has the key. The key goes
+// in at i.
+func (b *batch) fits(n *leaf, key []byte) (i int, fast, has bool, err error) {
+	bpt := b.bpt
+	if n.meta.keyCount == 0 {
+		return 0, false, false, nil
+	}
+	i, has, err = find(bpt.varchar, bpt.cmp, n, key)
+	if err != nil {
+		return 0, false, false, err
+	} else if has && bpt.meta.flags&consts.UNIQUE_KEYS != 0 {
+		return 0, false, true, nil
+	}
+	c, err := n.cmpKeyAt(bpt.varchar, bpt.cmp, 0, key)
+	if err != nil {
+		return 0, false, false, err
+	} else if c < 0 || !n.fitsKey(key) {
+		return 0, false, false, nil
+	}
+	// the keys are in order so the leaf is pure (or may be the start of
+	// a pure run) if its first and last keys are the same
+	err = n.doKeyAt(bpt.varchar, 0, func(first []byte) error {
+		return n.doKeyAt(bpt.varchar, int(n.meta.keyCount)-1, func(last []byte) error {
+			fast = !bytes.Equal(first, last)
+			return nil
+		})
+	})
+	return i, fast, false, err
+}
+
+// Add the pairs put straight into the leaf to the counts on the path to
+// it.
+func (b *batch) flush() error {
+	bpt := b.bpt
+	if b.added == 0 || bpt.meta.flags&consts.SUBTREE_COUNTS == 0 {
+		b.added = 0
+		return nil
+	}
+	for _, s := range b.path {
+		err := bpt.doInternal(s.n, func(n *internal) error {
+			*n.count(s.i) += b.added
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	b.added = 0
+	return nil
+}
@@ -0,0 +1,101 @@
+package bptree
+
+import "testing"
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+import (
+	"github.com/timtadh/fs2/consts"
+)
+
+func (t *T) testAddBatch(keySize, valSize int, kvs KVS, opts ...Option) {
+	bf, clean := t.blkfile()
+	defer clean()
+	bpt, err := New(bf, keySize, valSize, opts...)
+	t.assert_nil(err)
+	perm := rand.Perm(len(kvs))
+	// some pairs go in one at a time so the batches land in a tree
+	for _, i := range perm[:len(perm)/10] {
+		t.assert_nil(bpt.Add(kvs[i].key, kvs[i].value))
+	}
+	perm = perm[len(perm)/10:]
+	b := &WriteBatch{}
+	for len(perm) > 0 {
+		n := 1 + rand.Intn(1500)
+		if n > len(perm) {
+			n = len(perm)
+		}
+		b.Reset()
+		for _, i := range perm[:n] {
+			b.Add(kvs[i].key, kvs[i].value)
+		}
+		t.assert("len", b.Len() == n)
+		t.assert_nil(bpt.WriteBatch(b))
+		t.assert_nil(bpt.Verify())
+		perm = perm[n:]
+	}
+	if bpt.meta.flags&consts.SUBTREE_COUNTS != 0 {
+		t.assert_counts(bpt, kvs)
+	} else {
+		t.assert_loaded(bpt, kvs)
+	}
+}
+
+func TestAddBatchFixed(x *testing.T) {
+	t := (*T)(x)
+	t.testAddBatch(8, 8, t.bulkKVS(6000, t.rand_key, func() []byte { return t.rand_value(8) }))
+}
+
+func TestAddBatchVarchar(x *testing.T) {
+	t := (*T)(x)
+	t.testAddBatch(-1, -1, t.bulkKVS(4000,
+		func() []byte { return t.rand_varchar(1, 30) },
+		func() []byte { return t.rand_varchar(1, 60) }))
+}
+
+func TestAddBatchCounts(x *testing.T) {
+	t := (*T)(x)
+	t.testAddBatch(8, 8, t.bulkKVS(6000, t.rand_key, func() []byte { return t.rand_value(8) }), SubtreeCounts())
+}
+
+func TestAddBatchCompressed(x *testing.T) {
+	t := (*T)(x)
+	t.testAddBatch(24, 8, t.bulkKVS(6000, t.composite_key, func() []byte { return t.rand_value(8) }), PrefixCompression())
+}
+
+func TestAddBatchErrors(x *testing.T) {
+	t := (*T)(x)
+	bf, clean := t.blkfile()
+	defer clean()
+	bpt, err := New(bf, 8, 8, UniqueKeys())
+	t.assert_nil(err)
+	there := t.rand_key()
+	t.assert_nil(bpt.Add(there, t.rand_value(8)))
+	twice := t.rand_key()
+	pairs := []Pair{
+		{Key: t.rand_key(), Value: t.rand_value(8)},
+		{Key: t.rand_key()[:4], Value: t.rand_value(8)},
+		{Key: twice, Value: t.rand_value(8)},
+		{Key: t.rand_key(), Value: t.rand_value(3)},
+		{Key: there, Value: t.rand_value(8)},
+		{Key: twice, Value: t.rand_value(8)},
+		{Key: t.rand_key(), Value: t.rand_value(8)},
+	}
+	err = bpt.AddBatch(pairs)
+	be, ok := err.(*BatchError)
+	t.assert(fmt.Sprintf("expected a *BatchError got %v", err), ok)
+	for _, i := range []int{1, 3, 4, 5} {
+		t.assert(fmt.Sprintf("pair %d should have failed", i), be.Errors[i] != nil)
+	}
+	t.assert(fmt.Sprintf("%d pairs failed", len(be.Errors)), len(be.Errors) == 4)
+	t.assert_nil(bpt.Verify())
+	t.assert("size", bpt.Size() == 4)
+	for _, i := range []int{0, 2, 6} {
+		value, has, err := bpt.Get(pairs[i].Key)
+		t.assert_nil(err)
+		t.assert(fmt.Sprintf("pair %d was added", i), has && string(value) == string(pairs[i].Value))
+	}
+}
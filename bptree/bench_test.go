@@ -175,3 +175,90 @@ func BenchmarkBpTreeAdd(x *testing.B) {
 		clean()
 	}
 }
+
+func BenchmarkBpTreeAddBatch(x *testing.B) {
+	LEAF_CAP := 190
+	t := (*B)(x)
+	x.StopTimer()
+	x.ResetTimer()
+	for TEST := 0; TEST < t.N; TEST++ {
+		bf, clean := t.blkfile()
+		bpt, err := New(bf, 8, 8)
+		t.assert_nil(err)
+		pairs := make([]Pair, 0, LEAF_CAP*20)
+		for i := 0; i < cap(pairs); i++ {
+			pairs = append(pairs, Pair{
+				Key:   t.rand_key(),
+				Value: t.rand_value(8),
+			})
+		}
+		{
+			x.StartTimer()
+			t.assert_nil(bpt.AddBatch(pairs))
+			x.StopTimer()
+		}
+		clean()
+	}
+}
+
+func BenchmarkBpTreeAddFixed(x *testing.B) {
+	LEAF_CAP := 190
+	t := (*B)(x)
+	x.StopTimer()
+	x.ResetTimer()
+	for TEST := 0; TEST < t.N; TEST++ {
+		bf, clean := t.blkfile()
+		bpt, err := New(bf, 8, 8)
+		t.assert_nil(err)
+		pairs := make([]Pair, 0, LEAF_CAP*20)
+		for i := 0; i < cap(pairs); i++ {
+			pairs = append(pairs, Pair{
+				Key:   t.rand_key(),
+				Value: t.rand_value(8),
+			})
+		}
+		{
+			x.StartTimer()
+			for _, p := range pairs {
+				t.assert_nil(bpt.Add(p.Key, p.Value))
+			}
+			x.StopTimer()
+		}
+		clean()
+	}
+}
+
+// A tree of fixed size pairs for the read benchmarks.
+func (t *B) loaded(n int) (*BpTree, func()) {
+	bf, clean := t.blkfile()
+	bpt, err := New(bf, 8, 8)
+	t.assert_nil(err)
+	for i := 0; i < n; i++ {
+		t.assert_nil(bpt.Add(t.rand_key(), t.rand_value(8)))
+	}
+	return bpt, clean
+}
+
+func BenchmarkBpTreeRange(x *testing.B) {
+	t := (*B)(x)
+	bpt, clean := t.loaded(190 * 20)
+	defer clean()
+	x.ReportAllocs()
+	x.ResetTimer()
+	for TEST := 0; TEST < t.N; TEST++ {
+		t.assert_nil(bpt.DoRange(nil, nil, func(k, v []byte) error { return nil }))
+	}
+}
+
+func BenchmarkBpTreeViewRange(x *testing.B) {
+	t := (*B)(x)
+	bpt, clean := t.loaded(190 * 20)
+	defer clean()
+	x.ReportAllocs()
+	x.ResetTimer()
+	for TEST := 0; TEST < t.N; TEST++ {
+		t.assert_nil(bpt.View(func(v ReadView) error {
+			return v.DoRange(nil, nil, func(k, v []byte) error { return nil })
+		}))
+	}
+}
@@ -1,10 +1,14 @@
 package bptree
 
 import (
+	"bytes"
 	"reflect"
+	"sync"
+	"sync/atomic"
 )
 
 import (
+	"github.com/timtadh/fs2/checksum"
 	"github.com/timtadh/fs2/consts"
 	"github.com/timtadh/fs2/errors"
 	"github.com/timtadh/fs2/fmap"
@@ -12,11 +16,28 @@ import (
 )
 
 // The Ubiquitous B+ Tree
+//
+// The whole tree is latched with one readers/writer lock, the nodes are
+// not latched individually. Any number of readers (Has, Count, Find,
+// Range and the steps of the iterators) may run at once but a writer
+// (Add, Remove, ...) waits for every reader holding the latch and the
+// readers wait for the writer. Iterators only hold the latch while they
+// step so a writer may change the tree in between steps. Reads which
+// must run while the tree is being written (or must not see the writes)
+// should be made on a Snapshot(), it does not take the tree's latch.
+// Views (see View) hold the latch for as long as they run.
 type BpTree struct {
 	bf      *fmap.BlockFile
 	varchar *Varchar
 	metaOff uint64
 	meta    *bpTreeMeta
+	latch   sync.RWMutex
+	nodes   checksum.Tracker
+	cmp     Comparator
+	mods    uint64     // bumped by every write, Cursors use it to notice changes
+	readers int32      // goroutines holding the read latch, use sync/atomic
+	tx      *Tx        // the open transaction, guarded by the latch
+	txEnded *sync.Cond // signaled (with the latch) when the transaction ends
 }
 
 type bpTreeMeta struct {
@@ -26,6 +47,9 @@ type bpTreeMeta struct {
 	keySize     uint16
 	valSize     uint16
 	flags       consts.Flag
+	version     uint16
+	magic       uint32
+	compare     [MaxComparatorName]byte // set if flags has COMPARATOR
 }
 
 var bpTreeMetaSize uintptr
@@ -42,7 +66,11 @@ func newBpTreeMeta(bf *fmap.BlockFile, metaOff uint64, keySize, valSize uint16,
 	}
 	err = bf.Do(a, 1, func(bytes []byte) error {
 		_, err := newLeaf(flags, bytes, keySize, valSize)
-		return err
+		if err != nil {
+			return err
+		}
+		sealNode(bytes)
+		return nil
 	})
 	if err != nil {
 		return nil, err
@@ -58,6 +86,8 @@ func newBpTreeMeta(bf *fmap.BlockFile, metaOff uint64, keySize, valSize uint16,
 		keySize:     keySize,
 		valSize:     valSize,
 		flags:       flags,
+		version:     VERSION,
+		magic:       bpTreeMagic,
 	}
 	return meta, nil
 }
@@ -82,6 +112,9 @@ func (m *bpTreeMeta) Clone() *bpTreeMeta {
 		keySize:     m.keySize,
 		valSize:     m.valSize,
 		flags:       m.flags,
+		version:     m.version,
+		magic:       m.magic,
+		compare:     m.compare,
 	}
 }
 
@@ -92,28 +125,68 @@ func (m *bpTreeMeta) CopyInto(o *bpTreeMeta) {
 	o.keySize = m.keySize
 	o.valSize = m.valSize
 	o.flags = m.flags
+	o.version = m.version
+	o.magic = m.magic
+	o.compare = m.compare
 }
 
 func (b *BpTree) doMeta(do func(*bpTreeMeta) error) error {
-	return b.bf.Do(b.metaOff, 1, func(data []byte) error {
+	return b.doBlock(b.metaOff, func(data []byte) error {
 		meta := (*bpTreeMeta)(slice.AsSlice(&data).Array)
 		return do(meta)
 	})
 }
 
 func (b *BpTree) writeMeta() error {
+	b.mods++
 	return b.doMeta(func(m *bpTreeMeta) error {
 		b.meta.CopyInto(m)
 		return nil
 	})
 }
 
+// Take the write latch once no transaction is open on the tree (see
+// Begin). The methods of a Tx take the latch directly.
+func (b *BpTree) lock() {
+	b.latch.Lock()
+	for b.tx != nil {
+		b.txEnded.Wait()
+	}
+}
+
+func (b *BpTree) unlock() {
+	b.latch.Unlock()
+}
+
+// Take the read latch. While any goroutine holds it no one writes the
+// tree, so the blocks are loaded for reading (see doBlock).
+func (b *BpTree) rlock() {
+	b.latch.RLock()
+	atomic.AddInt32(&b.readers, 1)
+}
+
+func (b *BpTree) runlock() {
+	atomic.AddInt32(&b.readers, -1)
+	b.latch.RUnlock()
+}
+
+// Load the block at a. While the tree is being read it is loaded with
+// DoRead so it is not logged, journaled or copied into the snapshots of
+// the file (none of which a read needs).
+func (b *BpTree) doBlock(a uint64, do func([]byte) error) error {
+	if atomic.LoadInt32(&b.readers) > 0 {
+		return b.bf.DoRead(a, 1, do)
+	}
+	return b.bf.Do(a, 1, do)
+}
+
 // Create a new B+ Tree in the given BlockFile.
 //
 // bf *BlockFile. Can be an anonymous map or a file backed map
 // keySize int. If this is negative it will use varchar keys
 // valSize int. If this is negative it will use varchar values
-func New(bf *fmap.BlockFile, keySize, valSize int) (*BpTree, error) {
+// opts ...Option. See Checksums and CompareWith
+func New(bf *fmap.BlockFile, keySize, valSize int, opts ...Option) (*BpTree, error) {
 	metaOff, err := bf.Allocate()
 	if err != nil {
 		return nil, err
@@ -125,20 +198,38 @@ func New(bf *fmap.BlockFile, keySize, valSize int) (*BpTree, error) {
 	if err != nil {
 		return nil, err
 	}
-	return NewAt(bf, metaOff, keySize, valSize)
+	return NewAt(bf, metaOff, keySize, valSize, opts...)
+}
+
+// Create a new B+ Tree whose keys may be any length (including empty).
+// The keys (and the values) are stored in the tree's Varchar and are
+// ordered lexicographically (as by bytes.Compare) exactly like fixed
+// size keys. This is the same as New(bf, -1, -1, opts...).
+func NewVarKeys(bf *fmap.BlockFile, opts ...Option) (*BpTree, error) {
+	return New(bf, -1, -1, opts...)
 }
 
-func NewAt(bf *fmap.BlockFile, metaOff uint64, keySize, valSize int) (*BpTree, error) {
+func NewAt(bf *fmap.BlockFile, metaOff uint64, keySize, valSize int, opts ...Option) (*BpTree, error) {
 	if bf.BlockSize() != consts.BLOCKSIZE {
 		return nil, errors.Errorf("The block size must be %v, got %v", consts.BLOCKSIZE, bf.BlockSize())
 	}
-	if keysPerInternal(int(bf.BlockSize()), keySize+valSize) < 3 {
-		return nil, errors.Errorf("Key is too large (fewer than 3 keys per internal node)")
-	}
 	if keySize == 0 {
 		return nil, errors.Errorf("keySize was 0")
 	}
-	var flags consts.Flag = 0
+	o := makeOptions(opts)
+	var flags consts.Flag = o.flags
+	cmp := Comparator(bytes.Compare)
+	if o.comparator != "" && o.comparator != DefaultComparator {
+		var err error
+		cmp, err = lookupComparator(o.comparator)
+		if err != nil {
+			return nil, err
+		}
+		flags = flags | consts.COMPARATOR
+	}
+	if flags&consts.PREFIX_COMPRESSION != 0 && (keySize < 0 || flags&consts.COMPARATOR != 0) {
+		return nil, errors.Errorf("PrefixCompression needs fixed size keys in the default order")
+	}
 	if keySize < 0 {
 		keySize = 8
 		flags = flags | consts.VARCHAR_KEYS
@@ -147,13 +238,25 @@ func NewAt(bf *fmap.BlockFile, metaOff uint64, keySize, valSize int) (*BpTree, e
 		valSize = 8
 		flags = flags | consts.VARCHAR_VALS
 	}
+	if keysPerInternal(int(bf.BlockSize()), keySize+valSize) < 3 {
+		return nil, errors.Errorf("Key is too large (fewer than 3 keys per internal node)")
+	}
+	if flags&consts.CHECKSUMS != 0 {
+		err := bf.AddFeatures(fmap.FEATURE_CHECKSUMS)
+		if err != nil {
+			return nil, err
+		}
+	}
 	meta, err := newBpTreeMeta(bf, metaOff, uint16(keySize), uint16(valSize), flags)
 	if err != nil {
 		return nil, err
 	}
+	if flags&consts.COMPARATOR != 0 {
+		copy(meta.compare[:], o.comparator)
+	}
 	var v *Varchar
 	if flags&(consts.VARCHAR_KEYS|consts.VARCHAR_VALS) != 0 {
-		v, err = NewVarchar(bf, meta.varcharCtrl)
+		v, err = NewVarchar(bf, meta.varcharCtrl, flagOptions(flags)...)
 		if err != nil {
 			return nil, err
 		}
@@ -163,6 +266,10 @@ func NewAt(bf *fmap.BlockFile, metaOff uint64, keySize, valSize int) (*BpTree, e
 		metaOff: metaOff,
 		meta:    meta,
 		varchar: v,
+		cmp:     cmp,
+	}
+	if v != nil {
+		v.reading = &bpt.readers
 	}
 	return bpt, bpt.writeMeta()
 }
@@ -183,6 +290,14 @@ func OpenAt(bf *fmap.BlockFile, metaOff uint64) (*BpTree, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = meta.validate(bf)
+	if err != nil {
+		return nil, err
+	}
+	cmp, err := meta.comparator()
+	if err != nil {
+		return nil, err
+	}
 	var v *Varchar
 	if meta.flags&(consts.VARCHAR_KEYS|consts.VARCHAR_VALS) != 0 {
 		v, err = OpenVarchar(bf, meta.varcharCtrl)
@@ -195,16 +310,34 @@ func OpenAt(bf *fmap.BlockFile, metaOff uint64) (*BpTree, error) {
 		metaOff: metaOff,
 		meta:    meta,
 		varchar: v,
+		cmp:     cmp,
+	}
+	if v != nil {
+		v.reading = &bpt.readers
+	}
+	if meta.version < VERSION {
+		err = bpt.migrate()
+		if err != nil {
+			return nil, err
+		}
 	}
 	return bpt, nil
 }
 
-// What is the key size of this tree?
+// What is the key size of this tree? It is -1 if the keys are variable
+// length (see NewVarKeys).
 func (b *BpTree) KeySize() int {
+	b.rlock()
+	defer b.runlock()
+	if b.meta.flags&consts.VARCHAR_KEYS != 0 {
+		return -1
+	}
 	return int(b.meta.keySize)
 }
 
 // How many items are in the tree?
 func (b *BpTree) Size() int {
+	b.rlock()
+	defer b.runlock()
 	return int(b.meta.itemCount)
 }
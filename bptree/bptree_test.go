@@ -0,0 +1,118 @@
+package bptree
+
+import "testing"
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+import (
+	"github.com/timtadh/fs2/fmap"
+)
+
+func TestNewVarKeys(x *testing.T) {
+	t := (*T)(x)
+	bf, err := fmap.CreateBlockFile(PATH)
+	t.assert_nil(err)
+	defer func() {
+		t.assert_nil(bf.Remove())
+	}()
+	bpt, err := NewVarKeys(bf)
+	t.assert_nil(err)
+	t.assert("key size", bpt.KeySize() == -1)
+
+	// keys which are prefixes of each other, empty and long keys and
+	// duplicates of all of them
+	kvs := make(KVS, 0, 2000)
+	for _, k := range [][]byte{{}, {0}, []byte("a"), []byte("ab"), []byte("abc"), []byte("b"), bytes.Repeat([]byte("z"), 3*fmap.BLOCKSIZE)} {
+		for j := 0; j < 3; j++ {
+			kvs = append(kvs, &KV{key: k, value: []byte(fmt.Sprintf("%x-%d", k, j))})
+		}
+	}
+	for len(kvs) < cap(kvs) {
+		kv := &KV{key: t.rand_varchar(0, 40), value: t.rand_varchar(1, 64)}
+		kvs = append(kvs, kv)
+		if len(kvs)%5 == 0 && len(kvs) < cap(kvs) {
+			kvs = append(kvs, &KV{key: kv.key, value: t.rand_varchar(1, 64)})
+		}
+	}
+	for _, kv := range kvs {
+		t.assert_nil(bpt.Add(kv.key, kv.value))
+	}
+	sort.Stable(kvs)
+
+	check := func(bpt *BpTree) {
+		t.assert("size", bpt.Size() == len(kvs))
+		for i, kv := range kvs {
+			t.assert_hasKV(bpt)(fmt.Sprintf("idx %v", i), kv.key, kv.value)
+			count := 0
+			for _, o := range kvs {
+				if bytes.Equal(o.key, kv.key) {
+					count++
+				}
+			}
+			c, err := bpt.Count(kv.key)
+			t.assert_nil(err)
+			t.assert(fmt.Sprintf("count %v != %v", c, count), c == count)
+		}
+		// the whole tree in order, forwards and backwards
+		i := 0
+		t.assert_nil(bpt.DoRange(nil, nil, func(k, v []byte) error {
+			t.assert(fmt.Sprintf("forward key %d", i), bytes.Equal(k, kvs[i].key))
+			i++
+			return nil
+		}))
+		t.assert("forward count", i == len(kvs))
+		i = len(kvs)
+		t.assert_nil(bpt.DoRange(kvs[len(kvs)-1].key, kvs[0].key, func(k, v []byte) error {
+			i--
+			t.assert(fmt.Sprintf("backward key %d", i), bytes.Equal(k, kvs[i].key))
+			return nil
+		}))
+		t.assert("backward count", i == 0)
+		// a range between prefixes
+		from, to := []byte("a"), []byte("abc")
+		count := 0
+		for _, kv := range kvs {
+			if bytes.Compare(kv.key, from) >= 0 && bytes.Compare(kv.key, to) <= 0 {
+				count++
+			}
+		}
+		found := 0
+		t.assert_nil(bpt.DoRange(from, to, func(k, v []byte) error {
+			t.assert("in range", bytes.Compare(k, from) >= 0 && bytes.Compare(k, to) <= 0)
+			found++
+			return nil
+		}))
+		t.assert(fmt.Sprintf("range found %v expected %v", found, count), found == count)
+	}
+	check(bpt)
+
+	fixed, clean := t.bptFixed()
+	t.assert("fixed key size", fixed.KeySize() == 8)
+	t.assert("a short key should be rejected by a fixed tree", fixed.Add([]byte("short"), t.rand_value(8)) != nil)
+	clean()
+
+	// survives reopening
+	t.assert_nil(bf.Close())
+	bf, err = fmap.OpenBlockFile(PATH)
+	t.assert_nil(err)
+	bpt, err = Open(bf)
+	t.assert_nil(err)
+	t.assert("key size after open", bpt.KeySize() == -1)
+	check(bpt)
+
+	// removing one of the duplicates of a prefix key leaves the rest
+	t.assert_nil(bpt.Remove([]byte("ab"), func(v []byte) bool {
+		return bytes.Equal(v, []byte(fmt.Sprintf("%x-%d", "ab", 1)))
+	}))
+	c, err := bpt.Count([]byte("ab"))
+	t.assert_nil(err)
+	t.assert("removed one duplicate", c == 2)
+	c, err = bpt.Count([]byte("abc"))
+	t.assert_nil(err)
+	t.assert("the longer key is untouched", c == 3)
+	t.assert_nil(bf.Close())
+}
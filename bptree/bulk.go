@@ -0,0 +1,375 @@
+package bptree
+
+import (
+	"bytes"
+	"math"
+)
+
+import (
+	"github.com/timtadh/fs2"
+	"github.com/timtadh/fs2/consts"
+	"github.com/timtadh/fs2/errors"
+	"github.com/timtadh/fs2/fmap"
+	"github.com/timtadh/fs2/slice"
+)
+
+// How full BulkLoad packs the leaves and internal nodes, 0 < f <= 1.
+// The default is 1 (as full as the nodes get through Add). Trees which
+// will have more keys added after they are loaded should use a lower
+// fill factor so the Adds do not split every node they touch. Trees
+// made with PrefixCompression ignore it.
+func FillFactor(f float64) Option {
+	return func(o *options) {
+		o.fill = f
+	}
+}
+
+// Create a new B+ Tree (as New does) filled with the key/value pairs
+// from kvi. The keys must be in order (by the tree's Comparator, see
+// CompareWith) and may repeat. Rather than inserting the pairs one by
+// one the leaves are packed (see FillFactor) as the pairs are read and
+// the internal nodes are built on top of them at the end, which is
+// much faster than calling Add for every pair. If an error is returned
+// the tree is incomplete and the BlockFile should be discarded.
+func BulkLoad(bf *fmap.BlockFile, keySize, valSize int, kvi fs2.Iterator, opts ...Option) (*BpTree, error) {
+	bpt, err := New(bf, keySize, valSize, opts...)
+	if err != nil {
+		return nil, err
+	}
+	err = bpt.bulkLoad(kvi, makeOptions(opts).fill)
+	if err != nil {
+		return nil, err
+	}
+	return bpt, nil
+}
+
+// BulkLoad a tree whose meta data goes in the (allocated) block at
+// metaOff, see NewAt.
+func BulkLoadAt(bf *fmap.BlockFile, metaOff uint64, keySize, valSize int, kvi fs2.Iterator, opts ...Option) (*BpTree, error) {
+	bpt, err := NewAt(bf, metaOff, keySize, valSize, opts...)
+	if err != nil {
+		return nil, err
+	}
+	err = bpt.bulkLoad(kvi, makeOptions(opts).fill)
+	if err != nil {
+		return nil, err
+	}
+	return bpt, nil
+}
+
+// A key (in the form it is stored in the nodes), the node it leads to
+// and the number of pairs under the node.
+type bulkKP struct {
+	key   []byte
+	ptr   uint64
+	count uint64
+}
+
+type bulkLoader struct {
+	bpt      *BpTree
+	target   int      // how many pairs go in a leaf before starting another
+	max      int      // how many pairs fit in a leaf
+	index    []bulkKP // the leaves which go in the internal nodes
+	leaf     uint64   // the leaf being filled
+	count    int      // the pairs in the leaf
+	runStart int      // where the run of the current key starts in the leaf
+	chained  bool     // the leaf continues a pure run (it is not in the index)
+	key      []byte   // the current key
+	vkey     []byte   // the current key as stored (differs for varchar keys)
+}
+
+func (self *BpTree) bulkLoad(kvi fs2.Iterator, fill float64) (err error) {
+	self.lock()
+	defer self.unlock()
+	if fill == 0 {
+		fill = 1
+	} else if fill < 0 || fill > 1 || math.IsNaN(fill) {
+		return errors.Errorf("The fill factor must be in (0, 1], got %v", fill)
+	}
+	if self.meta.itemCount != 0 {
+		return errors.Errorf("Can only bulk load into an empty tree")
+	}
+	if self.meta.flags&consts.PREFIX_COMPRESSION != 0 {
+		return self.addEach(kvi)
+	}
+	l := &bulkLoader{bpt: self, leaf: self.meta.root, runStart: -1}
+	err = self.doLeaf(l.leaf, func(n *leaf) error {
+		l.max = int(n.meta.keyCap) - 1
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	l.target = int(fill * float64(l.max))
+	if l.target < 1 {
+		l.target = 1
+	}
+	var key, value []byte
+	for key, value, err, kvi = kvi(); kvi != nil; key, value, err, kvi = kvi() {
+		if err := l.add(key, value); err != nil {
+			return err
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if l.count == 0 {
+		return nil
+	}
+	root, err := l.buildIndex(fill)
+	if err != nil {
+		return err
+	}
+	self.meta.root = root
+	return self.writeMeta()
+}
+
+// Load a compressed tree (see PrefixCompression) by adding the pairs one
+// at a time. How many pairs fit in a leaf depends on the prefix its keys
+// share so the leaves cannot be packed ahead of time.
+func (self *BpTree) addEach(kvi fs2.Iterator) (err error) {
+	var prev []byte
+	var key, value []byte
+	for key, value, err, kvi = kvi(); kvi != nil; key, value, err, kvi = kvi() {
+		if len(key) != int(self.meta.keySize) {
+			return errors.Errorf("Key was not the correct size got, %v, expected, %v", len(key), self.meta.keySize)
+		}
+		same := prev != nil && bytes.Equal(key, prev)
+		if prev != nil && !same && self.cmp(prev, key) > 0 {
+			return errors.Errorf("BulkLoad needs the keys in order, %v came after %v", key, prev)
+		} else if same && self.meta.flags&consts.UNIQUE_KEYS != 0 {
+			return errors.Errorf("The tree has unique keys but %v repeated", key)
+		}
+		prev = append(prev[:0], key...)
+		value, err = self.checkValue(value)
+		if err != nil {
+			return err
+		}
+		cntDelta, root, err := self.add(self.meta.root, key, value, nil)
+		if err != nil {
+			return err
+		}
+		self.meta.itemCount += cntDelta
+		self.meta.root = root
+	}
+	if err != nil {
+		return err
+	}
+	return self.writeMeta()
+}
+
+func (l *bulkLoader) add(key, value []byte) (err error) {
+	bpt := l.bpt
+	if len(key) != int(bpt.meta.keySize) && bpt.meta.flags&consts.VARCHAR_KEYS == 0 {
+		return errors.Errorf("Key was not the correct size got, %v, expected, %v", len(key), bpt.meta.keySize)
+	}
+	same := l.key != nil && bytes.Equal(key, l.key)
+	if l.key != nil && !same && bpt.cmp(l.key, key) > 0 {
+		return errors.Errorf("BulkLoad needs the keys in order, %v came after %v", key, l.key)
+	} else if same && bpt.meta.flags&consts.UNIQUE_KEYS != 0 {
+		return errors.Errorf("The tree has unique keys but %v repeated", key)
+	}
+	value, err = bpt.checkValue(value)
+	if err != nil {
+		return err
+	}
+	if same {
+		if l.runStart == 0 && l.count >= l.max {
+			// the leaf only has this key, continue the pure run
+			if err := l.nextLeaf(false); err != nil {
+				return err
+			}
+		} else if l.runStart > 0 && l.count >= l.target {
+			// the run goes in a leaf (run) of its own
+			if err := l.moveRun(); err != nil {
+				return err
+			}
+		}
+		if bpt.meta.flags&consts.VARCHAR_KEYS != 0 {
+			if err := bpt.varchar.Ref(*slice.AsUint64(&l.vkey)); err != nil {
+				return err
+			}
+		}
+	} else {
+		l.key = append(l.key[:0], key...)
+		if l.key == nil {
+			l.key = []byte{}
+		}
+		l.vkey, err = l.storedKey(key)
+		if err != nil {
+			return err
+		}
+		if l.chained || l.count >= l.target {
+			if err := l.nextLeaf(true); err != nil {
+				return err
+			}
+		} else if l.count == 0 {
+			l.index = append(l.index, bulkKP{key: l.vkey, ptr: l.leaf})
+		}
+		l.runStart = l.count
+	}
+	err = bpt.doLeaf(l.leaf, func(n *leaf) error {
+		copy(n.key(l.count), l.vkey)
+		copy(n.val(l.count), value)
+		n.meta.keyCount++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	l.count++
+	l.index[len(l.index)-1].count++
+	bpt.meta.itemCount++
+	return nil
+}
+
+// The key as it is stored in the nodes, for varchar keys this allocates
+// the key (with one reference for its first pair).
+func (l *bulkLoader) storedKey(key []byte) ([]byte, error) {
+	bpt := l.bpt
+	if bpt.meta.flags&consts.VARCHAR_KEYS == 0 {
+		k := make([]byte, len(key))
+		copy(k, key)
+		return k, nil
+	}
+	a, err := bpt.varchar.Alloc(len(key))
+	if err != nil {
+		return nil, err
+	}
+	err = bpt.varchar.Do(a, func(data []byte) error {
+		copy(data, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return slice.Uint64AsSlice(&a), nil
+}
+
+// Start filling a new leaf. Indexed leaves go in the internal nodes, the
+// others continue a pure run.
+func (l *bulkLoader) nextLeaf(indexed bool) error {
+	bpt := l.bpt
+	a, err := bpt.newLeaf()
+	if err != nil {
+		return err
+	}
+	prev := l.leaf
+	err = bpt.doLeaf(prev, func(p *leaf) error {
+		return bpt.doLeaf(a, func(n *leaf) error {
+			p.meta.next = a
+			n.meta.prev = prev
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if indexed {
+		l.index = append(l.index, bulkKP{key: l.vkey, ptr: a})
+	}
+	l.leaf = a
+	l.count = 0
+	l.runStart = 0
+	l.chained = !indexed
+	return nil
+}
+
+// Move the run of the current key out of the leaf into a new leaf.
+func (l *bulkLoader) moveRun() error {
+	from := l.leaf
+	start := l.runStart
+	moved := l.count - start
+	if err := l.nextLeaf(true); err != nil {
+		return err
+	}
+	err := l.bpt.doLeaf(from, func(m *leaf) error {
+		return l.bpt.doLeaf(l.leaf, func(n *leaf) error {
+			for i := 0; i < moved; i++ {
+				copy(n.key(i), m.key(start+i))
+				copy(n.val(i), m.val(start+i))
+				fmap.MemClr(m.key(start + i))
+				fmap.MemClr(m.val(start + i))
+			}
+			n.meta.keyCount = uint16(moved)
+			m.meta.keyCount = uint16(start)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	l.count = moved
+	l.index[len(l.index)-2].count -= uint64(moved)
+	l.index[len(l.index)-1].count = uint64(moved)
+	return nil
+}
+
+// Build the internal nodes over the indexed leaves, level by level,
+// returning the root.
+func (l *bulkLoader) buildIndex(fill float64) (uint64, error) {
+	bpt := l.bpt
+	level := l.index
+	for len(level) > 1 {
+		a, err := bpt.newInternal()
+		if err != nil {
+			return 0, err
+		}
+		var max int
+		err = bpt.doInternal(a, func(n *internal) error {
+			max = int(n.meta.keyCap) - 1
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		target := int(fill * float64(max))
+		if target < 2 {
+			target = 2
+		}
+		// spread the keys evenly so the last node is not nearly empty
+		nodes := (len(level) + target - 1) / target
+		next := make([]bulkKP, 0, nodes)
+		for i := 0; i < nodes; i++ {
+			s := i * len(level) / nodes
+			e := (i + 1) * len(level) / nodes
+			if i > 0 {
+				a, err = bpt.newInternal()
+				if err != nil {
+					return 0, err
+				}
+			}
+			err = l.fillInternal(a, level[s:e])
+			if err != nil {
+				return 0, err
+			}
+			var count uint64
+			for _, kp := range level[s:e] {
+				count += kp.count
+			}
+			next = append(next, bulkKP{key: level[s].key, ptr: a, count: count})
+		}
+		level = next
+	}
+	return level[0].ptr, nil
+}
+
+func (l *bulkLoader) fillInternal(a uint64, kps []bulkKP) error {
+	bpt := l.bpt
+	return bpt.doInternal(a, func(n *internal) error {
+		for i, kp := range kps {
+			if bpt.meta.flags&consts.VARCHAR_KEYS != 0 {
+				if err := bpt.varchar.Ref(*slice.AsUint64(&kp.key)); err != nil {
+					return err
+				}
+			}
+			copy(n.key(i), kp.key)
+			*n.ptr(i) = kp.ptr
+			if n.counted() {
+				*n.count(i) = kp.count
+			}
+		}
+		n.meta.keyCount = uint16(len(kps))
+		return nil
+	})
+}
@@ -0,0 +1,153 @@
+package bptree
+
+import "testing"
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+import (
+	"github.com/timtadh/fs2"
+)
+
+func kvsIterator(kvs KVS) fs2.Iterator {
+	var kvi fs2.Iterator
+	i := 0
+	kvi = func() ([]byte, []byte, error, fs2.Iterator) {
+		if i >= len(kvs) {
+			return nil, nil, nil, nil
+		}
+		kv := kvs[i]
+		i++
+		return kv.key, kv.value, nil, kvi
+	}
+	return kvi
+}
+
+// sorted pairs with some long runs of duplicate keys (which become pure
+// runs) and some short ones
+func (t *T) bulkKVS(n int, key func() []byte, value func() []byte) KVS {
+	kvs := make(KVS, 0, n)
+	for len(kvs) < n {
+		k := key()
+		dups := 1
+		switch len(kvs) % 7 {
+		case 0:
+			dups = 3
+		case 3:
+			dups = 600
+		}
+		for j := 0; j < dups && len(kvs) < n; j++ {
+			kvs = append(kvs, &KV{key: k, value: value()})
+		}
+	}
+	sort.Stable(kvs)
+	return kvs
+}
+
+func (t *T) assert_loaded(bpt *BpTree, kvs KVS) {
+	t.assert_nil(bpt.Verify())
+	t.assert(fmt.Sprintf("size %v != %v", bpt.Size(), len(kvs)), bpt.Size() == len(kvs))
+	seen := make(map[string]int)
+	i := 0
+	t.assert_nil(bpt.DoRange(nil, nil, func(k, v []byte) error {
+		t.assert(fmt.Sprintf("key %d out of order", i), bytes.Equal(k, kvs[i].key))
+		seen[string(k)+"|"+string(v)]++
+		i++
+		return nil
+	}))
+	t.assert(fmt.Sprintf("iterated %v expected %v", i, len(kvs)), i == len(kvs))
+	for _, kv := range kvs {
+		seen[string(kv.key)+"|"+string(kv.value)]--
+	}
+	for _, c := range seen {
+		t.assert("the values should match", c == 0)
+	}
+	for i := 0; i < len(kvs); i += 97 {
+		c, err := bpt.Count(kvs[i].key)
+		t.assert_nil(err)
+		expected := 0
+		for _, kv := range kvs {
+			if bytes.Equal(kv.key, kvs[i].key) {
+				expected++
+			}
+		}
+		t.assert(fmt.Sprintf("count %v expected %v", c, expected), c == expected)
+	}
+}
+
+func (t *T) testBulkLoad(kvs KVS, keySize, valSize int, opts ...Option) {
+	bf, clean := t.blkfile()
+	defer clean()
+	bpt, err := BulkLoad(bf, keySize, valSize, kvsIterator(kvs), opts...)
+	t.assert_nil(err)
+	t.assert_loaded(bpt, kvs)
+	// the tree keeps working after it is loaded
+	more := make(KVS, 0, 500)
+	for i := 0; i < cap(more); i++ {
+		kv := &KV{key: kvs[(i*31)%len(kvs)].key, value: kvs[i%len(kvs)].value}
+		if i%2 == 0 {
+			kv.key = t.rand_key()
+			if keySize < 0 {
+				kv.key = t.rand_varchar(1, 20)
+			}
+		}
+		more = append(more, kv)
+		t.assert_nil(bpt.Add(kv.key, kv.value))
+	}
+	all := append(append(KVS{}, kvs...), more...)
+	sort.Stable(all)
+	t.assert_nil(bpt.Verify())
+	t.assert("size after adds", bpt.Size() == len(all))
+	for i := 0; i < len(all); i += 13 {
+		t.assert_hasKV(bpt)(fmt.Sprintf("idx %v", i), all[i].key, all[i].value)
+	}
+	for i, kv := range more {
+		if i%3 == 0 {
+			value := kv.value
+			t.assert_nil(bpt.Remove(kv.key, func(v []byte) bool { return bytes.Equal(v, value) }))
+		}
+	}
+	t.assert_nil(bpt.Verify())
+}
+
+func TestBulkLoadFixed(x *testing.T) {
+	t := (*T)(x)
+	kvs := t.bulkKVS(20000, t.rand_key, func() []byte { return t.rand_value(8) })
+	t.testBulkLoad(kvs, 8, 8)
+	// small nodes make a deeper tree
+	t.testBulkLoad(kvs, 8, 8, FillFactor(.05))
+}
+
+func TestBulkLoadVarchar(x *testing.T) {
+	t := (*T)(x)
+	kvs := t.bulkKVS(5000,
+		func() []byte { return t.rand_varchar(0, 24) },
+		func() []byte { return t.rand_varchar(1, 64) })
+	t.testBulkLoad(kvs, -1, -1, FillFactor(.5), Checksums())
+}
+
+func TestBulkLoadErrors(x *testing.T) {
+	t := (*T)(x)
+	bf, clean := t.blkfile()
+	defer clean()
+	kvs := KVS{
+		{key: []byte("b"), value: []byte("1")},
+		{key: []byte("a"), value: []byte("2")},
+	}
+	_, err := BulkLoad(bf, -1, -1, kvsIterator(kvs))
+	t.assert("out of order keys should fail", err != nil)
+	_, err = BulkLoad(bf, -1, -1, kvsIterator(kvs), FillFactor(2))
+	t.assert("a fill factor > 1 should fail", err != nil)
+	// but they are in order for a reversed tree
+	bpt, err := BulkLoad(bf, -1, -1, kvsIterator(kvs), CompareWith("reverse"))
+	t.assert_nil(err)
+	t.assert("loaded", bpt.Size() == 2)
+	empty, err := BulkLoad(bf, 8, 8, kvsIterator(nil))
+	t.assert_nil(err)
+	t.assert("empty", empty.Size() == 0)
+	t.assert_nil(empty.Add(t.rand_key(), t.rand_value(8)))
+	t.assert_nil(empty.Verify())
+}
@@ -0,0 +1,109 @@
+package bptree
+
+import (
+	"encoding/binary"
+	"unsafe"
+)
+
+import (
+	"github.com/timtadh/fs2/checksum"
+	"github.com/timtadh/fs2/consts"
+	"github.com/timtadh/fs2/errors"
+)
+
+// When a tree is made with the Checksums option every node carries a
+// CRC32C of its contents. Leaves keep it in the leafMeta (in what used
+// to be padding) and internal nodes in the last 4 bytes of the block
+// (which is why they hold fewer keys). Varchar runs keep it in the 4
+// bytes following the data.
+//
+// The checksum is verified on the outermost access to the block and
+// updated (if it changed) on the outermost exit, see checksum.Tracker.
+// A read never writes the checksum so trees in read only files and
+// snapshots are verified in the same way.
+const checksumSize = 4
+
+var leafChecksumOffset = int(unsafe.Offsetof(leafMeta{}.checksum))
+
+// The checksum of the node in bytes and the bytes it is stored in.
+func nodeChecksum(bytes []byte) (sum uint32, stored []byte) {
+	flags := consts.AsFlag(bytes)
+	if flags&consts.LEAF != 0 {
+		end := leafChecksumOffset + checksumSize
+		return checksum.Sum(bytes[:leafChecksumOffset], bytes[end:]), bytes[leafChecksumOffset:end]
+	}
+	end := len(bytes) - checksumSize
+	return checksum.Sum(bytes[:end]), bytes[end:]
+}
+
+// Is bytes (still) a node with a checksum? A node freed while it was in
+// use has a free list pointer (a multiple of the block size) where the
+// flags were so the LEAF and INTERNAL bits are clear.
+func hasChecksum(bytes []byte) bool {
+	flags := consts.AsFlag(bytes)
+	return flags&consts.CHECKSUMS != 0 && flags&(consts.LEAF|consts.INTERNAL) != 0
+}
+
+func verifyNode(a uint64, bytes []byte) error {
+	sum, stored := nodeChecksum(bytes)
+	if expected := binary.LittleEndian.Uint32(stored); sum != expected {
+		return errors.Corruption(a, expected, sum)
+	}
+	return nil
+}
+
+func sealNode(bytes []byte) {
+	if !hasChecksum(bytes) {
+		return
+	}
+	sum, stored := nodeChecksum(bytes)
+	if binary.LittleEndian.Uint32(stored) != sum {
+		binary.LittleEndian.PutUint32(stored, sum)
+	}
+}
+
+// Run do on the node at a verifying its checksum before and updating it
+// after.
+func (self *BpTree) checked(a uint64, bytes []byte, do func() error) error {
+	if !hasChecksum(bytes) {
+		return do()
+	}
+	if self.nodes.Enter(a) {
+		if err := verifyNode(a, bytes); err != nil {
+			self.nodes.Exit(a)
+			return err
+		}
+	}
+	err := do()
+	if self.nodes.Exit(a) {
+		sealNode(bytes)
+	}
+	return err
+}
+
+// The checksum of a varchar run covers the flags and length of the run
+// and its data (but not the ref count, which changes without the data
+// being touched).
+func runChecksum(bytes []byte) (sum uint32, stored []byte) {
+	m := asRunMeta(bytes)
+	end := varRunMetaSize + int(m.length)
+	return checksum.Sum(bytes[:8], bytes[varRunMetaSize:end]), bytes[end : end+checksumSize]
+}
+
+func verifyRun(a uint64, bytes []byte) error {
+	sum, stored := runChecksum(bytes)
+	if expected := binary.LittleEndian.Uint32(stored); sum != expected {
+		return errors.Corruption(a, expected, sum)
+	}
+	return nil
+}
+
+func sealRun(bytes []byte) {
+	if consts.AsFlag(bytes) != consts.VARCHAR_RUN {
+		return
+	}
+	sum, stored := runChecksum(bytes)
+	if binary.LittleEndian.Uint32(stored) != sum {
+		binary.LittleEndian.PutUint32(stored, sum)
+	}
+}
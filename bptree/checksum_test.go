@@ -0,0 +1,82 @@
+package bptree
+
+import "testing"
+
+import (
+	"github.com/timtadh/fs2/errors"
+	"github.com/timtadh/fs2/slice"
+)
+
+func (t *T) bptChecksums() (*BpTree, func()) {
+	bf, bf_clean := t.blkfile()
+	bpt, err := New(bf, -1, -1, Checksums())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bpt, bf_clean
+}
+
+func (t *T) assert_corrupt(a uint64, err error) {
+	cerr, ok := err.(*errors.CorruptionError)
+	t.assert("expected a corruption error", ok)
+	t.assert("the error should name the block", cerr.Offset == a)
+}
+
+func TestChecksums(x *testing.T) {
+	t := (*T)(x)
+	bpt, clean := t.bptChecksums()
+	defer clean()
+	kvs := make(KVS, 0, 500)
+	for i := 0; i < cap(kvs); i++ {
+		kv := &KV{key: t.rand_key(), value: t.rand_value(24)}
+		kvs = append(kvs, kv)
+		t.assert_nil(bpt.Add(kv.key, kv.value))
+	}
+	for _, kv := range kvs {
+		t.assert_hasKV(bpt)("should have the kv", kv.key, kv.value)
+	}
+	t.assert_nil(bpt.Verify())
+	for _, kv := range kvs[:250] {
+		t.assert_nil(bpt.Remove(kv.key, func([]byte) bool { return true }))
+	}
+	for _, kv := range kvs[250:] {
+		t.assert_hasKV(bpt)("should have the kv", kv.key, kv.value)
+	}
+	t.assert_nil(bpt.Verify())
+}
+
+func TestChecksumsCorruptNode(x *testing.T) {
+	t := (*T)(x)
+	bpt, clean := t.bptChecksums()
+	defer clean()
+	kv := &KV{key: t.rand_key(), value: t.rand_value(24)}
+	t.assert_nil(bpt.Add(kv.key, kv.value))
+	root := bpt.meta.root
+	t.assert_nil(bpt.bf.Do(root, 1, func(bytes []byte) error {
+		bytes[leafMetaSize] ^= 0xff
+		return nil
+	}))
+	_, err := bpt.Has(kv.key)
+	t.assert_corrupt(root, err)
+}
+
+func TestChecksumsCorruptRun(x *testing.T) {
+	t := (*T)(x)
+	bpt, clean := t.bptChecksums()
+	defer clean()
+	kv := &KV{key: t.rand_key(), value: t.rand_value(24)}
+	t.assert_nil(bpt.Add(kv.key, kv.value))
+	var a uint64
+	t.assert_nil(bpt.doLeaf(bpt.meta.root, func(n *leaf) error {
+		v := n.val(0)
+		a = *slice.AsUint64(&v)
+		return nil
+	}))
+	offset, start, blks := bpt.varchar.startOffsetBlks(a)
+	t.assert_nil(bpt.bf.Do(start, blks, func(bytes []byte) error {
+		bytes[offset+varRunMetaSize] ^= 0xff
+		return nil
+	}))
+	err := bpt.DoFind(kv.key, func(k, v []byte) error { return nil })
+	t.assert_corrupt(a, err)
+}
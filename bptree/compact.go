@@ -0,0 +1,390 @@
+package bptree
+
+import (
+	"sort"
+)
+
+import (
+	"github.com/timtadh/fs2/consts"
+	"github.com/timtadh/fs2/errors"
+	"github.com/timtadh/fs2/slice"
+)
+
+// A Relocator moves the blocks of B+Trees for fmap.BlockFile.Compact. It
+// knows where every node of the trees added to it lives and who points
+// at it (the parent, or the tree's meta data for the root, and the
+// neighbouring leaves) so it can fix those pointers up when a node is
+// moved. It can also fix up trees whose values are offsets of blocks
+// owned by some other structure (see AddPointers).
+//
+// Blocks it does not know about (meta data and control blocks, the
+// storage of the varchar runs) are not moved. Instead the runs of a tree
+// are packed into the bottom of its Varchar when the tree is added (see
+// AddTree). The trees must not be used by anyone else from when they are
+// added until the compaction is done.
+type Relocator struct {
+	nodes    map[uint64]*nodeRef
+	pointers map[uint64]*pointerRef
+	// the pointers stored in each leaf of a pointer tree
+	leafPointers map[uint64][]uint64
+}
+
+type nodeRef struct {
+	bpt     *BpTree
+	parent  uint64 // 0 for the root
+	chained bool   // a leaf of a pure run only its neighbours point at
+}
+
+type pointerRef struct {
+	bpt  *BpTree
+	leaf uint64
+	idx  int
+}
+
+func NewRelocator() *Relocator {
+	return &Relocator{
+		nodes:        make(map[uint64]*nodeRef),
+		pointers:     make(map[uint64]*pointerRef),
+		leafPointers: make(map[uint64][]uint64),
+	}
+}
+
+// Add the nodes of the tree (and of the trees in its Varchar if it has
+// one). The varchar runs of the tree are packed first: each run is moved
+// into the lowest free space of the Varchar which fits it (fixing up the
+// keys and values which point at it) and the blocks this empties are
+// given back to the file for Compact to reclaim.
+func (r *Relocator) AddTree(bpt *BpTree) error {
+	if bpt.varchar != nil {
+		if err := bpt.packRuns(); err != nil {
+			return err
+		}
+	}
+	err := r.addNode(bpt, bpt.meta.root, 0)
+	if err != nil {
+		return err
+	}
+	err = r.addChained(bpt)
+	if err != nil {
+		return err
+	}
+	if bpt.varchar != nil {
+		return r.AddVarchar(bpt.varchar)
+	}
+	return nil
+}
+
+// Add the trees the Varchar uses to track its free space.
+func (r *Relocator) AddVarchar(v *Varchar) error {
+	err := r.AddTree(v.posTree)
+	if err != nil {
+		return err
+	}
+	return r.AddTree(v.sizeTree)
+}
+
+// The values of bpt are the offsets of blocks which belong to the
+// caller. Allow those blocks to be moved (updating the values). The
+// values must be fixed size 8 byte offsets. The tree itself should also
+// be added with AddTree.
+func (r *Relocator) AddPointers(bpt *BpTree) error {
+	if bpt.meta.valSize != 8 || bpt.varchar != nil {
+		return errors.Errorf("The values of a pointer tree must be 8 byte offsets")
+	}
+	a, err := bpt.firstLeaf()
+	if err != nil {
+		return err
+	}
+	for a != 0 {
+		err = bpt.doLeaf(a, func(n *leaf) error {
+			for i := 0; i < n.keyCount(); i++ {
+				v := n.val(i)
+				p := *slice.AsUint64(&v)
+				r.pointers[p] = &pointerRef{bpt: bpt, leaf: a, idx: i}
+				r.leafPointers[a] = append(r.leafPointers[a], p)
+			}
+			a = n.meta.next
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Relocator) addNode(bpt *BpTree, a, parent uint64) error {
+	r.nodes[a] = &nodeRef{bpt: bpt, parent: parent}
+	return bpt.do(
+		a,
+		func(n *internal) error {
+			for _, p := range n.ptrs_uint64s() {
+				if err := r.addNode(bpt, p, a); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		func(n *leaf) error { return nil },
+	)
+}
+
+// Add the leaves which are not pointed at by a parent, the leaves after
+// the first in a pure run. They are only found by walking the leaves.
+func (r *Relocator) addChained(bpt *BpTree) error {
+	a, err := bpt.firstLeaf()
+	if err != nil {
+		return err
+	}
+	for a != 0 {
+		if _, has := r.nodes[a]; !has {
+			r.nodes[a] = &nodeRef{bpt: bpt, chained: true}
+		}
+		err = bpt.doLeaf(a, func(n *leaf) error {
+			a = n.meta.next
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The first leaf of the tree.
+func (self *BpTree) firstLeaf() (a uint64, err error) {
+	a = self.meta.root
+	for {
+		var next uint64
+		err = self.do(
+			a,
+			func(n *internal) error {
+				next = *n.ptr(0)
+				return nil
+			},
+			func(n *leaf) error { return nil },
+		)
+		if err != nil {
+			return 0, err
+		} else if next == 0 {
+			return a, nil
+		}
+		a = next
+	}
+}
+
+// The block at from has been copied to to. Fix up the pointers to it.
+// This is an fmap.Relocator.
+func (r *Relocator) Relocate(from, to uint64) (bool, error) {
+	if ref, has := r.nodes[from]; has {
+		return true, r.moveNode(ref, from, to)
+	} else if ref, has := r.pointers[from]; has {
+		delete(r.pointers, from)
+		r.pointers[to] = ref
+		ptrs := r.leafPointers[ref.leaf]
+		for i := range ptrs {
+			if ptrs[i] == from {
+				ptrs[i] = to
+			}
+		}
+		return true, ref.bpt.doLeaf(ref.leaf, func(n *leaf) error {
+			v := n.val(ref.idx)
+			p := slice.AsUint64(&v)
+			if *p != from {
+				return errors.Errorf("Expected the value to point at %d", from)
+			}
+			*p = to
+			return nil
+		})
+	}
+	return false, nil
+}
+
+func (r *Relocator) moveNode(ref *nodeRef, from, to uint64) error {
+	bpt := ref.bpt
+	delete(r.nodes, from)
+	r.nodes[to] = ref
+	var err error
+	if ref.chained {
+		// only the neighbouring leaves point at it, fixed below
+	} else if ref.parent == 0 {
+		bpt.meta.root = to
+		err = bpt.writeMeta()
+	} else {
+		err = bpt.doInternal(ref.parent, func(n *internal) error {
+			for i := 0; i < n.keyCount(); i++ {
+				if p := n.ptr(i); *p == from {
+					*p = to
+					return nil
+				}
+			}
+			return errors.Errorf("The parent of %d did not point at it", from)
+		})
+	}
+	if err != nil {
+		return err
+	}
+	return bpt.do(
+		to,
+		func(n *internal) error {
+			for _, p := range n.ptrs_uint64s() {
+				r.nodes[p].parent = to
+			}
+			return nil
+		},
+		func(n *leaf) error {
+			for _, p := range r.leafPointers[from] {
+				r.pointers[p].leaf = to
+			}
+			if ptrs, has := r.leafPointers[from]; has {
+				delete(r.leafPointers, from)
+				r.leafPointers[to] = ptrs
+			}
+			if n.meta.prev != 0 {
+				err := bpt.doLeaf(n.meta.prev, func(m *leaf) error {
+					m.meta.next = to
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+			if n.meta.next != 0 {
+				return bpt.doLeaf(n.meta.next, func(m *leaf) error {
+					m.meta.prev = to
+					return nil
+				})
+			}
+			return nil
+		},
+	)
+}
+
+// A slot in a node which holds the address of a varchar run.
+type runSlot struct {
+	node uint64
+	idx  int
+	val  bool // a leaf value rather than a key
+}
+
+// Pack the varchar runs of the tree into the bottom of its Varchar,
+// moving the highest runs first, then give the blocks left empty back to
+// the file.
+func (self *BpTree) packRuns() error {
+	slots, err := self.runSlots()
+	if err != nil {
+		return err
+	}
+	runs := make([]uint64, 0, len(slots))
+	for a := range slots {
+		runs = append(runs, a)
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i] > runs[j] })
+	for _, a := range runs {
+		b, moved, err := self.varchar.move(a)
+		if err != nil {
+			return err
+		} else if !moved {
+			continue
+		}
+		for _, s := range slots[a] {
+			err := self.do(
+				s.node,
+				func(n *internal) error {
+					k := n.key(s.idx)
+					*slice.AsUint64(&k) = b
+					return nil
+				},
+				func(n *leaf) error {
+					p := n.key(s.idx)
+					if s.val {
+						p = n.val(s.idx)
+					}
+					*slice.AsUint64(&p) = b
+					return nil
+				},
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return self.varchar.release()
+}
+
+// Every slot of the tree which holds the address of a varchar run, by
+// the address. The leaves are walked in order so the leaves of pure runs
+// are included.
+func (self *BpTree) runSlots() (map[uint64][]runSlot, error) {
+	slots := make(map[uint64][]runSlot)
+	add := func(s runSlot, p []byte) {
+		a := *slice.AsUint64(&p)
+		slots[a] = append(slots[a], s)
+	}
+	var walk func(a uint64) error
+	walk = func(a uint64) error {
+		return self.do(
+			a,
+			func(n *internal) error {
+				for i := 0; i < n.keyCount(); i++ {
+					if n.meta.flags&consts.VARCHAR_KEYS != 0 {
+						add(runSlot{node: a, idx: i}, n.key(i))
+					}
+					if err := walk(*n.ptr(i)); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			func(n *leaf) error { return nil },
+		)
+	}
+	err := walk(self.meta.root)
+	if err != nil {
+		return nil, err
+	}
+	a, err := self.firstLeaf()
+	if err != nil {
+		return nil, err
+	}
+	for a != 0 {
+		err = self.doLeaf(a, func(n *leaf) error {
+			for i := 0; i < n.keyCount(); i++ {
+				if n.meta.flags&consts.VARCHAR_KEYS != 0 {
+					add(runSlot{node: a, idx: i}, n.key(i))
+				}
+				if n.meta.flags&consts.VARCHAR_VALS != 0 {
+					add(runSlot{node: a, idx: i, val: true}, n.val(i))
+				}
+			}
+			a = n.meta.next
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return slots, nil
+}
+
+// Compact the BlockFile the tree is in, packing the runs of its Varchar
+// and moving the nodes of the tree (and its Varchar) from the end of the
+// file into free blocks and shrinking the file. Only use this if the tree is the only structure in
+// the BlockFile, otherwise build a Relocator covering all of them and
+// call fmap.BlockFile.Compact. It returns the number of bytes the file
+// shrank by.
+func (self *BpTree) Compact() (reclaimed uint64, err error) {
+	self.lock()
+	defer self.unlock()
+	if self.bf.ReadOnly() {
+		return 0, errors.Errorf("The B+Tree is read only")
+	}
+	r := NewRelocator()
+	err = r.AddTree(self)
+	if err != nil {
+		return 0, err
+	}
+	// the leaves move so Cursors must find their places again
+	self.mods++
+	return self.bf.Compact(r.Relocate)
+}
@@ -0,0 +1,169 @@
+package bptree
+
+import "testing"
+
+import (
+	"fmt"
+)
+
+import (
+	"github.com/timtadh/fs2/fmap"
+	"github.com/timtadh/fs2/slice"
+)
+
+func (t *T) testCompact(n, keySize, valSize int, opts ...Option) {
+	bf, err := fmap.CreateBlockFile(PATH)
+	t.assert_nil(err)
+	defer func() {
+		t.assert_nil(bf.Close())
+		t.assert_nil(bf.Remove())
+	}()
+	bpt, err := New(bf, keySize, valSize, opts...)
+	t.assert_nil(err)
+	kvs := make([]*KV, 0, n)
+	for i := 0; i < cap(kvs); i++ {
+		kv := &KV{key: t.rand_key(), value: t.rand_key()}
+		kvs = append(kvs, kv)
+		t.assert_nil(bpt.Add(kv.key, kv.value))
+	}
+	for _, kv := range kvs[:n*9/10] {
+		t.assert_nil(bpt.Remove(kv.key, func([]byte) bool { return true }))
+	}
+	kvs = kvs[n*9/10:]
+	before, err := bf.Size()
+	t.assert_nil(err)
+	reclaimed, err := bpt.Compact()
+	t.assert_nil(err)
+	after, err := bf.Size()
+	t.assert_nil(err)
+	t.assert(fmt.Sprintf("the file should shrink %d -> %d", before, after), after < before)
+	t.assert(fmt.Sprintf("reclaimed %d of %d", reclaimed, before-after), reclaimed == before-after)
+	t.assert_nil(bpt.Verify())
+	for i, kv := range kvs {
+		t.assert_hasKV(bpt)(fmt.Sprintf("idx %v", i), kv.key, kv.value)
+	}
+	bpt, err = Open(bf)
+	t.assert_nil(err)
+	t.assert("size", bpt.Size() == len(kvs))
+	for i, kv := range kvs {
+		t.assert_hasKV(bpt)(fmt.Sprintf("idx %v", i), kv.key, kv.value)
+	}
+	for i := 0; i < n/5; i++ {
+		kv := &KV{key: t.rand_key(), value: t.rand_key()}
+		kvs = append(kvs, kv)
+		t.assert_nil(bpt.Add(kv.key, kv.value))
+	}
+	for i, kv := range kvs {
+		t.assert_hasKV(bpt)(fmt.Sprintf("idx %v", i), kv.key, kv.value)
+	}
+}
+
+func TestCompactFixed(x *testing.T) {
+	(*T)(x).testCompact(5000, 8, 8)
+}
+
+func TestCompactVarchar(x *testing.T) {
+	(*T)(x).testCompact(1500, -1, -1, Checksums())
+}
+
+func TestCompactPointers(x *testing.T) {
+	t := (*T)(x)
+	bpt, clean := t.bptFixed()
+	defer clean()
+	bf := bpt.bf
+	blocks := make(map[string]byte)
+	holes := make([]uint64, 0, 500)
+	for i := 0; i < 1500; i++ {
+		if i%3 == 0 {
+			a, err := bf.Allocate()
+			t.assert_nil(err)
+			holes = append(holes, a)
+		}
+		a, err := bf.Allocate()
+		t.assert_nil(err)
+		t.assert_nil(bf.Do(a, 1, func(bytes []byte) error {
+			bytes[0] = byte(i)
+			return nil
+		}))
+		key := t.rand_key()
+		blocks[string(key)] = byte(i)
+		value := make([]byte, 8)
+		*slice.AsUint64(&value) = a
+		t.assert_nil(bpt.Add(key, value))
+	}
+	for _, a := range holes {
+		t.assert_nil(bf.Free(a))
+	}
+	before, err := bf.Size()
+	t.assert_nil(err)
+	r := NewRelocator()
+	t.assert_nil(r.AddTree(bpt))
+	t.assert_nil(r.AddPointers(bpt))
+	_, err = bf.Compact(r.Relocate)
+	t.assert_nil(err)
+	after, err := bf.Size()
+	t.assert_nil(err)
+	t.assert(fmt.Sprintf("the file should shrink %d -> %d", before, after), after < before)
+	t.assert_nil(bpt.Verify())
+	t.assert_nil(bpt.DoIterate(func(key, value []byte) error {
+		a := *slice.AsUint64(&value)
+		t.assert("the pointer should be in the file", a < after)
+		return bf.Do(a, 1, func(bytes []byte) error {
+			t.assert("the pointer should be updated", bytes[0] == blocks[string(key)])
+			return nil
+		})
+	}))
+}
+
+func TestCompactPureRunsVarchar(x *testing.T) {
+	t := (*T)(x)
+	bf, err := fmap.CreateBlockFile(PATH)
+	t.assert_nil(err)
+	defer func() {
+		t.assert_nil(bf.Close())
+		t.assert_nil(bf.Remove())
+	}()
+	bpt, err := New(bf, -1, -1, Checksums())
+	t.assert_nil(err)
+	kvs := make([]*KV, 0, 4000)
+	for i := 0; i < 100; i++ {
+		key := t.rand_varchar(8, 17)
+		// enough values for the key to fill a pure run of several leaves
+		for j := 0; j < 40; j++ {
+			kv := &KV{key: key, value: t.rand_varchar(64, 512)}
+			kvs = append(kvs, kv)
+			t.assert_nil(bpt.Add(kv.key, kv.value))
+		}
+	}
+	for i := 0; i < len(kvs)*9/10; i += 40 {
+		t.assert_nil(bpt.Remove(kvs[i].key, func([]byte) bool { return true }))
+	}
+	kvs = kvs[len(kvs)*9/10:]
+	before, err := bf.Size()
+	t.assert_nil(err)
+	_, err = bpt.Compact()
+	t.assert_nil(err)
+	after, err := bf.Size()
+	t.assert_nil(err)
+	t.assert(fmt.Sprintf("the file should shrink by half %d -> %d", before, after), after < before/2)
+	t.assert_nil(bpt.Verify())
+	for i, kv := range kvs {
+		t.assert_hasKV(bpt)(fmt.Sprintf("idx %v", i), kv.key, kv.value)
+	}
+	bpt, err = Open(bf)
+	t.assert_nil(err)
+	t.assert("size", bpt.Size() == len(kvs))
+	t.assert_nil(bpt.Verify())
+	for i, kv := range kvs {
+		t.assert_hasKV(bpt)(fmt.Sprintf("idx %v", i), kv.key, kv.value)
+	}
+	for i := 0; i < 200; i++ {
+		kv := &KV{key: kvs[0].key, value: t.rand_varchar(64, 512)}
+		kvs = append(kvs, kv)
+		t.assert_nil(bpt.Add(kv.key, kv.value))
+	}
+	t.assert_nil(bpt.Verify())
+	for i, kv := range kvs {
+		t.assert_hasKV(bpt)(fmt.Sprintf("idx %v", i), kv.key, kv.value)
+	}
+}
@@ -0,0 +1,209 @@
+package bptree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"sync"
+)
+
+import (
+	"github.com/timtadh/fs2/consts"
+	"github.com/timtadh/fs2/errors"
+)
+
+// A Comparator orders the keys of a tree. It returns a negative number
+// if a sorts before b, 0 if they are the same key and a positive number
+// if a sorts after b. The tree uses bytes.Equal to match duplicate keys
+// so a Comparator must only return 0 when the keys are byte for byte
+// equal. It must never change the order of keys already in a file.
+type Comparator func(a, b []byte) int
+
+// The longest name a Comparator may be registered under (the name is
+// stored in the tree's meta data).
+const MaxComparatorName = 32
+
+// The Comparator trees use when none is given.
+const DefaultComparator = "bytes"
+
+var comparators = struct {
+	sync.RWMutex
+	byName map[string]Comparator
+}{byName: make(map[string]Comparator)}
+
+// Register a Comparator under a name. Trees are made with a Comparator
+// with the CompareWith option, the name is stored in the tree and the
+// Comparator is looked up again when the tree is opened so it must be
+// registered (under the same name) before then, usually from an init
+// function. It panics if the name is empty, too long or already taken.
+//
+// The built in comparators are:
+//
+//	bytes          lexicographic (bytes.Compare), the default
+//	int            big endian two's complement signed integers
+//	float          big endian IEEE 754 float32s or float64s
+//	reverse        bytes in reverse order
+//	reverse-int    int in reverse order
+//	reverse-float  float in reverse order
+func RegisterComparator(name string, cmp Comparator) {
+	if name == "" || len(name) > MaxComparatorName {
+		panic(errors.Errorf("comparator names must be 1 to %d bytes, got %q", MaxComparatorName, name))
+	}
+	comparators.Lock()
+	defer comparators.Unlock()
+	if _, has := comparators.byName[name]; has {
+		panic(errors.Errorf("a comparator named %q is already registered", name))
+	}
+	comparators.byName[name] = cmp
+}
+
+func lookupComparator(name string) (Comparator, error) {
+	comparators.RLock()
+	defer comparators.RUnlock()
+	cmp, has := comparators.byName[name]
+	if !has {
+		return nil, errors.Errorf("There is no comparator registered as %q", name)
+	}
+	return cmp, nil
+}
+
+// Order the keys of a new tree with the Comparator registered under
+// name (see RegisterComparator). Only applies to trees, it is ignored by
+// a Varchar.
+func CompareWith(name string) Option {
+	return func(o *options) {
+		o.comparator = name
+	}
+}
+
+// Reverse the order of a Comparator.
+func Reverse(cmp Comparator) Comparator {
+	return func(a, b []byte) int {
+		return cmp(b, a)
+	}
+}
+
+func init() {
+	RegisterComparator(DefaultComparator, bytes.Compare)
+	RegisterComparator("int", compareInts)
+	RegisterComparator("float", compareFloats)
+	RegisterComparator("reverse", Reverse(bytes.Compare))
+	RegisterComparator("reverse-int", Reverse(compareInts))
+	RegisterComparator("reverse-float", Reverse(compareFloats))
+}
+
+// Compares big endian two's complement integers. Integers of different
+// widths are compared by value (ties, eg. 1 as an int32 and an int64,
+// go to the shorter key so the order stays consistent with
+// bytes.Equal).
+func compareInts(a, b []byte) int {
+	neg := func(x []byte) bool { return len(x) > 0 && x[0]&0x80 != 0 }
+	an, bn := neg(a), neg(b)
+	if an != bn {
+		if an {
+			return -1
+		}
+		return 1
+	}
+	// same sign: sign extend the shorter one
+	var ext byte
+	if an {
+		ext = 0xff
+	}
+	n := len(a)
+	if len(b) > n {
+		n = len(b)
+	}
+	at := func(x []byte, i int) byte {
+		j := i - (n - len(x))
+		if j < 0 {
+			return ext
+		}
+		return x[j]
+	}
+	for i := 0; i < n; i++ {
+		if x, y := at(a, i), at(b, i); x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
+	}
+	return compareLen(a, b)
+}
+
+// Compares big endian IEEE 754 float32s (4 byte keys) and float64s (8
+// byte keys) by value. -0 sorts before +0 and NaNs sort after +Inf
+// (before -Inf if their sign bit is set). Keys of other lengths sort
+// after all of the floats (and by bytes.Compare amongst themselves).
+func compareFloats(a, b []byte) int {
+	x, aok := floatBits(a)
+	y, bok := floatBits(b)
+	if !aok || !bok {
+		if aok {
+			return -1
+		} else if bok {
+			return 1
+		}
+		return bytes.Compare(a, b)
+	}
+	if x < y {
+		return -1
+	} else if x > y {
+		return 1
+	}
+	return compareLen(a, b)
+}
+
+// The bits of the float widened to a float64 and made to sort as an
+// unsigned integer.
+func floatBits(x []byte) (uint64, bool) {
+	var bits uint64
+	switch len(x) {
+	case 4:
+		f := math.Float32frombits(binary.BigEndian.Uint32(x))
+		bits = math.Float64bits(float64(f))
+	case 8:
+		bits = binary.BigEndian.Uint64(x)
+	default:
+		return 0, false
+	}
+	if bits&(1<<63) != 0 {
+		return ^bits, true
+	}
+	return bits | (1 << 63), true
+}
+
+func compareLen(a, b []byte) int {
+	if len(a) < len(b) {
+		return -1
+	} else if len(a) > len(b) {
+		return 1
+	}
+	return bytes.Compare(a, b)
+}
+
+// The Comparator for a tree with the given meta data.
+func (m *bpTreeMeta) comparator() (Comparator, error) {
+	if m.flags&consts.COMPARATOR == 0 {
+		return bytes.Compare, nil
+	}
+	return lookupComparator(m.comparatorName())
+}
+
+func (m *bpTreeMeta) comparatorName() string {
+	if m.flags&consts.COMPARATOR == 0 {
+		return DefaultComparator
+	}
+	n := bytes.IndexByte(m.compare[:], 0)
+	if n < 0 {
+		n = len(m.compare)
+	}
+	return string(m.compare[:n])
+}
+
+// The name of the Comparator which orders the keys of the tree.
+func (self *BpTree) ComparatorName() string {
+	self.rlock()
+	defer self.runlock()
+	return self.meta.comparatorName()
+}
@@ -0,0 +1,162 @@
+package bptree
+
+import "testing"
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+import (
+	"github.com/timtadh/fs2/fmap"
+)
+
+func (t *T) assert_ordered(cmp Comparator, keys [][]byte) {
+	for i := 1; i < len(keys); i++ {
+		t.assert(fmt.Sprintf("%v should sort before %v", keys[i-1], keys[i]), cmp(keys[i-1], keys[i]) < 0)
+		t.assert(fmt.Sprintf("%v should sort after %v", keys[i], keys[i-1]), cmp(keys[i], keys[i-1]) > 0)
+		t.assert(fmt.Sprintf("%v should equal itself", keys[i]), cmp(keys[i], keys[i]) == 0)
+	}
+}
+
+func int64Key(i int64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(i))
+	return k
+}
+
+func float64Key(f float64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, math.Float64bits(f))
+	return k
+}
+
+func TestComparators(x *testing.T) {
+	t := (*T)(x)
+	int32Key := func(i int32) []byte {
+		k := make([]byte, 4)
+		binary.BigEndian.PutUint32(k, uint32(i))
+		return k
+	}
+	t.assert_ordered(compareInts, [][]byte{
+		int64Key(math.MinInt64), int32Key(-70000), int64Key(-2), int32Key(-1), int64Key(-1),
+		{}, int32Key(0), int64Key(0), int32Key(1), int64Key(1), int64Key(1 << 40), int64Key(math.MaxInt64),
+	})
+	float32Key := func(f float32) []byte {
+		k := make([]byte, 4)
+		binary.BigEndian.PutUint32(k, math.Float32bits(f))
+		return k
+	}
+	t.assert_ordered(compareFloats, [][]byte{
+		float64Key(math.Inf(-1)), float64Key(-1e300), float32Key(-2.5), float64Key(-2.5),
+		float64Key(-1e-300), float64Key(math.Copysign(0, -1)), float64Key(0), float32Key(1),
+		float64Key(1), float64Key(1.5), float64Key(math.Inf(1)), float64Key(math.NaN()),
+		{}, {1, 2, 3},
+	})
+	rev, err := lookupComparator("reverse")
+	t.assert_nil(err)
+	t.assert_ordered(rev, [][]byte{[]byte("b"), []byte("ab"), []byte("a"), {}})
+	_, err = lookupComparator("not a comparator")
+	t.assert("unknown comparators should not be found", err != nil)
+}
+
+func TestCompareWithInts(x *testing.T) {
+	t := (*T)(x)
+	bf, err := fmap.CreateBlockFile(PATH)
+	t.assert_nil(err)
+	defer func() {
+		t.assert_nil(bf.Remove())
+	}()
+	bpt, err := New(bf, 8, 8, CompareWith("int"))
+	t.assert_nil(err)
+	t.assert("name", bpt.ComparatorName() == "int")
+	keys := make([]int64, 0, 2000)
+	for i := 0; i < cap(keys); i++ {
+		k := rand.Int63n(1000) - 500
+		if i%10 == 0 {
+			k = rand.Int63() - rand.Int63()
+		}
+		keys = append(keys, k)
+		t.assert_nil(bpt.Add(int64Key(k), t.rand_value(8)))
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	check := func(bpt *BpTree) {
+		i := 0
+		t.assert_nil(bpt.DoRange(nil, nil, func(k, v []byte) error {
+			t.assert(fmt.Sprintf("key %d was %d expected %d", i, int64(binary.BigEndian.Uint64(k)), keys[i]), bytes.Equal(k, int64Key(keys[i])))
+			i++
+			return nil
+		}))
+		t.assert("saw all of the keys", i == len(keys))
+		// a range which crosses zero
+		count := 0
+		for _, k := range keys {
+			if k >= -100 && k <= 100 {
+				count++
+			}
+		}
+		found := 0
+		t.assert_nil(bpt.DoRange(int64Key(-100), int64Key(100), func(k, v []byte) error {
+			i := int64(binary.BigEndian.Uint64(k))
+			t.assert(fmt.Sprintf("%d out of range", i), i >= -100 && i <= 100)
+			found++
+			return nil
+		}))
+		t.assert(fmt.Sprintf("found %d expected %d", found, count), found == count)
+		c, err := bpt.Count(int64Key(keys[len(keys)/2]))
+		t.assert_nil(err)
+		t.assert("count", c >= 1)
+	}
+	check(bpt)
+	t.assert_nil(bpt.Verify())
+	t.assert_nil(bf.Close())
+
+	// reopening uses the same order
+	bf, err = fmap.OpenBlockFile(PATH)
+	t.assert_nil(err)
+	bpt, err = Open(bf)
+	t.assert_nil(err)
+	t.assert("name after open", bpt.ComparatorName() == "int")
+	check(bpt)
+
+	// a tree ordered by a comparator which is not registered cannot be
+	// opened
+	bpt.meta.compare = [MaxComparatorName]byte{}
+	copy(bpt.meta.compare[:], "unregistered")
+	t.assert_nil(bpt.writeMeta())
+	_, err = Open(bf)
+	t.assert("should not open without the comparator", err != nil)
+	t.assert_nil(bf.Close())
+}
+
+func TestCompareWithReverse(x *testing.T) {
+	t := (*T)(x)
+	bf, clean := t.blkfile()
+	defer clean()
+	_, err := New(bf, -1, -1, CompareWith("not a comparator"))
+	t.assert("unknown comparator should fail", err != nil)
+	bpt, err := NewVarKeys(bf, CompareWith("reverse"))
+	t.assert_nil(err)
+	kvs := make(KVS, 0, 1000)
+	for i := 0; i < cap(kvs); i++ {
+		kv := t.make_kv()
+		kvs = append(kvs, kv)
+		t.assert_nil(bpt.Add(kv.key, kv.value))
+	}
+	sort.Sort(sort.Reverse(kvs))
+	i := 0
+	t.assert_nil(bpt.DoRange(nil, nil, func(k, v []byte) error {
+		t.assert(fmt.Sprintf("key %d", i), bytes.Equal(k, kvs[i].key))
+		i++
+		return nil
+	}))
+	t.assert("saw all of the keys", i == len(kvs))
+	for i, kv := range kvs {
+		t.assert_hasKV(bpt)(fmt.Sprintf("idx %v", i), kv.key, kv.value)
+	}
+	t.assert_nil(bpt.Verify())
+}
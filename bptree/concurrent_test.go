@@ -0,0 +1,193 @@
+package bptree
+
+import "testing"
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+func TestConcurrentReadersWriter(x *testing.T) {
+	t := (*T)(x)
+	bpt, clean := t.bpt()
+	defer clean()
+	kvs := make(KVS, 0, 1000)
+	for i := 0; i < cap(kvs); i++ {
+		kv := t.make_kv()
+		kvs = append(kvs, kv)
+		t.assert_nil(bpt.Add(kv.key, kv.value))
+	}
+	sort.Stable(kvs)
+	snap, err := bpt.Snapshot()
+	t.assert_nil(err)
+	errs := make(chan error, 16)
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, kv := range kvs {
+				has, err := bpt.Has(kv.key)
+				if err != nil {
+					errs <- err
+					return
+				} else if !has {
+					errs <- fmt.Errorf("missing key %v", kv.key)
+					return
+				}
+			}
+		}()
+	}
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			i := 0
+			err := snap.DoIterate(func(key, value []byte) error {
+				if !bytes.Equal(key, kvs[i].key) {
+					return fmt.Errorf("key %v != %v", key, kvs[i].key)
+				}
+				i++
+				return nil
+			})
+			if err != nil {
+				errs <- err
+			} else if i != len(kvs) {
+				errs <- fmt.Errorf("saw %v expected %v", i, len(kvs))
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 2000; i++ {
+			kv := t.make_kv()
+			if err := bpt.Add(kv.key, kv.value); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	t.assert_nil(snap.Close())
+	t.assert_nil(bpt.Verify())
+	t.assert("size", bpt.Size() == len(kvs)+2000)
+}
+
+func TestConcurrentRangeWriter(x *testing.T) {
+	t := (*T)(x)
+	bpt, clean := t.bpt()
+	defer clean()
+	kvs := make(KVS, 0, 500)
+	for i := 0; i < cap(kvs); i++ {
+		kv := t.make_kv()
+		kvs = append(kvs, kv)
+		t.assert_nil(bpt.Add(kv.key, kv.value))
+	}
+	has := make(map[string]bool, len(kvs))
+	for _, kv := range kvs {
+		has[string(kv.key)] = true
+	}
+	// the readers walk the tree while the writer splits, merges and frees
+	// the leaves under them, they must see the keys in order and every key
+	// the writer leaves alone
+	scan := func(reverse bool) error {
+		seen := 0
+		var prev []byte
+		err := bpt.DoRangeWith(RangeOptions{Reverse: reverse}, func(key, value []byte) error {
+			if prev != nil {
+				c := bytes.Compare(prev, key)
+				if (!reverse && c > 0) || (reverse && c < 0) {
+					return fmt.Errorf("key %v out of order after %v", key, prev)
+				}
+			}
+			prev = key
+			if has[string(key)] {
+				seen++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		} else if seen != len(kvs) {
+			return fmt.Errorf("saw %v of %v keys", seen, len(kvs))
+		}
+		return nil
+	}
+	errs := make(chan error, 16)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(reverse bool) {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if err := scan(reverse); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(r%2 == 1)
+	}
+	for i := 0; i < 10; i++ {
+		added := make([]*KV, 0, 300)
+		for j := 0; j < cap(added); j++ {
+			kv := t.make_kv()
+			added = append(added, kv)
+			t.assert_nil(bpt.Add(kv.key, kv.value))
+		}
+		for _, kv := range added {
+			t.assert_nil(bpt.Remove(kv.key, func([]byte) bool { return true }))
+		}
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	t.assert_nil(bpt.Verify())
+	t.assert("size", bpt.Size() == len(kvs))
+}
+
+// The live tree's latch is held for the whole of a write, reads from a
+// snapshot do not wait for it.
+func TestConcurrentSnapshotDuringWrite(x *testing.T) {
+	t := (*T)(x)
+	bpt, clean := t.bpt()
+	defer clean()
+	kv := t.make_kv()
+	t.assert_nil(bpt.Add(kv.key, kv.value))
+	snap, err := bpt.Snapshot()
+	t.assert_nil(err)
+	defer snap.Close()
+	bpt.lock()
+	done := make(chan error, 1)
+	go func() {
+		has, err := snap.Has(kv.key)
+		if err == nil && !has {
+			err = fmt.Errorf("missing key %v", kv.key)
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		bpt.unlock()
+		t.assert_nil(err)
+	case <-time.After(10 * time.Second):
+		bpt.unlock()
+		t.Fatal("the snapshot read waited for the writer")
+	}
+}
@@ -0,0 +1,289 @@
+package bptree
+
+import (
+	"github.com/timtadh/fs2/consts"
+	"github.com/timtadh/fs2/errors"
+)
+
+// How many pairs have keys between [from, to] inclusive (nil is the
+// start or end of the tree, as for Range). The tree must have been made
+// with SubtreeCounts.
+func (self *BpTree) CountRange(from, to []byte) (count int, err error) {
+	self.rlock()
+	defer self.runlock()
+	if err := self.checkCounted(); err != nil {
+		return 0, err
+	}
+	start, end, err := self.rangeRanks(from, to)
+	if err != nil {
+		return 0, err
+	}
+	return int(end - start), nil
+}
+
+// The pairs with keys in [from, to] are the pairs [start, end) of the
+// tree. The caller holds the latch.
+func (self *BpTree) rangeRanks(from, to []byte) (start, end uint64, err error) {
+	if from != nil && to != nil && self.cmp(from, to) > 0 {
+		// a backwards Range has the same pairs
+		from, to = to, from
+	}
+	end = self.meta.itemCount
+	if to != nil {
+		end, err = self.rank(self.meta.root, self.meta.itemCount, to, true)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if from != nil {
+		start, err = self.rank(self.meta.root, self.meta.itemCount, from, false)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return start, end, nil
+}
+
+// How many pairs have keys less than key. It is the index of the key's
+// first pair in the tree if it is there (or where it would go if it is
+// not). The tree must have been made with SubtreeCounts.
+func (self *BpTree) Rank(key []byte) (int, error) {
+	self.rlock()
+	defer self.runlock()
+	if err := self.checkCounted(); err != nil {
+		return 0, err
+	}
+	r, err := self.rank(self.meta.root, self.meta.itemCount, key, false)
+	if err != nil {
+		return 0, err
+	}
+	return int(r), nil
+}
+
+// The i'th pair (from 0) in the tree, in the order DoIterate gives them.
+// To page through a tree 100 pairs at a time Select the first pair of
+// the page and iterate from there:
+//
+//	key, _, err := bpt.Select(page * 100)
+//	if err != nil {
+//		panic(err)
+//	}
+//
+// (For duplicate keys skip Select(i) - Rank(key) pairs of the key.)
+// Select reads O(log n) blocks to reach the leaf the i'th pair's run of
+// keys starts in. The leaves of a run of one duplicated key are not
+// indexed so it then walks them, costing O(log n + r/b) where r is the
+// length of the run and b the pairs in a leaf. The key and value are
+// copies. The tree must have been made with SubtreeCounts.
+func (self *BpTree) Select(i int) (key, value []byte, err error) {
+	self.rlock()
+	defer self.runlock()
+	if err := self.checkCounted(); err != nil {
+		return nil, nil, err
+	}
+	if i < 0 || uint64(i) >= self.meta.itemCount {
+		return nil, nil, errors.Errorf("Select(%d) is out of range, the tree has %d pairs", i, self.meta.itemCount)
+	}
+	return self.selectKV(uint64(i))
+}
+
+// Copy the i'th pair. The caller holds the latch.
+func (self *BpTree) selectKV(i uint64) (key, value []byte, err error) {
+	a, j, err := self._select(self.meta.root, i)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = self.doKV(a, j, func(k, v []byte) error {
+		key = make([]byte, len(k))
+		copy(key, k)
+		value = make([]byte, len(v))
+		copy(value, v)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, value, nil
+}
+
+func (self *BpTree) checkCounted() error {
+	if self.meta.flags&consts.SUBTREE_COUNTS == 0 {
+		return errors.Errorf("The tree does not keep counts, make it with SubtreeCounts")
+	}
+	return nil
+}
+
+// Set the count of the child p of one of the (split) internal nodes a
+// and b.
+func (self *BpTree) setCount(a, b, p, count uint64) error {
+	var has bool
+	err := self.doInternal(a, func(n *internal) error {
+		has = n.setCount(p, count)
+		return nil
+	})
+	if err != nil || has {
+		return err
+	}
+	err = self.doInternal(b, func(n *internal) error {
+		has = n.setCount(p, count)
+		return nil
+	})
+	if err != nil {
+		return err
+	} else if !has {
+		return errors.Errorf("Neither %v nor %v point at %v", a, b, p)
+	}
+	return nil
+}
+
+// The number of pairs under the node at n. For a leaf it counts the
+// leaves from n up to the sibling (the next indexed leaf) so it includes
+// the rest of a pure run.
+func (self *BpTree) subtreeCount(n, sibling uint64) (count uint64, err error) {
+	var flags consts.Flag
+	err = self.doBlock(n, func(bytes []byte) error {
+		flags = consts.AsFlag(bytes)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if flags&consts.INTERNAL != 0 {
+		err = self.doInternal(n, func(n *internal) error {
+			count = n.total()
+			return nil
+		})
+		return count, err
+	} else if flags&consts.LEAF == 0 {
+		return 0, errors.Errorf("Unknown block type")
+	}
+	for a := n; a != 0 && a != sibling; {
+		err = self.doLeaf(a, func(n *leaf) error {
+			count += uint64(n.meta.keyCount)
+			a = n.meta.next
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return count, nil
+}
+
+// The number of pairs under n (which holds count pairs) with keys less
+// than key, or less than or equal to key if inclusive.
+func (self *BpTree) rank(n, count uint64, key []byte, inclusive bool) (r uint64, err error) {
+	var kid, kidCount uint64
+	err = self.do(
+		n,
+		func(n *internal) error {
+			i, has, err := find(self.varchar, self.cmp, n, key)
+			if err != nil {
+				return err
+			}
+			if !has && i == 0 {
+				// every pair in the subtree is after the key
+				return nil
+			} else if has && !inclusive {
+				// keys do not straddle children so the key starts at i
+				for j := 0; j < i; j++ {
+					r += *n.count(j)
+				}
+				return nil
+			} else if !has {
+				i--
+			}
+			for j := 0; j < i; j++ {
+				r += *n.count(j)
+			}
+			kid = *n.ptr(i)
+			kidCount = *n.count(i)
+			return nil
+		},
+		func(n *leaf) error {
+			if n.meta.keyCount == 0 {
+				return nil
+			}
+			i, _, err := find(self.varchar, self.cmp, n, key)
+			if err != nil {
+				return err
+			}
+			for inclusive && i < int(n.meta.keyCount) {
+				c, err := n.cmpKeyAt(self.varchar, self.cmp, i, key)
+				if err != nil {
+					return err
+				} else if c != 0 {
+					break
+				}
+				i++
+			}
+			if i >= int(n.meta.keyCount) {
+				// the rest of a pure run (of the last key) comes before
+				// the key too
+				r = count
+			} else {
+				r = uint64(i)
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+	if kid == 0 {
+		return r, nil
+	}
+	kr, err := self.rank(kid, kidCount, key, inclusive)
+	if err != nil {
+		return 0, err
+	}
+	return r + kr, nil
+}
+
+// The leaf and index of the i'th pair under n. The internal nodes are
+// descended by their counts but a pure run's leaves are walked.
+func (self *BpTree) _select(n, i uint64) (a uint64, j int, err error) {
+	var kid uint64
+	err = self.do(
+		n,
+		func(n *internal) error {
+			for k := 0; k < int(n.meta.keyCount); k++ {
+				c := *n.count(k)
+				if i < c {
+					kid = *n.ptr(k)
+					return nil
+				}
+				i -= c
+			}
+			return errors.Errorf("The counts of the node were less than the select")
+		},
+		func(n *leaf) error { return nil },
+	)
+	if err != nil {
+		return 0, 0, err
+	}
+	if kid != 0 {
+		return self._select(kid, i)
+	}
+	for a = n; a != 0; {
+		var next uint64
+		found := false
+		err = self.doLeaf(a, func(n *leaf) error {
+			if i < uint64(n.meta.keyCount) {
+				j = int(i)
+				found = true
+				return nil
+			}
+			i -= uint64(n.meta.keyCount)
+			next = n.meta.next
+			return nil
+		})
+		if err != nil {
+			return 0, 0, err
+		} else if found {
+			return a, j, nil
+		}
+		a = next
+	}
+	return 0, 0, errors.Errorf("Ran off the end of the leaves selecting")
+}
@@ -0,0 +1,188 @@
+package bptree
+
+import "testing"
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+// kvs is the content of the tree, sorted by key.
+func (t *T) assert_counts(bpt *BpTree, kvs KVS) {
+	t.assert_loaded(bpt, kvs)
+	for i := 0; i < len(kvs); i += 31 {
+		key, _, err := bpt.Select(i)
+		t.assert_nil(err)
+		t.assert(fmt.Sprintf("Select(%v) was %v expected %v", i, key, kvs[i].key), bytes.Equal(key, kvs[i].key))
+		r, err := bpt.Rank(key)
+		t.assert_nil(err)
+		t.assert(fmt.Sprintf("Rank(%v) was %v expected %v", key, r, firstOf(kvs, key)), r == firstOf(kvs, key))
+		j := (i * 7) % len(kvs)
+		from, to := kvs[i].key, kvs[j].key
+		if bytes.Compare(from, to) > 0 {
+			from, to = to, from
+		}
+		c, err := bpt.CountRange(from, to)
+		t.assert_nil(err)
+		expected := len(kvs) - len(keepOutside(kvs, from, to, nil))
+		t.assert(fmt.Sprintf("CountRange was %v expected %v", c, expected), c == expected)
+	}
+	if len(kvs) > 0 {
+		c, err := bpt.CountRange(nil, kvs[len(kvs)/2].key)
+		t.assert_nil(err)
+		t.assert("CountRange to", c == len(kvs)-len(keepOutside(kvs, nil, kvs[len(kvs)/2].key, nil)))
+		c, err = bpt.CountRange(kvs[len(kvs)/2].key, nil)
+		t.assert_nil(err)
+		t.assert("CountRange from", c == len(kvs)-len(keepOutside(kvs, kvs[len(kvs)/2].key, nil, nil)))
+	}
+	c, err := bpt.CountRange(nil, nil)
+	t.assert_nil(err)
+	t.assert("CountRange everything", c == len(kvs))
+	_, _, err = bpt.Select(len(kvs))
+	t.assert("Select past the end", err != nil)
+}
+
+func (t *T) testCounts(keySize, valSize int, kvs KVS) {
+	bf, clean := t.blkfile()
+	defer clean()
+	bpt, err := New(bf, keySize, valSize, SubtreeCounts())
+	t.assert_nil(err)
+	t.assert_counts(bpt, KVS{})
+	for _, i := range rand.Perm(len(kvs)) {
+		t.assert_nil(bpt.Add(kvs[i].key, kvs[i].value))
+	}
+	t.assert_counts(bpt, kvs)
+
+	// the keys of every other pair (some of them pure runs)
+	removed := make(map[string]bool)
+	for i := 0; i < len(kvs); i += 2 {
+		removed[string(kvs[i].key)] = true
+	}
+	kept := make(KVS, 0, len(kvs))
+	for k := range removed {
+		t.assert_nil(bpt.Remove([]byte(k), func([]byte) bool { return true }))
+	}
+	for _, kv := range kvs {
+		if !removed[string(kv.key)] {
+			kept = append(kept, kv)
+		}
+	}
+	kvs = kept
+	t.assert_counts(bpt, kvs)
+
+	from, to := kvs[len(kvs)/5].key, kvs[len(kvs)/3].key
+	t.assert_nil(bpt.DeleteRange(from, to))
+	kvs = keepOutside(kvs, from, to, nil)
+	t.assert_counts(bpt, kvs)
+}
+
+func TestCountsFixed(x *testing.T) {
+	t := (*T)(x)
+	t.testCounts(8, 8, t.bulkKVS(4000, t.rand_key, func() []byte { return t.rand_value(8) }))
+}
+
+func TestCountsVarchar(x *testing.T) {
+	t := (*T)(x)
+	t.testCounts(-1, -1, t.bulkKVS(3000,
+		func() []byte { return t.rand_varchar(1, 30) },
+		func() []byte { return t.rand_varchar(1, 60) }))
+}
+
+func TestCountsBulkLoad(x *testing.T) {
+	t := (*T)(x)
+	bf, clean := t.blkfile()
+	defer clean()
+	kvs := t.bulkKVS(5000, t.rand_key, func() []byte { return t.rand_value(8) })
+	bpt, err := BulkLoad(bf, 8, 8, kvsIterator(kvs), SubtreeCounts(), FillFactor(.6))
+	t.assert_nil(err)
+	t.assert_counts(bpt, kvs)
+	// the counts keep up with Adds into the loaded tree
+	for i := 0; i < 1000; i++ {
+		kv := &KV{key: t.rand_key(), value: t.rand_value(8)}
+		t.assert_nil(bpt.Add(kv.key, kv.value))
+		j := firstOf(kvs, kv.key)
+		kvs = append(kvs, nil)
+		copy(kvs[j+1:], kvs[j:])
+		kvs[j] = kv
+	}
+	t.assert_counts(bpt, kvs)
+}
+
+func TestCountsUniqueKeys(x *testing.T) {
+	t := (*T)(x)
+	bf, clean := t.blkfile()
+	defer clean()
+	bpt, err := New(bf, 8, 8, UniqueKeys(), SubtreeCounts())
+	t.assert_nil(err)
+	keys := make([][]byte, 0, 2000)
+	for i := 0; i < cap(keys); i++ {
+		keys = append(keys, t.rand_key())
+		t.assert_nil(bpt.Put(keys[i], t.rand_value(8)))
+	}
+	// replacing values and failed puts do not change the counts
+	for _, k := range keys {
+		t.assert_nil(bpt.Put(k, t.rand_value(8)))
+		_, err := bpt.PutIfAbsent(k, t.rand_value(8))
+		t.assert_nil(err)
+	}
+	t.assert_nil(bpt.Verify())
+	t.assert("size", bpt.Size() == len(keys))
+	c, err := bpt.CountRange(nil, nil)
+	t.assert_nil(err)
+	t.assert("counted", c == len(keys))
+}
+
+func TestCountsNeedSubtreeCounts(x *testing.T) {
+	t := (*T)(x)
+	bpt, clean := t.bptFixed()
+	defer clean()
+	t.assert_nil(bpt.Add(t.rand_key(), t.rand_value(8)))
+	_, err := bpt.Rank(t.rand_key())
+	t.assert("Rank", err != nil)
+	_, err = bpt.CountRange(nil, nil)
+	t.assert("CountRange", err != nil)
+	_, _, err = bpt.Select(0)
+	t.assert("Select", err != nil)
+}
+
+func TestCountsDeep(x *testing.T) {
+	t := (*T)(x)
+	bf, clean := t.blkfile()
+	defer clean()
+	bpt, err := New(bf, 8, 8, SubtreeCounts())
+	t.assert_nil(err)
+	// enough leaves for the internal nodes to split
+	kvs := make(KVS, 0, 60000)
+	for i := 0; i < cap(kvs); i++ {
+		kv := &KV{key: t.rand_key(), value: t.rand_value(8)}
+		kvs = append(kvs, kv)
+		t.assert_nil(bpt.Add(kv.key, kv.value))
+	}
+	t.assert_nil(bpt.Verify())
+	sort.Stable(kvs)
+	check := func() {
+		for i := 0; i < len(kvs); i += 997 {
+			key, _, err := bpt.Select(i)
+			t.assert_nil(err)
+			t.assert("Select", bytes.Equal(key, kvs[i].key))
+			r, err := bpt.Rank(key)
+			t.assert_nil(err)
+			t.assert("Rank", r == firstOf(kvs, key))
+		}
+	}
+	check()
+	kept := kvs[:0]
+	for i, kv := range kvs {
+		if i%3 == 0 {
+			t.assert_nil(bpt.Remove(kv.key, func([]byte) bool { return true }))
+		} else {
+			kept = append(kept, kv)
+		}
+	}
+	kvs = kept
+	t.assert_nil(bpt.Verify())
+	t.assert("size", bpt.Size() == len(kvs))
+	check()
+}
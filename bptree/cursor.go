@@ -0,0 +1,458 @@
+package bptree
+
+import (
+	"bytes"
+)
+
+import (
+	"github.com/timtadh/fs2/errors"
+)
+
+type cursorState int
+
+const (
+	cursorBefore  cursorState = iota // before the first pair
+	cursorOn                         // on a pair
+	cursorDeleted                    // where a pair was, before the pair after it
+	cursorAfter                      // after the last pair
+)
+
+// A Cursor is a position in the tree which can step forward (Next) and
+// backward (Prev) and be moved (Seek, SeekLast) at any time. Unlike the
+// iterators it is not tied to a direction or a range which makes it
+// suitable for merge joins and for resuming a scan from the last key a
+// client saw.
+//
+//	c := bpt.Cursor()
+//	var ok bool
+//	for ok, err = c.Seek(from); ok && err == nil; ok, err = c.Next() {
+//		// do something with c.Key() and c.Value()
+//	}
+//	if err != nil {
+//		// handle error
+//	}
+//
+// A new Cursor is before the first pair (so Next moves it onto the
+// first pair). Stepping off either end leaves it after the last pair or
+// before the first, from where Prev and Next step back into the tree.
+//
+// The Cursor holds its place (the leaf and index of its pair) between
+// calls. If the tree changes (through the cursor or not) it finds its
+// place again by its key and value (and how many pairs with the same
+// key came before it). If its own pair was removed it ends up between
+// the pairs either side of it. For a position which cannot be disturbed use a
+// Cursor from a Snapshot. A Cursor must not be used from more than one
+// goroutine at once.
+type Cursor struct {
+	bpt      *BpTree
+	readOnly bool // from a Snapshot
+	state    cursorState
+	a        uint64
+	i        int
+	mods     uint64 // bpt.mods when a, i were found
+	key      []byte
+	value    []byte
+	dup      int // how many pairs with key come before this one
+}
+
+// Make a new Cursor positioned before the first pair in the tree.
+func (self *BpTree) Cursor() *Cursor {
+	return &Cursor{bpt: self, state: cursorBefore}
+}
+
+// Is the cursor on a pair?
+func (c *Cursor) Valid() bool {
+	return c.state == cursorOn
+}
+
+// The key of the pair the cursor is on (nil if it is not on a pair). It
+// is a copy, it is safe to hold onto.
+func (c *Cursor) Key() []byte {
+	if c.state != cursorOn {
+		return nil
+	}
+	return c.key
+}
+
+// The value of the pair the cursor is on (nil if it is not on a pair),
+// as it was when the cursor moved onto the pair or last updated it. It
+// is a copy, it is safe to hold onto.
+func (c *Cursor) Value() []byte {
+	if c.state != cursorOn {
+		return nil
+	}
+	return c.value
+}
+
+// Move the cursor to the first pair whose key is greater than or equal
+// to key (the first pair in the tree if key is nil). Returns false if
+// there is no such pair, the cursor is then after the last pair.
+func (c *Cursor) Seek(key []byte) (bool, error) {
+	bpt := c.bpt
+	bpt.rlock()
+	defer bpt.runlock()
+	a, i, end, err := c.start(key)
+	if err != nil {
+		return false, err
+	} else if end {
+		c.state = cursorAfter
+		return false, nil
+	}
+	return true, c.load(a, i, 0)
+}
+
+// Move the cursor to the last pair in the tree. Returns false if the
+// tree is empty.
+func (c *Cursor) SeekLast() (bool, error) {
+	bpt := c.bpt
+	bpt.rlock()
+	defer bpt.runlock()
+	return c.last()
+}
+
+// Step to the next pair. Returns false when it steps past the last
+// pair.
+func (c *Cursor) Next() (bool, error) {
+	bpt := c.bpt
+	bpt.rlock()
+	defer bpt.runlock()
+	var a uint64
+	var i, at int
+	var end bool
+	var err error
+	switch c.state {
+	case cursorAfter:
+		return false, nil
+	case cursorBefore:
+		a, i, end, err = c.start(nil)
+	default:
+		var ours bool
+		a, i, at, end, ours, err = c.locate()
+		if err == nil && !end && ours {
+			at++
+			a, i, end, err = bpt.nextLoc(a, i)
+		}
+	}
+	if err != nil {
+		return false, err
+	} else if end {
+		c.state = cursorAfter
+		return false, nil
+	}
+	dup := 0
+	if c.state != cursorBefore {
+		equal, err := c.keyIs(a, i, c.key)
+		if err != nil {
+			return false, err
+		} else if equal {
+			dup = at
+		}
+	}
+	return true, c.load(a, i, dup)
+}
+
+// Step to the previous pair. Returns false when it steps before the
+// first pair.
+func (c *Cursor) Prev() (bool, error) {
+	bpt := c.bpt
+	bpt.rlock()
+	defer bpt.runlock()
+	switch c.state {
+	case cursorBefore:
+		return false, nil
+	case cursorAfter:
+		return c.last()
+	}
+	a, i, at, _, _, err := c.locate()
+	if err != nil {
+		return false, err
+	}
+	a, i, end, err := bpt.prevLoc(a, i)
+	if err != nil {
+		return false, err
+	} else if end {
+		c.state = cursorBefore
+		return false, nil
+	}
+	equal, err := c.keyIs(a, i, c.key)
+	if err != nil {
+		return false, err
+	} else if equal {
+		return true, c.load(a, i, at-1)
+	}
+	dup, err := c.dupsBefore(a, i)
+	if err != nil {
+		return false, err
+	}
+	return true, c.load(a, i, dup)
+}
+
+// Remove the pair the cursor is on. Afterwards the cursor is not on a
+// pair, Next moves it to the pair which came after the removed one and
+// Prev to the pair which came before it.
+func (c *Cursor) Delete() error {
+	bpt := c.bpt
+	bpt.lock()
+	defer bpt.unlock()
+	if c.readOnly || bpt.bf.ReadOnly() {
+		return errors.Errorf("Cannot remove from a read only tree")
+	}
+	a, i, at, err := c.ours()
+	if err != nil {
+		return err
+	}
+	// Remove offers the pairs with the key to `where` last to first so
+	// count them to know when it gets to this one.
+	total := at
+	for end := false; !end; {
+		equal, err := c.keyIs(a, i, c.key)
+		if err != nil {
+			return err
+		} else if !equal {
+			break
+		}
+		total++
+		a, i, end, err = bpt.nextLoc(a, i)
+		if err != nil {
+			return err
+		}
+	}
+	seen := 0
+	where := func([]byte) bool {
+		idx := total - 1 - seen
+		seen++
+		return idx == at
+	}
+	cntDelta, root, err := bpt.remove(bpt.meta.root, c.key, where)
+	if err != nil {
+		return err
+	}
+	bpt.meta.itemCount -= cntDelta
+	bpt.meta.root = root
+	c.state = cursorDeleted
+	c.value = nil
+	return bpt.writeMeta()
+}
+
+// Replace the value of the pair the cursor is on.
+func (c *Cursor) Update(value []byte) error {
+	bpt := c.bpt
+	bpt.lock()
+	defer bpt.unlock()
+	if c.readOnly || bpt.bf.ReadOnly() {
+		return errors.Errorf("Cannot update a read only tree")
+	}
+	a, i, _, err := c.ours()
+	if err != nil {
+		return err
+	}
+	v, err := bpt.checkValue(value)
+	if err != nil {
+		return err
+	}
+	err = bpt.doLeaf(a, func(n *leaf) error {
+		return n.updateValueAt(bpt.varchar, i, v)
+	})
+	if err != nil {
+		return err
+	}
+	c.value = make([]byte, len(value))
+	copy(c.value, value)
+	return nil
+}
+
+// Find the first pair with a key greater than or equal to key (or the
+// first pair if key is nil).
+func (c *Cursor) start(key []byte) (a uint64, i int, end bool, err error) {
+	bpt := c.bpt
+	a, i, err = bpt.getStart(key)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	var less bool
+	err = bpt.doLeaf(a, func(n *leaf) error {
+		if i >= int(n.meta.keyCount) {
+			// this happens when the tree is empty!
+			end = true
+			return nil
+		} else if key == nil {
+			return nil
+		}
+		return n.doKeyAt(bpt.varchar, i, func(k []byte) error {
+			less = bpt.cmp(k, key) < 0
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, 0, false, err
+	} else if less {
+		// every key is less than the search key
+		return bpt.nextLoc(a, i)
+	}
+	return a, i, end, nil
+}
+
+func (c *Cursor) last() (bool, error) {
+	bpt := c.bpt
+	a, i, err := bpt.lastKey(bpt.meta.root)
+	if err != nil {
+		return false, err
+	}
+	var empty bool
+	err = bpt.doLeaf(a, func(n *leaf) error {
+		empty = n.meta.keyCount == 0
+		return nil
+	})
+	if err != nil {
+		return false, err
+	} else if empty {
+		c.state = cursorAfter
+		return false, nil
+	}
+	dup, err := c.dupsBefore(a, i)
+	if err != nil {
+		return false, err
+	}
+	return true, c.load(a, i, dup)
+}
+
+// Find the cursor's place in the tree. The location is the cursor's
+// pair (ours is true) or, if that pair is gone, the pair which came
+// after it (end is true if there is no such pair). At is how many pairs
+// with the cursor's key come before the location.
+//
+// After the tree changes the pair with the cursor's key and value
+// nearest to its old index among the pairs with the key is its pair
+// (pairs with the key may have been added or removed before it). If
+// there is none the pair is gone.
+func (c *Cursor) locate() (a uint64, i, at int, end, ours bool, err error) {
+	bpt := c.bpt
+	if c.mods == bpt.mods {
+		return c.a, c.i, c.dup, false, c.state == cursorOn, nil
+	}
+	var ba uint64
+	var bi, best int = 0, -1
+	var da uint64
+	var di int
+	dupFound := false
+	a, i, end, err = c.start(c.key)
+	for ; err == nil && !end; at++ {
+		var equal bool
+		equal, err = c.keyIs(a, i, c.key)
+		if err != nil || !equal {
+			break
+		}
+		if at == c.dup {
+			da, di, dupFound = a, i, true
+		}
+		if c.state != cursorOn {
+			if dupFound {
+				break
+			}
+		} else if best >= 0 && at-c.dup >= c.dup-best {
+			// the rest are further away
+			break
+		} else {
+			var same bool
+			same, err = c.valueIs(a, i, c.value)
+			if err != nil {
+				break
+			} else if same {
+				ba, bi, best = a, i, at
+			}
+		}
+		a, i, end, err = bpt.nextLoc(a, i)
+	}
+	if err != nil {
+		return 0, 0, 0, false, false, err
+	}
+	if best >= 0 {
+		c.a, c.i, c.dup, c.mods = ba, bi, best, bpt.mods
+		return ba, bi, best, false, true, nil
+	}
+	if c.state == cursorOn {
+		c.state = cursorDeleted
+		c.value = nil
+	}
+	if dupFound {
+		return da, di, c.dup, false, false, nil
+	}
+	return a, i, at, end, false, nil
+}
+
+// The location of the cursor's pair and how many pairs with its key
+// come before it, it is an error if the cursor is not on a pair.
+func (c *Cursor) ours() (a uint64, i, at int, err error) {
+	if c.state != cursorOn {
+		return 0, 0, 0, errors.Errorf("The cursor is not on a pair")
+	}
+	a, i, at, _, ours, err := c.locate()
+	if err != nil {
+		return 0, 0, 0, err
+	} else if !ours {
+		return 0, 0, 0, errors.Errorf("The pair under the cursor was removed")
+	}
+	return a, i, at, nil
+}
+
+// Does the pair at a, i have the key?
+func (c *Cursor) keyIs(a uint64, i int, key []byte) (equal bool, err error) {
+	err = c.bpt.doKey(a, i, func(k []byte) error {
+		equal = bytes.Equal(k, key)
+		return nil
+	})
+	return equal, err
+}
+
+// Does the pair at a, i have the value?
+func (c *Cursor) valueIs(a uint64, i int, value []byte) (equal bool, err error) {
+	err = c.bpt.doKV(a, i, func(_, v []byte) error {
+		equal = bytes.Equal(v, value)
+		return nil
+	})
+	return equal, err
+}
+
+// How many pairs before a, i have the same key.
+func (c *Cursor) dupsBefore(a uint64, i int) (int, error) {
+	bpt := c.bpt
+	key, err := bpt.keyAt(a, i)
+	if err != nil {
+		return 0, err
+	}
+	dup := 0
+	for {
+		var end bool
+		a, i, end, err = bpt.prevLoc(a, i)
+		if err != nil {
+			return 0, err
+		} else if end {
+			return dup, nil
+		}
+		equal, err := c.keyIs(a, i, key)
+		if err != nil {
+			return 0, err
+		} else if !equal {
+			return dup, nil
+		}
+		dup++
+	}
+}
+
+// Put the cursor on the pair at a, i.
+func (c *Cursor) load(a uint64, i int, dup int) error {
+	err := c.bpt.doKV(a, i, func(k, v []byte) error {
+		c.key = make([]byte, len(k))
+		copy(c.key, k)
+		c.value = make([]byte, len(v))
+		copy(c.value, v)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.state = cursorOn
+	c.a, c.i, c.mods = a, i, c.bpt.mods
+	c.dup = dup
+	return nil
+}
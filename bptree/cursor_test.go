@@ -0,0 +1,313 @@
+package bptree
+
+import "testing"
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+import (
+	"github.com/timtadh/fs2/slice"
+)
+
+func (t *T) assert_on(c *Cursor, kvs KVS, i int) func(bool, error) {
+	return func(ok bool, err error) {
+		t.assert_nil(err)
+		if i < 0 || i >= len(kvs) {
+			t.assert(fmt.Sprintf("should be off the end at %v", i), !ok && !c.Valid() && c.Key() == nil)
+			return
+		}
+		t.assert(fmt.Sprintf("should be on %v", i), ok && c.Valid())
+		t.assert(fmt.Sprintf("key %v was %v expected %v", i, c.Key(), kvs[i].key), bytes.Equal(c.Key(), kvs[i].key))
+		t.assert(fmt.Sprintf("value %v was %v expected %v", i, c.Value(), kvs[i].value), bytes.Equal(c.Value(), kvs[i].value))
+	}
+}
+
+// index of the first pair with key >= kvs[i].key
+func firstOf(kvs KVS, key []byte) int {
+	return sort.Search(len(kvs), func(j int) bool { return bytes.Compare(kvs[j].key, key) >= 0 })
+}
+
+func TestCursorWalk(x *testing.T) {
+	t := (*T)(x)
+	kvs := t.bulkKVS(5000, t.rand_key, func() []byte { return t.rand_value(8) })
+	bf, clean := t.blkfile()
+	defer clean()
+	// bulk loading keeps the duplicates in order so the values match too
+	bpt, err := BulkLoad(bf, 8, 8, kvsIterator(kvs), FillFactor(.5))
+	t.assert_nil(err)
+
+	c := bpt.Cursor()
+	t.assert("new cursor is not on a pair", !c.Valid())
+	for i := 0; i <= len(kvs); i++ {
+		t.assert_on(c, kvs, i)(c.Next())
+	}
+	t.assert_on(c, kvs, len(kvs))(c.Next())
+	for i := len(kvs) - 1; i >= -1; i-- {
+		t.assert_on(c, kvs, i)(c.Prev())
+	}
+	t.assert_on(c, kvs, -1)(c.Prev())
+	t.assert_on(c, kvs, 0)(c.Next())
+
+	t.assert_on(c, kvs, len(kvs)-1)(c.SeekLast())
+	t.assert_on(c, kvs, 0)(c.Seek(nil))
+	for i := 0; i < len(kvs); i += 37 {
+		t.assert_on(c, kvs, firstOf(kvs, kvs[i].key))(c.Seek(kvs[i].key))
+		key := t.rand_key()
+		j := firstOf(kvs, key)
+		t.assert_on(c, kvs, j)(c.Seek(key))
+		t.assert_on(c, kvs, j-1)(c.Prev())
+	}
+	end := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	t.assert_on(c, kvs, firstOf(kvs, end))(c.Seek(end))
+
+	// wander around
+	c = bpt.Cursor()
+	i := -1
+	for step := 0; step < 20000; step++ {
+		if rand.Intn(2) == 0 {
+			if i < len(kvs) {
+				i++
+			}
+			t.assert_on(c, kvs, i)(c.Next())
+		} else {
+			if i >= 0 {
+				i--
+			}
+			t.assert_on(c, kvs, i)(c.Prev())
+		}
+		if step%5000 == 0 {
+			i = rand.Intn(len(kvs))
+			i = firstOf(kvs, kvs[i].key)
+			t.assert_on(c, kvs, i)(c.Seek(kvs[i].key))
+		}
+	}
+
+	empty, err := New(bf, 8, 8)
+	t.assert_nil(err)
+	c = empty.Cursor()
+	t.assert_on(c, nil, 0)(c.Next())
+	t.assert_on(c, nil, 0)(c.SeekLast())
+	t.assert_on(c, nil, 0)(c.Seek(nil))
+	t.assert_on(c, nil, -1)(c.Prev())
+}
+
+func TestCursorDelete(x *testing.T) {
+	t := (*T)(x)
+	kvs := t.bulkKVS(4000,
+		func() []byte { return t.rand_varchar(0, 24) },
+		func() []byte { return t.rand_varchar(1, 64) })
+	bf, clean := t.blkfile()
+	defer clean()
+	bpt, err := BulkLoad(bf, -1, -1, kvsIterator(kvs), FillFactor(.5))
+	t.assert_nil(err)
+
+	// delete every third pair going forward
+	kept := make(KVS, 0, len(kvs))
+	c := bpt.Cursor()
+	for i := 0; i < len(kvs); i++ {
+		t.assert_on(c, kvs, i)(c.Next())
+		if i%3 == 0 {
+			t.assert_nil(c.Delete())
+			t.assert("not on a pair after delete", !c.Valid() && c.Value() == nil)
+			t.assert("cannot delete twice", c.Delete() != nil)
+			t.assert("cannot update", c.Update([]byte("x")) != nil)
+		} else {
+			kept = append(kept, kvs[i])
+		}
+	}
+	t.assert_on(c, kvs, len(kvs))(c.Next())
+	t.assert_nil(bpt.Verify())
+	t.assert(fmt.Sprintf("size %v expected %v", bpt.Size(), len(kept)), bpt.Size() == len(kept))
+	t.assert_loaded(bpt, kept)
+
+	// and every other pair going backward
+	kvs = kept
+	kept = make(KVS, 0, len(kvs))
+	for i := len(kvs) - 1; i >= 0; i-- {
+		t.assert_on(c, kvs, i)(c.Prev())
+		if i%2 == 1 {
+			t.assert_nil(c.Delete())
+			// stepping after the delete lands either side of the hole
+			t.assert_on(c, kvs, i+1)(c.Next())
+			t.assert_on(c, kvs, i-1)(c.Prev())
+			t.assert_on(c, kvs, i+1)(c.Next())
+		} else {
+			kept = append(kept, kvs[i])
+		}
+	}
+	for i, j := 0, len(kept)-1; i < j; i, j = i+1, j-1 {
+		kept[i], kept[j] = kept[j], kept[i]
+	}
+	t.assert_nil(bpt.Verify())
+	t.assert_loaded(bpt, kept)
+
+	// delete the rest
+	for ok, err := c.Seek(nil); ok; ok, err = c.Next() {
+		t.assert_nil(err)
+		t.assert_nil(c.Delete())
+	}
+	t.assert("empty", bpt.Size() == 0)
+	t.assert_on(c, nil, 0)(c.Seek(nil))
+	t.assert_nil(bpt.Verify())
+}
+
+func TestCursorUpdate(x *testing.T) {
+	t := (*T)(x)
+	bpt, clean := t.bpt()
+	defer clean()
+	kvs := make(KVS, 0, 1000)
+	for i := 0; i < cap(kvs); i++ {
+		kv := t.make_kv()
+		kvs = append(kvs, kv)
+		t.assert_nil(bpt.Add(kv.key, kv.value))
+	}
+	sort.Stable(kvs)
+	c := bpt.Cursor()
+	for ok, err := c.Next(); ok; ok, err = c.Next() {
+		t.assert_nil(err)
+		value := t.rand_varchar(1, 100)
+		t.assert_nil(c.Update(value))
+		t.assert("updated value", bytes.Equal(c.Value(), value))
+	}
+	t.assert_nil(bpt.Verify())
+	values := make(map[string]int)
+	c = bpt.Cursor()
+	for ok, err := c.Next(); ok; ok, err = c.Next() {
+		t.assert_nil(err)
+		values[string(c.Value())]++
+	}
+	t.assert_nil(bpt.DoIterate(func(k, v []byte) error {
+		values[string(v)]--
+		return nil
+	}))
+	for _, n := range values {
+		t.assert("values match", n == 0)
+	}
+	// the leaves hold the only reference to the new values
+	a, err := bpt.firstLeaf()
+	t.assert_nil(err)
+	for a != 0 {
+		t.assert_nil(bpt.doLeaf(a, func(n *leaf) error {
+			for i := 0; i < int(n.meta.keyCount); i++ {
+				v := n.val(i)
+				err := bpt.varchar.doRun(*slice.AsUint64(&v), func(m *varRunMeta) error {
+					t.assert(fmt.Sprintf("refs %v", m.refs), m.refs == 1)
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+			a = n.meta.next
+			return nil
+		}))
+	}
+
+	fixed, clean2 := t.bptFixed()
+	defer clean2()
+	t.assert_nil(fixed.Add(t.rand_key(), t.rand_value(8)))
+	c = fixed.Cursor()
+	_, err = c.Next()
+	t.assert_nil(err)
+	t.assert("wrong size", c.Update(t.rand_value(9)) != nil)
+	value := t.rand_value(8)
+	t.assert_nil(c.Update(value))
+	t.assert_hasKV(fixed)("updated", c.Key(), value)
+}
+
+func TestCursorTreeChanges(x *testing.T) {
+	t := (*T)(x)
+	bpt, clean := t.bptFixed()
+	defer clean()
+	kvs := make(KVS, 0, 2000)
+	for i := 0; i < cap(kvs); i++ {
+		kv := &KV{key: t.rand_key(), value: t.rand_value(8)}
+		kvs = append(kvs, kv)
+		t.assert_nil(bpt.Add(kv.key, kv.value))
+	}
+	sort.Stable(kvs)
+	c := bpt.Cursor()
+	mid := len(kvs) / 2
+	t.assert_on(c, kvs, mid)(c.Seek(kvs[mid].key))
+
+	// split the leaves around the cursor
+	key := kvs[mid].key
+	for i := 0; i < 2000; i++ {
+		kv := &KV{key: t.rand_key(), value: t.rand_value(8)}
+		kvs = append(kvs, kv)
+		t.assert_nil(bpt.Add(kv.key, kv.value))
+	}
+	sort.Stable(kvs)
+	mid = firstOf(kvs, key)
+	t.assert("still on its pair", bytes.Equal(c.Key(), key))
+	t.assert_on(c, kvs, mid+1)(c.Next())
+	t.assert_on(c, kvs, mid)(c.Prev())
+
+	// remove the pair under the cursor from outside of it
+	t.assert_nil(bpt.Remove(kvs[mid].key, func([]byte) bool { return true }))
+	t.assert("update after remove", c.Update(t.rand_value(8)) != nil)
+	t.assert("not valid", !c.Valid())
+	t.assert_on(c, kvs, mid+1)(c.Next())
+	t.assert_on(c, kvs, mid-1)(c.Prev())
+
+	// a cursor from a snapshot does not move and cannot write
+	snap, err := bpt.Snapshot()
+	t.assert_nil(err)
+	sc := snap.Cursor()
+	t.assert_on(sc, kvs, mid+1)(sc.Seek(kvs[mid+1].key))
+	t.assert_nil(bpt.Remove(kvs[mid+1].key, func([]byte) bool { return true }))
+	t.assert_on(sc, kvs, mid+1)(sc.Seek(kvs[mid+1].key))
+	t.assert("snapshot update", sc.Update(t.rand_value(8)) != nil)
+	t.assert("snapshot delete", sc.Delete() != nil)
+	t.assert_nil(snap.Close())
+	t.assert_nil(bpt.Verify())
+}
+
+func TestCursorDuplicatesChange(x *testing.T) {
+	t := (*T)(x)
+	bpt, clean := t.bptFixed()
+	defer clean()
+	key := t.rand_key()
+	values := make(map[string]bool)
+	for i := 0; i < 5; i++ {
+		value := t.rand_value(8)
+		values[string(value)] = true
+		t.assert_nil(bpt.Add(key, value))
+	}
+	c := bpt.Cursor()
+	ok, err := c.Seek(key)
+	t.assert_nil(err)
+	t.assert("on the key", ok)
+	for i := 0; i < 3; i++ {
+		ok, err = c.Next()
+		t.assert_nil(err)
+		t.assert("on the key", ok)
+	}
+	seen := c.Value()
+
+	// another pair with the key moves the cursor's pair along
+	added := t.rand_value(8)
+	values[string(added)] = true
+	t.assert_nil(bpt.Add(key, added))
+	t.assert_nil(c.Delete())
+	delete(values, string(seen))
+	t.assert_nil(bpt.DoFind(key, func(_, value []byte) error {
+		t.assert(fmt.Sprintf("unexpected value %v", value), values[string(value)])
+		delete(values, string(value))
+		return nil
+	}))
+	t.assert(fmt.Sprintf("the wrong pair was deleted, missing %v", values), len(values) == 0)
+
+	// the cursor's pair is gone when no pair has its value
+	ok, err = c.Next()
+	t.assert_nil(err)
+	t.assert("on the key", ok)
+	seen = c.Value()
+	t.assert_nil(bpt.Remove(key, func(value []byte) bool { return bytes.Equal(value, seen) }))
+	t.assert("update of a removed pair", c.Update(t.rand_value(8)) != nil)
+	t.assert_nil(bpt.Verify())
+}
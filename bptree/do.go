@@ -24,8 +24,13 @@ func (self *BpTree) new(init func([]byte) error) (uint64, error) {
 	if err != nil {
 		return 0, err
 	}
-	err = self.bf.Do(a, 1, func(bytes []byte) error {
-		return init(bytes)
+	err = self.doBlock(a, func(bytes []byte) error {
+		err := init(bytes)
+		if err != nil {
+			return err
+		}
+		sealNode(bytes)
+		return nil
 	})
 	if err != nil {
 		return 0, err
@@ -95,12 +100,16 @@ func (self *BpTree) do(
 	internalDo func(*internal) error,
 	leafDo func(*leaf) error,
 ) error {
-	return self.bf.Do(a, 1, func(bytes []byte) error {
+	return self.doBlock(a, func(bytes []byte) error {
 		flags := consts.AsFlag(bytes)
 		if flags&consts.INTERNAL != 0 {
-			return internalDo(asInternal(bytes))
+			return self.checked(a, bytes, func() error {
+				return internalDo(asInternal(bytes))
+			})
 		} else if flags&consts.LEAF != 0 {
-			return leafDo(asLeaf(bytes))
+			return self.checked(a, bytes, func() error {
+				return leafDo(asLeaf(bytes))
+			})
 		} else {
 			return errors.Errorf("Unknown block type")
 		}
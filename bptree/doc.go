@@ -2,18 +2,51 @@
 A Memory Mapped B+ Tree
 
 This is a low level file structure. It is a memory mapped B+ Tree. It
-is not thread safe nor is it safe to access the backing file from
-multiple processes at once.
+is safe to use from multiple goroutines: readers run in parallel with
+each other but not with a writer, only reads from a Snapshot run
+alongside the writer (see the BpTree type for the details). It is not
+safe to access the backing file from multiple processes at once.
 
 Features:
 
-1. Fixed size key. Set at B+ Tree creation. Key resizes mean the tree
-needs to be recreated.
+1. Fixed size or variable length keys. Set at B+ Tree creation. Fixed
+key resizes mean the tree needs to be recreated. Variable length keys
+(NewVarKeys) may be any byte string.
 
 2. Variable length values. They can very from 0 bytes to 2^32 - 1 bytes.
+Values can be rewritten in place with Update.
 
 3. Duplicate key support. Duplicates are kept out of the index and
-only occur in the leaves.
+only occur in the leaves. Trees made with UniqueKeys are maps instead,
+with Put, PutIfAbsent and CompareAndSwap which replace values in place.
+
+4. Pluggable key order. Keys are ordered lexicographically unless the
+tree is made with the CompareWith option naming a Comparator registered
+with RegisterComparator (there are built ins for signed integers, floats
+and reversed orders). The name is stored in the tree and used again by
+Open.
+
+5. Bulk loading. BulkLoad builds a tree from pairs which are already in
+order by packing the leaves directly (see FillFactor) rather than
+adding the pairs one at a time. AddBatch (and WriteBatch) add a batch
+of pairs to an existing tree leaf by leaf.
+
+6. Cursors. A Cursor steps forwards and backwards through the pairs,
+can Seek to a key at any time and can Delete or Update the pair it is
+on.
+
+7. Order statistics. Trees made with SubtreeCounts keep the number of
+pairs under every internal node's children so CountRange and Rank do
+not scan. Select, Sample and SampleRange use them to find a pair in
+O(log n) block reads plus one read per leaf they step over inside a run
+of a duplicated key (the leaves of a run are linked, not indexed), so
+selecting into a run of r pairs costs O(log n + r/b) for b pairs per
+leaf.
+
+8. Prefix scans and compression. PrefixScan and DoPrefix iterate the
+keys starting with a prefix. Trees of fixed size keys made with
+PrefixCompression store the prefix the keys of a leaf share once so
+composite keys (tenant, timestamp, id) pack many more pairs per leaf.
 
 Creating a new *BpTree
 
@@ -42,9 +75,10 @@ Opening a *BpTree
 	// do stuff with bpt
 
 Add a key/value pair. Note, since this is low level you have to
-serialize your keys and values. The length of the []byte representing
-the key must exactly match the key size of the B+ Tree. You can find out
-what that was set to by called `bpt.KeySize()`
+serialize your keys and values. Unless the tree was made with
+NewVarKeys the length of the []byte representing the key must exactly
+match the key size of the B+ Tree. You can find out what that was set to
+by called `bpt.KeySize()` (it is -1 for variable length keys)
 
 	import (
 		"encoding/binary"
@@ -98,6 +132,29 @@ the iterators (Range, Find, Keys, Values, Iterate) called the Do iterface.
 It is recommended that you always use the Do* interfaces. The other is
 provided if the cost of extra method calls is too high.
 
+With Go 1.23 or later the iterators can also be ranged over (All,
+BackwardSeq, RangeSeq, FindSeq, PrefixSeq, KeySeq and ValueSeq). The
+second value returned is checked for the error once the loop is done.
+
+	pairs, errf := bpt.FindSeq(kBytes)
+	for key, value := range pairs {
+		// do stuff with the keys and values
+	}
+	if err := errf(); err != nil {
+		log.Fatal(err)
+	}
+
+All of these copy the keys and values out of the memory map. View reads
+without copying: the keys and values handed out inside it alias the
+mapping and are valid until the function given to View returns.
+
+	err = bpt.View(func(v bptree.ReadView) error {
+		return v.DoFind(kBytes, func(key, value []byte) error {
+			// do not keep or modify the key and value
+			return nil
+		})
+	})
+
 Removal is also slightly more complicated due to the duplicate keys.
 This example will remove all key/value pairs associated with the given
 key:
@@ -121,11 +178,22 @@ to remove just the one I added earlier do:
 That wraps up the basic usage. If you want to ensure that the bytes you
 have written are in fact on disk you have 2 options
 
-1. call bf.Sync() - Note this uses the async mmap interface under the
-hood. The bytes are not guarateed to hit the disk after this returns but
-they will go there soon.
+1. call bf.Sync() - Note by default this uses the async mmap interface
+under the hood. The bytes are not guarateed to hit the disk after this
+returns but they will go there soon. Call bf.SetSyncMode(fmap.SYNC)
+first if you need Sync to wait until the bytes are on disk.
 
 2. call bf.Close()
 
+To detect bytes which were damaged after they were written create the
+tree with checksums:
+
+	bpt, err := bptree.New(bf, -1, -1, bptree.Checksums())
+
+Every node and varchar run then carries a CRC32C which is checked when
+it is loaded. A block which does not match is reported as an
+*errors.CorruptionError naming the offset of the block. The option is
+stored in the file so Open does not need it.
+
 */
 package bptree
@@ -17,7 +17,7 @@ func (self *BpTree) firstKey(a uint64, do func(key []byte) error) error {
 			if int(n.meta.keyCount) == 0 {
 				return errors.Errorf("Block was empty")
 			}
-			return do(n.key(0))
+			return do(n.fullKey(0))
 		},
 	)
 }
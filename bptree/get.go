@@ -2,6 +2,7 @@ package bptree
 
 import (
 	"bytes"
+	"context"
 )
 
 import (
@@ -12,36 +13,6 @@ import (
 
 type bpt_iterator func() (a uint64, idx int, err error, bi bpt_iterator)
 
-func doIter(run func() (fs2.Iterator, error), do func(key, value []byte) error) error {
-	kvi, err := run()
-	if err != nil {
-		return err
-	}
-	var key, value []byte
-	for key, value, err, kvi = kvi(); kvi != nil; key, value, err, kvi = kvi() {
-		e := do(key, value)
-		if e != nil {
-			return e
-		}
-	}
-	return err
-}
-
-func doItemIter(run func() (fs2.ItemIterator, error), do func([]byte) error) error {
-	it, err := run()
-	if err != nil {
-		return err
-	}
-	var item []byte
-	for item, err, it = it(); it != nil; item, err, it = it() {
-		e := do(item)
-		if e != nil {
-			return e
-		}
-	}
-	return err
-}
-
 // Iterate over all of the key/value pairs in the tree
 //
 // 	err = bpt.DoIterate(func(key, value []byte) error {
@@ -51,11 +22,20 @@ func doItemIter(run func() (fs2.ItemIterator, error), do func([]byte) error) err
 // 		// handle error
 // 	}
 //
+// Return fs2.ErrStop (or wrap it) from do to stop early, DoIterate then
+// returns nil.
+//
 // Note, it is safe for the keys and values to escape the `do` context.
 // They are copied into it so you cannot harm the tree. An unsafe
 // version of this is being considered.
 func (self *BpTree) DoIterate(do func(key, value []byte) error) error {
-	return doIter(
+	return self.DoIterateCtx(context.Background(), do)
+}
+
+// DoIterate which stops (returning ctx.Err()) once the context is done.
+func (self *BpTree) DoIterateCtx(ctx context.Context, do func(key, value []byte) error) error {
+	return fs2.DoCtx(
+		ctx,
 		func() (fs2.Iterator, error) { return self.Iterate() },
 		do,
 	)
@@ -90,7 +70,13 @@ func (self *BpTree) Iterate() (kvi fs2.Iterator, err error) {
 // Iterate over all of the keys in the tree. See DoIterate() for usage
 // details
 func (self *BpTree) DoKeys(do func([]byte) error) error {
-	return doItemIter(
+	return self.DoKeysCtx(context.Background(), do)
+}
+
+// DoKeys which stops (returning ctx.Err()) once the context is done.
+func (self *BpTree) DoKeysCtx(ctx context.Context, do func([]byte) error) error {
+	return fs2.DoItemCtx(
+		ctx,
 		func() (fs2.ItemIterator, error) { return self.Keys() },
 		do,
 	)
@@ -123,7 +109,13 @@ func (self *BpTree) Keys() (it fs2.ItemIterator, err error) {
 // Iterate over all of the values in the tree. See DoIterate() for usage
 // details
 func (self *BpTree) DoValues(do func([]byte) error) error {
-	return doItemIter(
+	return self.DoValuesCtx(context.Background(), do)
+}
+
+// DoValues which stops (returning ctx.Err()) once the context is done.
+func (self *BpTree) DoValuesCtx(ctx context.Context, do func([]byte) error) error {
+	return fs2.DoItemCtx(
+		ctx,
 		func() (fs2.ItemIterator, error) { return self.Values() },
 		do,
 	)
@@ -152,7 +144,13 @@ func (self *BpTree) Values() (it fs2.ItemIterator, err error) {
 // Iterate over all of the key/values pairs with the given key. See
 // DoIterate() for usage details.
 func (self *BpTree) DoFind(key []byte, do func(key, value []byte) error) error {
-	return doIter(
+	return self.DoFindCtx(context.Background(), key, do)
+}
+
+// DoFind which stops (returning ctx.Err()) once the context is done.
+func (self *BpTree) DoFindCtx(ctx context.Context, key []byte, do func(key, value []byte) error) error {
+	return fs2.DoCtx(
+		ctx,
 		func() (fs2.Iterator, error) { return self.Find(key) },
 		do,
 	)
@@ -183,7 +181,13 @@ func (self *BpTree) Count(key []byte) (count int, err error) {
 // Iterate over all of the key/values pairs in reverse. See DoIterate()
 // for usage details.
 func (self *BpTree) DoBackward(do func(key, value []byte) error) error {
-	return doIter(
+	return self.DoBackwardCtx(context.Background(), do)
+}
+
+// DoBackward which stops (returning ctx.Err()) once the context is done.
+func (self *BpTree) DoBackwardCtx(ctx context.Context, do func(key, value []byte) error) error {
+	return fs2.DoCtx(
+		ctx,
 		func() (fs2.Iterator, error) { return self.Backward() },
 		do,
 	)
@@ -193,7 +197,14 @@ func (self *BpTree) DoBackward(do func(key, value []byte) error) error {
 // for usage details.
 func (self *BpTree) Backward() (kvi fs2.Iterator, err error) {
 	var bi bpt_iterator
+	self.rlock()
 	bi, err = self.backward(nil, nil)
+	if err == nil {
+		bi = self.live(bi, nil, func(key []byte) (bpt_iterator, error) {
+			return self.backward(key, nil)
+		})
+	}
+	self.runlock()
 	if err != nil {
 		return nil, err
 	}
@@ -203,69 +214,83 @@ func (self *BpTree) Backward() (kvi fs2.Iterator, err error) {
 // Iterate over all of the key/values pairs between [from, to]
 // inclusive. See DoIterate() for usage details.
 func (self *BpTree) DoRange(from, to []byte, do func(key, value []byte) error) error {
-	return doIter(
+	return self.DoRangeCtx(context.Background(), from, to, do)
+}
+
+// DoRange which stops (returning ctx.Err()) once the context is done.
+func (self *BpTree) DoRangeCtx(ctx context.Context, from, to []byte, do func(key, value []byte) error) error {
+	return fs2.DoCtx(
+		ctx,
 		func() (fs2.Iterator, error) { return self.Range(from, to) },
 		do,
 	)
 }
 
 func (self *BpTree) rangeIterator(from, to []byte) (bi bpt_iterator, err error) {
-	if from != nil && to == nil {
-		bi, err = self.forward(from, to)
-	} else if bytes.Compare(from, to) <= 0 {
-		bi, err = self.forward(from, to)
-	} else {
-		bi, err = self.backward(from, to)
+	// nil is the start (or end) of the tree
+	walk := self.forward
+	if from != nil && to != nil && self.cmp(from, to) > 0 {
+		walk = self.backward
+	}
+	bi, err = walk(from, to)
+	if err != nil {
+		return nil, err
 	}
-	return bi, err
+	return self.live(bi, from, func(key []byte) (bpt_iterator, error) {
+		return walk(key, to)
+	}), nil
 }
 
 // Iterate over all of the key/values pairs between [from, to]
-// inclusive. See Iterate() for usage details.
+// inclusive. If from is greater than to the pairs are in reverse order.
+// See RangeWith() for exclusive bounds, limits and offsets and Iterate()
+// for usage details.
 func (self *BpTree) Range(from, to []byte) (kvi fs2.Iterator, err error) {
+	self.rlock()
 	bi, err := self.rangeIterator(from, to)
+	self.runlock()
 	if err != nil {
 		return nil, err
 	}
 	return self._range(bi)
 }
 
+// Range without copying, the keys and values alias the mapping. They
+// may be changed by the next write to the tree so copy them to keep them
+// (or use View, which holds the latch).
 func (self *BpTree) UnsafeRange(from, to []byte) (kvi fs2.Iterator, err error) {
+	self.rlock()
 	bi, err := self.rangeIterator(from, to)
+	self.runlock()
 	if err != nil {
 		return nil, err
 	}
 	return self._rangeUnsafe(bi)
 }
 
+// The pairs at the locations bi steps through, copied out of the
+// mapping while the read latch is held (a writer may change them as
+// soon as it is released).
 func (self *BpTree) _range(bi bpt_iterator) (kvi fs2.Iterator, err error) {
-	unsafeKvi, err := self._rangeUnsafe(bi)
-	if err != nil {
-		return nil, err
-	}
-	// fmt.Println(errors.Errorf("called _range"))
-	kvi = func() (key, value []byte, e error, it fs2.Iterator) {
-		var k []byte
-		var v []byte
-		k, v, err, unsafeKvi = unsafeKvi()
-		if err != nil {
-			return nil, nil, err, nil
-		}
-		if unsafeKvi == nil {
-			return nil, nil, nil, nil
-		}
-		key = make([]byte, len(k))
+	return self.pairs(bi, func(k, v []byte) ([]byte, []byte) {
+		key := make([]byte, len(k))
 		copy(key, k)
-		value = make([]byte, len(v))
-		// fmt.Println(errors.Errorf("copy"))
+		value := make([]byte, len(v))
 		copy(value, v)
-		return key, value, nil, kvi
-	}
-	return kvi, nil
+		return key, value
+	}), nil
 }
 
 func (self *BpTree) _rangeUnsafe(bi bpt_iterator) (kvi fs2.Iterator, err error) {
-	kvi = func() (key, value []byte, e error, it fs2.Iterator) {
+	return self.pairs(bi, func(k, v []byte) ([]byte, []byte) {
+		return k, v
+	}), nil
+}
+
+func (self *BpTree) pairs(bi bpt_iterator, pair func(k, v []byte) ([]byte, []byte)) (kvi fs2.Iterator) {
+	kvi = func() (key, value []byte, err error, it fs2.Iterator) {
+		self.rlock()
+		defer self.runlock()
 		var a uint64
 		var i int
 		a, i, err, bi = bi()
@@ -276,8 +301,7 @@ func (self *BpTree) _rangeUnsafe(bi bpt_iterator) (kvi fs2.Iterator, err error)
 			return nil, nil, nil, nil
 		}
 		err = self.doKV(a, i, func(k, v []byte) error {
-			key = k
-			value = v
+			key, value = pair(k, v)
 			return nil
 		})
 		if err != nil {
@@ -285,7 +309,7 @@ func (self *BpTree) _rangeUnsafe(bi bpt_iterator) (kvi fs2.Iterator, err error)
 		}
 		return key, value, nil, kvi
 	}
-	return kvi, nil
+	return kvi
 }
 
 /* returns the key at the address and index or an error
@@ -329,7 +353,7 @@ func (self *BpTree) getStart(key []byte) (a uint64, i int, err error) {
 
 func (self *BpTree) _getStart(n uint64, key []byte) (a uint64, i int, err error) {
 	var flags consts.Flag
-	err = self.bf.Do(n, 1, func(bytes []byte) error {
+	err = self.doBlock(n, func(bytes []byte) error {
 		flags = consts.AsFlag(bytes)
 		return nil
 	})
@@ -352,7 +376,7 @@ func (self *BpTree) internalGetStart(n uint64, key []byte) (a uint64, i int, err
 			kid = *n.ptr(0)
 			return nil
 		}
-		i, has, err := find(self.varchar, n, key)
+		i, has, err := find(self.varchar, self.cmp, n, key)
 		if err != nil {
 			return err
 		}
@@ -384,7 +408,7 @@ func (self *BpTree) leafGetStart(n uint64, key []byte, stop bool, end uint64) (a
 			return nil
 		}
 		var has bool
-		i, has, err = find(self.varchar, n, key)
+		i, has, err = find(self.varchar, self.cmp, n, key)
 		if err != nil {
 			return err
 		}
@@ -392,7 +416,7 @@ func (self *BpTree) leafGetStart(n uint64, key []byte, stop bool, end uint64) (a
 			i = int(n.meta.keyCount) - 1
 		}
 		return n.doKeyAt(self.varchar, i, func(k []byte) error {
-			if !has && n.meta.next != 0 && bytes.Compare(k, key) < 0 {
+			if !has && n.meta.next != 0 && self.cmp(k, key) < 0 {
 				next = n.meta.next
 			}
 			return nil
@@ -409,7 +433,7 @@ func (self *BpTree) leafGetStart(n uint64, key []byte, stop bool, end uint64) (a
 
 func (self *BpTree) lastKey(n uint64) (a uint64, i int, err error) {
 	var flags consts.Flag
-	err = self.bf.Do(n, 1, func(bytes []byte) error {
+	err = self.doBlock(n, func(bytes []byte) error {
 		flags = consts.AsFlag(bytes)
 		return nil
 	})
@@ -517,7 +541,7 @@ func (self *BpTree) forward(from, to []byte) (bi bpt_iterator, err error) {
 			return nil
 		}
 		return n.doKeyAt(self.varchar, i, func(k []byte) error {
-			less = bytes.Compare(k, from) < 0
+			less = self.cmp(k, from) < 0
 			return nil
 		})
 	})
@@ -550,7 +574,7 @@ func (self *BpTree) forwardFrom(a uint64, i int, to []byte) (bi bpt_iterator, er
 		var less bool = false
 		err = self.doLeaf(a, func(n *leaf) error {
 			return n.doKeyAt(self.varchar, i, func(k []byte) error {
-				less = bytes.Compare(to, k) < 0
+				less = self.cmp(to, k) < 0
 				return nil
 			})
 		})
@@ -579,17 +603,24 @@ func (self *BpTree) backward(from, to []byte) (bi bpt_iterator, err error) {
 			return nil
 		}
 		return n.doKeyAt(self.varchar, i, func(k []byte) error {
-			greater = bytes.Compare(k, from) > 0
+			greater = self.cmp(k, from) > 0
 			return nil
 		})
 	})
 	if err != nil {
 		return nil, err
 	} else if greater {
-		bi = func() (uint64, int, error, bpt_iterator) {
-			return 0, 0, nil, nil
+		// from is not in the tree, start from the key before it
+		var end bool
+		a, i, end, err = self.prevLoc(a, i)
+		if err != nil {
+			return nil, err
+		} else if end {
+			bi = func() (uint64, int, error, bpt_iterator) {
+				return 0, 0, nil, nil
+			}
+			return bi, nil
 		}
-		return bi, nil
 	}
 	return self.backwardFrom(a, i, to)
 }
@@ -612,7 +643,7 @@ func (self *BpTree) backwardFrom(a uint64, i int, to []byte) (bi bpt_iterator, e
 		var more bool = false
 		err = self.doLeaf(a, func(n *leaf) error {
 			return n.doKeyAt(self.varchar, i, func(k []byte) error {
-				more = bytes.Compare(to, k) > 0
+				more = self.cmp(to, k) > 0
 				return nil
 			})
 		})
@@ -627,6 +658,62 @@ func (self *BpTree) backwardFrom(a uint64, i int, to []byte) (bi bpt_iterator, e
 	return bi, nil
 }
 
+// Make bi, which starts at from, safe to step after the tree has
+// changed. The iterators of Range and friends only hold the latch while
+// they step so between steps a writer may split, merge or free the leaf
+// bi is in. When the tree has been written (self.mods has moved on) the
+// returned iterator calls seek with the key it last returned (or from
+// if it has not returned anything yet) to start again from the first
+// pair with that key, in the direction of iteration, and skips the pairs
+// with that key it has already returned. It must be stepped with the
+// latch held.
+func (self *BpTree) live(bi bpt_iterator, from []byte, seek func(key []byte) (bpt_iterator, error)) bpt_iterator {
+	mods := self.mods
+	last := append([]byte(nil), from...)
+	seen := 0 // pairs with the key last returned so far
+	skip := 0
+	var next bpt_iterator
+	next = func() (a uint64, i int, err error, _ bpt_iterator) {
+		if mods != self.mods {
+			mods = self.mods
+			bi, err = seek(last)
+			if err != nil {
+				return 0, 0, err, nil
+			}
+			skip = seen
+		}
+		for {
+			a, i, err, bi = bi()
+			if err != nil {
+				return 0, 0, err, nil
+			} else if bi == nil {
+				return 0, 0, nil, nil
+			}
+			same := false
+			err = self.doKey(a, i, func(k []byte) error {
+				same = seen > 0 && self.cmp(k, last) == 0
+				if !same {
+					last = append(last[:0], k...)
+				}
+				return nil
+			})
+			if err != nil {
+				return 0, 0, err, nil
+			}
+			if !same {
+				seen, skip = 1, 0
+			} else if skip > 0 {
+				skip--
+				continue
+			} else {
+				seen++
+			}
+			return a, i, nil, next
+		}
+	}
+	return next
+}
+
 func (self *BpTree) nextLoc(a uint64, i int) (uint64, int, bool, error) {
 	j := i + 1
 	nextBlk := func(a uint64, j int) (uint64, int, bool, error) {
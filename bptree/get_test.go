@@ -4,10 +4,17 @@ import "testing"
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"os"
 	"sort"
 )
 
+import (
+	"github.com/timtadh/fs2"
+	"github.com/timtadh/fs2/fmap"
+)
+
 func TestIterateEmpty(x *testing.T) {
 	t := (*T)(x)
 	bpt, clean := t.bpt()
@@ -282,3 +289,166 @@ func TestRangeRegress(x *testing.T) {
 	}))
 	clean()
 }
+
+func TestRangeBackwardMissingKey(x *testing.T) {
+	t := (*T)(x)
+	bpt, clean := t.bptFixed()
+	defer clean()
+	key := func(i byte) []byte { return []byte{0, 0, 0, 0, 0, 0, 0, i} }
+	for i := byte(0); i < 10; i += 2 {
+		t.assert_nil(bpt.Add(key(i), key(i)))
+	}
+	ranges := []struct {
+		from, to byte
+		expect   []byte
+	}{
+		{6, 2, []byte{6, 4, 2}},
+		{5, 1, []byte{4, 2}}, // 5 is not in the tree, the range starts from 4
+		{9, 5, []byte{8, 6}},
+		{5, 5, []byte{}},
+		{1, 0, []byte{0}},
+		{5, 4, []byte{4}},
+		{3, 3, []byte{}},
+	}
+	for _, r := range ranges {
+		got := []byte{}
+		t.assert_nil(bpt.DoRange(key(r.from), key(r.to), func(k, v []byte) error {
+			got = append(got, k[7])
+			return nil
+		}))
+		t.assert(fmt.Sprintf("range %v %v got %v", r.from, r.to, got), bytes.Equal(got, r.expect))
+	}
+}
+
+func TestReadsNotLogged(x *testing.T) {
+	t := (*T)(x)
+	bf, err := fmap.CreateBlockFile(PATH)
+	t.assert_nil(err)
+	defer func() {
+		t.assert_nil(bf.Remove())
+	}()
+	t.assert_nil(bf.EnableLog())
+	bpt, err := New(bf, -1, -1)
+	t.assert_nil(err)
+	kvs := make([]*KV, 0, 500)
+	for i := 0; i < cap(kvs); i++ {
+		kv := t.make_kv()
+		kvs = append(kvs, kv)
+		t.assert_nil(bpt.Add(kv.key, kv.value))
+	}
+	t.assert_nil(bf.Sync())
+	logSize := func() int64 {
+		fi, err := os.Stat(bf.Path() + fmap.LOGSUFFIX)
+		t.assert_nil(err)
+		return fi.Size()
+	}
+	size := logSize()
+	for i, kv := range kvs {
+		t.assert_hasKV(bpt)(fmt.Sprintf("idx %v", i), kv.key, kv.value)
+	}
+	t.assert_nil(bpt.DoIterate(func(k, v []byte) error {
+		// a checkpoint does not wait for the readers
+		return bf.Sync()
+	}))
+	t.assert("the reads were logged", logSize() == size)
+	t.assert_nil(bpt.Add(kvs[0].key, kvs[0].value))
+	t.assert("the write was not logged", logSize() > size)
+	t.assert_nil(bf.Close())
+}
+
+func TestReadOnly(x *testing.T) {
+	t := (*T)(x)
+	bf, err := fmap.CreateBlockFile(PATH)
+	t.assert_nil(err)
+	defer func() {
+		t.assert_nil(bf.Remove())
+	}()
+	bpt, err := New(bf, -1, -1)
+	t.assert_nil(err)
+	kvs := make([]*KV, 0, 500)
+	for i := 0; i < cap(kvs); i++ {
+		kv := t.make_kv()
+		kvs = append(kvs, kv)
+		t.assert_nil(bpt.Add(kv.key, kv.value))
+	}
+	t.assert_nil(bf.Sync())
+	ro, err := fmap.OpenBlockFileReadOnly(PATH)
+	t.assert_nil(err)
+	rbpt, err := Open(ro)
+	t.assert_nil(err)
+	t.assert("size", rbpt.Size() == len(kvs))
+	for i, kv := range kvs {
+		t.assert_hasKV(rbpt)(fmt.Sprintf("idx %v", i), kv.key, kv.value)
+	}
+	t.assert("add should fail", rbpt.Add(kvs[0].key, kvs[0].value) != nil)
+	t.assert("remove should fail", rbpt.Remove(kvs[0].key, func([]byte) bool { return true }) != nil)
+	t.assert_nil(ro.Close())
+	t.assert_nil(bf.Close())
+}
+
+func TestDoStop(x *testing.T) {
+	t := (*T)(x)
+	kvs := make(KVS, 0, 500)
+	for i := 0; i < cap(kvs); i++ {
+		kvs = append(kvs, &KV{key: t.rand_key(), value: t.rand_value(8)})
+	}
+	sort.Sort(kvs)
+	bpt, clean := t.bptFixed()
+	defer clean()
+	for _, kv := range kvs {
+		t.assert_nil(bpt.Add(kv.key, kv.value))
+	}
+	stopAt := func(n int) (*int, func(k, v []byte) error) {
+		count := 0
+		return &count, func(k, v []byte) error {
+			count++
+			if count == n {
+				return fs2.ErrStop
+			}
+			return nil
+		}
+	}
+	count, do := stopAt(10)
+	t.assert_nil(bpt.DoIterate(do))
+	t.assert(fmt.Sprintf("iterated %v expected 10", *count), *count == 10)
+	count, do = stopAt(7)
+	t.assert_nil(bpt.DoRange(kvs[100].key, kvs[300].key, do))
+	t.assert(fmt.Sprintf("ranged %v expected 7", *count), *count == 7)
+	keys := 0
+	t.assert_nil(bpt.DoKeys(func(k []byte) error {
+		keys++
+		if keys == 3 {
+			return fs2.ErrStop
+		}
+		return nil
+	}))
+	t.assert(fmt.Sprintf("keys %v expected 3", keys), keys == 3)
+	values := 0
+	t.assert_nil(bpt.DoValues(func(v []byte) error {
+		values++
+		if values == 5 {
+			return fmt.Errorf("found the value: %w", fs2.ErrStop)
+		}
+		return nil
+	}))
+	t.assert(fmt.Sprintf("values %v expected 5", values), values == 5)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	count, do = stopAt(-1)
+	seen := 0
+	err := bpt.DoIterateCtx(ctx, func(k, v []byte) error {
+		seen++
+		if seen == 20 {
+			cancel()
+		}
+		return do(k, v)
+	})
+	t.assert(fmt.Sprintf("expected context.Canceled got %v", err), err == context.Canceled)
+	t.assert(fmt.Sprintf("iterated %v after the cancel", *count), *count == 20)
+	err = bpt.DoFindCtx(ctx, kvs[0].key, func(k, v []byte) error {
+		t.assert("iterated a cancelled context", false)
+		return nil
+	})
+	t.assert(fmt.Sprintf("expected context.Canceled got %v", err), err == context.Canceled)
+	t.assert_nil(bpt.DoRangeCtx(context.Background(), kvs[0].key, kvs[len(kvs)-1].key, func(k, v []byte) error { return nil }))
+}
@@ -43,8 +43,29 @@ store.
 // Add a key/value pair to the tree. There is a reason this isn't called
 // `Put`, this operation does not replace or modify any data in the
 // tree. It only adds this key. The B+ Tree supports duplicate keys and
-// even duplicate keys with the same value!
+// even duplicate keys with the same value! (Unless it was made with
+// UniqueKeys, then adding a key which is already there is an error.)
 func (self *BpTree) Add(key, value []byte) (err error) {
+	self.lock()
+	defer self.unlock()
+	return self._add(key, value)
+}
+
+func (self *BpTree) _add(key, value []byte) (err error) {
+	if self.meta.flags&consts.UNIQUE_KEYS != 0 {
+		var had bool
+		err = self.put(key, value, func(old []byte, has bool) (bool, error) {
+			had = has
+			return !has, nil
+		})
+		if err == nil && had {
+			return errors.Errorf("The key is already in the tree (it has unique keys), use Put to replace its value")
+		}
+		return err
+	}
+	if self.bf.ReadOnly() {
+		return errors.Errorf("Cannot add to a tree in a read only file")
+	}
 	if len(key) != int(self.meta.keySize) && self.meta.flags&consts.VARCHAR_KEYS == 0 {
 		return errors.Errorf("Key was not the correct size got, %v, expected, %v", len(key), self.meta.keySize)
 	}
@@ -52,7 +73,7 @@ func (self *BpTree) Add(key, value []byte) (err error) {
 	if err != nil {
 		return err
 	}
-	cntDelta, root, err := self.add(self.meta.root, key, value, true)
+	cntDelta, root, err := self.add(self.meta.root, key, value, nil)
 	if err != nil {
 		return err
 	}
@@ -61,8 +82,8 @@ func (self *BpTree) Add(key, value []byte) (err error) {
 	return self.writeMeta()
 }
 
-func (self *BpTree) add(root uint64, key, value []byte, allowDups bool) (cntDelta, newRoot uint64, err error) {
-	a, b, err := self.insert(root, key, value, allowDups)
+func (self *BpTree) add(root uint64, key, value []byte, put putFunc) (cntDelta, newRoot uint64, err error) {
+	a, b, err := self.insert(root, key, value, put)
 	if err != nil {
 		return 0, 0, err
 	} else if b == 0 {
@@ -72,16 +93,35 @@ func (self *BpTree) add(root uint64, key, value []byte, allowDups bool) (cntDelt
 	if err != nil {
 		return 0, 0, err
 	}
+	var aCount, bCount uint64
+	if self.meta.flags&consts.SUBTREE_COUNTS != 0 {
+		aCount, err = self.subtreeCount(a, b)
+		if err != nil {
+			return 0, 0, err
+		}
+		bCount, err = self.subtreeCount(b, 0)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
 	err = self.doInternal(newRoot, func(n *internal) error {
 		err := self.firstKey(a, func(akey []byte) error {
-			return n.putKP(self.varchar, akey, a)
+			return n.putKP(self.varchar, self.cmp, akey, a)
 		})
 		if err != nil {
 			return err
 		}
-		return self.firstKey(b, func(bkey []byte) error {
-			return n.putKP(self.varchar, bkey, b)
+		err = self.firstKey(b, func(bkey []byte) error {
+			return n.putKP(self.varchar, self.cmp, bkey, b)
 		})
+		if err != nil {
+			return err
+		}
+		if n.counted() {
+			n.setCount(a, aCount)
+			n.setCount(b, bCount)
+		}
+		return nil
 	})
 	if err != nil {
 		return 0, 0, err
@@ -89,13 +129,28 @@ func (self *BpTree) add(root uint64, key, value []byte, allowDups bool) (cntDelt
 	return 1, newRoot, nil
 }
 
+// Wrap put so inserted says whether the insert added a pair (rather
+// than replacing a value or not writing at all). Without a put (when
+// duplicates are allowed) every insert adds a pair.
+func countInserted(put putFunc, inserted *bool) putFunc {
+	*inserted = true
+	if put == nil {
+		return nil
+	}
+	return func(old []byte, has bool) (bool, error) {
+		write, err := put(old, has)
+		*inserted = write && !has
+		return write, err
+	}
+}
+
 /* right is only set on split left is always set.
  * - When split is false left is the pointer to block
  * - When split is true left is the pointer to the new left block
  */
-func (self *BpTree) insert(n uint64, key, value []byte, allowDups bool) (a, b uint64, err error) {
+func (self *BpTree) insert(n uint64, key, value []byte, put putFunc) (a, b uint64, err error) {
 	var flags consts.Flag
-	err = self.bf.Do(n, 1, func(bytes []byte) error {
+	err = self.doBlock(n, func(bytes []byte) error {
 		flags = consts.AsFlag(bytes)
 		return nil
 	})
@@ -103,9 +158,9 @@ func (self *BpTree) insert(n uint64, key, value []byte, allowDups bool) (a, b ui
 		return 0, 0, err
 	}
 	if flags&consts.INTERNAL != 0 {
-		return self.internalInsert(n, key, value, allowDups)
+		return self.internalInsert(n, key, value, put)
 	} else if flags&consts.LEAF != 0 {
-		return self.leafInsert(n, key, value, allowDups)
+		return self.leafInsert(n, key, value, put)
 	} else {
 		return 0, 0, errors.Errorf("Unknown block type")
 	}
@@ -117,13 +172,15 @@ func (self *BpTree) insert(n uint64, key, value []byte, allowDups bool) (a, b ui
  *    - if the block is full, split this block
  *    - else insert the new key/pointer into this block
  */
-func (self *BpTree) internalInsert(n uint64, key, value []byte, allowDups bool) (a, b uint64, err error) {
+func (self *BpTree) internalInsert(n uint64, key, value []byte, put putFunc) (a, b uint64, err error) {
 	// log.Println("internalInsert", n, key)
 	var i int
-	var ptr uint64
+	var ptr, count uint64
+	var inserted bool
+	put = countInserted(put, &inserted)
 	err = self.doInternal(n, func(n *internal) (err error) {
 		var has bool
-		i, has, err = find(self.varchar, n, key)
+		i, has, err = find(self.varchar, self.cmp, n, key)
 		if err != nil {
 			return err
 		}
@@ -133,21 +190,39 @@ func (self *BpTree) internalInsert(n uint64, key, value []byte, allowDups bool)
 			i--
 		}
 		ptr = *n.ptr(i)
+		if n.counted() {
+			count = *n.count(i)
+		}
 		return nil
 	})
 	if err != nil {
 		return 0, 0, err
 	}
-	p, q, err := self.insert(ptr, key, value, allowDups)
+	p, q, err := self.insert(ptr, key, value, put)
 	if err != nil {
 		return 0, 0, err
 	}
+	if inserted {
+		count++
+	}
+	// the counts of p and q (if the child split) share the old count
+	var pCount, qCount uint64 = count, 0
+	if q != 0 && self.meta.flags&consts.SUBTREE_COUNTS != 0 {
+		pCount, err = self.subtreeCount(p, q)
+		if err != nil {
+			return 0, 0, err
+		}
+		qCount = count - pCount
+	}
 	var must_split bool = false
 	var split_key []byte = nil
 	err = self.doInternal(n, func(m *internal) error {
 		*m.ptr(i) = p
+		if m.counted() {
+			*m.count(i) = pCount
+		}
 		err := self.firstKey(p, func(key []byte) error {
-			return m.updateK(self.varchar, i, key)
+			return m.updateK(self.varchar, self.cmp, i, key)
 		})
 		if err != nil {
 			return err
@@ -160,7 +235,14 @@ func (self *BpTree) internalInsert(n uint64, key, value []byte, allowDups bool)
 					copy(split_key, key)
 					return nil
 				}
-				return m.putKP(self.varchar, key, q)
+				err := m.putKP(self.varchar, self.cmp, key, q)
+				if err != nil {
+					return err
+				}
+				if m.counted() {
+					m.setCount(q, qCount)
+				}
+				return nil
 			})
 		}
 		return nil
@@ -179,6 +261,12 @@ func (self *BpTree) internalInsert(n uint64, key, value []byte, allowDups bool)
 		if err != nil {
 			return 0, 0, err
 		}
+		if self.meta.flags&consts.SUBTREE_COUNTS != 0 {
+			err = self.setCount(a, b, q, qCount)
+			if err != nil {
+				return 0, 0, err
+			}
+		}
 	} else {
 		a = n
 		b = 0
@@ -186,11 +274,11 @@ func (self *BpTree) internalInsert(n uint64, key, value []byte, allowDups bool)
 	return a, b, nil
 }
 
-func (self *BpTree) newVarcharKey(n uint64, key []byte, allowDups bool) (vkey []byte, err error) {
+func (self *BpTree) newVarcharKey(n uint64, key []byte) (vkey []byte, err error) {
 	var has bool
 	err = self.doLeaf(n, func(n *leaf) error {
 		var idx int
-		idx, has, err = find(self.varchar, n, key)
+		idx, has, err = find(self.varchar, self.cmp, n, key)
 		if err != nil {
 			return err
 		}
@@ -221,18 +309,20 @@ func (self *BpTree) newVarcharKey(n uint64, key []byte, allowDups bool) (vkey []
 	return slice.Uint64AsSlice(&k), nil
 }
 
-func (self *BpTree) leafInsert(n uint64, key, value []byte, allowDups bool) (a, b uint64, err error) {
+// If put is nil the key may be duplicated (as by Add) otherwise the tree
+// has unique keys and put decides whether the pair is written.
+func (self *BpTree) leafInsert(n uint64, key, value []byte, put putFunc) (a, b uint64, err error) {
 	var vkey []byte = nil
 	if self.meta.flags&consts.VARCHAR_KEYS != 0 {
-		vkey, err = self.newVarcharKey(n, key, allowDups)
+		vkey, err = self.newVarcharKey(n, key)
 		if err != nil {
 			return 0, 0, err
 		}
 	}
-	if allowDups {
+	if put == nil {
 		return self.leafDupAllowInsert(n, vkey, key, value)
 	} else {
-		return self.leafNoDupInsert(n, vkey, key, value)
+		return self.leafNoDupInsert(n, vkey, key, value, put)
 	}
 }
 
@@ -274,11 +364,11 @@ func (self *BpTree) leafDupAllowInsert(n uint64, vkey, key, value []byte) (a, b
 	}
 	err = self.doLeaf(n, func(n *leaf) error {
 		if n.keyCount() <= 1 {
-			return n.put(self.varchar, vkey, key, value)
+			return n.put(self.varchar, self.cmp, vkey, key, value)
 		}
-		full := !n.fitsAnother()
+		full := !n.fitsKey(key)
 		if pure {
-			cmp, err := n.cmpKeyAt(self.varchar, 0, key)
+			cmp, err := n.cmpKeyAt(self.varchar, self.cmp, 0, key)
 			if err != nil {
 				return err
 			}
@@ -290,7 +380,7 @@ func (self *BpTree) leafDupAllowInsert(n uint64, vkey, key, value []byte) (a, b
 					return nil
 				} else {
 					// log.Println("   pure, ! full,   sameKey")
-					return n.put(self.varchar, vkey, key, value)
+					return n.put(self.varchar, self.cmp, vkey, key, value)
 				}
 			} else {
 				// log.Println("   pure,       , ! sameKey")
@@ -304,7 +394,7 @@ func (self *BpTree) leafDupAllowInsert(n uint64, vkey, key, value []byte) (a, b
 				return nil
 			} else {
 				// log.Println(" ! pure,   full,          ")
-				return n.put(self.varchar, vkey, key, value)
+				return n.put(self.varchar, self.cmp, vkey, key, value)
 			}
 		}
 	})
@@ -321,30 +411,48 @@ func (self *BpTree) leafDupAllowInsert(n uint64, vkey, key, value []byte) (a, b
 	return n, 0, nil
 }
 
-func (self *BpTree) leafNoDupInsert(n uint64, vkey, key, value []byte) (a, b uint64, err error) {
+func (self *BpTree) leafNoDupInsert(n uint64, vkey, key, value []byte, put putFunc) (a, b uint64, err error) {
 	// log.Println("leafNoDupInsert", n, key)
 	var mustSplit bool = false
+	var has, write bool
 	// no need to check for purity as this tree will have unique keys
-	err = self.doLeaf(n, func(n *leaf) error {
-		if n.keyCount() <= 0 {
-			return n.put(self.varchar, vkey, key, value)
+	err = self.doLeaf(n, func(n *leaf) (err error) {
+		var idx int
+		if n.keyCount() > 0 {
+			idx, has, err = find(self.varchar, self.cmp, n, key)
+			if err != nil {
+				return err
+			}
 		}
-		full := !n.fitsAnother()
-		idx, has, err := find(self.varchar, n, key)
-		if err != nil {
+		if has {
+			err = n.doValueAt(self.varchar, idx, func(old []byte) (err error) {
+				write, err = put(old, true)
+				return err
+			})
+		} else {
+			write, err = put(nil, false)
+		}
+		if err != nil || !write {
 			return err
 		} else if has {
 			return n.updateValueAt(self.varchar, idx, value)
-		} else if full {
+		} else if !n.fitsKey(key) {
 			mustSplit = true
 			return nil
 		} else {
-			return n.put(self.varchar, vkey, key, value)
+			return n.put(self.varchar, self.cmp, vkey, key, value)
 		}
 	})
 	if err != nil {
 		return 0, 0, err
 	}
+	if vkey != nil && (has || !write) {
+		// the key was not stored so drop the reference newVarcharKey made
+		err = self.varchar.Deref(*slice.AsUint64(&vkey))
+		if err != nil {
+			return 0, 0, err
+		}
+	}
 	if mustSplit {
 		return self.leafSplit(n, vkey, key, value)
 	}
@@ -402,7 +510,7 @@ func (self *BpTree) pureLeafInsert(n uint64, vkey, key, value []byte) (a, b uint
 		err := self.doLeaf(a, func(n *leaf) error {
 			if n.fitsAnother() {
 				inserted = true
-				return n.put(self.varchar, vkey, key, value)
+				return n.put(self.varchar, self.cmp, vkey, key, value)
 			}
 			return nil
 		})
@@ -421,7 +529,7 @@ func (self *BpTree) pureLeafInsert(n uint64, vkey, key, value []byte) (a, b uint
 			return 0, 0, err
 		}
 		err = self.doLeaf(b, func(m *leaf) error {
-			return m.put(self.varchar, vkey, key, value)
+			return m.put(self.varchar, self.cmp, vkey, key, value)
 		})
 		if err != nil {
 			return 0, 0, err
@@ -443,7 +551,7 @@ func (self *BpTree) pureLeafInsert(n uint64, vkey, key, value []byte) (a, b uint
  * - insert the new key/pointer combo into the correct block
  *
  * Note. in the varchar case, the key is not the key but a pointer to a
- * key. This complicates the bytes.Compare line significantly.
+ * key. This complicates the comparison significantly.
  */
 func (self *BpTree) internalSplit(n uint64, key []byte, ptr uint64) (a, b uint64, err error) {
 	// log.Println("internalSplit", n, key)
@@ -454,23 +562,23 @@ func (self *BpTree) internalSplit(n uint64, key []byte, ptr uint64) (a, b uint64
 	}
 	err = self.doInternal(a, func(n *internal) error {
 		return self.doInternal(b, func(m *internal) (err error) {
-			err = n.balance(self.varchar, m)
+			err = n.balance(self.varchar, self.cmp, m)
 			if err != nil {
 				return err
 			}
 			if self.meta.flags&consts.VARCHAR_KEYS == 0 {
-				if bytes.Compare(key, m.key(0)) < 0 {
-					return n.putKP(self.varchar, key, ptr)
+				if self.cmp(key, m.key(0)) < 0 {
+					return n.putKP(self.varchar, self.cmp, key, ptr)
 				} else {
-					return m.putKP(self.varchar, key, ptr)
+					return m.putKP(self.varchar, self.cmp, key, ptr)
 				}
 			} else {
 				return self.varchar.Do(*slice.AsUint64(&key), func(k []byte) error {
 					return m.doKeyAt(self.varchar, 0, func(m_key_0 []byte) error {
-						if bytes.Compare(k, m_key_0) < 0 {
-							return n.putKP(self.varchar, key, ptr)
+						if self.cmp(k, m_key_0) < 0 {
+							return n.putKP(self.varchar, self.cmp, key, ptr)
 						} else {
-							return m.putKP(self.varchar, key, ptr)
+							return m.putKP(self.varchar, self.cmp, key, ptr)
 						}
 					})
 				})
@@ -492,9 +600,13 @@ func (self *BpTree) internalSplit(n uint64, key []byte, ptr uint64) (a, b uint64
 func (self *BpTree) leafSplit(n uint64, vkey, key, value []byte) (a, b uint64, err error) {
 	// log.Println("leafSplit", n, key)
 	var isPure bool = false
+	var shares bool = true
 	a = n
 	err = self.doLeaf(a, func(n *leaf) (err error) {
 		isPure = n.pure(self.varchar)
+		if n.compressed() {
+			shares = n.sharesPrefix(key)
+		}
 		return nil
 	})
 	if err != nil {
@@ -502,6 +614,8 @@ func (self *BpTree) leafSplit(n uint64, vkey, key, value []byte) (a, b uint64, e
 	}
 	if isPure {
 		return self.pureLeafSplit(n, vkey, key, value)
+	} else if !shares {
+		return self.prefixLeafSplit(n, key, value)
 	}
 	b, err = self.newLeaf()
 	if err != nil {
@@ -513,22 +627,22 @@ func (self *BpTree) leafSplit(n uint64, vkey, key, value []byte) (a, b uint64, e
 			return err
 		}
 		return self.doLeaf(b, func(m *leaf) (err error) {
-			err = n.balance(self.varchar, m)
+			err = n.balance(self.varchar, self.cmp, m)
 			if err != nil {
 				return err
 			}
 			return m.doKeyAt(self.varchar, 0, func(mk []byte) error {
 				if self.meta.flags&consts.VARCHAR_KEYS != 0 {
-					if bytes.Compare(key, mk) < 0 {
-						return n.putKV(self.varchar, vkey, value)
+					if self.cmp(key, mk) < 0 {
+						return n.putKV(self.varchar, self.cmp, vkey, value)
 					} else {
-						return m.putKV(self.varchar, vkey, value)
+						return m.putKV(self.varchar, self.cmp, vkey, value)
 					}
 				} else {
-					if bytes.Compare(key, mk) < 0 {
-						return n.putKV(self.varchar, key, value)
+					if self.cmp(key, mk) < 0 {
+						return n.putKV(self.varchar, self.cmp, key, value)
 					} else {
-						return m.putKV(self.varchar, key, value)
+						return m.putKV(self.varchar, self.cmp, key, value)
 					}
 				}
 			})
@@ -540,6 +654,42 @@ func (self *BpTree) leafSplit(n uint64, vkey, key, value []byte) (a, b uint64, e
 	return a, b, nil
 }
 
+/* a prefix leaf split is for a key which does not start with the prefix
+ * of a full compressed leaf. Every key in the leaf starts with the prefix
+ * so the key is either before all of them or after all of them. It is
+ * put in a new leaf on that side of the leaf (as the leaf may not hold
+ * its keys with a shorter prefix).
+ */
+func (self *BpTree) prefixLeafSplit(n uint64, key, value []byte) (a, b uint64, err error) {
+	// log.Println("prefixLeafSplit", n, key)
+	new_off, err := self.newLeaf()
+	if err != nil {
+		return 0, 0, err
+	}
+	err = self.doLeaf(new_off, func(m *leaf) error {
+		return m.putKV(self.varchar, self.cmp, key, value)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	err = self.doLeaf(n, func(node *leaf) error {
+		c, err := node.cmpKeyAt(self.varchar, self.cmp, 0, key)
+		if err != nil {
+			return err
+		}
+		if c < 0 {
+			a, b = new_off, n
+			return self.insertListNode(new_off, node.meta.prev, n)
+		}
+		a, b = n, new_off
+		return self.insertListNode(new_off, n, node.meta.next)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return a, b, nil
+}
+
 /* a pure leaf split has two cases:
  *  1) the inserted key is less than the current pure block.
  *     - a new block should be created before the current block
@@ -561,7 +711,7 @@ func (self *BpTree) pureLeafSplit(n uint64, vkey, key, value []byte) (a, b uint6
 	}
 	err = self.doLeaf(n, func(node *leaf) (err error) {
 		return node.doKeyAt(self.varchar, 0, func(node_key_0 []byte) error {
-			if bytes.Compare(key, node_key_0) < 0 {
+			if self.cmp(key, node_key_0) < 0 {
 				a = new_off
 				b = n
 				err = self.insertListNode(a, node.meta.prev, b)
@@ -570,9 +720,9 @@ func (self *BpTree) pureLeafSplit(n uint64, vkey, key, value []byte) (a, b uint6
 				}
 				return self.doLeaf(a, func(anode *leaf) (err error) {
 					if self.meta.flags&consts.VARCHAR_KEYS != 0 {
-						return anode.putKV(self.varchar, vkey, value)
+						return anode.putKV(self.varchar, self.cmp, vkey, value)
 					} else {
-						return anode.putKV(self.varchar, key, value)
+						return anode.putKV(self.varchar, self.cmp, key, value)
 					}
 				})
 			} else {
@@ -614,21 +764,21 @@ func (self *BpTree) pureLeafSplit(n uint64, vkey, key, value []byte) (a, b uint6
 						if m.fitsAnother() && bytes.Equal(key, m_key_0) {
 							unneeded = true
 							if self.meta.flags&consts.VARCHAR_KEYS != 0 {
-								return m.putKV(self.varchar, vkey, value)
+								return m.putKV(self.varchar, self.cmp, vkey, value)
 							} else {
-								return m.putKV(self.varchar, key, value)
+								return m.putKV(self.varchar, self.cmp, key, value)
 							}
 						} else {
 							return self.doLeaf(new_off, func(o *leaf) (err error) {
 								if self.meta.flags&consts.VARCHAR_KEYS != 0 {
-									err = o.putKV(self.varchar, vkey, value)
+									err = o.putKV(self.varchar, self.cmp, vkey, value)
 								} else {
-									err = o.putKV(self.varchar, key, value)
+									err = o.putKV(self.varchar, self.cmp, key, value)
 								}
 								if err != nil {
 									return err
 								}
-								if bytes.Compare(key, m_key_0) >= 0 {
+								if self.cmp(key, m_key_0) >= 0 {
 									err = self.insertListNode(new_off, e, m.meta.next)
 								} else {
 									err = self.insertListNode(new_off, m.meta.prev, e)
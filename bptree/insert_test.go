@@ -102,7 +102,7 @@ func TestLeafInsert(x *testing.T) {
 			t.assert_nil(err)
 			t.assert(fmt.Sprintf("wrong key %v != %v", kv.key, k), bytes.Equal(kv.key, k))
 			t.assert_nil(bpt.doLeaf(a, func(n *leaf) error {
-				t.assert_value(kv.value)(n.firstValue(bpt.varchar, kv.key))
+				t.assert_value(kv.value)(n.firstValue(bpt.varchar, bpt.cmp, kv.key))
 				return nil
 			}))
 		}
@@ -170,7 +170,7 @@ func TestLeafSplit(x *testing.T) {
 			}
 			t.assert(fmt.Sprintf("wrong key %v != %v", kv.key, k), bytes.Equal(kv.key, k))
 			t.assert_nil(bpt.doLeaf(a, func(n *leaf) error {
-				t.assert_value(kv.value)(n.firstValue(bpt.varchar, kv.key))
+				t.assert_value(kv.value)(n.firstValue(bpt.varchar, bpt.cmp, kv.key))
 				return nil
 			}))
 		}
@@ -205,7 +205,7 @@ func TestInsert3Level(x *testing.T) {
 		t.assert_nil(err)
 		t.assert(fmt.Sprintf("wrong key %v == %v", kv.key, k), bytes.Equal(kv.key, k))
 		t.assert_nil(bpt.doLeaf(a, func(n *leaf) error {
-			t.assert_value(kv.value)(n.firstValue(bpt.varchar, kv.key))
+			t.assert_value(kv.value)(n.firstValue(bpt.varchar, bpt.cmp, kv.key))
 			return nil
 		}))
 	}
@@ -238,7 +238,7 @@ func TestEndOfPureRun(x *testing.T) {
 				cur = next
 			}
 			t.assert_nil(bpt.doLeaf(cur, func(cur *leaf) error {
-				return cur.putKV(bpt.varchar, kv.key, kv.value)
+				return cur.putKV(bpt.varchar, bpt.cmp, kv.key, kv.value)
 			}))
 		}
 		end, err := bpt.endOfPureRun(start)
@@ -281,7 +281,7 @@ func TestEndOfPureRunVarchar(x *testing.T) {
 				cur = next
 			}
 			t.assert_nil(bpt.doLeaf(cur, func(cur *leaf) error {
-				return cur.putKV(bpt.varchar, kv.key, kv.value)
+				return cur.putKV(bpt.varchar, bpt.cmp, kv.key, kv.value)
 			}))
 		}
 		end, err := bpt.endOfPureRun(start)
@@ -302,7 +302,7 @@ func TestInternalSplit(x *testing.T) {
 			kp := t.make_kp()
 			kps = append(kps, kp)
 			t.assert_nil(bpt.doInternal(a, func(a *internal) error {
-				return a.putKP(bpt.varchar, kp.key, kp.ptr)
+				return a.putKP(bpt.varchar, bpt.cmp, kp.key, kp.ptr)
 			}))
 		}
 		sort.Sort(kps)
@@ -316,7 +316,7 @@ func TestInternalSplit(x *testing.T) {
 		t.assert_nil(bpt.doInternal(p, func(p *internal) error {
 			for ; i < len(kps); i++ {
 				kp := kps[i]
-				j, has, err := find(bpt.varchar, p, kp.key)
+				j, has, err := find(bpt.varchar, bpt.cmp, p, kp.key)
 				t.assert_nil(err)
 				if !has {
 					break
@@ -324,7 +324,7 @@ func TestInternalSplit(x *testing.T) {
 				t.assert("keys should equal", t.key(p.key(j)) == t.key(kp.key))
 				t.assert("ptrs should equal", *p.ptr(j) == kp.ptr)
 			}
-			j, has, err := find(bpt.varchar, p, split_kp.key)
+			j, has, err := find(bpt.varchar, bpt.cmp, p, split_kp.key)
 			t.assert_nil(err)
 			if !has {
 				return nil
@@ -337,7 +337,7 @@ func TestInternalSplit(x *testing.T) {
 		t.assert_nil(bpt.doInternal(q, func(q *internal) error {
 			for ; i < len(kps); i++ {
 				kp := kps[i]
-				j, has, err := find(bpt.varchar, q, kp.key)
+				j, has, err := find(bpt.varchar, bpt.cmp, q, kp.key)
 				t.assert_nil(err)
 				if !has {
 					break
@@ -345,7 +345,7 @@ func TestInternalSplit(x *testing.T) {
 				t.assert("keys should equal", t.key(q.key(j)) == t.key(kp.key))
 				t.assert("ptrs should equal", *q.ptr(j) == kp.ptr)
 			}
-			j, has, err := find(bpt.varchar, q, split_kp.key)
+			j, has, err := find(bpt.varchar, bpt.cmp, q, split_kp.key)
 			t.assert_nil(err)
 			if !has {
 				return nil
@@ -391,22 +391,22 @@ func TestInternalInsertSplit(x *testing.T) {
 			v0, err := bpt.checkValue(kvs[0].value)
 			t.assert_nil(err)
 			t.assert_nil(bpt.doLeaf(a, func(a *leaf) error {
-				return a.putKV(bpt.varchar, kvs[0].key, v0)
+				return a.putKV(bpt.varchar, bpt.cmp, kvs[0].key, v0)
 			}))
 			vL, err := bpt.checkValue(kvs[LEAF_CAP].value)
 			t.assert_nil(err)
 			t.assert_nil(bpt.doLeaf(b, func(b *leaf) error {
-				return b.putKV(bpt.varchar, kvs[LEAF_CAP].key, vL)
+				return b.putKV(bpt.varchar, bpt.cmp, kvs[LEAF_CAP].key, vL)
 			}))
-			t.assert_nil(I.putKP(bpt.varchar, kvs[0].key, a))
-			t.assert_nil(I.putKP(bpt.varchar, kvs[LEAF_CAP].key, b))
+			t.assert_nil(I.putKP(bpt.varchar, bpt.cmp, kvs[0].key, a))
+			t.assert_nil(I.putKP(bpt.varchar, bpt.cmp, kvs[LEAF_CAP].key, b))
 			return nil
 		}))
 		for i := 1; i < LEAF_CAP; i++ {
 			kv := kvs[i]
 			v, err := bpt.checkValue(kv.value)
 			t.assert_nil(err)
-			p, q, err := bpt.leafInsert(a, kv.key, v, true)
+			p, q, err := bpt.leafInsert(a, kv.key, v, nil)
 			t.assert_nil(err)
 			t.assert(fmt.Sprintf("p should be a, at idx %v, cap %v", i, LEAF_CAP), p == a)
 			t.assert(fmt.Sprintf("q should be 0 a, at idx %v, cap %v", i, LEAF_CAP), q == 0)
@@ -415,7 +415,7 @@ func TestInternalInsertSplit(x *testing.T) {
 			kv := kvs[i]
 			v, err := bpt.checkValue(kv.value)
 			t.assert_nil(err)
-			p, q, err := bpt.leafInsert(b, kv.key, v, true)
+			p, q, err := bpt.leafInsert(b, kv.key, v, nil)
 			t.assert_nil(err)
 			t.assert(fmt.Sprintf("p should be b, at idx %v, cap %v", i, LEAF_CAP), p == b)
 			t.assert(fmt.Sprintf("q should be 0 a, at idx %v, cap %v", i, LEAF_CAP), q == 0)
@@ -426,7 +426,7 @@ func TestInternalInsertSplit(x *testing.T) {
 		}
 		sv, err := bpt.checkValue(split_kv.value)
 		t.assert_nil(err)
-		p, q, err := bpt.internalInsert(I, split_kv.key, sv, true)
+		p, q, err := bpt.internalInsert(I, split_kv.key, sv, nil)
 		t.assert_nil(err)
 		t.assert("p should be I", p == I)
 		t.assert("q should not be 0", q != 0)
@@ -434,10 +434,10 @@ func TestInternalInsertSplit(x *testing.T) {
 		t.assert_nil(err)
 		t.assert_nil(bpt.doInternal(root, func(n *internal) error {
 			t.assert_nil(bpt.firstKey(p, func(pkey []byte) error {
-				return n.putKP(bpt.varchar, pkey, p)
+				return n.putKP(bpt.varchar, bpt.cmp, pkey, p)
 			}))
 			return bpt.firstKey(q, func(qkey []byte) error {
-				return n.putKP(bpt.varchar, qkey, q)
+				return n.putKP(bpt.varchar, bpt.cmp, qkey, q)
 			})
 		}))
 		bpt.meta.root = root
@@ -451,7 +451,7 @@ func TestInternalInsertSplit(x *testing.T) {
 			k2 := t.key(k)
 			t.assert(fmt.Sprintf("wrong key %v == %v", k1, k2), k1 == k2)
 			t.assert_nil(bpt.doLeaf(a, func(n *leaf) error {
-				t.assert_value(kv.value)(n.firstValue(bpt.varchar, kv.key))
+				t.assert_value(kv.value)(n.firstValue(bpt.varchar, bpt.cmp, kv.key))
 				return nil
 			}))
 		}
@@ -1,7 +1,6 @@
 package bptree
 
 import (
-	"bytes"
 	"fmt"
 	"log"
 	"reflect"
@@ -24,6 +23,9 @@ type baseMeta struct {
 
 const ptrSize = 8
 
+// the size of a subtree count (see SubtreeCounts)
+const countSize = 8
+
 const baseMetaSize = 8
 
 var baseMetaSizeActual int
@@ -138,16 +140,59 @@ func (n *internal) ptrs_uint64s() []uint64 {
 	return *sl.AsUint64s()
 }
 
+// Does the node keep the number of pairs under each child?
+func (n *internal) counted() bool {
+	return n.meta.flags&consts.SUBTREE_COUNTS != 0
+}
+
+// The number of pairs under child i. The counts follow the ptrs and are
+// only there if the node is counted.
+func (n *internal) count(i int) *uint64 {
+	keySize := int(n.meta.keySize)
+	keyCap := int(n.meta.keyCap)
+	s := keyCap*keySize + keyCap*ptrSize + i*countSize
+	bytes := n.bytes[s : s+countSize]
+	return slice.AsUint64(&bytes)
+}
+
+func (n *internal) counts() []byte {
+	keySize := int(n.meta.keySize)
+	keyCap := int(n.meta.keyCap)
+	s := keyCap*keySize + keyCap*ptrSize
+	e := s + keyCap*countSize
+	return n.bytes[s:e]
+}
+
+// Set the count of the child at p. Returns false if p is not a child of
+// the node.
+func (n *internal) setCount(p, count uint64) bool {
+	for i := 0; i < int(n.meta.keyCount); i++ {
+		if *n.ptr(i) == p {
+			*n.count(i) = count
+			return true
+		}
+	}
+	return false
+}
+
+// The number of pairs under the node.
+func (n *internal) total() (total uint64) {
+	for i := 0; i < int(n.meta.keyCount); i++ {
+		total += *n.count(i)
+	}
+	return total
+}
+
 func (n *internal) keyCount() int {
 	return int(n.meta.keyCount)
 }
 
-func (n *internal) cmpKeyAt(vc *Varchar, i int, key []byte) (cmp int, err error) {
+func (n *internal) cmpKeyAt(vc *Varchar, cmp Comparator, i int, key []byte) (c int, err error) {
 	err = n.doKeyAt(vc, i, func(key_i []byte) error {
-		cmp = bytes.Compare(key, key_i)
+		c = cmp(key, key_i)
 		return nil
 	})
-	return cmp, err
+	return c, err
 }
 
 func (n *internal) doKeyAt(vc *Varchar, i int, do func([]byte) error) error {
@@ -179,8 +224,8 @@ func (n *internal) full() bool {
 	return n.meta.keyCount+1 >= n.meta.keyCap
 }
 
-func (n *internal) findPtr(v *Varchar, key []byte) (uint64, error) {
-	i, has, err := find(v, n, key)
+func (n *internal) findPtr(v *Varchar, cmp Comparator, key []byte) (uint64, error) {
+	i, has, err := find(v, cmp, n, key)
 	if err != nil {
 		return 0, err
 	}
@@ -190,22 +235,22 @@ func (n *internal) findPtr(v *Varchar, key []byte) (uint64, error) {
 	return *n.ptr(i), nil
 }
 
-func (n *internal) _has(v *Varchar, key []byte) bool {
-	_, has, err := find(v, n, key)
+func (n *internal) _has(v *Varchar, cmp Comparator, key []byte) bool {
+	_, has, err := find(v, cmp, n, key)
 	if err != nil {
 		log.Fatal(err)
 	}
 	return has
 }
 
-func (n *internal) updateK(v *Varchar, i int, key []byte) error {
+func (n *internal) updateK(v *Varchar, cmp Comparator, i int, key []byte) error {
 	if i < 0 || i >= int(n.meta.keyCount) {
 		return errors.Errorf("key is out of range")
 	}
 	if len(key) != int(n.meta.keySize) {
 		return errors.Errorf("key was the wrong size")
 	}
-	idx, has, err := find(v, n, key)
+	idx, has, err := find(v, cmp, n, key)
 	if err != nil {
 		return err
 	}
@@ -240,7 +285,7 @@ func (n *internal) updateK(v *Varchar, i int, key []byte) error {
 		copy(n.key(i), key)
 	}
 	/*
-		err = checkOrder(v, n)
+		err = checkOrder(v, cmp, n)
 		if err != nil {
 			log.Println("replaced key", oldk)
 			log.Println(n.Debug(v))
@@ -264,7 +309,7 @@ func (n *internal) bigUpdateK(v *Varchar, i int, key []byte) (err error) {
 	return nil
 }
 
-func (n *internal) putKP(v *Varchar, key []byte, p uint64) (err error) {
+func (n *internal) putKP(v *Varchar, cmp Comparator, key []byte, p uint64) (err error) {
 	if len(key) != int(n.meta.keySize) {
 		return errors.Errorf("key was the wrong size")
 	}
@@ -277,7 +322,7 @@ func (n *internal) putKP(v *Varchar, key []byte, p uint64) (err error) {
 			return err
 		}
 	}
-	err = n.putKey(v, key, func(i int) error {
+	err = n.putKey(v, cmp, key, func(i int) error {
 		ptrs := n.ptrs()
 		chunkSize := (int(n.meta.keyCount) - i) * ptrSize
 		s := i * ptrSize
@@ -285,6 +330,11 @@ func (n *internal) putKP(v *Varchar, key []byte, p uint64) (err error) {
 		to := ptrs[s+ptrSize : s+chunkSize+ptrSize]
 		copy(to, from)
 		*n.ptr(i) = p
+		if n.counted() {
+			counts := n.counts()
+			copy(counts[s+countSize:s+chunkSize+countSize], counts[s:s+chunkSize])
+			*n.count(i) = 0
+		}
 		return nil
 	})
 	if err != nil {
@@ -292,7 +342,7 @@ func (n *internal) putKP(v *Varchar, key []byte, p uint64) (err error) {
 	}
 	n.meta.keyCount++
 	/*
-		err = checkOrder(v, n)
+		err = checkOrder(v, cmp, n)
 		if err != nil {
 			log.Println(n.Debug(v))
 			return err
@@ -301,8 +351,8 @@ func (n *internal) putKP(v *Varchar, key []byte, p uint64) (err error) {
 	return nil
 }
 
-func (n *internal) delKP(v *Varchar, key []byte) error {
-	i, has, err := find(v, n, key)
+func (n *internal) delKP(v *Varchar, cmp Comparator, key []byte) error {
+	i, has, err := find(v, cmp, n, key)
 	if err != nil {
 		return err
 	}
@@ -313,10 +363,10 @@ func (n *internal) delKP(v *Varchar, key []byte) error {
 	} else if i >= int(n.meta.keyCount) {
 		return errors.Errorf("find returned a int > than len(keys)")
 	}
-	return n.delItemAt(v, i)
+	return n.delItemAt(v, cmp, i)
 }
 
-func (n *internal) delItemAt(v *Varchar, i int) error {
+func (n *internal) delItemAt(v *Varchar, cmp Comparator, i int) error {
 	// remove the key
 	err := n.delKeyAt(v, i)
 	if err != nil {
@@ -330,10 +380,15 @@ func (n *internal) delItemAt(v *Varchar, i int) error {
 	to := ptrs[s : s+chunkSize]
 	copy(to, from)
 	*n.ptr(int(n.meta.keyCount - 1)) = 0
+	if n.counted() {
+		counts := n.counts()
+		copy(counts[s:s+chunkSize], counts[s+countSize:s+countSize+chunkSize])
+		*n.count(int(n.meta.keyCount - 1)) = 0
+	}
 	// do the book keeping
 	n.meta.keyCount--
 	/*
-		err = checkOrder(v, n)
+		err = checkOrder(v, cmp, n)
 		if err != nil {
 			log.Println("del at", i)
 			log.Println(n.Debug(v))
@@ -343,7 +398,7 @@ func (n *internal) delItemAt(v *Varchar, i int) error {
 	return nil
 }
 
-func (n *internal) putKey(v *Varchar, key []byte, put func(i int) error) (err error) {
+func (n *internal) putKey(v *Varchar, cmp Comparator, key []byte, put func(i int) error) (err error) {
 	if n.keyCount()+1 >= int(n.meta.keyCap) {
 		return errors.Errorf("Block is full.")
 	}
@@ -351,10 +406,10 @@ func (n *internal) putKey(v *Varchar, key []byte, put func(i int) error) (err er
 	var i int
 	var has bool
 	if n.meta.flags&consts.VARCHAR_KEYS == 0 {
-		i, has, err = find(v, n, key)
+		i, has, err = find(v, cmp, n, key)
 	} else {
 		err = v.Do(*slice.AsUint64(&key), func(key []byte) (err error) {
-			i, has, err = find(v, n, key)
+			i, has, err = find(v, cmp, n, key)
 			return err
 		})
 	}
@@ -432,7 +487,16 @@ func asInternal(backing []byte) *internal {
 func newInternal(flags consts.Flag, backing []byte, keySize uint16) (*internal, error) {
 	n := asInternal(backing)
 
-	keyCap := uint16(keysPerInternal(len(backing), int(keySize)))
+	available := len(backing)
+	if flags&consts.CHECKSUMS != 0 {
+		available -= checksumSize
+	}
+	kvSize := int(keySize)
+	if flags&consts.SUBTREE_COUNTS != 0 {
+		// the counts take the same room as another key
+		kvSize += countSize
+	}
+	keyCap := uint16(keysPerInternal(available, kvSize))
 	n.meta.Init(consts.INTERNAL|flags, keySize, keyCap)
 
 	return n, nil
@@ -41,46 +41,46 @@ func TestPutDelKPRand(x *testing.T) {
 		for i := 0; i < cap(kps); i++ {
 			kp := t.make_kp()
 			kps = append(kps, kp)
-			t.assert_nil(n.putKP(bpt.varchar, kp.key, kp.ptr))
-			t.assert("could not find key in internal", n._has(bpt.varchar, kp.key))
-			t.assert_ptr(kp.ptr)(n.findPtr(bpt.varchar, kp.key))
+			t.assert_nil(n.putKP(bpt.varchar, bpt.cmp, kp.key, kp.ptr))
+			t.assert("could not find key in internal", n._has(bpt.varchar, bpt.cmp, kp.key))
+			t.assert_ptr(kp.ptr)(n.findPtr(bpt.varchar, bpt.cmp, kp.key))
 		}
 		for _, kp := range kps {
-			t.assert("could not find key in internal", n._has(bpt.varchar, kp.key))
-			t.assert_ptr(kp.ptr)(n.findPtr(bpt.varchar, kp.key))
+			t.assert("could not find key in internal", n._has(bpt.varchar, bpt.cmp, kp.key))
+			t.assert_ptr(kp.ptr)(n.findPtr(bpt.varchar, bpt.cmp, kp.key))
 		}
 		for i, kp := range kps {
-			t.assert_nil(n.delKP(bpt.varchar, kp.key))
+			t.assert_nil(n.delKP(bpt.varchar, bpt.cmp, kp.key))
 			for _, kp2 := range kps[:i+1] {
-				t.assert("found key in internal", !n._has(bpt.varchar, kp2.key))
+				t.assert("found key in internal", !n._has(bpt.varchar, bpt.cmp, kp2.key))
 			}
 		}
 		for _, kp := range kps {
-			t.assert_nil(n.putKP(bpt.varchar, kp.key, kp.ptr))
-			t.assert("could not find key in internal", n._has(bpt.varchar, kp.key))
-			t.assert_ptr(kp.ptr)(n.findPtr(bpt.varchar, kp.key))
+			t.assert_nil(n.putKP(bpt.varchar, bpt.cmp, kp.key, kp.ptr))
+			t.assert("could not find key in internal", n._has(bpt.varchar, bpt.cmp, kp.key))
+			t.assert_ptr(kp.ptr)(n.findPtr(bpt.varchar, bpt.cmp, kp.key))
 		}
 		for i, kp := range kps {
-			t.assert_nil(n.delKP(bpt.varchar, kp.key))
-			t.assert("found key in internal", !n._has(bpt.varchar, kp.key))
+			t.assert_nil(n.delKP(bpt.varchar, bpt.cmp, kp.key))
+			t.assert("found key in internal", !n._has(bpt.varchar, bpt.cmp, kp.key))
 			for j, kp2 := range kps {
 				if j != i {
-					t.assert("could not find key in internal", n._has(bpt.varchar, kp2.key))
+					t.assert("could not find key in internal", n._has(bpt.varchar, bpt.cmp, kp2.key))
 				}
 			}
-			t.assert_nil(n.putKP(bpt.varchar, kp.key, kp.ptr))
-			t.assert("could not find key in internal", n._has(bpt.varchar, kp.key))
-			t.assert_ptr(kp.ptr)(n.findPtr(bpt.varchar, kp.key))
+			t.assert_nil(n.putKP(bpt.varchar, bpt.cmp, kp.key, kp.ptr))
+			t.assert("could not find key in internal", n._has(bpt.varchar, bpt.cmp, kp.key))
+			t.assert_ptr(kp.ptr)(n.findPtr(bpt.varchar, bpt.cmp, kp.key))
 		}
 		for _, kp := range kps {
-			t.assert("could not find key in internal", n._has(bpt.varchar, kp.key))
-			t.assert_ptr(kp.ptr)(n.findPtr(bpt.varchar, kp.key))
+			t.assert("could not find key in internal", n._has(bpt.varchar, bpt.cmp, kp.key))
+			t.assert_ptr(kp.ptr)(n.findPtr(bpt.varchar, bpt.cmp, kp.key))
 		}
 		for _, kp := range kps {
-			t.assert_nil(n.delKP(bpt.varchar, kp.key))
+			t.assert_nil(n.delKP(bpt.varchar, bpt.cmp, kp.key))
 		}
 		for _, kp := range kps {
-			t.assert("found key in internal", !n._has(bpt.varchar, kp.key))
+			t.assert("found key in internal", !n._has(bpt.varchar, bpt.cmp, kp.key))
 		}
 	}
 }
@@ -110,13 +110,13 @@ func TestPutKPRand(x *testing.T) {
 		for i := 0; i < cap(kps); i++ {
 			kp := make_kp()
 			kps = append(kps, kp)
-			t.assert_nil(n.putKP(bpt.varchar, kp.key, kp.ptr))
-			t.assert("could not find key in internal", n._has(bpt.varchar, kp.key))
-			t.assert_ptr(kp.ptr)(n.findPtr(bpt.varchar, kp.key))
+			t.assert_nil(n.putKP(bpt.varchar, bpt.cmp, kp.key, kp.ptr))
+			t.assert("could not find key in internal", n._has(bpt.varchar, bpt.cmp, kp.key))
+			t.assert_ptr(kp.ptr)(n.findPtr(bpt.varchar, bpt.cmp, kp.key))
 		}
 		for _, kp := range kps {
-			t.assert("could not find key in internal", n._has(bpt.varchar, kp.key))
-			t.assert_ptr(kp.ptr)(n.findPtr(bpt.varchar, kp.key))
+			t.assert("could not find key in internal", n._has(bpt.varchar, bpt.cmp, kp.key))
+			t.assert_ptr(kp.ptr)(n.findPtr(bpt.varchar, bpt.cmp, kp.key))
 		}
 	}
 }
@@ -131,36 +131,36 @@ func TestPutKP(x *testing.T) {
 	k3 := uint64(12)
 	k4 := uint64(8)
 	k5 := uint64(5)
-	t.assert_nil(n.putKP(bpt.varchar, t.bkey(&k1), k1))
-	t.assert("could not find key in internal", n._has(bpt.varchar, t.bkey(&k1)))
-	t.assert_ptr(k1)(n.findPtr(bpt.varchar, t.bkey(&k1)))
+	t.assert_nil(n.putKP(bpt.varchar, bpt.cmp, t.bkey(&k1), k1))
+	t.assert("could not find key in internal", n._has(bpt.varchar, bpt.cmp, t.bkey(&k1)))
+	t.assert_ptr(k1)(n.findPtr(bpt.varchar, bpt.cmp, t.bkey(&k1)))
 
-	t.assert_nil(n.putKP(bpt.varchar, t.bkey(&k2), k2))
-	t.assert("could not find key in internal", n._has(bpt.varchar, t.bkey(&k2)))
-	t.assert_ptr(k2)(n.findPtr(bpt.varchar, t.bkey(&k2)))
+	t.assert_nil(n.putKP(bpt.varchar, bpt.cmp, t.bkey(&k2), k2))
+	t.assert("could not find key in internal", n._has(bpt.varchar, bpt.cmp, t.bkey(&k2)))
+	t.assert_ptr(k2)(n.findPtr(bpt.varchar, bpt.cmp, t.bkey(&k2)))
 
-	t.assert_nil(n.putKP(bpt.varchar, t.bkey(&k3), k3))
-	t.assert("could not find key in internal", n._has(bpt.varchar, t.bkey(&k3)))
-	t.assert_ptr(k3)(n.findPtr(bpt.varchar, t.bkey(&k3)))
+	t.assert_nil(n.putKP(bpt.varchar, bpt.cmp, t.bkey(&k3), k3))
+	t.assert("could not find key in internal", n._has(bpt.varchar, bpt.cmp, t.bkey(&k3)))
+	t.assert_ptr(k3)(n.findPtr(bpt.varchar, bpt.cmp, t.bkey(&k3)))
 
-	t.assert_nil(n.putKP(bpt.varchar, t.bkey(&k4), k4))
-	t.assert("could not find key in internal", n._has(bpt.varchar, t.bkey(&k4)))
-	t.assert_ptr(k4)(n.findPtr(bpt.varchar, t.bkey(&k4)))
+	t.assert_nil(n.putKP(bpt.varchar, bpt.cmp, t.bkey(&k4), k4))
+	t.assert("could not find key in internal", n._has(bpt.varchar, bpt.cmp, t.bkey(&k4)))
+	t.assert_ptr(k4)(n.findPtr(bpt.varchar, bpt.cmp, t.bkey(&k4)))
 
-	t.assert_nil(n.putKP(bpt.varchar, t.bkey(&k5), k5))
-	t.assert("could not find key in internal", n._has(bpt.varchar, t.bkey(&k5)))
-	t.assert_ptr(k5)(n.findPtr(bpt.varchar, t.bkey(&k5)))
+	t.assert_nil(n.putKP(bpt.varchar, bpt.cmp, t.bkey(&k5), k5))
+	t.assert("could not find key in internal", n._has(bpt.varchar, bpt.cmp, t.bkey(&k5)))
+	t.assert_ptr(k5)(n.findPtr(bpt.varchar, bpt.cmp, t.bkey(&k5)))
 
-	t.assert("could not find key in internal", n._has(bpt.varchar, t.bkey(&k1)))
-	t.assert("could not find key in internal", n._has(bpt.varchar, t.bkey(&k2)))
-	t.assert("could not find key in internal", n._has(bpt.varchar, t.bkey(&k3)))
-	t.assert("could not find key in internal", n._has(bpt.varchar, t.bkey(&k4)))
-	t.assert("could not find key in internal", n._has(bpt.varchar, t.bkey(&k5)))
-	t.assert_ptr(k1)(n.findPtr(bpt.varchar, t.bkey(&k1)))
-	t.assert_ptr(k2)(n.findPtr(bpt.varchar, t.bkey(&k2)))
-	t.assert_ptr(k3)(n.findPtr(bpt.varchar, t.bkey(&k3)))
-	t.assert_ptr(k4)(n.findPtr(bpt.varchar, t.bkey(&k4)))
-	t.assert_ptr(k5)(n.findPtr(bpt.varchar, t.bkey(&k5)))
+	t.assert("could not find key in internal", n._has(bpt.varchar, bpt.cmp, t.bkey(&k1)))
+	t.assert("could not find key in internal", n._has(bpt.varchar, bpt.cmp, t.bkey(&k2)))
+	t.assert("could not find key in internal", n._has(bpt.varchar, bpt.cmp, t.bkey(&k3)))
+	t.assert("could not find key in internal", n._has(bpt.varchar, bpt.cmp, t.bkey(&k4)))
+	t.assert("could not find key in internal", n._has(bpt.varchar, bpt.cmp, t.bkey(&k5)))
+	t.assert_ptr(k1)(n.findPtr(bpt.varchar, bpt.cmp, t.bkey(&k1)))
+	t.assert_ptr(k2)(n.findPtr(bpt.varchar, bpt.cmp, t.bkey(&k2)))
+	t.assert_ptr(k3)(n.findPtr(bpt.varchar, bpt.cmp, t.bkey(&k3)))
+	t.assert_ptr(k4)(n.findPtr(bpt.varchar, bpt.cmp, t.bkey(&k4)))
+	t.assert_ptr(k5)(n.findPtr(bpt.varchar, bpt.cmp, t.bkey(&k5)))
 }
 
 func TestNewInternal(t *testing.T) {
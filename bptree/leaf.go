@@ -16,9 +16,11 @@ import (
 
 type leafMeta struct {
 	baseMeta
-	next    uint64
-	prev    uint64
-	valSize uint16
+	next      uint64
+	prev      uint64
+	valSize   uint16
+	prefixLen uint16
+	checksum  uint32
 }
 
 type leaf struct {
@@ -49,6 +51,8 @@ func (m *leafMeta) Init(flags consts.Flag, keySize, keyCap, valSize uint16) {
 	m.next = 0
 	m.prev = 0
 	m.valSize = valSize
+	m.prefixLen = 0
+	m.checksum = 0
 }
 
 func (m *leafMeta) Size() uintptr {
@@ -57,8 +61,8 @@ func (m *leafMeta) Size() uintptr {
 
 func (m *leafMeta) String() string {
 	return fmt.Sprintf(
-		"%v, valSize: %v, next: %v, prev: %v",
-		&m.baseMeta, m.valSize, m.next, m.prev)
+		"%v, valSize: %v, prefixLen: %v, next: %v, prev: %v",
+		&m.baseMeta, m.valSize, m.prefixLen, m.next, m.prev)
 }
 
 func (n *leaf) String() string {
@@ -77,16 +81,16 @@ func (n *leaf) keyCount() int {
 	return int(n.meta.keyCount)
 }
 
-func (n *leaf) _has(v *Varchar, key []byte) bool {
-	_, has, err := find(v, n, key)
+func (n *leaf) _has(v *Varchar, cmp Comparator, key []byte) bool {
+	_, has, err := find(v, cmp, n, key)
 	if err != nil {
 		log.Fatal(err)
 	}
 	return has
 }
 
-func (n *leaf) firstValue(vc *Varchar, key []byte) ([]byte, error) {
-	i, has, err := find(vc, n, key)
+func (n *leaf) firstValue(vc *Varchar, cmp Comparator, key []byte) ([]byte, error) {
+	i, has, err := find(vc, cmp, n, key)
 	if err != nil {
 		return nil, err
 	}
@@ -110,8 +114,8 @@ func (n *leaf) firstValue(vc *Varchar, key []byte) ([]byte, error) {
 	}
 }
 
-func (n *leaf) hasValue(vc *Varchar, key, value []byte) (bool, error) {
-	i, has, err := find(vc, n, key)
+func (n *leaf) hasValue(vc *Varchar, cmp Comparator, key, value []byte) (bool, error) {
+	i, has, err := find(vc, cmp, n, key)
 	if err != nil {
 		return false, err
 	}
@@ -148,16 +152,24 @@ func (n *leaf) doKeyAt(vc *Varchar, i int, do func([]byte) error) error {
 	if flags&consts.VARCHAR_KEYS != 0 {
 		return n.doBig(vc, n.key(i), do)
 	} else {
-		return do(n.key(i))
+		return do(n.fullKey(i))
 	}
 }
 
-func (n *leaf) cmpKeyAt(vc *Varchar, i int, key []byte) (cmp int, err error) {
+func (n *leaf) cmpKeyAt(vc *Varchar, cmp Comparator, i int, key []byte) (c int, err error) {
+	if plen := int(n.meta.prefixLen); plen != 0 && len(key) >= plen {
+		// compressed trees are in the default order so the prefix and
+		// the rest of the key can be compared separately
+		if c := bytes.Compare(key[:plen], n.prefix()); c != 0 {
+			return c, nil
+		}
+		return bytes.Compare(key[plen:], n.key(i)), nil
+	}
 	err = n.doKeyAt(vc, i, func(key_i []byte) error {
-		cmp = bytes.Compare(key, key_i)
+		c = cmp(key, key_i)
 		return nil
 	})
-	return cmp, err
+	return c, err
 }
 
 /*
@@ -178,22 +190,53 @@ func (n *leaf) doBig(vc *Varchar, v []byte, do func([]byte) error) error {
 	})
 }
 
+// The key slot i. In a compressed leaf it is only the part of the key
+// after the prefix, see fullKey.
 func (n *leaf) key(i int) []byte {
-	keySize := int(n.meta.keySize)
-	s := keySize * i
-	e := s + keySize
+	plen := int(n.meta.prefixLen)
+	slotSize := n.slotSize()
+	s := plen + slotSize*i
+	e := s + slotSize
 	return n.bytes[s:e]
 }
 
 func (n *leaf) val(i int) []byte {
-	keySize := int(n.meta.keySize)
+	plen := int(n.meta.prefixLen)
 	keyCap := int(n.meta.keyCap)
 	valSize := int(n.meta.valSize)
-	s := keyCap*keySize + valSize*i
+	s := plen + keyCap*n.slotSize() + valSize*i
 	e := s + valSize
 	return n.bytes[s:e]
 }
 
+// The whole key i. For a compressed leaf it is a copy (the prefix
+// followed by the key slot) otherwise it is the key slot itself.
+func (n *leaf) fullKey(i int) []byte {
+	plen := int(n.meta.prefixLen)
+	if plen == 0 {
+		return n.key(i)
+	}
+	key := make([]byte, n.meta.keySize)
+	copy(key, n.prefix())
+	copy(key[plen:], n.key(i))
+	return key
+}
+
+// The size of the key slots, the keySize less the prefix.
+func (n *leaf) slotSize() int {
+	return int(n.meta.keySize) - int(n.meta.prefixLen)
+}
+
+// The prefix every key in the leaf shares, it is stored once at the
+// start of the leaf (before the key slots).
+func (n *leaf) prefix() []byte {
+	return n.bytes[:n.meta.prefixLen]
+}
+
+func (n *leaf) compressed() bool {
+	return n.meta.flags&consts.PREFIX_COMPRESSION != 0
+}
+
 // this is for debugging
 func (n *leaf) _keys() [][]byte {
 	keys := make([][]byte, 0, n.meta.keyCount)
@@ -249,18 +292,16 @@ func (n *leaf) _realVals(v *Varchar) [][]byte {
 }
 
 func (n *leaf) keys() []byte {
-	keySize := int(n.meta.keySize)
 	keyCap := int(n.meta.keyCap)
-	s := 0
-	e := s + keyCap*keySize
+	s := int(n.meta.prefixLen)
+	e := s + keyCap*n.slotSize()
 	return n.bytes[s:e]
 }
 
 func (n *leaf) vals() []byte {
-	keySize := int(n.meta.keySize)
 	keyCap := int(n.meta.keyCap)
 	valSize := int(n.meta.valSize)
-	s := keyCap * keySize
+	s := int(n.meta.prefixLen) + keyCap*n.slotSize()
 	e := s + keyCap*valSize
 	return n.bytes[s:e]
 }
@@ -269,6 +310,105 @@ func (n *leaf) fitsAnother() bool {
 	return n.meta.keyCount+1 < n.meta.keyCap
 }
 
+// Does the key fit in the leaf? A key which does not share the prefix
+// of a compressed leaf shortens it so the leaf holds fewer pairs.
+func (n *leaf) fitsKey(key []byte) bool {
+	if !n.compressed() || n.meta.keyCount == 0 {
+		return n.fitsAnother()
+	}
+	plen := commonPrefix(n.prefix(), key)
+	keyCap := leafCap(len(n.bytes), int(n.meta.keySize), int(n.meta.valSize), plen)
+	return int(n.meta.keyCount)+1 < keyCap
+}
+
+// Does the key start with the prefix of the leaf?
+func (n *leaf) sharesPrefix(key []byte) bool {
+	return commonPrefix(n.prefix(), key) == int(n.meta.prefixLen)
+}
+
+// Shorten the prefix of the compressed leaf to the part the key shares
+// with it. An empty leaf takes (as much as it can of) the key as its
+// prefix.
+func (n *leaf) sharePrefix(key []byte) error {
+	if n.meta.keyCount == 0 {
+		return n.reprefix(key[:n.maxPrefix()])
+	} else if n.sharesPrefix(key) {
+		return nil
+	}
+	return n.reprefix(key[:commonPrefix(n.prefix(), key)])
+}
+
+// Lengthen the prefix of the compressed leaf to all its keys share
+// (the keys are in order so it is what the first and last share).
+func (n *leaf) tighten() error {
+	if n.meta.keyCount == 0 {
+		return nil
+	}
+	first := n.fullKey(0)
+	plen := commonPrefix(first, n.fullKey(int(n.meta.keyCount)-1))
+	if plen > n.maxPrefix() {
+		plen = n.maxPrefix()
+	}
+	if plen <= int(n.meta.prefixLen) {
+		return nil
+	}
+	return n.reprefix(first[:plen])
+}
+
+// The longest prefix, the key slots may only be empty if the values are
+// not.
+func (n *leaf) maxPrefix() int {
+	if n.meta.valSize == 0 {
+		return int(n.meta.keySize) - 1
+	}
+	return int(n.meta.keySize)
+}
+
+// Lay the leaf out again with the prefix (which all of its keys must
+// start with). The key capacity changes with the length of the prefix.
+func (n *leaf) reprefix(prefix []byte) error {
+	count := int(n.meta.keyCount)
+	keySize := int(n.meta.keySize)
+	plen := len(prefix)
+	keyCap := leafCap(len(n.bytes), keySize, int(n.meta.valSize), plen)
+	if count >= keyCap {
+		return errors.Errorf("the pairs do not fit in the leaf with a %d byte prefix", plen)
+	}
+	prefix = append([]byte{}, prefix...)
+	keys := make([][]byte, 0, count)
+	vals := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		key := make([]byte, keySize)
+		copy(key, n.prefix())
+		copy(key[n.meta.prefixLen:], n.key(i))
+		keys = append(keys, key)
+		vals = append(vals, append([]byte{}, n.val(i)...))
+	}
+	fmap.MemClr(n.bytes[:])
+	n.meta.prefixLen = uint16(plen)
+	n.meta.keyCap = uint16(keyCap)
+	copy(n.bytes[:plen], prefix)
+	for i := 0; i < count; i++ {
+		copy(n.key(i), keys[i][plen:])
+		copy(n.val(i), vals[i])
+	}
+	return nil
+}
+
+// How many pairs fit in available bytes with a prefix of plen bytes.
+func leafCap(available, keySize, valSize, plen int) int {
+	return (available - plen) / (keySize - plen + valSize)
+}
+
+// The length of the prefix a and b share.
+func commonPrefix(a, b []byte) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
 // this method is totally UNSAFE
 func (n *leaf) pure(v *Varchar) bool {
 	if n.meta.keyCount == 0 {
@@ -308,14 +448,11 @@ func (n *leaf) updateValueAt(v *Varchar, i int, value []byte) (err error) {
 	flags := n.meta.flags
 	if flags&consts.VARCHAR_VALS != 0 {
 		oldv := n.val(i)
+		// the new value was allocated with the reference the leaf holds
 		err = v.Deref(*slice.AsUint64(&oldv))
 		if err != nil {
 			return err
 		}
-		err = v.Ref(*slice.AsUint64(&value))
-		if err != nil {
-			return err
-		}
 	}
 	copy(n.val(i), value)
 	return nil
@@ -323,20 +460,20 @@ func (n *leaf) updateValueAt(v *Varchar, i int, value []byte) (err error) {
 
 // puts the key, value into the leaf node. The vkey is the varchar key
 // if this is a tree is in varchar key mode.
-func (n *leaf) put(v *Varchar, vkey, key, value []byte) (err error) {
+func (n *leaf) put(v *Varchar, cmp Comparator, vkey, key, value []byte) (err error) {
 	if n.meta.flags&consts.VARCHAR_KEYS != 0 {
-		return n.putKV(v, vkey, value)
+		return n.putKV(v, cmp, vkey, value)
 	} else {
-		return n.putKV(v, key, value)
+		return n.putKV(v, cmp, key, value)
 	}
 }
 
-func (n *leaf) find(v *Varchar, key []byte) (idx int, has bool, err error) {
+func (n *leaf) find(v *Varchar, cmp Comparator, key []byte) (idx int, has bool, err error) {
 	if n.meta.flags&consts.VARCHAR_KEYS == 0 {
-		return find(v, n, key)
+		return find(v, cmp, n, key)
 	} else {
 		err = v.Do(*slice.AsUint64(&key), func(key []byte) (e error) {
-			idx, has, e = find(v, n, key)
+			idx, has, e = find(v, cmp, n, key)
 			return e
 		})
 		if err != nil {
@@ -346,21 +483,28 @@ func (n *leaf) find(v *Varchar, key []byte) (idx int, has bool, err error) {
 	}
 }
 
-func (n *leaf) putKV(v *Varchar, key []byte, value []byte) (err error) {
-	idx, _, err := n.find(v, key)
+func (n *leaf) putKV(v *Varchar, cmp Comparator, key []byte, value []byte) (err error) {
+	idx, _, err := n.find(v, cmp, key)
 	if err != nil {
 		return err
 	}
-	return n.doPutKV(v, idx, key, value)
+	return n.doPutKV(v, cmp, idx, key, value)
 }
 
-func (n *leaf) doPutKV(v *Varchar, idx int, key, value []byte) (err error) {
+func (n *leaf) doPutKV(v *Varchar, cmp Comparator, idx int, key, value []byte) (err error) {
 	if len(value) != int(n.meta.valSize) {
 		return errors.Errorf("value was the wrong size")
 	}
 	if len(key) != int(n.meta.keySize) {
 		return errors.Errorf("key was the wrong size")
 	}
+	if n.compressed() {
+		err = n.sharePrefix(key)
+		if err != nil {
+			return err
+		}
+		key = key[n.meta.prefixLen:]
+	}
 	if n.meta.keyCount+1 >= n.meta.keyCap {
 		return errors.Errorf("block is full")
 	}
@@ -369,7 +513,7 @@ func (n *leaf) doPutKV(v *Varchar, idx int, key, value []byte) (err error) {
 	}
 	keys := n.keys()
 	vals := n.vals()
-	keySize := int(n.meta.keySize)
+	keySize := n.slotSize()
 	valSize := int(n.meta.valSize)
 	if idx == int(n.meta.keyCount) {
 		// fantastic we don't nee to move any thing.
@@ -419,7 +563,7 @@ func (n *leaf) doPutKV(v *Varchar, idx int, key, value []byte) (err error) {
 	return nil
 
 	/*
-		err = checkOrder(v, n)
+		err = checkOrder(v, cmp, n)
 		if err != nil {
 			log.Println("inserted", key, value)
 			log.Println("at", idx)
@@ -430,13 +574,13 @@ func (n *leaf) doPutKV(v *Varchar, idx int, key, value []byte) (err error) {
 		fidx := 0
 		var has bool
 		if n.meta.flags&consts.VARCHAR_KEYS == 0 {
-			fidx, has, err = find(v, n, key)
+			fidx, has, err = find(v, cmp, n, key)
 			if err != nil {
 				return err
 			}
 		} else {
 			err = v.Do(*slice.AsUint64(&key), func(key []byte) (err error) {
-				fidx, has, err = find(v, n, key)
+				fidx, has, err = find(v, cmp, n, key)
 				return err
 			})
 			if err != nil {
@@ -464,14 +608,14 @@ func (n *leaf) doPutKV(v *Varchar, idx int, key, value []byte) (err error) {
 	*/
 }
 
-func (n *leaf) delKV(v *Varchar, key []byte, which func([]byte) bool) error {
+func (n *leaf) delKV(v *Varchar, cmp Comparator, key []byte, which func([]byte) bool) error {
 	if len(key) != int(n.meta.keySize) {
 		return errors.Errorf("key was the wrong size")
 	}
 	if n.meta.keyCount <= 0 {
 		return errors.Errorf("block is empty")
 	}
-	idx, has, err := find(v, n, key)
+	idx, has, err := find(v, cmp, n, key)
 	if err != nil {
 		return err
 	}
@@ -502,10 +646,10 @@ func (n *leaf) delKV(v *Varchar, key []byte, which func([]byte) bool) error {
 			break
 		}
 	}
-	return n.delItemAt(v, idx)
+	return n.delItemAt(v, cmp, idx)
 }
 
-func (n *leaf) delItemAt(v *Varchar, idx int) error {
+func (n *leaf) delItemAt(v *Varchar, cmp Comparator, idx int) error {
 	// ok we have our key_idx
 	if idx+1 == int(n.meta.keyCount) {
 		// sweet we can just drop the last
@@ -520,7 +664,7 @@ func (n *leaf) delItemAt(v *Varchar, idx int) error {
 	// drop the key
 	{
 		keys := n.keys()
-		keySize := int(n.meta.keySize)
+		keySize := n.slotSize()
 		chunkSize := chunk * keySize
 		s := idx * keySize
 		e := s + chunkSize
@@ -542,7 +686,7 @@ func (n *leaf) delItemAt(v *Varchar, idx int) error {
 	// do the book keeping
 	n.meta.keyCount--
 	/*
-		err := checkOrder(v, n)
+		err := checkOrder(v, cmp, n)
 		if err != nil {
 			log.Println("del at", idx)
 			log.Println(n)
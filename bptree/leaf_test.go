@@ -118,13 +118,13 @@ func TestPutKVRand(x *testing.T) {
 			}
 			kvs = append(kvs, kv)
 			// t.Log(n)
-			t.assert_nil(n.putKV(bpt.varchar, kv.key, kv.value))
-			t.assert("could not find key in leaf", n._has(bpt.varchar, kv.key))
-			t.assert_value(kv.value)(n.firstValue(bpt.varchar, kv.key))
+			t.assert_nil(n.putKV(bpt.varchar, bpt.cmp, kv.key, kv.value))
+			t.assert("could not find key in leaf", n._has(bpt.varchar, bpt.cmp, kv.key))
+			t.assert_value(kv.value)(n.firstValue(bpt.varchar, bpt.cmp, kv.key))
 		}
 		for _, kv := range kvs {
-			t.assert("could not find key in leaf", n._has(bpt.varchar, kv.key))
-			t.assert_value(kv.value)(n.firstValue(bpt.varchar, kv.key))
+			t.assert("could not find key in leaf", n._has(bpt.varchar, bpt.cmp, kv.key))
+			t.assert_value(kv.value)(n.firstValue(bpt.varchar, bpt.cmp, kv.key))
 		}
 	}
 }
@@ -151,49 +151,49 @@ func TestPutDelKVRand(x *testing.T) {
 				break
 			}
 			kvs = append(kvs, kv)
-			t.assert_nil(n.putKV(bpt.varchar, kv.key, kv.value))
-			t.assert("could not find key in leaf", n._has(bpt.varchar, kv.key))
-			t.assert_value(kv.value)(n.firstValue(bpt.varchar, kv.key))
+			t.assert_nil(n.putKV(bpt.varchar, bpt.cmp, kv.key, kv.value))
+			t.assert("could not find key in leaf", n._has(bpt.varchar, bpt.cmp, kv.key))
+			t.assert_value(kv.value)(n.firstValue(bpt.varchar, bpt.cmp, kv.key))
 		}
 		for _, kv := range kvs {
-			t.assert("could not find key in leaf", n._has(bpt.varchar, kv.key))
-			t.assert_value(kv.value)(n.firstValue(bpt.varchar, kv.key))
+			t.assert("could not find key in leaf", n._has(bpt.varchar, bpt.cmp, kv.key))
+			t.assert_value(kv.value)(n.firstValue(bpt.varchar, bpt.cmp, kv.key))
 		}
 		for i, kv := range kvs {
-			t.assert_nil(n.delKV(bpt.varchar, kv.key, func(b []byte) bool {
+			t.assert_nil(n.delKV(bpt.varchar, bpt.cmp, kv.key, func(b []byte) bool {
 				return bytes.Equal(b, kv.value)
 			}))
 			for _, kv2 := range kvs[:i+1] {
-				t.assert("found key in leaf", !n._has(bpt.varchar, kv2.key))
+				t.assert("found key in leaf", !n._has(bpt.varchar, bpt.cmp, kv2.key))
 			}
 		}
 		for _, kv := range kvs {
-			t.assert_nil(n.putKV(bpt.varchar, kv.key, kv.value))
-			t.assert("could not find key in leaf", n._has(bpt.varchar, kv.key))
-			t.assert_value(kv.value)(n.firstValue(bpt.varchar, kv.key))
+			t.assert_nil(n.putKV(bpt.varchar, bpt.cmp, kv.key, kv.value))
+			t.assert("could not find key in leaf", n._has(bpt.varchar, bpt.cmp, kv.key))
+			t.assert_value(kv.value)(n.firstValue(bpt.varchar, bpt.cmp, kv.key))
 		}
 		for _, kv := range kvs {
-			t.assert("could not find key in leaf", n._has(bpt.varchar, kv.key))
-			t.assert_value(kv.value)(n.firstValue(bpt.varchar, kv.key))
+			t.assert("could not find key in leaf", n._has(bpt.varchar, bpt.cmp, kv.key))
+			t.assert_value(kv.value)(n.firstValue(bpt.varchar, bpt.cmp, kv.key))
 		}
 		for _, kv := range kvs {
-			t.assert_nil(n.delKV(bpt.varchar, kv.key, func(b []byte) bool {
+			t.assert_nil(n.delKV(bpt.varchar, bpt.cmp, kv.key, func(b []byte) bool {
 				return bytes.Equal(b, kv.value)
 			}))
 			for _, kv2 := range kvs {
 				if !bytes.Equal(kv.key, kv2.key) {
-					t.assert("no key in leaf", n._has(bpt.varchar, kv2.key))
+					t.assert("no key in leaf", n._has(bpt.varchar, bpt.cmp, kv2.key))
 				}
 			}
-			t.assert("found key in leaf", !n._has(bpt.varchar, kv.key))
-			t.assert_nil(n.putKV(bpt.varchar, kv.key, kv.value))
+			t.assert("found key in leaf", !n._has(bpt.varchar, bpt.cmp, kv.key))
+			t.assert_nil(n.putKV(bpt.varchar, bpt.cmp, kv.key, kv.value))
 		}
 		for i, kv := range kvs {
-			t.assert_nil(n.delKV(bpt.varchar, kv.key, func(b []byte) bool {
+			t.assert_nil(n.delKV(bpt.varchar, bpt.cmp, kv.key, func(b []byte) bool {
 				return bytes.Equal(b, kv.value)
 			}))
 			for _, kv2 := range kvs[:i+1] {
-				t.assert("found key in leaf", !n._has(bpt.varchar, kv2.key))
+				t.assert("found key in leaf", !n._has(bpt.varchar, bpt.cmp, kv2.key))
 			}
 		}
 	}
@@ -227,15 +227,15 @@ func TestPutRepKVRand(x *testing.T) {
 			}
 			kvs = append(kvs, kv)
 			// t.Log(n)
-			t.assert_nil(n.putKV(bpt.varchar, kv.key, kv.value))
-			t.assert("could not find key in leaf", n._has(bpt.varchar, kv.key))
-			has, err := n.hasValue(bpt.varchar, kv.key, kv.value)
+			t.assert_nil(n.putKV(bpt.varchar, bpt.cmp, kv.key, kv.value))
+			t.assert("could not find key in leaf", n._has(bpt.varchar, bpt.cmp, kv.key))
+			has, err := n.hasValue(bpt.varchar, bpt.cmp, kv.key, kv.value)
 			t.assert_nil(err)
 			t.assert("could not find value in leaf", has)
 		}
 		for _, kv := range kvs {
-			t.assert("could not find key in leaf", n._has(bpt.varchar, kv.key))
-			has, err := n.hasValue(bpt.varchar, kv.key, kv.value)
+			t.assert("could not find key in leaf", n._has(bpt.varchar, bpt.cmp, kv.key))
+			has, err := n.hasValue(bpt.varchar, bpt.cmp, kv.key, kv.value)
 			t.assert_nil(err)
 			t.assert("could not find value in leaf", has)
 		}
@@ -258,36 +258,36 @@ func TestPutKV(x *testing.T) {
 	v4 := t.rand_bytes(8)
 	k5 := uint64(5)
 	v5 := t.rand_bytes(8)
-	t.assert_nil(n.putKV(bpt.varchar, t.bkey(&k1), v1))
-	t.assert("could not find key in leaf", n._has(bpt.varchar, t.bkey(&k1)))
-	t.assert_value(v1)(n.firstValue(bpt.varchar, t.bkey(&k1)))
+	t.assert_nil(n.putKV(bpt.varchar, bpt.cmp, t.bkey(&k1), v1))
+	t.assert("could not find key in leaf", n._has(bpt.varchar, bpt.cmp, t.bkey(&k1)))
+	t.assert_value(v1)(n.firstValue(bpt.varchar, bpt.cmp, t.bkey(&k1)))
 
-	t.assert_nil(n.putKV(bpt.varchar, t.bkey(&k2), v2))
-	t.assert("could not find key in leaf", n._has(bpt.varchar, t.bkey(&k2)))
-	t.assert_value(v2)(n.firstValue(bpt.varchar, t.bkey(&k2)))
+	t.assert_nil(n.putKV(bpt.varchar, bpt.cmp, t.bkey(&k2), v2))
+	t.assert("could not find key in leaf", n._has(bpt.varchar, bpt.cmp, t.bkey(&k2)))
+	t.assert_value(v2)(n.firstValue(bpt.varchar, bpt.cmp, t.bkey(&k2)))
 
-	t.assert_nil(n.putKV(bpt.varchar, t.bkey(&k3), v3))
-	t.assert("could not find key in leaf", n._has(bpt.varchar, t.bkey(&k3)))
-	t.assert_value(v3)(n.firstValue(bpt.varchar, t.bkey(&k3)))
+	t.assert_nil(n.putKV(bpt.varchar, bpt.cmp, t.bkey(&k3), v3))
+	t.assert("could not find key in leaf", n._has(bpt.varchar, bpt.cmp, t.bkey(&k3)))
+	t.assert_value(v3)(n.firstValue(bpt.varchar, bpt.cmp, t.bkey(&k3)))
 
-	t.assert_nil(n.putKV(bpt.varchar, t.bkey(&k4), v4))
-	t.assert("could not find key in leaf", n._has(bpt.varchar, t.bkey(&k4)))
-	t.assert_value(v4)(n.firstValue(bpt.varchar, t.bkey(&k4)))
+	t.assert_nil(n.putKV(bpt.varchar, bpt.cmp, t.bkey(&k4), v4))
+	t.assert("could not find key in leaf", n._has(bpt.varchar, bpt.cmp, t.bkey(&k4)))
+	t.assert_value(v4)(n.firstValue(bpt.varchar, bpt.cmp, t.bkey(&k4)))
 
-	t.assert_nil(n.putKV(bpt.varchar, t.bkey(&k5), v5))
-	t.assert("could not find key in leaf", n._has(bpt.varchar, t.bkey(&k5)))
-	t.assert_value(v5)(n.firstValue(bpt.varchar, t.bkey(&k5)))
+	t.assert_nil(n.putKV(bpt.varchar, bpt.cmp, t.bkey(&k5), v5))
+	t.assert("could not find key in leaf", n._has(bpt.varchar, bpt.cmp, t.bkey(&k5)))
+	t.assert_value(v5)(n.firstValue(bpt.varchar, bpt.cmp, t.bkey(&k5)))
 
-	t.assert("could not find key in leaf", n._has(bpt.varchar, t.bkey(&k1)))
-	t.assert_value(v1)(n.firstValue(bpt.varchar, t.bkey(&k1)))
-	t.assert("could not find key in leaf", n._has(bpt.varchar, t.bkey(&k2)))
-	t.assert_value(v2)(n.firstValue(bpt.varchar, t.bkey(&k2)))
-	t.assert("could not find key in leaf", n._has(bpt.varchar, t.bkey(&k3)))
-	t.assert_value(v3)(n.firstValue(bpt.varchar, t.bkey(&k3)))
-	t.assert("could not find key in leaf", n._has(bpt.varchar, t.bkey(&k4)))
-	t.assert_value(v4)(n.firstValue(bpt.varchar, t.bkey(&k4)))
-	t.assert("could not find key in leaf", n._has(bpt.varchar, t.bkey(&k5)))
-	t.assert_value(v5)(n.firstValue(bpt.varchar, t.bkey(&k5)))
+	t.assert("could not find key in leaf", n._has(bpt.varchar, bpt.cmp, t.bkey(&k1)))
+	t.assert_value(v1)(n.firstValue(bpt.varchar, bpt.cmp, t.bkey(&k1)))
+	t.assert("could not find key in leaf", n._has(bpt.varchar, bpt.cmp, t.bkey(&k2)))
+	t.assert_value(v2)(n.firstValue(bpt.varchar, bpt.cmp, t.bkey(&k2)))
+	t.assert("could not find key in leaf", n._has(bpt.varchar, bpt.cmp, t.bkey(&k3)))
+	t.assert_value(v3)(n.firstValue(bpt.varchar, bpt.cmp, t.bkey(&k3)))
+	t.assert("could not find key in leaf", n._has(bpt.varchar, bpt.cmp, t.bkey(&k4)))
+	t.assert_value(v4)(n.firstValue(bpt.varchar, bpt.cmp, t.bkey(&k4)))
+	t.assert("could not find key in leaf", n._has(bpt.varchar, bpt.cmp, t.bkey(&k5)))
+	t.assert_value(v5)(n.firstValue(bpt.varchar, bpt.cmp, t.bkey(&k5)))
 }
 
 func TestNewLeaf(t *testing.T) {
@@ -363,3 +363,22 @@ func TestLoadLeaf(t *testing.T) {
 		t.Error("keyCount was not 0")
 	}
 }
+
+func TestUpdateValueAtRefs(x *testing.T) {
+	t := (*T)(x)
+	bpt, clean := t.bpt()
+	defer clean()
+	v := bpt.varchar
+	n, err := newLeaf(consts.VARCHAR_VALS, make([]byte, consts.BLOCKSIZE), 8, 8)
+	t.assert_nil(err)
+	old, err := v.Alloc(16)
+	t.assert_nil(err)
+	t.assert_nil(n.putKV(v, bpt.cmp, t.rand_key(), slice.Uint64AsSlice(&old)))
+	a, err := v.Alloc(16)
+	t.assert_nil(err)
+	t.assert_nil(n.updateValueAt(v, 0, slice.Uint64AsSlice(&a)))
+	t.assert_nil(v.doRun(a, func(m *varRunMeta) error {
+		t.assert("the leaf should hold the only ref", m.refs == 1)
+		return nil
+	}))
+}
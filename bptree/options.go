@@ -0,0 +1,75 @@
+package bptree
+
+import (
+	"github.com/timtadh/fs2/consts"
+)
+
+// An Option changes how a new tree (or Varchar) is laid out. Options are
+// recorded in the file so they do not need to be passed to Open (except
+// FillFactor which only applies while bulk loading).
+type Option func(*options)
+
+type options struct {
+	flags      consts.Flag
+	comparator string
+	fill       float64
+}
+
+func makeOptions(opts []Option) *options {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// Store a CRC32C checksum in every leaf, internal node and varchar run.
+// The checksum is verified whenever the block is loaded and a
+// *errors.CorruptionError (naming the offset of the block) is returned
+// if it does not match. Internal nodes hold slightly fewer keys and
+// varchar runs are 4 bytes larger.
+func Checksums() Option {
+	return func(o *options) {
+		o.flags |= consts.CHECKSUMS
+	}
+}
+
+// Make a tree with unique keys, a map from keys to values rather than a
+// multi-map. Put replaces the value of a key, Add fails if the key is
+// already there and BulkLoad fails on repeated keys.
+func UniqueKeys() Option {
+	return func(o *options) {
+		o.flags |= consts.UNIQUE_KEYS
+	}
+}
+
+// Keep the number of pairs under each child of the internal nodes so
+// CountRange, Rank and Select take O(log n) rather than a scan. Internal
+// nodes hold fewer keys (the counts take as much room as the pointers)
+// and every Add and Remove updates the counts on its way back up.
+func SubtreeCounts() Option {
+	return func(o *options) {
+		o.flags |= consts.SUBTREE_COUNTS
+	}
+}
+
+// Store the prefix the keys of a leaf share once (at the start of the
+// leaf) and only the rest of each key in the key slots, so leaves of
+// composite keys like (tenant, timestamp, id) hold many more pairs. The
+// keys must be fixed size and in the default (lexicographic) order.
+// BulkLoad adds the pairs to such a tree one at a time (ignoring
+// FillFactor) as the leaves hold a varying number of pairs.
+func PrefixCompression() Option {
+	return func(o *options) {
+		o.flags |= consts.PREFIX_COMPRESSION
+	}
+}
+
+// The options a tree (or Varchar) with the given flags was made with.
+// Used to make the trees a structure is built on.
+func flagOptions(flags consts.Flag) []Option {
+	if flags&consts.CHECKSUMS != 0 {
+		return []Option{Checksums()}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package bptree
+
+import (
+	"bytes"
+	"context"
+)
+
+import (
+	"github.com/timtadh/fs2"
+	"github.com/timtadh/fs2/consts"
+	"github.com/timtadh/fs2/errors"
+)
+
+// Iterate over all of the key/value pairs whose keys start with prefix
+// (an empty prefix is the whole tree). See DoIterate() for usage
+// details.
+func (self *BpTree) DoPrefix(prefix []byte, do func(key, value []byte) error) error {
+	return self.DoPrefixCtx(context.Background(), prefix, do)
+}
+
+// DoPrefix which stops (returning ctx.Err()) once the context is done.
+func (self *BpTree) DoPrefixCtx(ctx context.Context, prefix []byte, do func(key, value []byte) error) error {
+	return fs2.DoCtx(
+		ctx,
+		func() (fs2.Iterator, error) { return self.PrefixScan(prefix) },
+		do,
+	)
+}
+
+// Iterate over all of the key/value pairs whose keys start with prefix
+// (an empty prefix is the whole tree), in order. Unlike Range the caller
+// does not need to work out the key after the last one with the prefix.
+// The keys sharing a prefix are only next to each other in the default
+// order so trees made with CompareWith cannot be scanned. See Iterate()
+// for usage details.
+func (self *BpTree) PrefixScan(prefix []byte) (kvi fs2.Iterator, err error) {
+	self.rlock()
+	bi, err := self.prefixIterator(prefix)
+	self.runlock()
+	if err != nil {
+		return nil, err
+	}
+	return self._range(bi)
+}
+
+func (self *BpTree) prefixIterator(prefix []byte) (bi bpt_iterator, err error) {
+	if self.meta.flags&consts.COMPARATOR != 0 {
+		return nil, errors.Errorf("Cannot scan a prefix of a tree with a Comparator, its keys are not in lexicographic order")
+	}
+	var from []byte
+	if len(prefix) > 0 {
+		from = prefix
+	}
+	fi, err := self.forward(from, nil)
+	if err != nil {
+		return nil, err
+	}
+	fi = self.live(fi, from, func(key []byte) (bpt_iterator, error) {
+		return self.forward(key, nil)
+	})
+	bi = func() (a uint64, i int, err error, _ bpt_iterator) {
+		a, i, err, fi = fi()
+		if err != nil {
+			return 0, 0, err, nil
+		} else if fi == nil {
+			return 0, 0, nil, nil
+		}
+		var has bool
+		err = self.doKey(a, i, func(k []byte) error {
+			has = bytes.HasPrefix(k, prefix)
+			return nil
+		})
+		if err != nil {
+			return 0, 0, err, nil
+		} else if !has {
+			return 0, 0, nil, nil
+		}
+		return a, i, nil, bi
+	}
+	return bi, nil
+}
@@ -0,0 +1,194 @@
+package bptree
+
+import "testing"
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+// A (tenant, timestamp, id) key, there are only a few tenants and the
+// timestamps are close together so the keys share long prefixes.
+func (t *T) composite_key() []byte {
+	key := make([]byte, 24)
+	binary.BigEndian.PutUint64(key[0:], uint64(rand.Intn(4)))
+	binary.BigEndian.PutUint64(key[8:], 1500000000+uint64(rand.Intn(100000)))
+	copy(key[16:], t.rand_key())
+	return key
+}
+
+// The pairs of kvs whose keys start with prefix.
+func withPrefix(kvs KVS, prefix []byte) KVS {
+	with := make(KVS, 0, len(kvs))
+	for _, kv := range kvs {
+		if bytes.HasPrefix(kv.key, prefix) {
+			with = append(with, kv)
+		}
+	}
+	return with
+}
+
+func (t *T) assert_prefixes(bpt *BpTree, kvs KVS) {
+	prefixes := [][]byte{nil, {}, {0, 1}, {0xff, 0xff, 0xff}}
+	for i := 0; i < len(kvs); i += 101 {
+		key := kvs[i].key
+		prefixes = append(prefixes, key[:1], key[:len(key)/2], key[:len(key)-1], key)
+	}
+	for _, prefix := range prefixes {
+		expected := withPrefix(kvs, prefix)
+		i := 0
+		t.assert_nil(bpt.DoPrefix(prefix, func(k, v []byte) error {
+			t.assert(fmt.Sprintf("key %d of the prefix %v", i, prefix), i < len(expected) && bytes.Equal(k, expected[i].key))
+			i++
+			return nil
+		}))
+		t.assert(fmt.Sprintf("scanned %v expected %v", i, len(expected)), i == len(expected))
+	}
+}
+
+func (t *T) testPrefix(keySize, valSize int, kvs KVS, opts ...Option) *BpTree {
+	bf, clean := t.blkfile()
+	defer clean()
+	bpt, err := New(bf, keySize, valSize, opts...)
+	t.assert_nil(err)
+	t.assert_prefixes(bpt, KVS{})
+	for _, i := range rand.Perm(len(kvs)) {
+		t.assert_nil(bpt.Add(kvs[i].key, kvs[i].value))
+	}
+	t.assert_loaded(bpt, kvs)
+	t.assert_prefixes(bpt, kvs)
+
+	removed := make(map[string]bool)
+	for i := 0; i < len(kvs); i += 3 {
+		removed[string(kvs[i].key)] = true
+	}
+	for k := range removed {
+		t.assert_nil(bpt.Remove([]byte(k), func([]byte) bool { return true }))
+	}
+	kept := make(KVS, 0, len(kvs))
+	for _, kv := range kvs {
+		if !removed[string(kv.key)] {
+			kept = append(kept, kv)
+		}
+	}
+	kvs = kept
+	t.assert_loaded(bpt, kvs)
+	t.assert_prefixes(bpt, kvs)
+
+	from, to := kvs[len(kvs)/5].key, kvs[len(kvs)/2].key
+	t.assert_nil(bpt.DeleteRange(from, to))
+	kvs = keepOutside(kvs, from, to, nil)
+	t.assert_loaded(bpt, kvs)
+	t.assert_prefixes(bpt, kvs)
+	return bpt
+}
+
+// How many leaves the tree has.
+func (t *T) leaves(bpt *BpTree) int {
+	a, _, err := bpt.getStart(nil)
+	t.assert_nil(err)
+	count := 0
+	for a != 0 {
+		count++
+		t.assert_nil(bpt.doLeaf(a, func(n *leaf) error {
+			a = n.meta.next
+			return nil
+		}))
+	}
+	return count
+}
+
+func TestPrefixScanFixed(x *testing.T) {
+	t := (*T)(x)
+	t.testPrefix(8, 8, t.bulkKVS(3000, t.rand_key, func() []byte { return t.rand_value(8) }))
+}
+
+func TestPrefixScanVarchar(x *testing.T) {
+	t := (*T)(x)
+	t.testPrefix(-1, -1, t.bulkKVS(3000,
+		func() []byte { return t.rand_varchar(1, 30) },
+		func() []byte { return t.rand_varchar(1, 60) }))
+}
+
+func TestPrefixScanComparator(x *testing.T) {
+	t := (*T)(x)
+	bf, clean := t.blkfile()
+	defer clean()
+	bpt, err := New(bf, 8, 8, CompareWith("int"))
+	t.assert_nil(err)
+	_, err = bpt.PrefixScan([]byte{1})
+	t.assert("the keys are not in lexicographic order", err != nil)
+}
+
+func TestPrefixCompression(x *testing.T) {
+	t := (*T)(x)
+	kvs := t.bulkKVS(5000, t.composite_key, func() []byte { return t.rand_value(8) })
+	t.testPrefix(24, 8, kvs, PrefixCompression())
+	// the key slots of a leaf of one key can only be empty with values
+	keys := make(KVS, 0, len(kvs))
+	for _, kv := range kvs {
+		keys = append(keys, &KV{key: kv.key, value: []byte{}})
+	}
+	t.testPrefix(24, 0, keys, PrefixCompression())
+	t.testPrefix(24, -1, kvs, PrefixCompression(), SubtreeCounts())
+}
+
+func TestPrefixCompressionRandomKeys(x *testing.T) {
+	t := (*T)(x)
+	// keys which share little make the leaves split on new prefixes
+	t.testPrefix(8, 8, t.bulkKVS(4000, t.rand_key, func() []byte { return t.rand_value(8) }), PrefixCompression())
+}
+
+func TestPrefixCompressionPacks(x *testing.T) {
+	t := (*T)(x)
+	kvs := make(KVS, 0, 20000)
+	for i := 0; i < cap(kvs); i++ {
+		kvs = append(kvs, &KV{key: t.composite_key(), value: t.rand_value(8)})
+	}
+	leaves := func(opts ...Option) int {
+		bf, clean := t.blkfile()
+		defer clean()
+		bpt, err := New(bf, 24, 8, opts...)
+		t.assert_nil(err)
+		for _, kv := range kvs {
+			t.assert_nil(bpt.Add(kv.key, kv.value))
+		}
+		t.assert_nil(bpt.Verify())
+		return t.leaves(bpt)
+	}
+	plain, compressed := leaves(), leaves(PrefixCompression())
+	t.assert(fmt.Sprintf("compressed %v plain %v", compressed, plain), compressed*4 < plain*3)
+}
+
+func TestPrefixCompressionUniqueBulk(x *testing.T) {
+	t := (*T)(x)
+	kvs := make(KVS, 0, 3000)
+	seen := make(map[string]bool)
+	for len(kvs) < cap(kvs) {
+		kv := &KV{key: t.composite_key(), value: t.rand_value(8)}
+		if !seen[string(kv.key)] {
+			seen[string(kv.key)] = true
+			kvs = append(kvs, kv)
+		}
+	}
+	sort.Sort(kvs)
+	bf, clean := t.blkfile()
+	defer clean()
+	bpt, err := BulkLoad(bf, 24, 8, kvsIterator(kvs), PrefixCompression(), UniqueKeys())
+	t.assert_nil(err)
+	t.assert_loaded(bpt, kvs)
+	for _, kv := range kvs[:100] {
+		kv.value = t.rand_value(8)
+		t.assert_nil(bpt.Put(kv.key, kv.value))
+	}
+	t.assert_loaded(bpt, kvs)
+	t.assert_prefixes(bpt, kvs)
+
+	_, err = New(bf, -1, 8, PrefixCompression())
+	t.assert("varchar keys", err != nil)
+	_, err = New(bf, 8, 8, PrefixCompression(), CompareWith("int"))
+	t.assert("comparator", err != nil)
+}
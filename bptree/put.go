@@ -0,0 +1,141 @@
+package bptree
+
+import (
+	"bytes"
+)
+
+import (
+	"github.com/timtadh/fs2/consts"
+	"github.com/timtadh/fs2/errors"
+	"github.com/timtadh/fs2/slice"
+)
+
+// Decides whether a pair is written into a tree with unique keys. It is
+// called (from the leaf the key belongs in) with the key's current value
+// and true if the key is in the tree or nil and false if it is not. If
+// it returns true the value is replaced (or the pair inserted).
+type putFunc func(old []byte, has bool) (bool, error)
+
+// Put the key/value pair into a tree made with UniqueKeys. If the key
+// is already in the tree its value is replaced (in place, in the same
+// descent which finds it).
+func (self *BpTree) Put(key, value []byte) error {
+	self.lock()
+	defer self.unlock()
+	return self._put(key, value)
+}
+
+func (self *BpTree) _put(key, value []byte) error {
+	return self.put(key, value, func(old []byte, has bool) (bool, error) {
+		return true, nil
+	})
+}
+
+// Put the key/value pair into a tree made with UniqueKeys unless the
+// key is already there. Returns true if the pair was added.
+func (self *BpTree) PutIfAbsent(key, value []byte) (added bool, err error) {
+	self.lock()
+	defer self.unlock()
+	return self._putIfAbsent(key, value)
+}
+
+func (self *BpTree) _putIfAbsent(key, value []byte) (added bool, err error) {
+	err = self.put(key, value, func(old []byte, has bool) (bool, error) {
+		added = !has
+		return added, nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return added, nil
+}
+
+// Replace the value of the key with new if its value is currently old
+// in a tree made with UniqueKeys. Returns true if the value was
+// swapped, false if the value did not match or the key is not in the
+// tree.
+func (self *BpTree) CompareAndSwap(key, old, new []byte) (swapped bool, err error) {
+	self.lock()
+	defer self.unlock()
+	return self._compareAndSwap(key, old, new)
+}
+
+func (self *BpTree) _compareAndSwap(key, old, new []byte) (swapped bool, err error) {
+	err = self.put(key, new, func(cur []byte, has bool) (bool, error) {
+		swapped = has && bytes.Equal(cur, old)
+		return swapped, nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return swapped, nil
+}
+
+// Get the value of the key. In a tree with duplicate keys it is the
+// value of the first pair with the key. Has is false if the key is not
+// in the tree. The value is a copy, it is safe to hold onto.
+func (self *BpTree) Get(key []byte) (value []byte, has bool, err error) {
+	self.rlock()
+	defer self.runlock()
+	a, i, err := self.getStart(key)
+	if err != nil {
+		return nil, false, err
+	}
+	empty, err := self.empty(a)
+	if err != nil {
+		return nil, false, err
+	} else if empty {
+		return nil, false, nil
+	}
+	err = self.doKV(a, i, func(k, v []byte) error {
+		has = bytes.Equal(key, k)
+		if has {
+			value = make([]byte, len(v))
+			copy(value, v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return value, has, nil
+}
+
+// Write the pair (as decided by put) into a tree with unique keys. The
+// caller holds the latch.
+func (self *BpTree) put(key, value []byte, put putFunc) (err error) {
+	if self.bf.ReadOnly() {
+		return errors.Errorf("Cannot put into a tree in a read only file")
+	}
+	if self.meta.flags&consts.UNIQUE_KEYS == 0 {
+		return errors.Errorf("The tree allows duplicate keys, make it with UniqueKeys to Put into it")
+	}
+	if len(key) != int(self.meta.keySize) && self.meta.flags&consts.VARCHAR_KEYS == 0 {
+		return errors.Errorf("Key was not the correct size got, %v, expected, %v", len(key), self.meta.keySize)
+	}
+	value, err = self.checkValue(value)
+	if err != nil {
+		return err
+	}
+	var had, wrote bool
+	_, root, err := self.add(self.meta.root, key, value, func(old []byte, has bool) (bool, error) {
+		had = has
+		wrote, err = put(old, has)
+		return wrote, err
+	})
+	if err != nil {
+		return err
+	}
+	if !wrote && self.meta.flags&consts.VARCHAR_VALS != 0 {
+		// checkValue stored the value for nothing
+		err = self.varchar.Deref(*slice.AsUint64(&value))
+		if err != nil {
+			return err
+		}
+	}
+	if wrote && !had {
+		self.meta.itemCount++
+	}
+	self.meta.root = root
+	return self.writeMeta()
+}
@@ -0,0 +1,172 @@
+package bptree
+
+import "testing"
+
+import (
+	"bytes"
+	"fmt"
+)
+
+import (
+	"github.com/timtadh/fs2/slice"
+)
+
+func (t *T) assert_get(bpt *BpTree, key, value []byte) {
+	v, has, err := bpt.Get(key)
+	t.assert_nil(err)
+	if value == nil {
+		t.assert(fmt.Sprintf("should not have %v", key), !has && v == nil)
+		return
+	}
+	t.assert(fmt.Sprintf("should have %v", key), has)
+	t.assert(fmt.Sprintf("%v had %v expected %v", key, v, value), bytes.Equal(v, value))
+}
+
+func (t *T) testPut(keySize, valSize int, key func() []byte, value func() []byte) {
+	bf, clean := t.blkfile()
+	defer clean()
+	bpt, err := New(bf, keySize, valSize, UniqueKeys())
+	t.assert_nil(err)
+	values := make(map[string][]byte)
+	keys := make([][]byte, 0, 2000)
+	for i := 0; i < cap(keys); i++ {
+		k := key()
+		if i%4 == 3 {
+			// replace the value of a key already there
+			k = keys[(i*7)%len(keys)]
+		} else if _, has := values[string(k)]; !has {
+			keys = append(keys, k)
+		}
+		v := value()
+		values[string(k)] = v
+		t.assert_nil(bpt.Put(k, v))
+	}
+	t.assert_nil(bpt.Verify())
+	t.assert(fmt.Sprintf("size %v expected %v", bpt.Size(), len(values)), bpt.Size() == len(values))
+	for k, v := range values {
+		t.assert_get(bpt, []byte(k), v)
+	}
+	count := 0
+	t.assert_nil(bpt.DoIterate(func(k, v []byte) error {
+		t.assert("iterated value", bytes.Equal(v, values[string(k)]))
+		count++
+		return nil
+	}))
+	t.assert("no duplicates", count == len(values))
+
+	k := keys[0]
+	t.assert("Add of a key which is there", bpt.Add(k, value()) != nil)
+	added, err := bpt.PutIfAbsent(k, value())
+	t.assert_nil(err)
+	t.assert("not added", !added)
+	t.assert_get(bpt, k, values[string(k)])
+
+	v := value()
+	swapped, err := bpt.CompareAndSwap(k, value(), v)
+	t.assert_nil(err)
+	t.assert("old value did not match", !swapped)
+	t.assert_get(bpt, k, values[string(k)])
+	swapped, err = bpt.CompareAndSwap(k, values[string(k)], v)
+	t.assert_nil(err)
+	t.assert("swapped", swapped)
+	t.assert_get(bpt, k, v)
+	values[string(k)] = v
+
+	k = key()
+	for values[string(k)] != nil {
+		k = key()
+	}
+	swapped, err = bpt.CompareAndSwap(k, nil, value())
+	t.assert_nil(err)
+	t.assert("missing key is not swapped", !swapped)
+	t.assert_get(bpt, k, nil)
+	v = value()
+	added, err = bpt.PutIfAbsent(k, v)
+	t.assert_nil(err)
+	t.assert("added", added)
+	t.assert_get(bpt, k, v)
+	values[string(k)] = v
+	t.assert_nil(bpt.Add(key(), value()))
+
+	t.assert_nil(bpt.Verify())
+	t.assert(fmt.Sprintf("size %v expected %v", bpt.Size(), len(values)+1), bpt.Size() == len(values)+1)
+	for k, v := range values {
+		t.assert_get(bpt, []byte(k), v)
+	}
+	for _, k := range keys[:len(keys)/2] {
+		t.assert_nil(bpt.Remove(k, func([]byte) bool { return true }))
+		t.assert_get(bpt, k, nil)
+	}
+	t.assert_nil(bpt.Verify())
+}
+
+func TestPutFixed(x *testing.T) {
+	t := (*T)(x)
+	t.testPut(8, 8, t.rand_key, func() []byte { return t.rand_value(8) })
+}
+
+func TestPutVarchar(x *testing.T) {
+	t := (*T)(x)
+	t.testPut(-1, -1,
+		func() []byte { return t.rand_varchar(0, 32) },
+		func() []byte { return t.rand_varchar(0, 64) })
+}
+
+func TestPutReferences(x *testing.T) {
+	t := (*T)(x)
+	bpt, clean := t.bpt()
+	defer clean()
+	_, err := bpt.PutIfAbsent(t.rand_key(), t.rand_value(8))
+	t.assert("cannot Put into a tree with duplicate keys", err != nil)
+
+	bf, clean2 := t.blkfile()
+	defer clean2()
+	bpt, err = NewVarKeys(bf, UniqueKeys())
+	t.assert_nil(err)
+	key := []byte("the key")
+	for i := 0; i < 500; i++ {
+		t.assert_nil(bpt.Put(key, t.rand_varchar(1, 100)))
+		_, err = bpt.PutIfAbsent(key, t.rand_varchar(1, 100))
+		t.assert_nil(err)
+		_, err = bpt.CompareAndSwap(key, nil, t.rand_varchar(1, 100))
+		t.assert_nil(err)
+	}
+	// the leaf holds the only references to the key and the value
+	t.assert_nil(bpt.doLeaf(bpt.meta.root, func(n *leaf) error {
+		t.assert("one pair", n.meta.keyCount == 1)
+		for _, b := range [][]byte{n.key(0), n.val(0)} {
+			err := bpt.varchar.doRun(*slice.AsUint64(&b), func(m *varRunMeta) error {
+				t.assert(fmt.Sprintf("refs %v", m.refs), m.refs == 1)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	kvs := KVS{
+		{key: []byte("a"), value: []byte("1")},
+		{key: []byte("a"), value: []byte("2")},
+	}
+	_, err = BulkLoad(bf, -1, -1, kvsIterator(kvs), UniqueKeys())
+	t.assert("unique trees cannot be loaded with repeated keys", err != nil)
+}
+
+func TestGetDuplicates(x *testing.T) {
+	t := (*T)(x)
+	bpt, clean := t.bptFixed()
+	defer clean()
+	key := t.rand_key()
+	for i := 0; i < 11; i++ {
+		t.assert_nil(bpt.Add(key, t.rand_value(8)))
+	}
+	v, has, err := bpt.Get(key)
+	t.assert_nil(err)
+	t.assert("has", has)
+	c, err := bpt.Count(key)
+	t.assert_nil(err)
+	t.assert("the value of a pair with the key", c == 11 && len(v) == 8)
+	t.assert_get(bpt, t.rand_key(), nil)
+}
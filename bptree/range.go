@@ -0,0 +1,217 @@
+package bptree
+
+import (
+	"bytes"
+)
+
+import (
+	"github.com/timtadh/fs2"
+	"github.com/timtadh/fs2/errors"
+)
+
+// Which pairs RangeWith iterates over and in what order. The zero value
+// is every pair in the tree in order.
+//
+// From and To are the lowest and highest keys of the range (in the order
+// of the tree) whichever way it is iterated, nil leaves that end of the
+// range open. The bounds are inclusive unless ExcludeFrom (ExcludeTo) is
+// set, then every pair with the key From (To) is left out. Reverse
+// iterates from To down to From. Offset pairs are skipped from the start
+// of the range (in the direction of iteration) and at most Limit pairs
+// are returned after them, a Limit of 0 is no limit.
+type RangeOptions struct {
+	From, To               []byte
+	ExcludeFrom, ExcludeTo bool
+	Reverse                bool
+	Offset, Limit          int
+}
+
+// Iterate over the key/value pairs chosen by opts. See RangeOptions for
+// the options and Iterate() for usage details.
+//
+//	kvi, err := bpt.RangeWith(bptree.RangeOptions{
+//		From: from, ExcludeFrom: true,
+//		Reverse: true,
+//		Limit: 10,
+//	})
+//
+// is the (up to) 10 greatest pairs with keys greater than from.
+func (self *BpTree) RangeWith(opts RangeOptions) (kvi fs2.Iterator, err error) {
+	self.rlock()
+	bi, err := self.optionsIterator(opts)
+	self.runlock()
+	if err != nil {
+		return nil, err
+	}
+	return self._range(bi)
+}
+
+// Iterate over the key/value pairs chosen by opts. See DoIterate() for
+// usage details.
+func (self *BpTree) DoRangeWith(opts RangeOptions, do func(key, value []byte) error) error {
+	return fs2.Do(
+		func() (fs2.Iterator, error) { return self.RangeWith(opts) },
+		do,
+	)
+}
+
+// Iterate over the keys of the pairs chosen by opts, each key once.
+// Offset and Limit count keys rather than pairs. See Iterate() for usage
+// details.
+func (self *BpTree) KeysWith(opts RangeOptions) (it fs2.ItemIterator, err error) {
+	if opts.Offset < 0 || opts.Limit < 0 {
+		return nil, errors.Errorf("The offset (%d) and limit (%d) cannot be negative", opts.Offset, opts.Limit)
+	}
+	skip, limit := opts.Offset, opts.Limit
+	opts.Offset, opts.Limit = 0, 0
+	kvi, err := self.RangeWith(opts)
+	if err != nil {
+		return nil, err
+	}
+	var pk []byte
+	taken := 0
+	it = func() (key []byte, err error, _it fs2.ItemIterator) {
+		for {
+			if limit > 0 && taken >= limit {
+				return nil, nil, nil
+			}
+			key, _, err, kvi = kvi()
+			if err != nil {
+				return nil, err, nil
+			}
+			if kvi == nil {
+				return nil, nil, nil
+			}
+			if pk != nil && bytes.Equal(pk, key) {
+				continue
+			}
+			pk = key
+			if skip > 0 {
+				skip--
+				continue
+			}
+			taken++
+			return key, nil, it
+		}
+	}
+	return it, nil
+}
+
+// Iterate over the keys chosen by opts. See KeysWith() and DoIterate()
+// for usage details.
+func (self *BpTree) DoKeysWith(opts RangeOptions, do func([]byte) error) error {
+	return fs2.DoItem(
+		func() (fs2.ItemIterator, error) { return self.KeysWith(opts) },
+		do,
+	)
+}
+
+// Iterate over the values of the pairs chosen by opts. See Iterate() for
+// usage details.
+func (self *BpTree) ValuesWith(opts RangeOptions) (it fs2.ItemIterator, err error) {
+	kvi, err := self.RangeWith(opts)
+	if err != nil {
+		return nil, err
+	}
+	it = func() (value []byte, err error, _it fs2.ItemIterator) {
+		_, value, err, kvi = kvi()
+		if err != nil {
+			return nil, err, nil
+		}
+		if kvi == nil {
+			return nil, nil, nil
+		}
+		return value, nil, it
+	}
+	return it, nil
+}
+
+// Iterate over the values chosen by opts. See DoIterate() for usage
+// details.
+func (self *BpTree) DoValuesWith(opts RangeOptions, do func([]byte) error) error {
+	return fs2.DoItem(
+		func() (fs2.ItemIterator, error) { return self.ValuesWith(opts) },
+		do,
+	)
+}
+
+// The locations of the pairs chosen by opts. The range is walked with
+// forward (or backward) from its first key to its last, the pairs with an
+// excluded bound are dropped as they are stepped over.
+func (self *BpTree) optionsIterator(opts RangeOptions) (bpt_iterator, error) {
+	if opts.Offset < 0 || opts.Limit < 0 {
+		return nil, errors.Errorf("The offset (%d) and limit (%d) cannot be negative", opts.Offset, opts.Limit)
+	}
+	empty := func() (uint64, int, error, bpt_iterator) {
+		return 0, 0, nil, nil
+	}
+	if opts.From != nil && opts.To != nil {
+		c := self.cmp(opts.From, opts.To)
+		if c > 0 || (c == 0 && (opts.ExcludeFrom || opts.ExcludeTo)) {
+			return empty, nil
+		}
+	}
+	first, last := opts.From, opts.To
+	excludeFirst, excludeLast := opts.ExcludeFrom, opts.ExcludeTo
+	walk := self.forward
+	if opts.Reverse {
+		first, last = last, first
+		excludeFirst, excludeLast = excludeLast, excludeFirst
+		walk = self.backward
+	}
+	bi, err := walk(first, last)
+	if err != nil {
+		return nil, err
+	}
+	bi = self.live(bi, first, func(key []byte) (bpt_iterator, error) {
+		return walk(key, last)
+	})
+	// an open end has nothing to exclude
+	started := !excludeFirst || first == nil
+	excludeLast = excludeLast && last != nil
+	skip := opts.Offset
+	taken := 0
+	var next bpt_iterator
+	next = func() (uint64, int, error, bpt_iterator) {
+		for {
+			if opts.Limit > 0 && taken >= opts.Limit {
+				return 0, 0, nil, nil
+			}
+			var a uint64
+			var i int
+			var err error
+			a, i, err, bi = bi()
+			if err != nil {
+				return 0, 0, err, nil
+			}
+			if bi == nil {
+				return 0, 0, nil, nil
+			}
+			if !started || excludeLast {
+				var atFirst, atLast bool
+				err = self.doKey(a, i, func(k []byte) error {
+					atFirst = !started && self.cmp(k, first) == 0
+					atLast = excludeLast && self.cmp(k, last) == 0
+					return nil
+				})
+				if err != nil {
+					return 0, 0, err, nil
+				}
+				if atFirst {
+					continue
+				}
+				started = true
+				if atLast {
+					return 0, 0, nil, nil
+				}
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			taken++
+			return a, i, nil, next
+		}
+	}
+	return next, nil
+}
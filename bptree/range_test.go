@@ -0,0 +1,169 @@
+package bptree
+
+import "testing"
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+)
+
+// The pairs of all (in the order of the tree) chosen by opts.
+func rangeModel(cmp Comparator, all KVS, opts RangeOptions) KVS {
+	in := make(KVS, 0, len(all))
+	for _, kv := range all {
+		if opts.From != nil {
+			c := cmp(kv.key, opts.From)
+			if c < 0 || (c == 0 && opts.ExcludeFrom) {
+				continue
+			}
+		}
+		if opts.To != nil {
+			c := cmp(kv.key, opts.To)
+			if c > 0 || (c == 0 && opts.ExcludeTo) {
+				continue
+			}
+		}
+		in = append(in, kv)
+	}
+	if opts.Reverse {
+		for i, j := 0, len(in)-1; i < j; i, j = i+1, j-1 {
+			in[i], in[j] = in[j], in[i]
+		}
+	}
+	if opts.Offset >= len(in) {
+		return KVS{}
+	}
+	in = in[opts.Offset:]
+	if opts.Limit > 0 && opts.Limit < len(in) {
+		in = in[:opts.Limit]
+	}
+	return in
+}
+
+func (t *T) assert_rangeWith(bpt *BpTree, all KVS, opts RangeOptions) {
+	expected := rangeModel(bpt.cmp, all, opts)
+	i := 0
+	t.assert_nil(bpt.DoRangeWith(opts, func(k, v []byte) error {
+		t.assert(fmt.Sprintf("pair %d of %+v", i, opts),
+			i < len(expected) && bytes.Equal(k, expected[i].key) && bytes.Equal(v, expected[i].value))
+		i++
+		return nil
+	}))
+	t.assert(fmt.Sprintf("got %v pairs expected %v for %+v", i, len(expected), opts), i == len(expected))
+	i = 0
+	t.assert_nil(bpt.DoValuesWith(opts, func(v []byte) error {
+		t.assert(fmt.Sprintf("value %d of %+v", i, opts), i < len(expected) && bytes.Equal(v, expected[i].value))
+		i++
+		return nil
+	}))
+	t.assert(fmt.Sprintf("got %v values expected %v", i, len(expected)), i == len(expected))
+
+	// the keys are counted by Offset and Limit
+	keyOpts := opts
+	keyOpts.Offset, keyOpts.Limit = 0, 0
+	keys := make([][]byte, 0, len(all))
+	for _, kv := range rangeModel(bpt.cmp, all, keyOpts) {
+		if len(keys) == 0 || !bytes.Equal(keys[len(keys)-1], kv.key) {
+			keys = append(keys, kv.key)
+		}
+	}
+	if opts.Offset < len(keys) {
+		keys = keys[opts.Offset:]
+	} else {
+		keys = keys[:0]
+	}
+	if opts.Limit > 0 && opts.Limit < len(keys) {
+		keys = keys[:opts.Limit]
+	}
+	i = 0
+	t.assert_nil(bpt.DoKeysWith(opts, func(k []byte) error {
+		t.assert(fmt.Sprintf("key %d of %+v", i, opts), i < len(keys) && bytes.Equal(k, keys[i]))
+		i++
+		return nil
+	}))
+	t.assert(fmt.Sprintf("got %v keys expected %v", i, len(keys)), i == len(keys))
+}
+
+func (t *T) testRangeWith(bpt *BpTree, kvs KVS) {
+	for _, i := range rand.Perm(len(kvs)) {
+		t.assert_nil(bpt.Add(kvs[i].key, kvs[i].value))
+	}
+	// the order of the values of a key is the tree's, take it from there
+	all := make(KVS, 0, len(kvs))
+	t.assert_nil(bpt.DoIterate(func(k, v []byte) error {
+		all = append(all, &KV{key: k, value: v})
+		return nil
+	}))
+	t.assert("size", len(all) == len(kvs))
+	bound := func() []byte {
+		switch rand.Intn(5) {
+		case 0:
+			return nil
+		case 1:
+			// most likely not in the tree
+			return t.rand_key()
+		default:
+			return all[rand.Intn(len(all))].key
+		}
+	}
+	for n := 0; n < 300; n++ {
+		opts := RangeOptions{
+			From:        bound(),
+			To:          bound(),
+			ExcludeFrom: rand.Intn(2) == 0,
+			ExcludeTo:   rand.Intn(2) == 0,
+			Reverse:     rand.Intn(2) == 0,
+		}
+		if rand.Intn(2) == 0 {
+			opts.Offset = rand.Intn(700)
+		}
+		if rand.Intn(2) == 0 {
+			opts.Limit = 1 + rand.Intn(700)
+		}
+		if opts.From != nil && opts.To != nil && bpt.cmp(opts.From, opts.To) > 0 && rand.Intn(4) != 0 {
+			opts.From, opts.To = opts.To, opts.From
+		}
+		t.assert_rangeWith(bpt, all, opts)
+	}
+	// the bounds sit on a long run of duplicates
+	run := all[len(all)/2].key
+	for _, key := range []*KV{all[0], all[len(all)-1], {key: run}} {
+		for _, ex := range []bool{false, true} {
+			for _, rev := range []bool{false, true} {
+				t.assert_rangeWith(bpt, all, RangeOptions{From: key.key, ExcludeFrom: ex, Reverse: rev})
+				t.assert_rangeWith(bpt, all, RangeOptions{To: key.key, ExcludeTo: ex, Reverse: rev})
+				t.assert_rangeWith(bpt, all, RangeOptions{From: key.key, To: key.key, ExcludeTo: ex, Reverse: rev})
+			}
+		}
+	}
+	_, err := bpt.RangeWith(RangeOptions{Limit: -1})
+	t.assert("negative limit", err != nil)
+	_, err = bpt.KeysWith(RangeOptions{Offset: -1})
+	t.assert("negative offset", err != nil)
+}
+
+func TestRangeWithFixed(x *testing.T) {
+	t := (*T)(x)
+	bpt, clean := t.bptFixed()
+	defer clean()
+	t.testRangeWith(bpt, t.bulkKVS(3000, t.rand_key, func() []byte { return t.rand_value(8) }))
+}
+
+func TestRangeWithVarchar(x *testing.T) {
+	t := (*T)(x)
+	bpt, clean := t.bpt()
+	defer clean()
+	t.testRangeWith(bpt, t.bulkKVS(3000,
+		func() []byte { return t.rand_varchar(1, 30) },
+		func() []byte { return t.rand_varchar(1, 60) }))
+}
+
+func TestRangeWithComparator(x *testing.T) {
+	t := (*T)(x)
+	bf, clean := t.blkfile()
+	defer clean()
+	bpt, err := New(bf, 8, 8, CompareWith("reverse"))
+	t.assert_nil(err)
+	t.testRangeWith(bpt, t.bulkKVS(3000, t.rand_key, func() []byte { return t.rand_value(8) }))
+}
@@ -22,6 +22,15 @@ import (
 // 	}
 //
 func (self *BpTree) Remove(key []byte, where func([]byte) bool) (err error) {
+	self.lock()
+	defer self.unlock()
+	return self._remove(key, where)
+}
+
+func (self *BpTree) _remove(key []byte, where func([]byte) bool) (err error) {
+	if self.bf.ReadOnly() {
+		return errors.Errorf("Cannot remove from a tree in a read only file")
+	}
 	cntDelta, root, err := self.remove(self.meta.root, key, where)
 	if err != nil {
 		return err
@@ -32,7 +41,14 @@ func (self *BpTree) Remove(key []byte, where func([]byte) bool) (err error) {
 }
 
 func (self *BpTree) remove(root uint64, key []byte, where func([]byte) bool) (cntDelta, newRoot uint64, err error) {
-	newRoot, err = self.delete(0, root, 0, key, where)
+	counted := func(value []byte) bool {
+		if where(value) {
+			cntDelta++
+			return true
+		}
+		return false
+	}
+	newRoot, err = self.delete(0, root, 0, key, counted)
 	if err != nil {
 		return 0, 0, err
 	}
@@ -42,12 +58,12 @@ func (self *BpTree) remove(root uint64, key []byte, where func([]byte) bool) (cn
 			return 0, 0, err
 		}
 	}
-	return 1, newRoot, nil
+	return cntDelta, newRoot, nil
 }
 
 func (self *BpTree) delete(parent, n, sibling uint64, key []byte, where func([]byte) bool) (a uint64, err error) {
 	var flags consts.Flag
-	err = self.bf.Do(n, 1, func(bytes []byte) error {
+	err = self.doBlock(n, func(bytes []byte) error {
 		flags = consts.AsFlag(bytes)
 		return nil
 	})
@@ -69,7 +85,7 @@ func (self *BpTree) internalDelete(parent, n, sibling uint64, key []byte, where
 	var kid uint64
 	err = self.doInternal(n, func(n *internal) (err error) {
 		var has bool
-		i, has, err = find(self.varchar, n, key)
+		i, has, err = find(self.varchar, self.cmp, n, key)
 		if err != nil {
 			return err
 		}
@@ -92,8 +108,16 @@ func (self *BpTree) internalDelete(parent, n, sibling uint64, key []byte, where
 	if err != nil {
 		return 0, err
 	}
+	var removed uint64
+	counted := func(value []byte) bool {
+		if where(value) {
+			removed++
+			return true
+		}
+		return false
+	}
 	okid := kid
-	kid, err = self.delete(n, kid, sibling, key, where)
+	kid, err = self.delete(n, kid, sibling, key, counted)
 	if err != nil {
 		self.doInternal(n, func(n *internal) (err error) {
 			log.Println(n.Debug(self.varchar))
@@ -106,7 +130,7 @@ func (self *BpTree) internalDelete(parent, n, sibling uint64, key []byte, where
 	}
 	if kid == 0 {
 		err = self.doInternal(n, func(n *internal) error {
-			return n.delItemAt(self.varchar, i)
+			return n.delItemAt(self.varchar, self.cmp, i)
 		})
 		if err != nil {
 			return 0, err
@@ -114,8 +138,11 @@ func (self *BpTree) internalDelete(parent, n, sibling uint64, key []byte, where
 	} else {
 		err = self.doInternal(n, func(n *internal) error {
 			*n.ptr(i) = kid
+			if n.counted() {
+				*n.count(i) -= removed
+			}
 			return self.firstKey(kid, func(kid_key []byte) error {
-				return n.updateK(self.varchar, i, kid_key)
+				return n.updateK(self.varchar, self.cmp, i, kid_key)
 			})
 		})
 		if err != nil {
@@ -138,7 +165,7 @@ func (self *BpTree) internalDelete(parent, n, sibling uint64, key []byte, where
 		return 0, err
 	}
 	if keyCount == 0 {
-		return 0, nil
+		return 0, self.bf.Free(n)
 	}
 	return n, nil
 }
@@ -150,7 +177,7 @@ func (self *BpTree) leafDelete(parent, n, sibling uint64, key []byte, where func
 	var i int
 	var has bool
 	err = self.doLeaf(a, func(n *leaf) error {
-		i, has, err = find(self.varchar, n, key)
+		i, has, err = find(self.varchar, self.cmp, n, key)
 		return err
 	})
 	if err != nil {
@@ -207,7 +234,7 @@ func (self *BpTree) leafDelete(parent, n, sibling uint64, key []byte, where func
 	for x := len(locs) - 1; x >= 0; x-- {
 		a := locs[x].a
 		i := locs[x].i
-		var vi uint64
+		var ki, vi uint64
 		var remove bool = false
 		err = self.doLeaf(a, func(n *leaf) error {
 			err = n.doValueAt(self.varchar, i, func(value []byte) error {
@@ -218,11 +245,15 @@ func (self *BpTree) leafDelete(parent, n, sibling uint64, key []byte, where func
 				return err
 			}
 			if remove {
+				if self.meta.flags&consts.VARCHAR_KEYS != 0 {
+					k := n.key(i)
+					ki = *slice.AsUint64(&k)
+				}
 				if self.meta.flags&consts.VARCHAR_VALS != 0 {
 					v := n.val(i)
 					vi = *slice.AsUint64(&v)
 				}
-				err = n.delItemAt(self.varchar, i)
+				err = n.delItemAt(self.varchar, self.cmp, i)
 				if err != nil {
 					return err
 				}
@@ -252,6 +283,12 @@ func (self *BpTree) leafDelete(parent, n, sibling uint64, key []byte, where func
 		if err != nil {
 			return 0, err
 		}
+		if remove && ki != 0 {
+			err = self.varchar.Deref(ki)
+			if err != nil {
+				return 0, err
+			}
+		}
 		if remove && vi != 0 && self.meta.flags&consts.VARCHAR_VALS != 0 {
 			err = self.varchar.Deref(vi)
 			if err != nil {
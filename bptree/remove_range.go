@@ -0,0 +1,428 @@
+package bptree
+
+import (
+	"github.com/timtadh/fs2/consts"
+	"github.com/timtadh/fs2/errors"
+	"github.com/timtadh/fs2/fmap"
+	"github.com/timtadh/fs2/slice"
+)
+
+// Remove the key/value pairs with keys between [from, to] inclusive (nil
+// is the start or end of the tree, as for Range) for which `where`
+// returns true. A nil `where` removes every pair in the range. Unlike
+// calling Remove for each key the tree is only descended once: each
+// leaf is compacted in one pass, emptied leaves (and internal nodes) are
+// freed and the internal nodes over the range are repaired on the way
+// back up, merging the children left underfull, and a root left with a
+// single child is replaced by it. To expire everything before a
+// timestamp:
+//
+//	err = bpt.RemoveRange(nil, cutoff, nil)
+//	if err != nil {
+//		panic(err)
+//	}
+//
+// The key and value given to `where` are only valid during the call.
+func (self *BpTree) RemoveRange(from, to []byte, where func(key, value []byte) bool) (err error) {
+	self.lock()
+	defer self.unlock()
+	return self._removeRange(from, to, where)
+}
+
+func (self *BpTree) _removeRange(from, to []byte, where func(key, value []byte) bool) (err error) {
+	if self.bf.ReadOnly() {
+		return errors.Errorf("Cannot remove from a tree in a read only file")
+	}
+	if from != nil && to != nil && self.cmp(from, to) > 0 {
+		from, to = to, from
+	}
+	root, removed, err := self.rangeDelete(self.meta.root, 0, from, to, where)
+	if err != nil {
+		return err
+	}
+	if root == 0 {
+		root, err = self.newLeaf()
+		if err != nil {
+			return err
+		}
+	}
+	root, err = self.collapseRoot(root)
+	if err != nil {
+		return err
+	}
+	self.meta.itemCount -= removed
+	self.meta.root = root
+	return self.writeMeta()
+}
+
+// Remove every pair with a key between [from, to] inclusive. This is
+// RemoveRange(from, to, nil).
+func (self *BpTree) DeleteRange(from, to []byte) error {
+	return self.RemoveRange(from, to, nil)
+}
+
+// Remove the pairs in the range from the subtree at n. Returns the new
+// address of the subtree (0 if it is now empty) and how many pairs were
+// removed. The sibling is the next node at the same level (see delete).
+func (self *BpTree) rangeDelete(n, sibling uint64, from, to []byte, where func(key, value []byte) bool) (a, removed uint64, err error) {
+	var flags consts.Flag
+	err = self.doBlock(n, func(bytes []byte) error {
+		flags = consts.AsFlag(bytes)
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if flags&consts.INTERNAL != 0 {
+		return self.internalRangeDelete(n, sibling, from, to, where)
+	} else if flags&consts.LEAF != 0 {
+		return self.leafRangeDelete(n, sibling, from, to, where)
+	} else {
+		return 0, 0, errors.Errorf("Unknown block type")
+	}
+}
+
+func (self *BpTree) internalRangeDelete(n, sibling uint64, from, to []byte, where func(key, value []byte) bool) (a, removed uint64, err error) {
+	// the children which may hold keys in the range and their siblings
+	var kids, siblings []uint64
+	var first int
+	err = self.doInternal(n, func(n *internal) error {
+		last := int(n.meta.keyCount) - 1
+		if from != nil {
+			i, has, err := find(self.varchar, self.cmp, n, from)
+			if err != nil {
+				return err
+			}
+			if !has && i > 0 {
+				i--
+			}
+			first = i
+		}
+		if to != nil {
+			i, has, err := find(self.varchar, self.cmp, n, to)
+			if err != nil {
+				return err
+			}
+			if !has {
+				// the keys of child i (and after) are all past to
+				i--
+			}
+			last = i
+		}
+		for i := first; i <= last; i++ {
+			kids = append(kids, *n.ptr(i))
+			if i+1 < int(n.meta.keyCount) {
+				siblings = append(siblings, *n.ptr(i + 1))
+			} else if sibling != 0 {
+				err := self.doInternal(sibling, func(m *internal) error {
+					siblings = append(siblings, *m.ptr(0))
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			} else {
+				siblings = append(siblings, 0)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(kids) == 0 {
+		return n, 0, nil
+	}
+	// The children are done first to last so the sibling each one stops
+	// at has not been touched yet.
+	counts := make([]uint64, len(kids))
+	for i, kid := range kids {
+		kids[i], counts[i], err = self.rangeDelete(kid, siblings[i], from, to, where)
+		if err != nil {
+			return 0, 0, err
+		}
+		removed += counts[i]
+	}
+	var keyCount int
+	err = self.doInternal(n, func(n *internal) error {
+		// last to first so deleting an item does not move the others
+		for j := len(kids) - 1; j >= 0; j-- {
+			i := first + j
+			if kids[j] == 0 {
+				err := n.delItemAt(self.varchar, self.cmp, i)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			*n.ptr(i) = kids[j]
+			if n.counted() {
+				*n.count(i) -= counts[j]
+			}
+			err := self.firstKey(kids[j], func(key []byte) error {
+				return n.updateK(self.varchar, self.cmp, i, key)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		keyCount = int(n.meta.keyCount)
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if keyCount == 0 {
+		return 0, removed, self.bf.Free(n)
+	}
+	// the children left (and their neighbours either side)
+	left := 0
+	for _, kid := range kids {
+		if kid != 0 {
+			left++
+		}
+	}
+	lo, hi := first-1, first+left
+	if lo < 0 {
+		lo = 0
+	}
+	if hi > keyCount-1 {
+		hi = keyCount - 1
+	}
+	err = self.mergeKids(n, lo, hi)
+	if err != nil {
+		return 0, 0, err
+	}
+	return n, removed, nil
+}
+
+// Merge the children of the internal node n from lo to hi (inclusive)
+// into the child before them where one of the two is less than half full
+// and they fit together.
+func (self *BpTree) mergeKids(n uint64, lo, hi int) error {
+	for i := lo; i < hi; {
+		var a, b uint64
+		err := self.doInternal(n, func(n *internal) error {
+			a, b = *n.ptr(i), *n.ptr(i + 1)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		merged, err := self.merge(a, b)
+		if err != nil {
+			return err
+		} else if !merged {
+			i++
+			continue
+		}
+		err = self.doInternal(n, func(n *internal) error {
+			if n.counted() {
+				*n.count(i) += *n.count(i + 1)
+			}
+			return n.delItemAt(self.varchar, self.cmp, i+1)
+		})
+		if err != nil {
+			return err
+		}
+		err = self.bf.Free(b)
+		if err != nil {
+			return err
+		}
+		hi--
+	}
+	return nil
+}
+
+// Move the items of the node b into the node before it, a, if either is
+// less than half full and they fit in a. Leaves in pure runs are left
+// as they are. Returns true if b is now empty (and unlinked from the
+// leaves), the caller frees it.
+func (self *BpTree) merge(a, b uint64) (merged bool, err error) {
+	var leaves bool
+	err = self.do(
+		a,
+		func(n *internal) error {
+			return self.doInternal(b, func(m *internal) error {
+				count := n.keyCount() + m.keyCount()
+				half := int(n.meta.keyCap) / 2
+				if (n.keyCount() >= half && m.keyCount() >= half) || count+1 >= int(n.meta.keyCap) {
+					return nil
+				}
+				for i := 0; i < m.keyCount(); i++ {
+					j := n.keyCount() + i
+					copy(n.key(j), m.key(i))
+					*n.ptr(j) = *m.ptr(i)
+					if n.counted() {
+						*n.count(j) = *m.count(i)
+					}
+				}
+				n.meta.keyCount = uint16(count)
+				merged = true
+				return nil
+			})
+		},
+		func(n *leaf) error {
+			if n.meta.next != b {
+				// a is the start of a pure run
+				return nil
+			}
+			return self.doLeaf(b, func(m *leaf) error {
+				if n.pure(self.varchar) || m.pure(self.varchar) {
+					return nil
+				}
+				count := n.keyCount() + m.keyCount()
+				half := int(n.meta.keyCap) / 2
+				if n.keyCount() >= half && m.keyCount() >= half {
+					return nil
+				}
+				plen, keyCap := 0, int(n.meta.keyCap)
+				if n.compressed() {
+					plen = commonPrefix(n.prefix(), m.prefix())
+					keyCap = leafCap(len(n.bytes), int(n.meta.keySize), int(n.meta.valSize), plen)
+				}
+				if count+1 >= keyCap {
+					return nil
+				}
+				if plen < int(n.meta.prefixLen) {
+					err := n.reprefix(n.prefix()[:plen])
+					if err != nil {
+						return err
+					}
+				}
+				for i := 0; i < m.keyCount(); i++ {
+					j := n.keyCount() + i
+					copy(n.key(j), m.fullKey(i)[plen:])
+					copy(n.val(j), m.val(i))
+				}
+				n.meta.keyCount = uint16(count)
+				m.meta.keyCount = 0
+				merged, leaves = true, true
+				return nil
+			})
+		},
+	)
+	if err != nil || !merged {
+		return false, err
+	} else if leaves {
+		err = self.delListNode(b)
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Replace a root with a single child with the child (until the root has
+// more than one).
+func (self *BpTree) collapseRoot(root uint64) (uint64, error) {
+	for {
+		var kid uint64
+		err := self.do(
+			root,
+			func(n *internal) error {
+				if n.keyCount() != 1 {
+					return nil
+				}
+				kid = *n.ptr(0)
+				return n.delItemAt(self.varchar, self.cmp, 0)
+			},
+			func(n *leaf) error { return nil },
+		)
+		if err != nil {
+			return 0, err
+		} else if kid == 0 {
+			return root, nil
+		}
+		err = self.bf.Free(root)
+		if err != nil {
+			return 0, err
+		}
+		root = kid
+	}
+}
+
+// Remove the pairs in the range from the leaf at n and the leaves which
+// continue its pure run (the leaves up to sibling). Returns the first of
+// those leaves which is not empty (0 if they all are).
+func (self *BpTree) leafRangeDelete(n, sibling uint64, from, to []byte, where func(key, value []byte) bool) (b, removed uint64, err error) {
+	done := false
+	for a := n; a != 0 && a != sibling && !done; {
+		var next uint64
+		var count int
+		// the varchar keys and values of the removed pairs
+		var refs []uint64
+		err = self.doLeaf(a, func(n *leaf) error {
+			next = n.meta.next
+			w := 0
+			for r := 0; r < int(n.meta.keyCount); r++ {
+				del := false
+				err := n.doKeyAt(self.varchar, r, func(k []byte) error {
+					if done || (from != nil && self.cmp(k, from) < 0) {
+						return nil
+					} else if to != nil && self.cmp(k, to) > 0 {
+						done = true
+						return nil
+					} else if where == nil {
+						del = true
+						return nil
+					}
+					return n.doValueAt(self.varchar, r, func(v []byte) error {
+						del = where(k, v)
+						return nil
+					})
+				})
+				if err != nil {
+					return err
+				}
+				if !del {
+					if w != r {
+						copy(n.key(w), n.key(r))
+						copy(n.val(w), n.val(r))
+					}
+					w++
+					continue
+				}
+				if n.meta.flags&consts.VARCHAR_KEYS != 0 {
+					k := n.key(r)
+					refs = append(refs, *slice.AsUint64(&k))
+				}
+				if n.meta.flags&consts.VARCHAR_VALS != 0 {
+					v := n.val(r)
+					refs = append(refs, *slice.AsUint64(&v))
+				}
+				removed++
+			}
+			for i := w; i < int(n.meta.keyCount); i++ {
+				fmap.MemClr(n.key(i))
+				fmap.MemClr(n.val(i))
+			}
+			n.meta.keyCount = uint16(w)
+			count = w
+			return nil
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, ref := range refs {
+			err = self.varchar.Deref(ref)
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+		if count == 0 {
+			err = self.delListNode(a)
+			if err != nil {
+				return 0, 0, err
+			}
+			err = self.bf.Free(a)
+			if err != nil {
+				return 0, 0, err
+			}
+		} else if b == 0 {
+			b = a
+		}
+		a = next
+	}
+	return b, removed, nil
+}
@@ -0,0 +1,132 @@
+package bptree
+
+import "testing"
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// The pairs of kvs which are not in [from, to] or for which where is
+// false.
+func keepOutside(kvs KVS, from, to []byte, where func(k, v []byte) bool) KVS {
+	kept := make(KVS, 0, len(kvs))
+	for _, kv := range kvs {
+		in := (from == nil || bytes.Compare(kv.key, from) >= 0) &&
+			(to == nil || bytes.Compare(kv.key, to) <= 0)
+		if in && (where == nil || where(kv.key, kv.value)) {
+			continue
+		}
+		kept = append(kept, kv)
+	}
+	return kept
+}
+
+func (t *T) testRemoveRange(bpt *BpTree, kvs KVS) {
+	for _, kv := range kvs {
+		t.assert_nil(bpt.Add(kv.key, kv.value))
+	}
+	t.assert_loaded(bpt, kvs)
+	// just the one key
+	key := kvs[len(kvs)/2].key
+	kvs = keepOutside(kvs, key, key, nil)
+	t.assert_nil(bpt.DeleteRange(key, key))
+	t.assert_loaded(bpt, kvs)
+	odd := func(k, v []byte) bool { return v[0]%2 == 1 }
+	ranges := []struct {
+		from, to []byte
+		where    func(k, v []byte) bool
+	}{
+		{kvs[len(kvs)/4].key, kvs[len(kvs)/2].key, nil},
+		// reversed
+		{kvs[len(kvs)-len(kvs)/8].key, kvs[len(kvs)-len(kvs)/4].key, nil},
+		{nil, kvs[len(kvs)/10].key, odd},
+		{kvs[len(kvs)/3].key, nil, odd},
+		{nil, kvs[len(kvs)/10].key, nil},
+	}
+	for _, r := range ranges {
+		from, to := r.from, r.to
+		if from != nil && to != nil && bytes.Compare(from, to) > 0 {
+			from, to = to, from
+		}
+		kvs = keepOutside(kvs, from, to, r.where)
+		t.assert_nil(bpt.RemoveRange(r.from, r.to, r.where))
+		t.assert_loaded(bpt, kvs)
+	}
+	t.assert_nil(bpt.DeleteRange(nil, nil))
+	t.assert_loaded(bpt, KVS{})
+	for _, kv := range kvs {
+		t.assert_nil(bpt.Add(kv.key, kv.value))
+	}
+	t.assert_loaded(bpt, kvs)
+}
+
+func TestRemoveRangeFixed(x *testing.T) {
+	t := (*T)(x)
+	bpt, clean := t.bptFixed()
+	defer clean()
+	t.testRemoveRange(bpt, t.bulkKVS(3000, t.rand_key, func() []byte { return t.rand_value(8) }))
+}
+
+func TestRemoveRangeVarchar(x *testing.T) {
+	t := (*T)(x)
+	bpt, clean := t.bpt()
+	defer clean()
+	t.testRemoveRange(bpt, t.bulkKVS(3000,
+		func() []byte { return t.rand_varchar(1, 30) },
+		func() []byte { return t.rand_varchar(1, 60) }))
+}
+
+func TestRemoveRangeMerges(x *testing.T) {
+	t := (*T)(x)
+	bpt, clean := t.bptFixed()
+	defer clean()
+	kvs := make(KVS, 0, 40000)
+	for i := 0; i < cap(kvs); i++ {
+		kvs = append(kvs, &KV{key: t.rand_key(), value: t.rand_value(8)})
+	}
+	sort.Sort(kvs)
+	for _, kv := range kvs {
+		t.assert_nil(bpt.Add(kv.key, kv.value))
+	}
+	leaves := func() (count, keyCap int) {
+		a, err := bpt.firstLeaf()
+		t.assert_nil(err)
+		for a != 0 {
+			t.assert_nil(bpt.doLeaf(a, func(n *leaf) error {
+				keyCap = int(n.meta.keyCap)
+				a = n.meta.next
+				return nil
+			}))
+			count++
+		}
+		return count, keyCap
+	}
+	keepEvery := func(n int) func(k, v []byte) bool {
+		keep := make(map[string]bool)
+		for i := 0; i < len(kvs); i += n {
+			keep[string(kvs[i].key)] = true
+		}
+		return func(k, v []byte) bool { return !keep[string(k)] }
+	}
+	// the leaves left a quarter full are merged
+	where := keepEvery(4)
+	kvs = keepOutside(kvs, nil, nil, where)
+	t.assert_nil(bpt.RemoveRange(nil, nil, where))
+	t.assert_loaded(bpt, kvs)
+	count, keyCap := leaves()
+	t.assert(fmt.Sprintf("%v leaves for %v pairs", count, len(kvs)), count <= 2*len(kvs)/(keyCap/2))
+	// and a root left with one child is replaced by it
+	where = keepEvery(50)
+	kvs = keepOutside(kvs, nil, nil, where)
+	t.assert_nil(bpt.RemoveRange(nil, nil, where))
+	t.assert_loaded(bpt, kvs)
+	count, _ = leaves()
+	t.assert(fmt.Sprintf("%v leaves for %v pairs", count, len(kvs)), count == 1)
+	t.assert_nil(bpt.do(
+		bpt.meta.root,
+		func(n *internal) error { return fmt.Errorf("the root should be the leaf") },
+		func(n *leaf) error { return nil },
+	))
+}
@@ -6,6 +6,10 @@ import (
 	"bytes"
 )
 
+import (
+	"github.com/timtadh/fs2/slice"
+)
+
 func (t *T) assert_has(bpt *BpTree) func(key []byte) {
 	return func(key []byte) {
 		// var err error = nil
@@ -44,7 +48,7 @@ func TestLeafRemove(x *testing.T) {
 				break
 			}
 			kvs = append(kvs, kv)
-			t.assert_nil(n.putKV(bpt.varchar, kv.key, kv.value))
+			t.assert_nil(n.putKV(bpt.varchar, bpt.cmp, kv.key, kv.value))
 			t.assert_nil(bpt.Add(kv.key, kv.value))
 			a, i, err := bpt.getStart(kv.key)
 			t.assert_nil(err)
@@ -52,7 +56,7 @@ func TestLeafRemove(x *testing.T) {
 			t.assert_nil(err)
 			t.assert("wrong key", t.key(kv.key) == t.key(k))
 			t.assert_nil(bpt.doLeaf(a, func(n *leaf) error {
-				t.assert_value(kv.value)(n.firstValue(bpt.varchar, kv.key))
+				t.assert_value(kv.value)(n.firstValue(bpt.varchar, bpt.cmp, kv.key))
 				return nil
 			}))
 		}
@@ -63,7 +67,7 @@ func TestLeafRemove(x *testing.T) {
 			t.assert_nil(err)
 			t.assert("wrong key", t.key(kv.key) == t.key(k))
 			t.assert_nil(bpt.doLeaf(a, func(n *leaf) error {
-				t.assert_value(kv.value)(n.firstValue(bpt.varchar, kv.key))
+				t.assert_value(kv.value)(n.firstValue(bpt.varchar, bpt.cmp, kv.key))
 				return nil
 			}))
 		}
@@ -80,7 +84,7 @@ func TestLeafRemove(x *testing.T) {
 			t.assert_nil(err)
 			t.assert_nil(bpt.doLeaf(a, func(n *leaf) error {
 				if t.key(kv.key) == t.key(k) {
-					t.assert_notValue(kv.value)(n.firstValue(bpt.varchar, kv.key))
+					t.assert_notValue(kv.value)(n.firstValue(bpt.varchar, bpt.cmp, kv.key))
 				}
 				return nil
 			}))
@@ -218,3 +222,37 @@ func TestAddRemoveRand(x *testing.T) {
 		clean()
 	}
 }
+
+func TestRemoveCountsAndRefs(x *testing.T) {
+	t := (*T)(x)
+	bpt, clean := t.bpt()
+	defer clean()
+	refs := func() (refs uint32) {
+		t.assert_nil(bpt.doLeaf(bpt.meta.root, func(n *leaf) error {
+			k := n.key(0)
+			return bpt.varchar.doRun(*slice.AsUint64(&k), func(m *varRunMeta) error {
+				refs = m.refs
+				return nil
+			})
+		}))
+		return refs
+	}
+	key := t.rand_varchar(1500, 2000)
+	for j := 0; j < 5; j++ {
+		t.assert_nil(bpt.Add(key, t.rand_varchar(1500, 2000)))
+	}
+	t.assert("each pair refs the key", refs() == 5)
+	t.assert_nil(bpt.Remove(key, func([]byte) bool { return false }))
+	t.assert("nothing removed", bpt.Size() == 5)
+	removed := 0
+	t.assert_nil(bpt.Remove(key, func([]byte) bool {
+		removed++
+		return removed%2 == 0
+	}))
+	t.assert("two removed", bpt.Size() == 3)
+	t.assert("the removed pairs deref the key", refs() == 3)
+	t.assert_nil(bpt.Remove(key, func([]byte) bool { return true }))
+	t.assert("all removed", bpt.Size() == 0)
+	t.assert_notHas(bpt)(key)
+	t.assert_nil(bpt.Verify())
+}
@@ -0,0 +1,112 @@
+package bptree
+
+import (
+	"math/rand"
+	"sort"
+)
+
+import (
+	"github.com/timtadh/fs2"
+	"github.com/timtadh/fs2/errors"
+)
+
+// A uniformly random key/value pair from the tree, every pair (including
+// each of the pairs of a duplicated key) is equally likely. The pair is
+// picked with Select so it takes O(log n), or O(log n + r/b) when it
+// lands in a run of r pairs of a duplicated key (see Select). The tree
+// must have been made with SubtreeCounts. The key and value are copies.
+func (self *BpTree) Sample(src rand.Source) (key, value []byte, err error) {
+	self.rlock()
+	defer self.runlock()
+	if err := self.checkCounted(); err != nil {
+		return nil, nil, err
+	}
+	if self.meta.itemCount == 0 {
+		return nil, nil, errors.Errorf("Cannot sample an empty tree")
+	}
+	i := rand.New(src).Int63n(int64(self.meta.itemCount))
+	return self.selectKV(uint64(i))
+}
+
+// Sample n distinct pairs (without replacement) uniformly from the pairs
+// with keys between [from, to] inclusive (nil is the start or end of the
+// tree, as for Range). If the range has n or fewer pairs they are all
+// returned. The sample is iterated in key order:
+//
+//	kvi, err := bpt.SampleRange(from, to, 100, rand.NewSource(seed))
+//	if err != nil {
+//		panic(err)
+//	}
+//	var key, value []byte
+//	for key, value, err, kvi = kvi(); kvi != nil; key, value, err, kvi = kvi() {
+//		// do something with the key and value
+//	}
+//	if err != nil {
+//		panic(err)
+//	}
+//
+// Each pair is found with Select so a sample from long runs of
+// duplicated keys costs up to O(n (log N + r/b)) (see Select). The pairs
+// are copied out of the tree before SampleRange returns. The tree must
+// have been made with SubtreeCounts.
+func (self *BpTree) SampleRange(from, to []byte, n int, src rand.Source) (kvi fs2.Iterator, err error) {
+	self.rlock()
+	defer self.runlock()
+	if err := self.checkCounted(); err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, errors.Errorf("Cannot take a sample of %d pairs", n)
+	}
+	start, end, err := self.rangeRanks(from, to)
+	if err != nil {
+		return nil, err
+	}
+	idxs := sampleIndices(rand.New(src), start, end, n)
+	keys := make([][]byte, 0, len(idxs))
+	values := make([][]byte, 0, len(idxs))
+	for _, i := range idxs {
+		key, value, err := self.selectKV(i)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		values = append(values, value)
+	}
+	var next fs2.Iterator
+	i := 0
+	next = func() ([]byte, []byte, error, fs2.Iterator) {
+		if i >= len(keys) {
+			return nil, nil, nil, nil
+		}
+		i++
+		return keys[i-1], values[i-1], nil, next
+	}
+	return next, nil
+}
+
+// Pick n distinct indices from [start, end) (all of them if there are
+// not more than n) in sorted order. Uses Floyd's algorithm so it only
+// does n draws however large the range is.
+func sampleIndices(r *rand.Rand, start, end uint64, n int) []uint64 {
+	size := end - start
+	if uint64(n) >= size {
+		idxs := make([]uint64, 0, size)
+		for i := start; i < end; i++ {
+			idxs = append(idxs, i)
+		}
+		return idxs
+	}
+	picked := make(map[uint64]bool, n)
+	idxs := make([]uint64, 0, n)
+	for j := size - uint64(n); j < size; j++ {
+		i := uint64(r.Int63n(int64(j + 1)))
+		if picked[i] {
+			i = j
+		}
+		picked[i] = true
+		idxs = append(idxs, start+i)
+	}
+	sort.Slice(idxs, func(a, b int) bool { return idxs[a] < idxs[b] })
+	return idxs
+}
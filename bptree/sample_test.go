@@ -0,0 +1,79 @@
+package bptree
+
+import "testing"
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+)
+
+func TestSampleDuplicates(x *testing.T) {
+	t := (*T)(x)
+	bf, clean := t.blkfile()
+	defer clean()
+	bpt, err := New(bf, 8, 8, SubtreeCounts())
+	t.assert_nil(err)
+	// a pure run holding most of the pairs and one lone key
+	run, lone := t.rand_key(), t.rand_key()
+	for i := 0; i < 1200; i++ {
+		t.assert_nil(bpt.Add(run, t.rand_value(8)))
+	}
+	t.assert_nil(bpt.Add(lone, t.rand_value(8)))
+	for i := 0; i < 799; i++ {
+		t.assert_nil(bpt.Add(t.rand_key(), t.rand_value(8)))
+	}
+	src := rand.NewSource(7)
+	var runs, lones int
+	const N = 20000
+	for i := 0; i < N; i++ {
+		key, _, err := bpt.Sample(src)
+		t.assert_nil(err)
+		if bytes.Equal(key, run) {
+			runs++
+		} else if bytes.Equal(key, lone) {
+			lones++
+		}
+	}
+	t.assert(fmt.Sprintf("the run was %v of the sample expected .6", float64(runs)/N), runs > N*57/100 && runs < N*63/100)
+	t.assert(fmt.Sprintf("the lone key was sampled %v times", lones), lones > 0 && lones < 30)
+}
+
+func TestSampleRange(x *testing.T) {
+	t := (*T)(x)
+	kvs := t.bulkKVS(5000, t.rand_key, func() []byte { return t.rand_value(8) })
+	bf, clean := t.blkfile()
+	defer clean()
+	bpt, err := BulkLoad(bf, 8, 8, kvsIterator(kvs), SubtreeCounts())
+	t.assert_nil(err)
+	src := rand.NewSource(11)
+	from, to := kvs[1000].key, kvs[3000].key
+	in := len(kvs) - len(keepOutside(kvs, from, to, nil))
+	for _, n := range []int{0, 1, 50, in, in + 10} {
+		kvi, err := bpt.SampleRange(from, to, n, src)
+		t.assert_nil(err)
+		seen := make(map[string]bool)
+		var prev []byte
+		var key, value []byte
+		for key, value, err, kvi = kvi(); kvi != nil; key, value, err, kvi = kvi() {
+			t.assert("in the range", bytes.Compare(from, key) <= 0 && bytes.Compare(key, to) <= 0)
+			t.assert("in order", prev == nil || bytes.Compare(prev, key) <= 0)
+			t.assert("distinct", !seen[string(key)+"|"+string(value)])
+			seen[string(key)+"|"+string(value)] = true
+			prev = key
+		}
+		t.assert_nil(err)
+		expected := n
+		if n > in {
+			expected = in
+		}
+		t.assert(fmt.Sprintf("sampled %v expected %v", len(seen), expected), len(seen) == expected)
+	}
+	_, err = bpt.SampleRange(nil, nil, -1, src)
+	t.assert("negative sample", err != nil)
+
+	empty, clean2 := t.bptFixed()
+	defer clean2()
+	_, _, err = empty.Sample(src)
+	t.assert("needs SubtreeCounts", err != nil)
+}
@@ -0,0 +1,108 @@
+//go:build go1.23
+
+package bptree
+
+import (
+	"iter"
+)
+
+import (
+	"github.com/timtadh/fs2"
+)
+
+// Range over all of the key/value pairs in the tree
+//
+//	pairs, errf := bpt.All()
+//	for key, value := range pairs {
+//		// do something with the key and value
+//	}
+//	if err := errf(); err != nil {
+//		// handle error
+//	}
+//
+// The func returned with the sequence gives the error which ended the
+// last loop over it (see fs2.Seq). As with Iterate the keys and values
+// are copies and may escape the loop.
+func (self *BpTree) All() (iter.Seq2[[]byte, []byte], func() error) {
+	return fs2.Seq(self.Iterate)
+}
+
+// Range over all of the key/value pairs in reverse. See All() for usage
+// details.
+func (self *BpTree) BackwardSeq() (iter.Seq2[[]byte, []byte], func() error) {
+	return fs2.Seq(self.Backward)
+}
+
+// Range over all of the key/value pairs between [from, to] inclusive.
+// See Range() for the order and All() for usage details.
+func (self *BpTree) RangeSeq(from, to []byte) (iter.Seq2[[]byte, []byte], func() error) {
+	return fs2.Seq(func() (fs2.Iterator, error) { return self.Range(from, to) })
+}
+
+// Range over all of the key/value pairs with the given key. See All()
+// for usage details.
+func (self *BpTree) FindSeq(key []byte) (iter.Seq2[[]byte, []byte], func() error) {
+	return fs2.Seq(func() (fs2.Iterator, error) { return self.Find(key) })
+}
+
+// Range over all of the key/value pairs whose keys start with prefix.
+// See PrefixScan() and All() for usage details.
+func (self *BpTree) PrefixSeq(prefix []byte) (iter.Seq2[[]byte, []byte], func() error) {
+	return fs2.Seq(func() (fs2.Iterator, error) { return self.PrefixScan(prefix) })
+}
+
+// Range over all of the keys in the tree. See All() for usage details.
+func (self *BpTree) KeySeq() (iter.Seq[[]byte], func() error) {
+	return fs2.ItemSeq(self.Keys)
+}
+
+// Range over all of the values in the tree. See All() for usage
+// details.
+func (self *BpTree) ValueSeq() (iter.Seq[[]byte], func() error) {
+	return fs2.ItemSeq(self.Values)
+}
+
+// See BpTree.All.
+func (s *Snapshot) All() (iter.Seq2[[]byte, []byte], func() error) {
+	return fs2.Seq(s.Iterate)
+}
+
+// See BpTree.BackwardSeq.
+func (s *Snapshot) BackwardSeq() (iter.Seq2[[]byte, []byte], func() error) {
+	return fs2.Seq(s.Backward)
+}
+
+// See BpTree.RangeSeq.
+func (s *Snapshot) RangeSeq(from, to []byte) (iter.Seq2[[]byte, []byte], func() error) {
+	return fs2.Seq(func() (fs2.Iterator, error) { return s.Range(from, to) })
+}
+
+// See BpTree.FindSeq.
+func (s *Snapshot) FindSeq(key []byte) (iter.Seq2[[]byte, []byte], func() error) {
+	return fs2.Seq(func() (fs2.Iterator, error) { return s.Find(key) })
+}
+
+// See BpTree.PrefixSeq.
+func (s *Snapshot) PrefixSeq(prefix []byte) (iter.Seq2[[]byte, []byte], func() error) {
+	return fs2.Seq(func() (fs2.Iterator, error) { return s.PrefixScan(prefix) })
+}
+
+// Range over the pairs of the transaction's tree. See BpTree.All.
+func (tx *Tx) All() (iter.Seq2[[]byte, []byte], func() error) {
+	return fs2.Seq(tx.Iterate)
+}
+
+// See BpTree.RangeSeq.
+func (tx *Tx) RangeSeq(from, to []byte) (iter.Seq2[[]byte, []byte], func() error) {
+	return fs2.Seq(func() (fs2.Iterator, error) { return tx.Range(from, to) })
+}
+
+// See BpTree.FindSeq.
+func (tx *Tx) FindSeq(key []byte) (iter.Seq2[[]byte, []byte], func() error) {
+	return fs2.Seq(func() (fs2.Iterator, error) { return tx.Find(key) })
+}
+
+// See BpTree.PrefixSeq.
+func (tx *Tx) PrefixSeq(prefix []byte) (iter.Seq2[[]byte, []byte], func() error) {
+	return fs2.Seq(func() (fs2.Iterator, error) { return tx.PrefixScan(prefix) })
+}
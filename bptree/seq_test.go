@@ -0,0 +1,87 @@
+//go:build go1.23
+
+package bptree
+
+import "testing"
+
+import (
+	"bytes"
+	"fmt"
+)
+
+func TestSeq(x *testing.T) {
+	t := (*T)(x)
+	kvs := t.bulkKVS(2000, t.rand_key, func() []byte { return t.rand_value(8) })
+	bpt, clean := t.bptFixed()
+	defer clean()
+	for _, kv := range kvs {
+		t.assert_nil(bpt.Add(kv.key, kv.value))
+	}
+	// the keys in order, the values of a key in any order
+	expect := func(name string, pairs func(func([]byte, []byte) bool), err func() error, kvs KVS, reverse bool) {
+		left := make(map[string]int)
+		for _, kv := range kvs {
+			left[string(kv.key)+"|"+string(kv.value)]++
+		}
+		var prev []byte
+		i := 0
+		for k, v := range pairs {
+			t.assert(fmt.Sprintf("%v: %v out of order", name, i), prev == nil || (bytes.Compare(prev, k) <= 0) != reverse || bytes.Equal(prev, k))
+			t.assert(fmt.Sprintf("%v: %v was not expected", name, i), left[string(k)+"|"+string(v)] > 0)
+			left[string(k)+"|"+string(v)]--
+			prev = k
+			i++
+		}
+		t.assert_nil(err())
+		t.assert(fmt.Sprintf("%v: got %v expected %v", name, i, len(kvs)), i == len(kvs))
+	}
+	pairs, err := bpt.All()
+	expect("all", pairs, err, kvs, false)
+	pairs, err = bpt.BackwardSeq()
+	expect("backward", pairs, err, kvs, true)
+	from, to := kvs[300].key, kvs[1500].key
+	in := make(KVS, 0, len(kvs))
+	for _, kv := range kvs {
+		if bytes.Compare(from, kv.key) <= 0 && bytes.Compare(kv.key, to) <= 0 {
+			in = append(in, kv)
+		}
+	}
+	pairs, err = bpt.RangeSeq(from, to)
+	expect("range", pairs, err, in, false)
+	pairs, err = bpt.RangeSeq(to, from)
+	expect("reversed range", pairs, err, in, true)
+	key := kvs[len(kvs)/2].key
+	pairs, err = bpt.FindSeq(key)
+	expect("find", pairs, err, keepOutside(kvs, nil, nil, func(k, v []byte) bool { return !bytes.Equal(k, key) }), false)
+
+	// breaking out of the loop is not an error and the sequence can be
+	// ranged over again
+	pairs, err = bpt.All()
+	for i := 0; i < 2; i++ {
+		count := 0
+		for range pairs {
+			count++
+			if count == 10 {
+				break
+			}
+		}
+		t.assert_nil(err())
+		t.assert(fmt.Sprintf("stopped after %v", count), count == 10)
+	}
+	keys, err := bpt.KeySeq()
+	distinct := 0
+	for range keys {
+		distinct++
+	}
+	t.assert_nil(err())
+	t.assert(fmt.Sprintf("distinct keys %v", distinct), distinct > 0 && distinct < len(kvs))
+
+	tx, e := bpt.Begin()
+	t.assert_nil(e)
+	t.assert_nil(tx.Commit())
+	pairs, err = tx.All()
+	for range pairs {
+		t.assert("ranged over a committed transaction", false)
+	}
+	t.assert("the transaction is done", err() != nil)
+}
@@ -0,0 +1,219 @@
+package bptree
+
+import (
+	"context"
+	"math/rand"
+)
+
+import (
+	"github.com/timtadh/fs2"
+)
+
+// A read only view of a B+ Tree frozen at the moment Snapshot() was
+// called. The live tree may continue to be modified (and its leaves
+// split and merged) while the snapshot is in use, the snapshot (and any
+// iterators created from it) will continue to see the tree as it was.
+//
+// Snapshots are built on fmap.BlockFile.Snapshot which copies blocks
+// out of the live file the first time they are touched after the
+// snapshot is taken. So long running scans should use a snapshot and
+// Close() it promptly when done. The BlockFile cannot be closed while
+// there are open snapshots.
+type Snapshot struct {
+	bpt *BpTree
+}
+
+// Take a snapshot of the tree.
+func (self *BpTree) Snapshot() (*Snapshot, error) {
+	self.rlock()
+	defer self.runlock()
+	bf, err := self.bf.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	bpt, err := OpenAt(bf, self.metaOff)
+	if err != nil {
+		bf.Close()
+		return nil, err
+	}
+	return &Snapshot{bpt: bpt}, nil
+}
+
+// Release the snapshot. It cannot be used after this.
+func (s *Snapshot) Close() error {
+	return s.bpt.bf.Close()
+}
+
+// What is the key size of this tree? It is -1 if the keys are variable
+// length.
+func (s *Snapshot) KeySize() int {
+	return s.bpt.KeySize()
+}
+
+// How many items were in the tree?
+func (s *Snapshot) Size() int {
+	return s.bpt.Size()
+}
+
+// See BpTree.Has.
+func (s *Snapshot) Has(key []byte) (bool, error) {
+	return s.bpt.Has(key)
+}
+
+// See BpTree.Get.
+func (s *Snapshot) Get(key []byte) ([]byte, bool, error) {
+	return s.bpt.Get(key)
+}
+
+// See BpTree.Count.
+func (s *Snapshot) Count(key []byte) (int, error) {
+	return s.bpt.Count(key)
+}
+
+// See BpTree.CountRange.
+func (s *Snapshot) CountRange(from, to []byte) (int, error) {
+	return s.bpt.CountRange(from, to)
+}
+
+// See BpTree.Rank.
+func (s *Snapshot) Rank(key []byte) (int, error) {
+	return s.bpt.Rank(key)
+}
+
+// See BpTree.Select.
+func (s *Snapshot) Select(i int) ([]byte, []byte, error) {
+	return s.bpt.Select(i)
+}
+
+// See BpTree.Sample.
+func (s *Snapshot) Sample(src rand.Source) ([]byte, []byte, error) {
+	return s.bpt.Sample(src)
+}
+
+// See BpTree.SampleRange.
+func (s *Snapshot) SampleRange(from, to []byte, n int, src rand.Source) (fs2.Iterator, error) {
+	return s.bpt.SampleRange(from, to, n, src)
+}
+
+// See BpTree.Find.
+func (s *Snapshot) Find(key []byte) (fs2.Iterator, error) {
+	return s.bpt.Find(key)
+}
+
+// See BpTree.DoFind.
+func (s *Snapshot) DoFind(key []byte, do func(key, value []byte) error) error {
+	return s.bpt.DoFind(key, do)
+}
+
+// See BpTree.DoFindCtx.
+func (s *Snapshot) DoFindCtx(ctx context.Context, key []byte, do func(key, value []byte) error) error {
+	return s.bpt.DoFindCtx(ctx, key, do)
+}
+
+// See BpTree.Range.
+func (s *Snapshot) Range(from, to []byte) (fs2.Iterator, error) {
+	return s.bpt.Range(from, to)
+}
+
+// See BpTree.DoRange.
+func (s *Snapshot) DoRange(from, to []byte, do func(key, value []byte) error) error {
+	return s.bpt.DoRange(from, to, do)
+}
+
+// See BpTree.DoRangeCtx.
+func (s *Snapshot) DoRangeCtx(ctx context.Context, from, to []byte, do func(key, value []byte) error) error {
+	return s.bpt.DoRangeCtx(ctx, from, to, do)
+}
+
+// See BpTree.RangeWith.
+func (s *Snapshot) RangeWith(opts RangeOptions) (fs2.Iterator, error) {
+	return s.bpt.RangeWith(opts)
+}
+
+// See BpTree.DoRangeWith.
+func (s *Snapshot) DoRangeWith(opts RangeOptions, do func(key, value []byte) error) error {
+	return s.bpt.DoRangeWith(opts, do)
+}
+
+// See BpTree.PrefixScan.
+func (s *Snapshot) PrefixScan(prefix []byte) (fs2.Iterator, error) {
+	return s.bpt.PrefixScan(prefix)
+}
+
+// See BpTree.DoPrefix.
+func (s *Snapshot) DoPrefix(prefix []byte, do func(key, value []byte) error) error {
+	return s.bpt.DoPrefix(prefix, do)
+}
+
+// See BpTree.DoPrefixCtx.
+func (s *Snapshot) DoPrefixCtx(ctx context.Context, prefix []byte, do func(key, value []byte) error) error {
+	return s.bpt.DoPrefixCtx(ctx, prefix, do)
+}
+
+// See BpTree.Iterate.
+func (s *Snapshot) Iterate() (fs2.Iterator, error) {
+	return s.bpt.Iterate()
+}
+
+// See BpTree.DoIterate.
+func (s *Snapshot) DoIterate(do func(key, value []byte) error) error {
+	return s.bpt.DoIterate(do)
+}
+
+// See BpTree.DoIterateCtx.
+func (s *Snapshot) DoIterateCtx(ctx context.Context, do func(key, value []byte) error) error {
+	return s.bpt.DoIterateCtx(ctx, do)
+}
+
+// See BpTree.Backward.
+func (s *Snapshot) Backward() (fs2.Iterator, error) {
+	return s.bpt.Backward()
+}
+
+// See BpTree.DoBackward.
+func (s *Snapshot) DoBackward(do func(key, value []byte) error) error {
+	return s.bpt.DoBackward(do)
+}
+
+// See BpTree.DoBackwardCtx.
+func (s *Snapshot) DoBackwardCtx(ctx context.Context, do func(key, value []byte) error) error {
+	return s.bpt.DoBackwardCtx(ctx, do)
+}
+
+// See BpTree.Keys.
+func (s *Snapshot) Keys() (fs2.ItemIterator, error) {
+	return s.bpt.Keys()
+}
+
+// See BpTree.DoKeys.
+func (s *Snapshot) DoKeys(do func([]byte) error) error {
+	return s.bpt.DoKeys(do)
+}
+
+// See BpTree.DoKeysCtx.
+func (s *Snapshot) DoKeysCtx(ctx context.Context, do func([]byte) error) error {
+	return s.bpt.DoKeysCtx(ctx, do)
+}
+
+// See BpTree.Values.
+func (s *Snapshot) Values() (fs2.ItemIterator, error) {
+	return s.bpt.Values()
+}
+
+// See BpTree.DoValues.
+func (s *Snapshot) DoValues(do func([]byte) error) error {
+	return s.bpt.DoValues(do)
+}
+
+// See BpTree.DoValuesCtx.
+func (s *Snapshot) DoValuesCtx(ctx context.Context, do func([]byte) error) error {
+	return s.bpt.DoValuesCtx(ctx, do)
+}
+
+// See BpTree.Cursor. Delete and Update return errors as the snapshot
+// is read only.
+func (s *Snapshot) Cursor() *Cursor {
+	c := s.bpt.Cursor()
+	c.readOnly = true
+	return c
+}
@@ -0,0 +1,59 @@
+package bptree
+
+import "testing"
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+func TestSnapshot(x *testing.T) {
+	t := (*T)(x)
+	bpt, clean := t.bpt()
+	defer clean()
+	kvs := make(KVS, 0, 2000)
+	for i := 0; i < cap(kvs); i++ {
+		kv := t.make_kv()
+		kvs = append(kvs, kv)
+		t.assert_nil(bpt.Add(kv.key, kv.value))
+	}
+	sort.Stable(kvs)
+	snap, err := bpt.Snapshot()
+	t.assert_nil(err)
+	kvi, err := snap.Iterate()
+	t.assert_nil(err)
+	i := 0
+	var key, value []byte
+	for key, value, err, kvi = kvi(); kvi != nil; key, value, err, kvi = kvi() {
+		t.assert(fmt.Sprintf("key %v != %v", key, kvs[i].key), bytes.Equal(key, kvs[i].key))
+		if i%100 == 0 {
+			// churn the live tree underneath the iterator
+			for j := 0; j < 200; j++ {
+				kv := t.make_kv()
+				t.assert_nil(bpt.Add(kv.key, kv.value))
+			}
+			for _, kv := range kvs[i : i+50] {
+				t.assert_nil(bpt.Remove(kv.key, func(v []byte) bool { return true }))
+			}
+		}
+		_ = value
+		i++
+	}
+	t.assert_nil(err)
+	t.assert(fmt.Sprintf("saw %v expected %v", i, len(kvs)), i == len(kvs))
+	t.assert("snapshot size", snap.Size() == len(kvs))
+	for _, kv := range kvs {
+		t.assert_nil(snap.DoFind(kv.key, func(k, v []byte) error {
+			t.assert("found wrong key", bytes.Equal(k, kv.key))
+			return nil
+		}))
+		has, err := snap.Has(kv.key)
+		t.assert_nil(err)
+		t.assert("snapshot lost a key", has)
+	}
+	t.assert("the live file cannot be closed", bpt.bf.Close() != nil)
+	t.assert_nil(snap.Close())
+	t.assert_nil(bpt.Verify())
+	t.assert("live size", bpt.Size() != len(kvs))
+}
@@ -0,0 +1,375 @@
+package bptree
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+)
+
+import (
+	"github.com/timtadh/fs2"
+	"github.com/timtadh/fs2/errors"
+)
+
+// A transaction on a B+ Tree. Every change made through the transaction
+// either lands (Commit) or is undone (Rollback). It is implemented with
+// the journal in the underlying BlockFile: the pre-image of every block
+// written while the transaction is open is kept in memory so Rollback
+// can restore the root, the item count, the varchar store and the
+// allocator exactly as they were when Begin was called. Blocks which
+// are only read are not journaled.
+//
+// While a transaction is open it is the only writer to the tree: Add,
+// Remove and the other writes made directly on the BpTree wait for it
+// to be committed or rolled back (so the goroutine which holds the
+// transaction must make its changes through the Tx). Readers are not
+// held up, they see the changes made so far.
+//
+// The journal covers the whole BlockFile, so only one transaction may be
+// open per file and changes made to other structures in the same file
+// while a transaction is open are part of the transaction. If any
+// operation in the transaction returns an error the tree may be in a
+// partial state and the transaction should be rolled back.
+//
+// Transactions are about atomicity not durability. If the write ahead
+// log is enabled on the BlockFile, Commit checkpoints the file so the
+// transaction survives a crash (and a crash before Commit recovers to
+// the state before the transaction). Otherwise call Sync on the
+// BlockFile as usual.
+type Tx struct {
+	bpt  *BpTree
+	done bool
+}
+
+// Begin a transaction on the tree. If a transaction is already open
+// on the tree it waits for that one to end.
+func (self *BpTree) Begin() (*Tx, error) {
+	self.lock()
+	defer self.unlock()
+	if err := self.bf.BeginJournal(); err != nil {
+		return nil, err
+	}
+	if self.txEnded == nil {
+		self.txEnded = sync.NewCond(&self.latch)
+	}
+	self.tx = &Tx{bpt: self}
+	return self.tx, nil
+}
+
+// Reload the meta data (and the meta data of the varchar trees) from
+// the file. Needed after the blocks underneath the tree are rolled
+// back.
+func (self *BpTree) reload() error {
+	meta, err := loadBpTreeMeta(self.bf, self.metaOff)
+	if err != nil {
+		return err
+	}
+	self.meta = meta
+	self.mods++
+	if self.varchar != nil {
+		err = self.varchar.posTree.reload()
+		if err != nil {
+			return err
+		}
+		err = self.varchar.sizeTree.reload()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *Tx) check() error {
+	if tx.done {
+		return errors.Errorf("The transaction has already been committed or rolled back")
+	}
+	return nil
+}
+
+// Run a write in the transaction holding the tree's write latch.
+func (tx *Tx) write(do func() error) error {
+	if err := tx.check(); err != nil {
+		return err
+	}
+	tx.bpt.latch.Lock()
+	defer tx.bpt.latch.Unlock()
+	return do()
+}
+
+// End the transaction and let the waiting writers in. Must hold the
+// tree's write latch.
+func (tx *Tx) end() {
+	tx.done = true
+	tx.bpt.tx = nil
+	tx.bpt.txEnded.Broadcast()
+}
+
+// Keep all of the changes made in the transaction.
+func (tx *Tx) Commit() error {
+	if err := tx.check(); err != nil {
+		return err
+	}
+	tx.bpt.latch.Lock()
+	defer tx.bpt.latch.Unlock()
+	if err := tx.bpt.bf.CommitJournal(); err != nil {
+		return err
+	}
+	tx.end()
+	if tx.bpt.bf.Logged() {
+		return tx.bpt.bf.Sync()
+	}
+	return nil
+}
+
+// Undo all of the changes made in the transaction. All iterators
+// created in the transaction must be exhausted (or abandoned) first.
+func (tx *Tx) Rollback() error {
+	if err := tx.check(); err != nil {
+		return err
+	}
+	tx.bpt.latch.Lock()
+	defer tx.bpt.latch.Unlock()
+	if err := tx.bpt.bf.RollbackJournal(); err != nil {
+		return err
+	}
+	tx.end()
+	return tx.bpt.reload()
+}
+
+// Add a key/value pair to the tree. See BpTree.Add.
+func (tx *Tx) Add(key, value []byte) error {
+	return tx.write(func() error { return tx.bpt._add(key, value) })
+}
+
+// Add a batch of key/value pairs to the tree. See BpTree.AddBatch.
+func (tx *Tx) AddBatch(pairs []Pair) error {
+	return tx.write(func() error { return tx.bpt._addBatch(pairs) })
+}
+
+// See BpTree.WriteBatch.
+func (tx *Tx) WriteBatch(b *WriteBatch) error {
+	return tx.AddBatch(b.pairs)
+}
+
+// Remove key/value pairs from the tree. See BpTree.Remove.
+func (tx *Tx) Remove(key []byte, where func([]byte) bool) error {
+	return tx.write(func() error { return tx.bpt._remove(key, where) })
+}
+
+// Remove the key/value pairs in a range from the tree. See
+// BpTree.RemoveRange.
+func (tx *Tx) RemoveRange(from, to []byte, where func(key, value []byte) bool) error {
+	return tx.write(func() error { return tx.bpt._removeRange(from, to, where) })
+}
+
+// Update the values of key/value pairs in place. See BpTree.Update.
+func (tx *Tx) Update(key []byte, where func([]byte) bool, update func(old []byte) []byte) error {
+	return tx.write(func() error { return tx.bpt._update(key, where, update) })
+}
+
+// Put a key/value pair into a tree with unique keys. See BpTree.Put.
+func (tx *Tx) Put(key, value []byte) error {
+	return tx.write(func() error { return tx.bpt._put(key, value) })
+}
+
+// Put a key/value pair unless the key is there. See
+// BpTree.PutIfAbsent.
+func (tx *Tx) PutIfAbsent(key, value []byte) (bool, error) {
+	var added bool
+	err := tx.write(func() (err error) {
+		added, err = tx.bpt._putIfAbsent(key, value)
+		return err
+	})
+	return added, err
+}
+
+// Swap the value of a key. See BpTree.CompareAndSwap.
+func (tx *Tx) CompareAndSwap(key, old, new []byte) (bool, error) {
+	var swapped bool
+	err := tx.write(func() (err error) {
+		swapped, err = tx.bpt._compareAndSwap(key, old, new)
+		return err
+	})
+	return swapped, err
+}
+
+// Get the value of a key. See BpTree.Get.
+func (tx *Tx) Get(key []byte) ([]byte, bool, error) {
+	if err := tx.check(); err != nil {
+		return nil, false, err
+	}
+	return tx.bpt.Get(key)
+}
+
+// Does the tree have the key? Sees the changes made in the transaction.
+func (tx *Tx) Has(key []byte) (bool, error) {
+	if err := tx.check(); err != nil {
+		return false, err
+	}
+	return tx.bpt.Has(key)
+}
+
+// How many items with the key? See BpTree.Count.
+func (tx *Tx) Count(key []byte) (int, error) {
+	if err := tx.check(); err != nil {
+		return 0, err
+	}
+	return tx.bpt.Count(key)
+}
+
+// How many items with keys in the range? See BpTree.CountRange.
+func (tx *Tx) CountRange(from, to []byte) (int, error) {
+	if err := tx.check(); err != nil {
+		return 0, err
+	}
+	return tx.bpt.CountRange(from, to)
+}
+
+// How many items with keys less than the key? See BpTree.Rank.
+func (tx *Tx) Rank(key []byte) (int, error) {
+	if err := tx.check(); err != nil {
+		return 0, err
+	}
+	return tx.bpt.Rank(key)
+}
+
+// The i'th item in the tree. See BpTree.Select.
+func (tx *Tx) Select(i int) ([]byte, []byte, error) {
+	if err := tx.check(); err != nil {
+		return nil, nil, err
+	}
+	return tx.bpt.Select(i)
+}
+
+// A random item from the tree. See BpTree.Sample.
+func (tx *Tx) Sample(src rand.Source) ([]byte, []byte, error) {
+	if err := tx.check(); err != nil {
+		return nil, nil, err
+	}
+	return tx.bpt.Sample(src)
+}
+
+// Random items with keys in the range. See BpTree.SampleRange.
+func (tx *Tx) SampleRange(from, to []byte, n int, src rand.Source) (fs2.Iterator, error) {
+	if err := tx.check(); err != nil {
+		return nil, err
+	}
+	return tx.bpt.SampleRange(from, to, n, src)
+}
+
+// How many items are in the tree?
+func (tx *Tx) Size() int {
+	return tx.bpt.Size()
+}
+
+// Find all of the pairs with the key. See BpTree.Find.
+func (tx *Tx) Find(key []byte) (fs2.Iterator, error) {
+	if err := tx.check(); err != nil {
+		return nil, err
+	}
+	return tx.bpt.Find(key)
+}
+
+// See BpTree.DoFind.
+func (tx *Tx) DoFind(key []byte, do func(key, value []byte) error) error {
+	if err := tx.check(); err != nil {
+		return err
+	}
+	return tx.bpt.DoFind(key, do)
+}
+
+// See BpTree.DoFindCtx.
+func (tx *Tx) DoFindCtx(ctx context.Context, key []byte, do func(key, value []byte) error) error {
+	if err := tx.check(); err != nil {
+		return err
+	}
+	return tx.bpt.DoFindCtx(ctx, key, do)
+}
+
+// Iterate over a range of keys. See BpTree.Range.
+func (tx *Tx) Range(from, to []byte) (fs2.Iterator, error) {
+	if err := tx.check(); err != nil {
+		return nil, err
+	}
+	return tx.bpt.Range(from, to)
+}
+
+// See BpTree.DoRange.
+func (tx *Tx) DoRange(from, to []byte, do func(key, value []byte) error) error {
+	if err := tx.check(); err != nil {
+		return err
+	}
+	return tx.bpt.DoRange(from, to, do)
+}
+
+// See BpTree.DoRangeCtx.
+func (tx *Tx) DoRangeCtx(ctx context.Context, from, to []byte, do func(key, value []byte) error) error {
+	if err := tx.check(); err != nil {
+		return err
+	}
+	return tx.bpt.DoRangeCtx(ctx, from, to, do)
+}
+
+// See BpTree.RangeWith.
+func (tx *Tx) RangeWith(opts RangeOptions) (fs2.Iterator, error) {
+	if err := tx.check(); err != nil {
+		return nil, err
+	}
+	return tx.bpt.RangeWith(opts)
+}
+
+// See BpTree.DoRangeWith.
+func (tx *Tx) DoRangeWith(opts RangeOptions, do func(key, value []byte) error) error {
+	if err := tx.check(); err != nil {
+		return err
+	}
+	return tx.bpt.DoRangeWith(opts, do)
+}
+
+// Iterate over the keys with a prefix. See BpTree.PrefixScan.
+func (tx *Tx) PrefixScan(prefix []byte) (fs2.Iterator, error) {
+	if err := tx.check(); err != nil {
+		return nil, err
+	}
+	return tx.bpt.PrefixScan(prefix)
+}
+
+// See BpTree.DoPrefix.
+func (tx *Tx) DoPrefix(prefix []byte, do func(key, value []byte) error) error {
+	if err := tx.check(); err != nil {
+		return err
+	}
+	return tx.bpt.DoPrefix(prefix, do)
+}
+
+// See BpTree.DoPrefixCtx.
+func (tx *Tx) DoPrefixCtx(ctx context.Context, prefix []byte, do func(key, value []byte) error) error {
+	if err := tx.check(); err != nil {
+		return err
+	}
+	return tx.bpt.DoPrefixCtx(ctx, prefix, do)
+}
+
+// Iterate over every pair in the tree. See BpTree.Iterate.
+func (tx *Tx) Iterate() (fs2.Iterator, error) {
+	if err := tx.check(); err != nil {
+		return nil, err
+	}
+	return tx.bpt.Iterate()
+}
+
+// See BpTree.DoIterate.
+func (tx *Tx) DoIterate(do func(key, value []byte) error) error {
+	if err := tx.check(); err != nil {
+		return err
+	}
+	return tx.bpt.DoIterate(do)
+}
+
+// See BpTree.DoIterateCtx.
+func (tx *Tx) DoIterateCtx(ctx context.Context, do func(key, value []byte) error) error {
+	if err := tx.check(); err != nil {
+		return err
+	}
+	return tx.bpt.DoIterateCtx(ctx, do)
+}
@@ -0,0 +1,120 @@
+package bptree
+
+import "testing"
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+func TestTxRollback(x *testing.T) {
+	t := (*T)(x)
+	bpt, clean := t.bpt()
+	defer clean()
+	kvs := make([]*KV, 0, 500)
+	for i := 0; i < cap(kvs); i++ {
+		kv := t.make_kv()
+		kvs = append(kvs, kv)
+		t.assert_nil(bpt.Add(kv.key, kv.value))
+	}
+	size, err := bpt.bf.Size()
+	t.assert_nil(err)
+	tx, err := bpt.Begin()
+	t.assert_nil(err)
+	added := make([]*KV, 0, 5000)
+	for i := 0; i < cap(added); i++ {
+		kv := t.make_kv()
+		added = append(added, kv)
+		t.assert_nil(tx.Add(kv.key, kv.value))
+	}
+	for _, kv := range kvs[:250] {
+		t.assert_nil(tx.Remove(kv.key, func(v []byte) bool {
+			return bytes.Equal(v, kv.value)
+		}))
+	}
+	for _, kv := range added {
+		t.assert_hasKV(bpt)("added", kv.key, kv.value)
+	}
+	t.assert_nil(tx.Rollback())
+	t.assert("tx should be done", tx.Add(kvs[0].key, kvs[0].value) != nil)
+	t.assert_nil(bpt.Verify())
+	t.assert(fmt.Sprintf("size %v != %v", bpt.Size(), len(kvs)), bpt.Size() == len(kvs))
+	for i, kv := range kvs {
+		t.assert_hasKV(bpt)(fmt.Sprintf("idx %v", i), kv.key, kv.value)
+	}
+	for _, kv := range added {
+		t.assert_notHasKV(bpt)(kv.key, kv.value)
+	}
+	nsize, err := bpt.bf.Size()
+	t.assert_nil(err)
+	t.assert("file was not shrunk", nsize == size)
+}
+
+func TestTxCommit(x *testing.T) {
+	t := (*T)(x)
+	bpt, clean := t.bpt()
+	defer clean()
+	tx, err := bpt.Begin()
+	t.assert_nil(err)
+	other, err := New(bpt.bf, 8, 8)
+	t.assert_nil(err)
+	_, err = other.Begin()
+	t.assert("only one tx per file at a time", err != nil)
+	kvs := make([]*KV, 0, 500)
+	for i := 0; i < cap(kvs); i++ {
+		kv := t.make_kv()
+		kvs = append(kvs, kv)
+		t.assert_nil(tx.Add(kv.key, kv.value))
+	}
+	t.assert_nil(tx.Commit())
+	t.assert("tx should be done", tx.Rollback() != nil)
+	t.assert_nil(bpt.Verify())
+	t.assert("size", bpt.Size() == len(kvs))
+	for i, kv := range kvs {
+		t.assert_hasKV(bpt)(fmt.Sprintf("idx %v", i), kv.key, kv.value)
+	}
+	tx, err = bpt.Begin()
+	t.assert_nil(err)
+	t.assert_nil(tx.Rollback())
+	t.assert("size", bpt.Size() == len(kvs))
+}
+
+func TestTxBlocksWriters(x *testing.T) {
+	t := (*T)(x)
+	bpt, clean := t.bpt()
+	defer clean()
+	tx, err := bpt.Begin()
+	t.assert_nil(err)
+	inTx := t.make_kv()
+	t.assert_nil(tx.Add(inTx.key, inTx.value))
+	outside := t.make_kv()
+	added := make(chan error)
+	go func() {
+		added <- bpt.Add(outside.key, outside.value)
+	}()
+	began := make(chan error)
+	go func() {
+		tx, err := bpt.Begin()
+		if err == nil {
+			err = tx.Commit()
+		}
+		began <- err
+	}()
+	select {
+	case <-added:
+		t.Fatal("the add did not wait for the transaction")
+	case <-began:
+		t.Fatal("the second transaction did not wait for the first")
+	case <-time.After(50 * time.Millisecond):
+	}
+	// readers are not held up
+	t.assert_hasKV(bpt)("in the tx", inTx.key, inTx.value)
+	t.assert_nil(tx.Rollback())
+	t.assert_nil(<-added)
+	t.assert_nil(<-began)
+	t.assert_nil(bpt.Verify())
+	t.assert("size", bpt.Size() == 1)
+	t.assert_hasKV(bpt)("outside the tx", outside.key, outside.value)
+	t.assert_notHasKV(bpt)(inTx.key, inTx.value)
+}
@@ -0,0 +1,69 @@
+package bptree
+
+import (
+	"github.com/timtadh/fs2/errors"
+)
+
+// Update one or more key/value pairs at the given key in place. The
+// callback `where` is called with the value of each pair with the key
+// and, if it returns true, the value is replaced with what `update`
+// returns when given the old value. The pairs stay where they are in
+// the tree (no splits or merges) so it is much cheaper than a Remove
+// followed by an Add. To increment every counter stored at a key:
+//
+//	err = bpt.Update(key,
+//		func(value []byte) bool { return true },
+//		func(old []byte) []byte {
+//			c := binary.BigEndian.Uint64(old) + 1
+//			binary.BigEndian.PutUint64(old, c)
+//			return old
+//		})
+//	if err != nil {
+//		panic(err)
+//	}
+//
+// The values given to the callbacks are copies so update may modify and
+// return the old value. For a tree with fixed size values the new
+// value must be the same size.
+func (self *BpTree) Update(key []byte, where func([]byte) bool, update func(old []byte) []byte) (err error) {
+	self.lock()
+	defer self.unlock()
+	return self._update(key, where, update)
+}
+
+func (self *BpTree) _update(key []byte, where func([]byte) bool, update func(old []byte) []byte) (err error) {
+	if self.bf.ReadOnly() {
+		return errors.Errorf("Cannot update a tree in a read only file")
+	}
+	next, err := self.forward(key, key)
+	if err != nil {
+		return err
+	}
+	var a uint64
+	var i int
+	for a, i, err, next = next(); next != nil; a, i, err, next = next() {
+		var old []byte
+		err = self.doKV(a, i, func(k, v []byte) error {
+			old = make([]byte, len(v))
+			copy(old, v)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if !where(old) {
+			continue
+		}
+		value, err := self.checkValue(update(old))
+		if err != nil {
+			return err
+		}
+		err = self.doLeaf(a, func(n *leaf) error {
+			return n.updateValueAt(self.varchar, i, value)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return err
+}
@@ -0,0 +1,86 @@
+package bptree
+
+import "testing"
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+func counter(c uint64) []byte {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, c)
+	return v
+}
+
+func TestUpdateCounters(x *testing.T) {
+	t := (*T)(x)
+	bpt, clean := t.bptFixed()
+	defer clean()
+	// enough duplicates of one key to make a pure run
+	keys := [][]byte{t.rand_key(), t.rand_key(), t.rand_key()}
+	counts := []int{1, 20, 700}
+	for j, key := range keys {
+		for i := 0; i < counts[j]; i++ {
+			t.assert_nil(bpt.Add(key, counter(uint64(i))))
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		t.assert_nil(bpt.Add(t.rand_key(), counter(0)))
+	}
+	size := bpt.Size()
+	incr := func(old []byte) []byte {
+		binary.BigEndian.PutUint64(old, binary.BigEndian.Uint64(old)+1000)
+		return old
+	}
+	even := func(v []byte) bool { return binary.BigEndian.Uint64(v)%2 == 0 }
+	for _, key := range keys {
+		t.assert_nil(bpt.Update(key, even, incr))
+	}
+	t.assert_nil(bpt.Verify())
+	t.assert("same size", bpt.Size() == size)
+	for j, key := range keys {
+		seen := make(map[uint64]bool)
+		t.assert_nil(bpt.DoFind(key, func(k, v []byte) error {
+			c := binary.BigEndian.Uint64(v)
+			if c >= 1000 {
+				t.assert(fmt.Sprintf("%v should have been even", c), (c-1000)%2 == 0)
+				c -= 1000
+			} else {
+				t.assert(fmt.Sprintf("%v should be odd", c), c%2 == 1)
+			}
+			seen[c] = true
+			return nil
+		}))
+		t.assert("all of the counters", len(seen) == counts[j])
+	}
+	t.assert("wrong size", bpt.Update(keys[0], even, func(old []byte) []byte { return nil }) != nil)
+	// a key which is not there has nothing to update
+	t.assert_nil(bpt.Update(t.rand_key(), even, incr))
+}
+
+func TestUpdateVarchar(x *testing.T) {
+	t := (*T)(x)
+	bpt, clean := t.bpt()
+	defer clean()
+	key := t.rand_varchar(1, 30)
+	values := make(map[string]bool)
+	for i := 0; i < 300; i++ {
+		v := t.rand_varchar(1, 60)
+		values[string(v)] = true
+		t.assert_nil(bpt.Add(key, v))
+		t.assert_nil(bpt.Add(t.rand_varchar(1, 30), t.rand_varchar(1, 60)))
+	}
+	grow := func(old []byte) []byte { return append(old, old...) }
+	t.assert_nil(bpt.Update(key, func([]byte) bool { return true }, grow))
+	t.assert_nil(bpt.Verify())
+	n := 0
+	t.assert_nil(bpt.DoFind(key, func(k, v []byte) error {
+		half := v[:len(v)/2]
+		t.assert("doubled", bytes.Equal(half, v[len(v)/2:]) && values[string(half)])
+		n++
+		return nil
+	}))
+	t.assert("all updated", n == 300)
+}
@@ -3,9 +3,11 @@ package bptree
 import (
 	"encoding/binary"
 	"reflect"
+	"sync/atomic"
 )
 
 import (
+	"github.com/timtadh/fs2/checksum"
 	"github.com/timtadh/fs2/consts"
 	"github.com/timtadh/fs2/errors"
 	"github.com/timtadh/fs2/fmap"
@@ -13,11 +15,14 @@ import (
 )
 
 type Varchar struct {
-	bf       *fmap.BlockFile
-	posTree  *BpTree
-	sizeTree *BpTree
-	a        uint64
-	blkSize  int
+	bf        *fmap.BlockFile
+	posTree   *BpTree
+	sizeTree  *BpTree
+	a         uint64
+	blkSize   int
+	checksums bool
+	runs      checksum.Tracker
+	reading   *int32 // the readers of the tree which owns the varchar
 }
 
 type varCtrl struct {
@@ -85,8 +90,8 @@ func init() {
 	}
 }
 
-func (vc *varCtrl) Init(posTree, sizeTree uint64) {
-	vc.flags = consts.VARCHAR_CTRL
+func (vc *varCtrl) Init(flags consts.Flag, posTree, sizeTree uint64) {
+	vc.flags = consts.VARCHAR_CTRL | flags
 	vc.posTree = posTree
 	vc.sizeTree = sizeTree
 }
@@ -122,13 +127,15 @@ func makeSize(bsize []byte) int {
 // of an allocated block. The block becomes the control block for the
 // varchar file (storing the free list for the allocator). It is
 // important for the parent structure to track the location of this
-// control block.
-func NewVarchar(bf *fmap.BlockFile, a uint64) (v *Varchar, err error) {
+// control block. The only option which applies to a Varchar is
+// Checksums.
+func NewVarchar(bf *fmap.BlockFile, a uint64, opts ...Option) (v *Varchar, err error) {
+	flags := makeOptions(opts).flags & consts.CHECKSUMS
 	ptOff, err := bf.Allocate()
 	if err != nil {
 		return nil, err
 	}
-	posTree, err := NewAt(bf, ptOff, 8, 0)
+	posTree, err := NewAt(bf, ptOff, 8, 0, flagOptions(flags)...)
 	if err != nil {
 		return nil, err
 	}
@@ -136,20 +143,21 @@ func NewVarchar(bf *fmap.BlockFile, a uint64) (v *Varchar, err error) {
 	if err != nil {
 		return nil, err
 	}
-	sizeTree, err := NewAt(bf, szOff, 4, 8)
+	sizeTree, err := NewAt(bf, szOff, 4, 8, flagOptions(flags)...)
 	if err != nil {
 		return nil, err
 	}
 	v = &Varchar{
-		bf:       bf,
-		posTree:  posTree,
-		sizeTree: sizeTree,
-		a:        a,
-		blkSize:  bf.BlockSize(),
+		bf:        bf,
+		posTree:   posTree,
+		sizeTree:  sizeTree,
+		a:         a,
+		blkSize:   bf.BlockSize(),
+		checksums: flags&consts.CHECKSUMS != 0,
 	}
 	err = v.bf.Do(v.a, 1, func(bytes []byte) error {
 		ctrl := asCtrl(bytes)
-		ctrl.Init(ptOff, szOff)
+		ctrl.Init(flags, ptOff, szOff)
 		return nil
 	})
 	if err != nil {
@@ -172,6 +180,7 @@ func OpenVarchar(bf *fmap.BlockFile, a uint64) (v *Varchar, err error) {
 		}
 		ptOff = ctrl.posTree
 		szOff = ctrl.sizeTree
+		v.checksums = ctrl.flags&consts.CHECKSUMS != 0
 		return nil
 	})
 	if err != nil {
@@ -188,6 +197,11 @@ func OpenVarchar(bf *fmap.BlockFile, a uint64) (v *Varchar, err error) {
 	return v, nil
 }
 
+// Does the Varchar checksum its runs?
+func (v *Varchar) Checksums() bool {
+	return v.checksums
+}
+
 // Allocate a varchar of the desired length.
 func (v *Varchar) Alloc(length int) (a uint64, err error) {
 	if uint32(length) >= maxArraySize {
@@ -247,6 +261,9 @@ func (v *Varchar) allocNew(length, fullLength int) (a uint64, err error) {
 
 func (v *Varchar) allocAmt(length int) int {
 	fullLength := length + varRunMetaSize
+	if v.checksums {
+		fullLength += checksumSize
+	}
 	if fullLength < varFreeSize {
 		return varFreeSize
 	}
@@ -457,6 +474,32 @@ func (v *Varchar) indexRemove(length int, a uint64) error {
 // values of the bytes (and these changes will be persisted). However,
 // you cannot change the length of the varchar.
 func (v *Varchar) Do(a uint64, do func([]byte) error) (err error) {
+	return v.doRunBytes(a, func(bytes []byte) error {
+		flags := consts.AsFlag(bytes)
+		if flags&consts.VARCHAR_RUN == 0 {
+			return errors.Errorf("bad address, was not a run block")
+		}
+		r := asRun(bytes)
+		if !v.checksums {
+			return do(r.bytes[:r.meta.length])
+		}
+		if v.runs.Enter(a) {
+			if err := verifyRun(a, bytes); err != nil {
+				v.runs.Exit(a)
+				return err
+			}
+		}
+		err := do(r.bytes[:r.meta.length])
+		if v.runs.Exit(a) {
+			sealRun(bytes)
+		}
+		return err
+	})
+}
+
+// Do with all of the bytes of the run at a (starting with the meta
+// data).
+func (v *Varchar) doRunBytes(a uint64, do func([]byte) error) (err error) {
 	return v.doRun(a, func(m *varRunMeta) error {
 		fullLength := v.allocAmt(int(m.length))
 		blks := uint64(v.blksNeeded(fullLength))
@@ -471,14 +514,8 @@ func (v *Varchar) Do(a uint64, do func([]byte) error) (err error) {
 		for start+blks*uint64(v.bf.BlockSize()) > uint64(size) {
 			blks--
 		}
-		return v.bf.Do(start, blks, func(bytes []byte) error {
-			bytes = bytes[offset:]
-			flags := consts.AsFlag(bytes)
-			if flags&consts.VARCHAR_RUN == 0 {
-				return errors.Errorf("bad address, was not a run block")
-			}
-			r := asRun(bytes)
-			return do(r.bytes[:r.meta.length])
+		return v.doBlocks(start, blks, func(bytes []byte) error {
+			return do(bytes[offset:])
 		})
 	})
 }
@@ -502,11 +539,11 @@ func (v *Varchar) UnsafeGet(a uint64) (bytes []byte, err error) {
 	for start+blks*uint64(v.bf.BlockSize()) > uint64(size) {
 		blks--
 	}
-	allBytes, err := v.bf.Get(start, blks)
-	if err != nil {
-		return nil, err
-	}
-	err = v.bf.Release(allBytes)
+	var allBytes []byte
+	err = v.doBlocks(start, blks, func(bytes []byte) error {
+		allBytes = bytes
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -515,10 +552,151 @@ func (v *Varchar) UnsafeGet(a uint64) (bytes []byte, err error) {
 	if flags&consts.VARCHAR_RUN == 0 {
 		return nil, errors.Errorf("bad address, was not a run block")
 	}
+	if v.checksums {
+		// only verify, the run may be being written further up the stack
+		if v.runs.Enter(a) {
+			err = verifyRun(a, bytes)
+		}
+		v.runs.Exit(a)
+		if err != nil {
+			return nil, err
+		}
+	}
 	r := asRun(bytes)
 	return r.bytes[:r.meta.length], nil
 }
 
+// Move the run at a to the lowest free segment which fits it, if there
+// is one before a, returning its new address. The data and the ref count
+// go with it. The caller fixes up whatever pointed at a.
+func (v *Varchar) move(a uint64) (b uint64, moved bool, err error) {
+	var length int
+	err = v.doRun(a, func(m *varRunMeta) error {
+		length = int(m.length)
+		return nil
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	fullLength := v.allocAmt(length)
+	b, size, found, err := v.lowestFit(fullLength, a)
+	if err != nil || !found {
+		return 0, false, err
+	}
+	err = v.indexRemove(size, b)
+	if err != nil {
+		return 0, false, err
+	}
+	err = v.newRun(b, length, fullLength, size)
+	if err != nil {
+		return 0, false, err
+	}
+	err = v.doRunBytes(a, func(from []byte) error {
+		return v.doRunBytes(b, func(to []byte) error {
+			f, t := asRun(from), asRun(to)
+			copy(t.bytes[:length], f.bytes[:length])
+			t.meta.refs = f.meta.refs
+			if v.checksums {
+				sealRun(to)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	return b, true, v.Free(a)
+}
+
+// The lowest free segment before the address before which is at least
+// fullLength long.
+func (v *Varchar) lowestFit(fullLength int, before uint64) (a uint64, size int, found bool, err error) {
+	next, err := v.posTree.UnsafeRange(nil, makeBKey(before))
+	if err != nil {
+		return 0, 0, false, err
+	}
+	var bkey []byte
+	for bkey, _, err, next = next(); next != nil; bkey, _, err, next = next() {
+		a = makeKey(bkey)
+		if a >= before {
+			break
+		}
+		err = v.doFree(a, func(m *varFree) error {
+			size = int(m.length)
+			return nil
+		})
+		if err != nil {
+			return 0, 0, false, err
+		}
+		if fullLength <= size {
+			return a, size, true, nil
+		}
+	}
+	return 0, 0, false, err
+}
+
+// Give the whole blocks in the free segments back to the BlockFile. The
+// part of a segment before (and after) its whole blocks stays free in
+// the Varchar.
+func (v *Varchar) release() error {
+	type segment struct {
+		a      uint64
+		length int
+	}
+	segments := make([]segment, 0, v.posTree.Size())
+	err := v.posTree.DoIterate(func(bkey, _ []byte) error {
+		s := segment{a: makeKey(bkey)}
+		err := v.doFree(s.a, func(m *varFree) error {
+			s.length = int(m.length)
+			return nil
+		})
+		segments = append(segments, s)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	blkSize := uint64(v.blkSize)
+	for _, s := range segments {
+		end := s.a + uint64(s.length)
+		start := (s.a + blkSize - 1) / blkSize * blkSize
+		stop := end / blkSize * blkSize
+		if head := start - s.a; head > 0 && head < varFreeSize {
+			start += blkSize
+		}
+		if tail := end - stop; tail > 0 && tail < varFreeSize {
+			stop -= blkSize
+		}
+		if start >= stop {
+			continue
+		}
+		err = v.indexRemove(s.length, s.a)
+		if err != nil {
+			return err
+		}
+		if head := int(start - s.a); head > 0 {
+			if err := v.newFree(s.a, head); err != nil {
+				return err
+			} else if err := v.indexAdd(head, s.a); err != nil {
+				return err
+			}
+		}
+		if tail := int(end - stop); tail > 0 {
+			if err := v.newFree(stop, tail); err != nil {
+				return err
+			} else if err := v.indexAdd(tail, stop); err != nil {
+				return err
+			}
+		}
+		for b := start; b < stop; b += blkSize {
+			if err := v.bf.Free(b); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // Ref increments the ref field of the block. It starts out as one (when
 // allocated). Each call to ref will add 1 to that.
 func (v *Varchar) Ref(a uint64) (err error) {
@@ -617,10 +795,10 @@ func (v *Varchar) do(
 	runDo func(*varRunMeta) error,
 ) error {
 	offset, start, blks := v.startOffsetBlks(a)
-	return v.bf.Do(start, blks, func(bytes []byte) error {
+	return v.doBlocks(start, blks, func(bytes []byte) error {
 		bytes = bytes[offset:]
 		flags := consts.AsFlag(bytes)
-		if flags == consts.VARCHAR_CTRL {
+		if flags&^consts.CHECKSUMS == consts.VARCHAR_CTRL {
 			return ctrlDo(asCtrl(bytes))
 		} else if flags == consts.VARCHAR_FREE {
 			return freeDo(asFree(bytes))
@@ -634,17 +812,26 @@ func (v *Varchar) do(
 
 func (v *Varchar) unsafeGet(a uint64) ([]byte, error) {
 	offset, start, blks := v.startOffsetBlks(a)
-	bytes, err := v.bf.Get(start, blks)
-	if err != nil {
-		return nil, err
-	}
-	err = v.bf.Release(bytes)
+	var bytes []byte
+	err := v.doBlocks(start, blks, func(b []byte) error {
+		bytes = b
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 	return bytes[offset:], nil
 }
 
+// Load the blocks, for reading only while the tree which owns the
+// varchar is being read (see BpTree.doBlock).
+func (v *Varchar) doBlocks(start, blks uint64, do func([]byte) error) error {
+	if v.reading != nil && atomic.LoadInt32(v.reading) > 0 {
+		return v.bf.DoRead(start, blks, do)
+	}
+	return v.bf.Do(start, blks, do)
+}
+
 // This is for making new free segments. You probably (most definitely)
 // want to use doFree.
 func (v *Varchar) doAsFree(a uint64, do func(*varFree) error) error {
@@ -698,12 +885,22 @@ func (v *Varchar) newRun(a uint64, length, fullLength, segLength int) (err error
 	if err != nil {
 		return err
 	}
-	return v.doRun(a, func(m *varRunMeta) error {
+	err = v.doRun(a, func(m *varRunMeta) error {
 		if extra != 0 {
 			m.extra += uint32(extra)
 		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	if v.checksums {
+		return v.doRunBytes(a, func(bytes []byte) error {
+			sealRun(bytes)
+			return nil
+		})
+	}
+	return nil
 }
 
 func (v *Varchar) doFreeNode(a uint64, do func(*listNode) error) error {
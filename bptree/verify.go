@@ -19,12 +19,27 @@ import (
 // structure of the tree itself. It could be corruption has occurred and this will not
 // find it as the tree is still a valid B+Tree.
 func (self *BpTree) Verify() (err error) {
-	return self.verify(0, 0, self.meta.root, 0)
+	self.rlock()
+	defer self.runlock()
+	err = self.verify(0, 0, self.meta.root, 0)
+	if err != nil {
+		return err
+	}
+	if self.meta.flags&consts.SUBTREE_COUNTS != 0 {
+		count, err := self.subtreeCount(self.meta.root, 0)
+		if err != nil {
+			return err
+		}
+		if count != self.meta.itemCount {
+			return errors.Errorf("The tree has %v pairs but its size is %v", count, self.meta.itemCount)
+		}
+	}
+	return nil
 }
 
 func (self *BpTree) verify(parent uint64, idx int, n, sibling uint64) (err error) {
 	var flags consts.Flag
-	err = self.bf.Do(n, 1, func(bytes []byte) error {
+	err = self.doBlock(n, func(bytes []byte) error {
 		flags = consts.AsFlag(bytes)
 		return nil
 	})
@@ -43,7 +58,7 @@ func (self *BpTree) verify(parent uint64, idx int, n, sibling uint64) (err error
 func (self *BpTree) internalVerify(parent uint64, idx int, n, sibling uint64) (err error) {
 	a := n
 	return self.doInternal(a, func(n *internal) error {
-		err := checkOrder(self.varchar, n)
+		err := checkOrder(self.varchar, self.cmp, n)
 		if err != nil {
 			log.Println("error in internalVerify")
 			log.Printf("out of order")
@@ -81,6 +96,17 @@ func (self *BpTree) internalVerify(parent uint64, idx int, n, sibling uint64) (e
 				log.Printf("n = %v, sibling = %v, parent = %v, parent idx = %v, i = %v, sib = %v", a, sibling, parent, idx, i, sib)
 				return err
 			}
+			if n.counted() {
+				count, err := self.subtreeCount(*n.ptr(i), sib)
+				if err != nil {
+					return err
+				}
+				if count != *n.count(i) {
+					log.Println("error in internalVerify")
+					log.Println("internal", a, n.Debug(self.varchar))
+					return errors.Errorf("kid %v of %v has %v pairs but its count is %v", i, a, count, *n.count(i))
+				}
+			}
 		}
 		return nil
 	})
@@ -147,7 +173,7 @@ func (self *BpTree) pureVerify(parent uint64, idx int, n, sibling uint64) (err e
 		}
 		e := run[len(run)-1]
 		return self.doLeaf(e, func(m *leaf) (err error) {
-			err = checkOrder(self.varchar, m)
+			err = checkOrder(self.varchar, self.cmp, m)
 			if err != nil {
 				log.Println("error in pureVerify")
 				log.Printf("e out of order")
@@ -208,7 +234,7 @@ func (self *BpTree) leafOrderVerify(parent uint64, idx int, n, sibling uint64) (
 			}
 			return nil
 		}
-		err := checkOrder(self.varchar, n)
+		err := checkOrder(self.varchar, self.cmp, n)
 		if err != nil {
 			log.Println("error in leafVerify")
 			log.Printf("out of order")
@@ -225,7 +251,7 @@ func (self *BpTree) leafOrderVerify(parent uint64, idx int, n, sibling uint64) (
 						return nil
 					}
 					return m.doKeyAt(self.varchar, 0, func(first []byte) error {
-						cmp := bytes.Compare(last, first)
+						cmp := self.cmp(last, first)
 						if cmp > 0 {
 							log.Println("a", a, n.Debug(self.varchar))
 							log.Println("a.meta.next", n.meta.next, m.Debug(self.varchar))
@@ -252,7 +278,7 @@ func (self *BpTree) leafOrderVerify(parent uint64, idx int, n, sibling uint64) (
 						return nil
 					}
 					return m.doKeyAt(self.varchar, m.keyCount()-1, func(last []byte) error {
-						cmp := bytes.Compare(last, first)
+						cmp := self.cmp(last, first)
 						if cmp > 0 {
 							log.Println("a.meta.prev", n.meta.prev, m.Debug(self.varchar))
 							log.Println("a", a, n.Debug(self.varchar))
@@ -0,0 +1,97 @@
+package bptree
+
+import (
+	"github.com/timtadh/fs2/consts"
+	"github.com/timtadh/fs2/errors"
+	"github.com/timtadh/fs2/fmap"
+)
+
+// The bpTreeMeta starts with a magic number and the version of the
+// tree's on disk format so OpenAt can tell a tree from some other block
+// (and a tree from a newer fs2 from one it understands). Trees made
+// before the magic number existed have zeros there and are treated as
+// version 0. They are upgraded in place by the registered migrations
+// when they are opened in a writable BlockFile.
+const bpTreeMagic uint32 = 0xb7ee0f52
+
+// The current version of the tree's on disk format.
+const VERSION uint16 = 1
+
+// The flags which may be set in a bpTreeMeta.
+const treeFlags = consts.VARCHAR_KEYS | consts.VARCHAR_VALS | consts.CHECKSUMS | consts.COMPARATOR | consts.UNIQUE_KEYS | consts.SUBTREE_COUNTS | consts.PREFIX_COMPRESSION
+
+// A Migration upgrades a tree from one version of the on disk format to
+// the next. The version in the tree's meta data is updated after it
+// returns successfully.
+type Migration func(bpt *BpTree) error
+
+var migrations = make(map[uint16]Migration)
+
+// Register the migration which upgrades trees from version from to
+// version from+1. Migrations are run in order when OpenAt opens an older
+// tree. It panics if a migration from that version is already
+// registered.
+func RegisterMigration(from uint16, m Migration) {
+	if _, has := migrations[from]; has {
+		panic(errors.Errorf("a migration from version %d is already registered", from))
+	}
+	migrations[from] = m
+}
+
+func init() {
+	// Version 0 trees only lack the magic number which migrate writes.
+	RegisterMigration(0, func(bpt *BpTree) error {
+		bpt.meta.magic = bpTreeMagic
+		return nil
+	})
+}
+
+func (m *bpTreeMeta) validate(bf *fmap.BlockFile) error {
+	if m.magic == 0 && m.version == 0 {
+		// a tree from before the magic number, check it looks like one.
+		size, err := bf.Size()
+		if err != nil {
+			return err
+		}
+		blksize := uint64(bf.BlockSize())
+		if m.keySize == 0 || m.root == 0 || m.root%blksize != 0 || m.root >= size {
+			return errors.Errorf("The block is not a B+Tree")
+		}
+	} else if m.magic != bpTreeMagic {
+		return errors.Errorf("The block is not a B+Tree (bad magic number)")
+	}
+	if m.version > VERSION {
+		return errors.Errorf("The B+Tree was written by a newer fs2 (version %d, this supports %d)", m.version, VERSION)
+	}
+	if m.flags&^treeFlags != 0 {
+		return errors.Errorf("The B+Tree uses unsupported flags (%x)", m.flags&^treeFlags)
+	}
+	return nil
+}
+
+func (self *BpTree) migrate() error {
+	if self.bf.ReadOnly() || self.bf.IsSnapshot() {
+		return errors.Errorf("The B+Tree is in an old format (version %d), open it in a writable BlockFile to upgrade it", self.meta.version)
+	}
+	for v := self.meta.version; v < VERSION; v++ {
+		m, has := migrations[v]
+		if !has {
+			return errors.Errorf("There is no migration from version %d", v)
+		}
+		if err := m(self); err != nil {
+			return err
+		}
+		self.meta.version = v + 1
+		if err := self.writeMeta(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The version of the tree's on disk format.
+func (self *BpTree) Version() int {
+	self.rlock()
+	defer self.runlock()
+	return int(self.meta.version)
+}
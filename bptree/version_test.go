@@ -0,0 +1,62 @@
+package bptree
+
+import "testing"
+
+import (
+	"fmt"
+)
+
+func TestOpenNotATree(x *testing.T) {
+	t := (*T)(x)
+	bpt, clean := t.bpt()
+	defer clean()
+	a, err := bpt.bf.Allocate()
+	t.assert_nil(err)
+	t.assert_nil(bpt.bf.Do(a, 1, func(bytes []byte) error {
+		for i := range bytes {
+			bytes[i] = byte(i*13 + 7)
+		}
+		return nil
+	}))
+	_, err = OpenAt(bpt.bf, a)
+	t.assert("opening garbage should fail", err != nil)
+	b, err := bpt.bf.Allocate()
+	t.assert_nil(err)
+	_, err = OpenAt(bpt.bf, b)
+	t.assert("opening an empty block should fail", err != nil)
+}
+
+func TestOpenNewer(x *testing.T) {
+	t := (*T)(x)
+	bpt, clean := t.bpt()
+	defer clean()
+	bpt.meta.version = VERSION + 1
+	t.assert_nil(bpt.writeMeta())
+	_, err := OpenAt(bpt.bf, bpt.metaOff)
+	t.assert("opening a newer tree should fail", err != nil)
+}
+
+func TestOpenLegacy(x *testing.T) {
+	t := (*T)(x)
+	bpt, clean := t.bpt()
+	defer clean()
+	kvs := make([]*KV, 0, 100)
+	for i := 0; i < cap(kvs); i++ {
+		kv := t.make_kv()
+		kvs = append(kvs, kv)
+		t.assert_nil(bpt.Add(kv.key, kv.value))
+	}
+	bpt.meta.version = 0
+	bpt.meta.magic = 0
+	t.assert_nil(bpt.writeMeta())
+	opened, err := OpenAt(bpt.bf, bpt.metaOff)
+	t.assert_nil(err)
+	t.assert("should be upgraded", opened.Version() == int(VERSION))
+	t.assert("should have the magic", opened.meta.magic == bpTreeMagic)
+	for i, kv := range kvs {
+		t.assert_hasKV(opened)(fmt.Sprintf("idx %v", i), kv.key, kv.value)
+	}
+	meta, err := loadBpTreeMeta(bpt.bf, bpt.metaOff)
+	t.assert_nil(err)
+	t.assert("the upgrade should be written", meta.version == VERSION && meta.magic == bpTreeMagic)
+}
@@ -0,0 +1,140 @@
+package bptree
+
+import (
+	"bytes"
+)
+
+import (
+	"github.com/timtadh/fs2"
+)
+
+// A read only view of the tree handed to the function given to View.
+// Unlike the methods of BpTree the keys and values it returns are not
+// copied, they alias the memory map. They are valid until the function
+// given to View returns and must not be modified.
+type ReadView struct {
+	bpt *BpTree
+}
+
+// Read the tree without copying the keys and values out of the memory
+// map
+//
+//	err = bpt.View(func(v bptree.ReadView) error {
+//		return v.DoRange(from, to, func(key, value []byte) error {
+//			// key and value alias the mapping, copy them to keep them
+//			return nil
+//		})
+//	})
+//
+// While do runs the tree's read latch is held, so writers to the tree
+// wait for the view to end, and the mapping is pinned (see
+// fmap.BlockFile.Pin) so nothing else in the file can resize it. This
+// means do must not modify the tree (or anything else in the same file),
+// it would wait on itself. Keep views short for the same reason.
+func (self *BpTree) View(do func(v ReadView) error) error {
+	self.rlock()
+	defer self.runlock()
+	err := self.bf.Pin()
+	if err != nil {
+		return err
+	}
+	err = do(ReadView{bpt: self})
+	if e := self.bf.Unpin(); e != nil && err == nil {
+		return e
+	}
+	return err
+}
+
+// How many items are in the tree?
+func (v ReadView) Size() int {
+	return int(v.bpt.meta.itemCount)
+}
+
+// Get the first value stored with the key. See BpTree.Get.
+func (v ReadView) Get(key []byte) (value []byte, has bool, err error) {
+	bpt := v.bpt
+	a, i, err := bpt.getStart(key)
+	if err != nil {
+		return nil, false, err
+	}
+	empty, err := bpt.empty(a)
+	if err != nil {
+		return nil, false, err
+	} else if empty {
+		return nil, false, nil
+	}
+	err = bpt.doKV(a, i, func(k, val []byte) error {
+		has = bytes.Equal(key, k)
+		if has {
+			value = val
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return value, has, nil
+}
+
+// Iterate over all of the key/value pairs with the given key. See
+// BpTree.Find.
+func (v ReadView) Find(key []byte) (fs2.Iterator, error) {
+	return v.Range(key, key)
+}
+
+// Iterate over all of the key/value pairs in the tree. See
+// BpTree.Iterate.
+func (v ReadView) Iterate() (fs2.Iterator, error) {
+	return v.Range(nil, nil)
+}
+
+// Iterate over all of the key/values pairs between [from, to]
+// inclusive. See BpTree.Range.
+func (v ReadView) Range(from, to []byte) (fs2.Iterator, error) {
+	bi, err := v.bpt.rangeIterator(from, to)
+	if err != nil {
+		return nil, err
+	}
+	return v.kvIter(bi), nil
+}
+
+// See BpTree.DoFind.
+func (v ReadView) DoFind(key []byte, do func(key, value []byte) error) error {
+	return fs2.Do(func() (fs2.Iterator, error) { return v.Find(key) }, do)
+}
+
+// See BpTree.DoIterate.
+func (v ReadView) DoIterate(do func(key, value []byte) error) error {
+	return fs2.Do(v.Iterate, do)
+}
+
+// See BpTree.DoRange.
+func (v ReadView) DoRange(from, to []byte, do func(key, value []byte) error) error {
+	return fs2.Do(func() (fs2.Iterator, error) { return v.Range(from, to) }, do)
+}
+
+// The pairs at the locations bi steps through. Unlike _rangeUnsafe it
+// does not take the latch, View holds it.
+func (v ReadView) kvIter(bi bpt_iterator) (kvi fs2.Iterator) {
+	kvi = func() (key, value []byte, err error, _ fs2.Iterator) {
+		var a uint64
+		var i int
+		a, i, err, bi = bi()
+		if err != nil {
+			return nil, nil, err, nil
+		}
+		if bi == nil {
+			return nil, nil, nil, nil
+		}
+		err = v.bpt.doKV(a, i, func(k, val []byte) error {
+			key = k
+			value = val
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err, nil
+		}
+		return key, value, nil, kvi
+	}
+	return kvi
+}
@@ -0,0 +1,142 @@
+package bptree
+
+import "testing"
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+func (t *T) testView(bpt *BpTree, kvs KVS) {
+	for _, kv := range kvs {
+		t.assert_nil(bpt.Add(kv.key, kv.value))
+	}
+	t.assert_nil(bpt.View(func(v ReadView) error {
+		t.assert("size", v.Size() == len(kvs))
+		i := 0
+		err := v.DoIterate(func(k, val []byte) error {
+			t.assert(fmt.Sprintf("key %d", i), bytes.Equal(k, kvs[i].key))
+			i++
+			return nil
+		})
+		t.assert(fmt.Sprintf("iterated %v expected %v", i, len(kvs)), i == len(kvs))
+		if err != nil {
+			return err
+		}
+		from, to := kvs[len(kvs)/4].key, kvs[len(kvs)/2].key
+		expected := len(kvs) - len(keepOutside(kvs, from, to, nil))
+		count := 0
+		err = v.DoRange(from, to, func(k, val []byte) error {
+			t.assert("in the range", bytes.Compare(from, k) <= 0 && bytes.Compare(k, to) <= 0)
+			count++
+			return nil
+		})
+		t.assert(fmt.Sprintf("ranged %v expected %v", count, expected), count == expected)
+		if err != nil {
+			return err
+		}
+		for _, kv := range kvs[:200] {
+			found := false
+			err = v.DoFind(kv.key, func(k, val []byte) error {
+				found = found || bytes.Equal(val, kv.value)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			t.assert("found the value", found)
+			_, has, err := v.Get(kv.key)
+			if err != nil {
+				return err
+			}
+			t.assert("has the key", has)
+		}
+		_, has, err := v.Get([]byte("not in the tree"))
+		t.assert("has a missing key", !has)
+		return err
+	}))
+}
+
+func TestViewFixed(x *testing.T) {
+	t := (*T)(x)
+	bpt, clean := t.bptFixed()
+	defer clean()
+	t.testView(bpt, t.bulkKVS(3000, t.rand_key, func() []byte { return t.rand_value(8) }))
+}
+
+func TestViewVarchar(x *testing.T) {
+	t := (*T)(x)
+	bpt, clean := t.bpt()
+	defer clean()
+	t.testView(bpt, t.bulkKVS(3000,
+		func() []byte { return t.rand_varchar(1, 30) },
+		func() []byte { return t.rand_varchar(1, 60) }))
+}
+
+func TestViewBlocksWriters(x *testing.T) {
+	t := (*T)(x)
+	bf, clean := t.blkfile()
+	defer clean()
+	bpt, err := New(bf, 8, 8)
+	t.assert_nil(err)
+	other, err := New(bf, 8, 8)
+	t.assert_nil(err)
+	key, value := t.rand_key(), t.rand_value(8)
+	t.assert_nil(bpt.Add(key, value))
+	added := make(chan error, 1)
+	grown := make(chan error, 1)
+	t.assert_nil(bpt.View(func(v ReadView) error {
+		aliased, has, err := v.Get(key)
+		t.assert_nil(err)
+		t.assert("has the key", has)
+		go func() { added <- bpt.Add(t.rand_key(), t.rand_value(8)) }()
+		start, err := bf.Size()
+		t.assert_nil(err)
+		go func() {
+			// add to the other tree until the file grows
+			for size := start; size == start; {
+				if err := other.Add(t.rand_key(), t.rand_value(8)); err != nil {
+					grown <- err
+					return
+				}
+				size, _ = bf.Size()
+			}
+			grown <- nil
+		}()
+		select {
+		case <-added:
+			t.assert("the tree was written during the view", false)
+		case err := <-grown:
+			t.assert(fmt.Sprintf("the file was resized during the view (%v)", err), false)
+		case <-time.After(100 * time.Millisecond):
+		}
+		t.assert("the value is intact", bytes.Equal(aliased, value))
+		return nil
+	}))
+	t.assert_nil(<-added)
+	t.assert_nil(<-grown)
+	t.assert_nil(bpt.Verify())
+	t.assert_nil(other.Verify())
+}
+
+func TestViewAllocs(x *testing.T) {
+	t := (*T)(x)
+	bpt, clean := t.bptFixed()
+	defer clean()
+	kvs := t.bulkKVS(1000, t.rand_key, func() []byte { return t.rand_value(8) })
+	for _, kv := range kvs {
+		t.assert_nil(bpt.Add(kv.key, kv.value))
+	}
+	copied := testing.AllocsPerRun(5, func() {
+		t.assert_nil(bpt.DoIterate(func(k, v []byte) error { return nil }))
+	})
+	var aliased float64
+	t.assert_nil(bpt.View(func(v ReadView) error {
+		aliased = testing.AllocsPerRun(5, func() {
+			t.assert_nil(v.DoIterate(func(k, v []byte) error { return nil }))
+		})
+		return nil
+	}))
+	t.assert(fmt.Sprintf("view allocs %v copying allocs %v", aliased, copied), aliased*2 < copied)
+}
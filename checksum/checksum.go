@@ -0,0 +1,54 @@
+// Package checksum computes the CRC32C (Castagnoli) checksums which the
+// structures in fs2 can store in their blocks and tracks which blocks are
+// in use so a checksum is only verified when a block is first entered
+// and only updated when the last user leaves it.
+package checksum
+
+import (
+	"hash/crc32"
+	"sync"
+)
+
+var table = crc32.MakeTable(crc32.Castagnoli)
+
+// The CRC32C of the concatenation of the parts.
+func Sum(parts ...[]byte) uint32 {
+	var sum uint32 = 0
+	for _, part := range parts {
+		sum = crc32.Update(sum, table, part)
+	}
+	return sum
+}
+
+// Tracks how deeply each block (by offset) is currently being accessed.
+// Accesses nest (a block is often re-entered while it is being changed)
+// so the checksum of a block can only be trusted on the outermost entry
+// and must be recomputed on the outermost exit. The zero value is ready
+// to use.
+type Tracker struct {
+	mu    sync.Mutex
+	depth map[uint64]int
+}
+
+// Enter the block at a. Returns true if this is the outermost entry.
+func (t *Tracker) Enter(a uint64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.depth == nil {
+		t.depth = make(map[uint64]int)
+	}
+	t.depth[a]++
+	return t.depth[a] == 1
+}
+
+// Exit the block at a. Returns true if this was the outermost exit.
+func (t *Tracker) Exit(a uint64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.depth[a]--
+	if t.depth[a] <= 0 {
+		delete(t.depth, a)
+		return true
+	}
+	return false
+}
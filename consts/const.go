@@ -18,6 +18,11 @@ const (
 	VARCHAR_VALS
 	LIST_CTRL
 	LIST_IDX
+	CHECKSUMS
+	COMPARATOR
+	UNIQUE_KEYS
+	SUBTREE_COUNTS
+	PREFIX_COMPRESSION
 )
 
 func AsFlag(bytes []byte) Flag {
@@ -29,3 +29,36 @@ func (e *Error) Error() string {
 func (e *Error) String() string {
 	return e.Error()
 }
+
+// A CorruptionError is returned when a block does not match the checksum
+// stored with it. Offset is the offset of the block (or varchar run) in
+// the file.
+type CorruptionError struct {
+	Offset   uint64
+	Expected uint32
+	Actual   uint32
+	Stack    []byte
+}
+
+func Corruption(offset uint64, expected, actual uint32) error {
+	buf := make([]byte, 50000)
+	n := runtime.Stack(buf, false)
+	trace := make([]byte, n)
+	copy(trace, buf)
+	return &CorruptionError{
+		Offset:   offset,
+		Expected: expected,
+		Actual:   actual,
+		Stack:    trace,
+	}
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf(
+		"corrupt block at offset %d, checksum was %08x expected %08x\n%s",
+		e.Offset, e.Actual, e.Expected, string(e.Stack))
+}
+
+func (e *CorruptionError) String() string {
+	return e.Error()
+}
@@ -0,0 +1,158 @@
+package fmap
+
+import (
+	"sort"
+)
+
+// A Relocator is called by Compact after the contents of the block at
+// from have been copied into the (free) block at to. It must update every
+// pointer to from so it points at to and return true. If the block
+// cannot be moved (for instance it is part of a multi block allocation)
+// it returns false, the block is left where it is and the compaction
+// goes on with the blocks before it.
+type Relocator func(from, to uint64) (moved bool, err error)
+
+// Give the free blocks at the end of the file back to the operating
+// system, shrinking the file. Like Compact it fails if the file is open
+// read only.
+func (self *BlockFile) Truncate() error {
+	if err := self.writable(); err != nil {
+		return err
+	}
+	unlock, err := self.lockShrink()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	free, err := self.freeBlocks()
+	if err != nil {
+		return err
+	}
+	_, err = self.truncate(free)
+	return err
+}
+
+// Keep read only BlockFiles out while the file shrinks. The returned
+// func lets them back in.
+func (self *BlockFile) lockShrink() (unlock func() error, err error) {
+	if self.file == nil {
+		return func() error { return nil }, nil
+	}
+	if err := lockShrink(self.file); err != nil {
+		return nil, err
+	}
+	return func() error { return unlockShrink(self.file) }, nil
+}
+
+// Compact the file: the live blocks at the end of the file are moved
+// (from the last block backwards) into the lowest free blocks and then
+// the file is truncated. The structures in the file are told about every
+// move through relocate, which is why this is normally called through
+// the structure (see bptree.BpTree.Compact) rather than directly. There
+// must be no outstanding pointers into the file and the structures must
+// not be used by anyone else while it runs. It returns the number of
+// bytes the file shrank by.
+//
+// A read only BlockFile (see OpenBlockFileReadOnly) would be left mapped
+// past the end of the file, so Compact fails without changing anything
+// if the file is open read only and read only opens fail while it runs.
+func (self *BlockFile) Compact(relocate Relocator) (reclaimed uint64, err error) {
+	if err := self.writable(); err != nil {
+		return 0, err
+	}
+	unlock, err := self.lockShrink()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	free, err := self.freeBlocks()
+	if err != nil {
+		return 0, err
+	}
+	holes := make([]uint64, 0, len(free))
+	for a := range free {
+		holes = append(holes, a)
+	}
+	sort.Slice(holes, func(i, j int) bool { return holes[i] < holes[j] })
+	blksize := uint64(self.blksize)
+	// the free list is rebuilt from free at the end (moving a block into
+	// a hole overwrites the hole's link in the list).
+	err = self.compact(free, holes, blksize, relocate)
+	if err != nil {
+		if e := self.setFreeList(free); e != nil {
+			return 0, e
+		}
+		return 0, err
+	}
+	return self.truncate(free)
+}
+
+func (self *BlockFile) compact(free map[uint64]bool, holes []uint64, blksize uint64, relocate Relocator) error {
+	var tail uint64
+	err := self.readCtrl(func(ctrl *ctrlblk) error {
+		tail = ctrl.header.tail
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for a := self.size - blksize; a > 0 && len(holes) > 0 && holes[0] < a; a -= blksize {
+		if free[a] {
+			continue
+		}
+		to := holes[0]
+		err = self.Do(a, 1, func(src []byte) error {
+			return self.Do(to, 1, func(dst []byte) error {
+				copy(dst, src)
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+		var moved bool
+		if a == tail {
+			// the tail of the control data is the file's own block
+			moved = true
+			err = self.ctrl(func(ctrl *ctrlblk) error {
+				ctrl.header.tail = to
+				return nil
+			})
+		} else {
+			moved, err = relocate(a, to)
+		}
+		if err != nil {
+			return err
+		} else if !moved {
+			// the hole only has a copy of the block, it stays free
+			continue
+		}
+		holes = holes[1:]
+		delete(free, to)
+		free[a] = true
+	}
+	return nil
+}
+
+// Drop the free blocks at the end of the file and rebuild the free list
+// from the rest. It returns the number of bytes dropped.
+func (self *BlockFile) truncate(free map[uint64]bool) (reclaimed uint64, err error) {
+	blksize := uint64(self.blksize)
+	end := self.size
+	for end > blksize && free[end-blksize] {
+		end -= blksize
+		delete(free, end)
+	}
+	err = self.setFreeList(free)
+	if err != nil {
+		return 0, err
+	}
+	if end == self.size {
+		return 0, nil
+	}
+	reclaimed = self.size - end
+	if err := self.resize(end); err != nil {
+		return 0, err
+	}
+	return reclaimed, nil
+}
@@ -7,5 +7,24 @@ allocate and free blocks inside of the file. To support resizing the
 underlying file outstanding pointers are tracked and are expected to be
 released. This is done through run time checking.
 
+Files are locked so only one BlockFile (in any process) has a file open
+for writing at a time. Other processes may open the file read only with
+OpenBlockFileReadOnly.
+
+The control block (block 0) ends with a header holding a magic number,
+the version of the on disk format, the block size and feature flags.
+It is checked when a file is opened. Files from older versions of fs2
+are upgraded in place by the migrations registered with
+RegisterMigration. Files from before the header are only upgraded when
+opened with OpenLegacyBlockFile.
+
+Freed blocks are kept as extents (runs of contiguous free blocks,
+adjacent free blocks are coalesced) and are reused, lowest offset
+first, by Allocate and AllocateBlocks. To give the space back to the
+operating system call Truncate (which drops the free blocks at the end
+of the file) or Compact (which first moves live blocks from the end of
+the file into the free blocks, with the help of the structures in the
+file, see bptree.Relocator).
+
 */
 package fmap
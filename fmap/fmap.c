@@ -43,6 +43,14 @@ int create_anon_mmap(void **addr, size_t length) {
 }
 
 int create_mmap(void **addr, int fd) {
+  return map_fd(addr, fd, PROT_READ | PROT_WRITE);
+}
+
+int create_readonly_mmap(void **addr, int fd) {
+  return map_fd(addr, fd, PROT_READ);
+}
+
+int map_fd(void **addr, int fd, int prot) {
   size_t length;
   int err = fd_size(fd, &length);
   if (err != 0) {
@@ -51,7 +59,7 @@ int create_mmap(void **addr, int fd) {
   void *mapped = NULL;
   mapped = mmap(NULL,  // address hint
                 length,
-                PROT_READ | PROT_WRITE,     // protection flags (rw)
+                prot,                       // protection flags
                 MAP_SHARED | MAP_POPULATE,  // writes reflect in the file,
                                             // prepopulate the tlb
                 fd,
@@ -99,13 +107,18 @@ int destroy_mmap(void *addr, int fd) {
   return 0;
 }
 
-int sync_mmap(void *addr, int fd) {
+int sync_mmap(void *addr, int fd, int flags) {
   size_t length;
   int err = fd_size(fd, &length);
   if (err != 0) {
     return err;
   }
-  int ret = msync(addr, length, MS_ASYNC | MS_INVALIDATE);
+  return sync_range(addr, fd, 0, length, flags);
+}
+
+int sync_range(void *addr, int fd, size_t offset, size_t length, int flags) {
+  void *start = (void *)((size_t)(addr) + offset);
+  int ret = msync(start, length, flags);
   if (ret != 0) {
     int err = errno;
     errno = 0;
@@ -113,11 +126,27 @@ int sync_mmap(void *addr, int fd) {
     fprintf(stderr, "MSYNC ERROR: %s\n", msg);
     return err;
   }
+  if ((flags & MS_SYNC) == 0) {
+    return 0;
+  }
+  ret = fdatasync(fd);
+  if (ret != 0) {
+    int err = errno;
+    errno = 0;
+    char *msg = strerror(err);
+    fprintf(stderr, "FDATASYNC ERROR: %s\n", msg);
+    return err;
+  }
   return 0;
 }
 
 int anon_resize(void *old_addr, void **new_addr, size_t old_length,
                 size_t new_length) {
+  return remap(old_addr, new_addr, old_length, new_length);
+}
+
+int remap(void *old_addr, void **new_addr, size_t old_length,
+          size_t new_length) {
   void *mapped = mremap(old_addr, old_length, new_length, MREMAP_MAYMOVE);
   if (mapped == MAP_FAILED) {
     int err = errno;
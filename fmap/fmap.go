@@ -9,6 +9,8 @@ import (
 	// "hash/crc32"
 	"os"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"unsafe"
 )
@@ -20,15 +22,6 @@ import (
 
 const BLOCKSIZE = 4096
 
-type freeblk struct {
-	next uint64
-}
-
-func loadFreeBlk(bytes []byte) *freeblk {
-	free_s := slice.AsSlice(&bytes)
-	return (*freeblk)(free_s.Array)
-}
-
 type ctrldata struct {
 	// checksum  uint32
 	blksize   uint32
@@ -53,10 +46,16 @@ func (cd *ctrldata) Size() uintptr {
 }
 
 type ctrlblk struct {
-	meta ctrldata
-	user [BLOCKSIZE - ctrldataSize]byte
+	meta   ctrldata
+	user   [BLOCKSIZE - ctrldataSize - headerSize]byte
+	header header
 }
 
+// The length of the control data. The last headerSize bytes of it do not
+// fit in the control block, they are kept in the tail block (see
+// header) which is only allocated once they are set.
+const ctrlUserSize = BLOCKSIZE - ctrldataSize
+
 func load_ctrlblk(bytes []byte) (cb *ctrlblk, err error) {
 	back := slice.AsSlice(&bytes)
 	cb = (*ctrlblk)(back.Array)
@@ -70,6 +69,7 @@ func new_ctrlblk(bytes []byte, blksize uint32) (cb *ctrlblk) {
 	cb.meta.free_head = 0
 	cb.meta.free_len = 0
 	MemClr(cb.user[:])
+	cb.header.Init(blksize)
 	return cb
 }
 
@@ -79,14 +79,37 @@ func (cb *ctrlblk) updateChkSum() {
 
 // A BlockFile represents the memory mapped file. It has a blocksize all
 // operations are done as block aligned operations.
+//
+// Get, Release and Do may be called concurrently from many goroutines.
+// The mapping is latched so a resize (or a Close) waits for in flight
+// calls to Get. However, the bytes themselves are not latched, and
+// neither are the allocator functions (Allocate, AllocateBlocks, Free,
+// SetControlData). The structure built on top of the BlockFile must make
+// sure there is only one writer at a time and that no one reads a block
+// while it is being written (see bptree.BpTree for an example).
 type BlockFile struct {
 	path        string
 	opened      bool
+	readonly    bool
+	syncMode    SyncMode
 	size        uint64
 	blksize     int
 	file        *os.File
 	mmap        unsafe.Pointer
-	outstanding int "total outstanding pointers"
+	outstanding int64        // total outstanding pointers, use sync/atomic
+	writers     int64        // outstanding pointers from Get, use sync/atomic
+	mu          sync.RWMutex // guards the mapping and the hooks below
+	hooks       sync.Mutex   // guards the contents of the hooks
+	wal         *wal
+	journal     *journal
+	snap        *snapshot
+	snapshots   []*BlockFile
+	free        *freeSpace // loaded on demand, see free.go
+	pinMu       sync.Mutex // guards pins, held while the file is resized
+	pins        int64      // see Pin, pins are also outstanding pointers
+	unpinned    *sync.Cond // signaled when the last pin is released
+	relMu       sync.Mutex // guards released
+	released    *sync.Cond // signaled when the last writer is released
 }
 
 // Zero the bytes of the passed in slice. It uses the length not the
@@ -157,11 +180,31 @@ func Anonymous(blksize uint32) (*BlockFile, error) {
 	return bf, nil
 }
 
-// Open a previously created BlockFile. This will fail if you didn't use
-// the creation functions to create the file (or at least have undefined
-// effects).
+// Open a previously created BlockFile. This will fail if the file was
+// not made with the creation functions (or was written by a newer
+// version of fs2). Files from older versions are upgraded in place, see
+// RegisterMigration. If the file has a write ahead log (see EnableLog)
+// the log is replayed before the file is mapped, rolling the file back
+// to the last checkpoint.
 func OpenBlockFile(path string) (*BlockFile, error) {
-	f, mmap, err := open(path)
+	return openBlockFile(path, false)
+}
+
+// Open a BlockFile written by a version of fs2 from before files had a
+// header (format version 0) and upgrade it in place. As such files
+// cannot be told apart from other files, only their control block and
+// free list are checked before the upgrade writes to them. Files with a
+// header are opened as with OpenBlockFile.
+func OpenLegacyBlockFile(path string) (*BlockFile, error) {
+	return openBlockFile(path, true)
+}
+
+func openBlockFile(path string, legacy bool) (*BlockFile, error) {
+	logged, err := hasLog(path)
+	if err != nil {
+		return nil, err
+	}
+	f, mmap, err := open(path, logged)
 	if err != nil {
 		return nil, err
 	}
@@ -174,20 +217,41 @@ func OpenBlockFile(path string) (*BlockFile, error) {
 	}
 	bf.size, err = bf.fileSize()
 	if err != nil {
+		bf.Close()
 		return nil, err
 	}
-	var blksize uint64
-	err = bf.ctrl(func(ctrl *ctrlblk) error {
-		blksize = uint64(ctrl.meta.blksize)
-		return nil
-	})
+	err = bf.loadHeader(legacy)
 	if err != nil {
+		bf.Close()
 		return nil, err
 	}
-	bf.blksize = int(blksize)
+	if logged {
+		w, err := openLog(path)
+		if err != nil {
+			bf.Close()
+			return nil, err
+		}
+		err = w.reset(bf.size)
+		if err != nil {
+			w.close()
+			bf.Close()
+			return nil, err
+		}
+		bf.wal = w
+	}
 	return bf, nil
 }
 
+func hasLog(path string) (bool, error) {
+	_, err := os.Stat(logPath(path))
+	if err != nil && os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 // The flag used when creating the file
 var CREATEFLAG = os.O_RDWR | os.O_CREATE | syscall.O_NOATIME | os.O_TRUNC
 
@@ -200,40 +264,80 @@ func anon_create(blksize uint32) (unsafe.Pointer, uint64, error) {
 }
 
 func create(path string, blksize uint32) (*os.File, unsafe.Pointer, uint64, error) {
-	f, err := do_open(path, CREATEFLAG)
+	// the file is truncated after it is locked (rather than with O_TRUNC)
+	// so a file in use by another process is left alone.
+	f, err := do_open(path, CREATEFLAG&^os.O_TRUNC)
 	if err != nil {
 		return nil, nil, 0, err
 	}
-	err = f.Truncate(int64(blksize))
+	ptr, size, err := do_create(path, f, blksize)
 	if err != nil {
+		f.Close()
 		return nil, nil, 0, err
 	}
+	return f, ptr, size, nil
+}
+
+func do_create(path string, f *os.File, blksize uint32) (unsafe.Pointer, uint64, error) {
+	err := lockWriter(f, true)
+	if err != nil {
+		return nil, 0, err
+	}
+	err = os.Remove(logPath(path))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, 0, err
+	}
+	if CREATEFLAG&os.O_TRUNC != 0 {
+		err = f.Truncate(0)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	err = f.Truncate(int64(blksize))
+	if err != nil {
+		return nil, 0, err
+	}
 	ptr, err := do_map(f)
 	if err != nil {
-		return nil, nil, 0, err
+		return nil, 0, err
 	}
 	fi, err := f.Stat()
 	if err != nil {
-		return nil, nil, 0, err
+		return nil, 0, err
 	}
-	return f, ptr, uint64(fi.Size()), nil
+	return ptr, uint64(fi.Size()), nil
 }
 
 // The flag used when opening the file
 var OPENFLAG = os.O_RDWR | os.O_CREATE | syscall.O_NOATIME
 
-func open(path string) (*os.File, unsafe.Pointer, error) {
+func open(path string, logged bool) (*os.File, unsafe.Pointer, error) {
 	f, err := do_open(path, OPENFLAG)
 	if err != nil {
 		return nil, nil, err
 	}
-	ptr, err := do_map(f)
+	ptr, err := do_open_map(path, f, logged)
 	if err != nil {
+		f.Close()
 		return nil, nil, err
 	}
 	return f, ptr, nil
 }
 
+func do_open_map(path string, f *os.File, logged bool) (unsafe.Pointer, error) {
+	err := lockWriter(f, false)
+	if err != nil {
+		return nil, err
+	}
+	if logged {
+		_, err = recoverLog(path, f)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return do_map(f)
+}
+
 func do_open(path string, FLAG int) (*os.File, error) {
 	f, err := os.OpenFile(path, FLAG, 0666)
 	if err != nil {
@@ -254,6 +358,15 @@ func do_map(f *os.File) (unsafe.Pointer, error) {
 	return mmap, nil
 }
 
+func do_readonly_map(f *os.File) (unsafe.Pointer, error) {
+	var mmap unsafe.Pointer
+	errno := C.create_readonly_mmap(&mmap, C.int(f.Fd()))
+	if errno != 0 {
+		return nil, errors.Errorf("Could not create read only map fd = %d, %d", f.Fd(), errno)
+	}
+	return mmap, nil
+}
+
 func do_anon_map(length uint32) (unsafe.Pointer, error) {
 	var mmap unsafe.Pointer = unsafe.Pointer(uintptr(0))
 	errno := C.create_anon_mmap(&mmap, C.size_t(length))
@@ -266,13 +379,45 @@ func do_anon_map(length uint32) (unsafe.Pointer, error) {
 // Close the file. Unmaps the region. There must be no outstanding
 // blocks.
 func (self *BlockFile) Close() error {
+	if self.snap != nil {
+		return self.closeSnapshot()
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
 	if !self.opened {
 		return errors.Errorf("File is not open")
 	}
-	if self.outstanding > 0 {
-		return errors.Errorf("Tried to close file when there were outstanding pointers (%d)", self.outstanding)
+	if n := atomic.LoadInt64(&self.outstanding); n > 0 {
+		return errors.Errorf("Tried to close file when there were outstanding pointers (%d)", n)
 	}
-	if self.file != nil {
+	if len(self.snapshots) > 0 {
+		return errors.Errorf("Tried to close file when there were open snapshots (%d)", len(self.snapshots))
+	}
+	if self.wal != nil {
+		if err := self.checkpoint(); err != nil {
+			return err
+		}
+		if err := self.wal.close(); err != nil {
+			return err
+		}
+		self.wal = nil
+	} else if self.file != nil && !self.readonly && self.syncMode != ASYNC {
+		if errno := C.sync_mmap(self.mmap, C.int(self.file.Fd()), C.MS_SYNC); errno != 0 {
+			return errors.Errorf("sync_mmap failed, %d", errno)
+		}
+	}
+	if self.readonly {
+		// the file may have grown since it was mapped so unmap by the
+		// length of the mapping not the length of the file.
+		if errno := C.destroy_anon_mmap(self.mmap, C.size_t(self.size)); errno != 0 {
+			return errors.Errorf("destroy_mmap failed, %d", errno)
+		}
+		if err := self.file.Close(); err != nil {
+			return err
+		} else {
+			self.file = nil
+		}
+	} else if self.file != nil {
 		if errno := C.destroy_mmap(self.mmap, C.int(self.file.Fd())); errno != 0 {
 			return errors.Errorf("destroy_mmap failed, %d", errno)
 		}
@@ -290,7 +435,8 @@ func (self *BlockFile) Close() error {
 	return nil
 }
 
-// Remove the underlying file. (must be already closed).
+// Remove the underlying file and its write ahead log (if there is one).
+// (must be already closed).
 func (self *BlockFile) Remove() error {
 	if self.opened {
 		return errors.Errorf("Expected file to be closed")
@@ -298,9 +444,77 @@ func (self *BlockFile) Remove() error {
 	if self.Path() == "" {
 		return errors.Errorf("This was an anonymous map")
 	}
+	err := os.Remove(logPath(self.Path()))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	return os.Remove(self.Path())
 }
 
+// Run the write ahead log, the journal and the snapshots on the blocks
+// about to be handed out. Must hold self.mu.
+func (self *BlockFile) runHooks(offset, length uint64) error {
+	self.hooks.Lock()
+	defer self.hooks.Unlock()
+	if self.wal != nil {
+		if err := self.logBlocks(offset, length); err != nil {
+			return err
+		}
+	}
+	if self.journal != nil {
+		self.journalBlocks(offset, length)
+	}
+	if len(self.snapshots) > 0 {
+		self.snapshotBlocks(offset, length)
+	}
+	return nil
+}
+
+// Can the file be modified?
+func (self *BlockFile) writable() error {
+	if !self.opened {
+		return errors.Errorf("File is not open")
+	}
+	if self.snap != nil {
+		return errors.Errorf("Snapshots are read only")
+	}
+	if self.readonly {
+		return errors.Errorf("%v was opened read only", self.path)
+	}
+	return nil
+}
+
+// Grow a read only mapping to cover end if the writer has grown the
+// file past the end of the mapping.
+func (self *BlockFile) follow(end uint64) error {
+	self.mu.RLock()
+	covered := !self.opened || end <= self.size
+	self.mu.RUnlock()
+	if covered {
+		return nil
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	size, err := self.fileSize()
+	if err != nil {
+		return err
+	}
+	if size <= self.size {
+		return nil
+	}
+	if atomic.LoadInt64(&self.outstanding) > 0 {
+		return errors.Errorf("cannot follow the growth of the file while there are outstanding pointers")
+	}
+	var new_mmap unsafe.Pointer
+	errno := C.remap(self.mmap, &new_mmap, C.size_t(self.size), C.size_t(size))
+	if errno != 0 {
+		return errors.Errorf("remap failed, %d", errno)
+	}
+	self.size = size
+	self.mmap = new_mmap
+	return nil
+}
+
 func (self *BlockFile) init_ctrl(blksize uint32) error {
 	return self.Do(0, 1, func(bytes []byte) error {
 		_ = new_ctrlblk(bytes, blksize)
@@ -320,13 +534,31 @@ func (self *BlockFile) ctrl(do func(*ctrlblk) error) error {
 	})
 }
 
+// Read the control block, do must not modify it.
+func (self *BlockFile) readCtrl(do func(*ctrlblk) error) error {
+	return self.DoRead(0, 1, func(bytes []byte) error {
+		cb, err := load_ctrlblk(bytes)
+		if err != nil {
+			return err
+		}
+		return do(cb)
+	})
+}
+
 // Get the "control data" this free form data which is stored in the
-// control block file. You can put whatever you want in here.
+// control block file. You can put whatever you want in here. It is
+// always BLOCKSIZE - 16 bytes long.
 func (self *BlockFile) ControlData() (data []byte, err error) {
-	err = self.ctrl(func(ctrl *ctrlblk) error {
-		data = make([]byte, len(ctrl.user))
-		copy(data, ctrl.user[:])
-		return nil
+	err = self.readCtrl(func(ctrl *ctrlblk) error {
+		data = make([]byte, ctrlUserSize)
+		n := copy(data, ctrl.user[:])
+		if ctrl.header.tail == 0 {
+			return nil
+		}
+		return self.DoRead(ctrl.header.tail, 1, func(bytes []byte) error {
+			copy(data[n:], bytes)
+			return nil
+		})
 	})
 	if err != nil {
 		return nil, err
@@ -345,11 +577,46 @@ func (self *BlockFile) SetControlData(data []byte) (err error) {
 
 // Same as SetControlData but does not call Sync() at the end.
 func (self *BlockFile) SetControlDataNoSync(data []byte) (err error) {
-	return self.ctrl(func(ctrl *ctrlblk) error {
-		if len(data) > len(ctrl.user) {
-			return errors.Errorf("control data was too large")
+	if err := self.writable(); err != nil {
+		return err
+	}
+	if len(data) > ctrlUserSize {
+		return errors.Errorf("control data was too large")
+	}
+	var n int
+	var tail uint64
+	err = self.ctrl(func(ctrl *ctrlblk) error {
+		n = copy(ctrl.user[:], data)
+		tail = ctrl.header.tail
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	rest := data[n:]
+	if tail == 0 {
+		zeros := true
+		for _, b := range rest {
+			zeros = zeros && b == 0
+		}
+		if zeros {
+			// a missing tail block reads as zeros
+			return nil
+		}
+		tail, err = self.Allocate()
+		if err != nil {
+			return err
 		}
-		copy(ctrl.user[:], data)
+		err = self.ctrl(func(ctrl *ctrlblk) error {
+			ctrl.header.tail = tail
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return self.Do(tail, 1, func(bytes []byte) error {
+		copy(bytes, rest)
 		return nil
 	})
 }
@@ -365,6 +632,8 @@ func (self *BlockFile) BlockSize() int {
 }
 
 func (self *BlockFile) Size() (uint64, error) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
 	return self.size, nil
 }
 
@@ -381,12 +650,24 @@ func (self *BlockFile) fileSize() (uint64, error) {
 }
 
 func (self *BlockFile) resize(size uint64) error {
-	if self.outstanding > 0 {
+	self.pinMu.Lock()
+	defer self.pinMu.Unlock()
+	self.waitUnpinned()
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if atomic.LoadInt64(&self.outstanding) > 0 {
 		return errors.Errorf("cannot resize the file while there are outstanding pointers")
 	}
 	if !self.opened {
 		return errors.Errorf("File is not open")
 	}
+	if size < self.size {
+		// the blocks cut off must be in the log, the journal and the
+		// snapshots so they can be restored (or read).
+		if err := self.runHooks(size, self.size-size); err != nil {
+			return err
+		}
+	}
 	if self.file == nil {
 		return self.anonResize(size)
 	}
@@ -414,44 +695,23 @@ func (self *BlockFile) anonResize(size uint64) error {
 // Free the block at the given offset. The offset is in bytes from the
 // start of the file.
 func (self *BlockFile) Free(offset uint64) error {
-	/*
-		errno := C.is_normal(self.mmap, C.size_t(offset), C.size_t(self.blksize))
-		if errno != 0 {
-			return errors.Errorf("is_normal failed, %d", errno)
-		}*/
-	_, err := self.zero(offset, 1)
-	if err != nil {
+	if err := self.writable(); err != nil {
 		return err
 	}
-	return self.ctrl(func(ctrl *ctrlblk) error {
-		head := ctrl.meta.free_head
-		return self.Do(offset, 1, func(free_bytes []byte) error {
-			free := loadFreeBlk(free_bytes)
-			free.next = head
-			ctrl.meta.free_head = offset
-			ctrl.meta.free_len += 1
-			return nil
-		})
-	})
-}
-
-func (self *BlockFile) pop_free() (offset uint64, err error) {
-	err = self.ctrl(func(ctrl *ctrlblk) error {
-		if ctrl.meta.free_head == 0 || ctrl.meta.free_len == 0 {
-			return errors.Errorf("No blocks free")
-		}
-		offset = ctrl.meta.free_head
-		return self.Do(offset, 1, func(bytes []byte) error {
-			free := loadFreeBlk(bytes)
-			ctrl.meta.free_head = free.next
-			ctrl.meta.free_len -= 1
-			return nil
-		})
-	})
+	if offset == 0 || offset%uint64(self.blksize) != 0 || offset >= self.size {
+		return errors.Errorf("Cannot free %d, it is not a block in the file", offset)
+	}
+	// check before zeroing, zeroing a free block would break the list
+	if free, err := self.isFree(offset); err != nil {
+		return err
+	} else if free {
+		return errors.Errorf("Double free of %d", offset)
+	}
+	_, err := self.zero(offset, 1)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	return offset, nil
+	return self.freeBlocksAt(offset, 1)
 }
 
 func (self *BlockFile) zero(offset uint64, n int) (uint64, error) {
@@ -468,78 +728,87 @@ func (self *BlockFile) zero(offset uint64, n int) (uint64, error) {
 	return offset, nil
 }
 
-func (self *BlockFile) alloc(n int) (offset uint64, err error) {
-	start_size := self.size
-	amt := uint64(self.blksize) * uint64(n)
-	if err := self.resize(self.size + amt); err != nil {
-		return 0, err
+// Grow the file by n blocks (less the free blocks already at the end of
+// the file) and put them in the free space.
+func (self *BlockFile) grow(n uint64) error {
+	last, has, err := self.lastExtent()
+	if err != nil {
+		return err
+	}
+	if has {
+		n -= last.blocks
+	}
+	start := self.size
+	if err := self.resize(self.size + n*uint64(self.blksize)); err != nil {
+		return err
 	}
-	return start_size, nil
+	return self.freeBlocksAt(start, n)
 }
 
-func (self *BlockFile) allocOne() (offset uint64, err error) {
-	n := uint64(256)
-	start_size := self.size
-	amt := uint64(self.blksize) * n
-	if err := self.resize(self.size + amt); err != nil {
+// Take n blocks from the free space growing the file if there is no
+// room.
+func (self *BlockFile) alloc(n uint64) (offset uint64, err error) {
+	offset, found, err := self.takeBlocks(n)
+	if err != nil {
 		return 0, err
+	} else if found {
+		return offset, nil
 	}
-	for i := uint64(1); i < n; i++ {
-		o := i * uint64(self.blksize)
-		err := self.Free(start_size + o)
-		if err != nil {
-			return 0, err
-		}
+	// single blocks grow the file 256 blocks at a time
+	grow := n
+	if n == 1 {
+		grow = 256
+	}
+	if err := self.grow(grow); err != nil {
+		return 0, err
 	}
-	return start_size, nil
+	offset, found, err = self.takeBlocks(n)
+	if err != nil {
+		return 0, err
+	} else if !found {
+		return 0, errors.Errorf("Could not allocate %d blocks after growing the file", n)
+	}
+	return offset, nil
 }
 
 // What is the address of the file in the address space of the program.
 // Use this at your own risk!
 func (self *BlockFile) Address() uintptr {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
 	return uintptr(self.mmap)
 }
 
 // Is the address given still the address of the memory map?
 func (self *BlockFile) Valid(address uintptr) bool {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
 	return address == uintptr(self.mmap)
 }
 
 // Allocate 1 block and return its offset.
 func (self *BlockFile) Allocate() (offset uint64, err error) {
-	if !self.opened {
-		return 0, errors.Errorf("File is not open")
+	if err := self.writable(); err != nil {
+		return 0, err
 	}
-	var resize bool = false
-	err = self.ctrl(func(ctrl *ctrlblk) error {
-		var err error
-		if ctrl.meta.free_len > 0 {
-			offset, err = self.pop_free()
-		} else {
-			resize = true
-		}
-		return err
-	})
+	offset, err = self.alloc(1)
 	if err != nil {
 		return 0, err
 	}
-	if resize {
-		offset, err = self.allocOne()
-		if err != nil {
-			return 0, err
-		}
-	}
 	return self.zero(offset, 1)
 }
 
 // Allocate n blocks. Return the offset of the first block. These are
-// guarranteed to be sequential. This always causes a file resize at the
-// moment.
+// guarranteed to be sequential. They come from the free space if there
+// is a free extent large enough, otherwise the file grows.
 func (self *BlockFile) AllocateBlocks(n int) (offset uint64, err error) {
-	if !self.opened {
-		return 0, errors.Errorf("File is not open")
+	if err := self.writable(); err != nil {
+		return 0, err
+	}
+	if n <= 0 {
+		return 0, errors.Errorf("Cannot allocate %d blocks", n)
 	}
-	offset, err = self.alloc(n)
+	offset, err = self.alloc(uint64(n))
 	if err != nil {
 		return 0, err
 	}
@@ -565,17 +834,57 @@ func (self *BlockFile) Do(offset, blocks uint64, do func([]byte) error) error {
 	return err
 }
 
+// Load the blocks at the given offset for reading then call the
+// callback, `do`, passing in the loaded bytes. The bytes must not be
+// modified. Unlike Do (and Get) the write ahead log, the journal and
+// the snapshots are not run on the blocks (there is nothing to undo or
+// preserve) and a checkpoint (see Sync) does not wait for them to be
+// released.
+func (self *BlockFile) DoRead(offset, blocks uint64, do func([]byte) error) error {
+	bytes, err := self.get(offset, blocks, false)
+	if err != nil {
+		return err
+	}
+	err = do(bytes)
+	atomic.AddInt64(&self.outstanding, -1)
+	return err
+}
+
 // Get the bytes at the offset and block count. You probably want to use
 // Do instead. You must call Release() on the bytes when done.
 func (self *BlockFile) Get(offset, blocks uint64) ([]byte, error) {
+	bytes, err := self.get(offset, blocks, true)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&self.writers, 1)
+	return bytes, nil
+}
+
+func (self *BlockFile) get(offset, blocks uint64, write bool) ([]byte, error) {
+	if self.snap != nil {
+		return self.snapshotGet(offset, blocks)
+	}
+	length := blocks * uint64(self.blksize)
+	if self.readonly {
+		if err := self.follow(offset + length); err != nil {
+			return nil, err
+		}
+	}
+	self.mu.RLock()
+	defer self.mu.RUnlock()
 	if !self.opened {
 		return nil, errors.Errorf("File is not open")
 	}
-	length := blocks * uint64(self.blksize)
 	if (offset + length) > uint64(self.size) {
 		return nil, errors.Errorf("Get outside of the file, (%d) %d + %d > %d", offset+length, offset, length, self.size)
 	}
-	self.outstanding += 1
+	if write && (self.wal != nil || self.journal != nil || len(self.snapshots) > 0) {
+		if err := self.runHooks(offset, length); err != nil {
+			return nil, err
+		}
+	}
+	atomic.AddInt64(&self.outstanding, 1)
 	slice := &slice.Slice{
 		Array: unsafe.Pointer(uintptr(self.mmap) + uintptr(offset)),
 		Len:   int(length),
@@ -588,19 +897,107 @@ func (self *BlockFile) Get(offset, blocks uint64) ([]byte, error) {
 // not allocated from the mapping. But why take chances, you probably
 // want to use the Do interface instead.
 func (self *BlockFile) Release(bytes []byte) error {
-	self.outstanding -= 1
+	atomic.AddInt64(&self.outstanding, -1)
+	if atomic.AddInt64(&self.writers, -1) == 0 {
+		self.relMu.Lock()
+		if self.released != nil {
+			self.released.Broadcast()
+		}
+		self.relMu.Unlock()
+	}
+	return nil
+}
+
+// How Sync (and SyncRange) write the mapping to disk.
+type SyncMode int
+
+const (
+	// Sync uses the async interface (via the MS_ASYNC flag) so the
+	// changes may not be written by the time it returns. However, they
+	// will be written soon. This is the default.
+	ASYNC SyncMode = iota
+	// Sync uses MS_SYNC and then fdatasync so the changes are on disk
+	// when it returns. Close also flushes the file.
+	SYNC
+	// Sync is the same as in ASYNC but Close flushes the file (as in
+	// SYNC) before unmapping it.
+	FSYNC_ON_CLOSE
+)
+
+// Set the SyncMode for the file. It is not stored in the file so it
+// must be set every time the file is opened.
+func (self *BlockFile) SetSyncMode(mode SyncMode) error {
+	switch mode {
+	case ASYNC, SYNC, FSYNC_ON_CLOSE:
+	default:
+		return errors.Errorf("unknown sync mode %d", mode)
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.syncMode = mode
 	return nil
 }
 
-// Sync the mmap'ed changes to disk. This uses the async interface (via
-// the MS_ASYNC flag) so the changes may not be written by the time this
+func (self *BlockFile) syncFlags() C.int {
+	if self.syncMode == SYNC {
+		return C.MS_SYNC
+	}
+	return C.MS_ASYNC | C.MS_INVALIDATE
+}
+
+// Sync the mmap'ed changes to disk. How depends on the SyncMode (see
+// SetSyncMode). By default it uses the async interface (via the
+// MS_ASYNC flag) so the changes may not be written by the time this
 // method returns. However, they will be written soon.
+//
+// If the write ahead log is enabled this instead checkpoints the file.
+// The changes are on disk when it returns and the log is emptied. The
+// checkpoint waits for the pointers handed out by Get (and Do) to be
+// released so it must not be taken while holding one. Blocks being read
+// (see DoRead) do not hold it up.
 func (self *BlockFile) Sync() error {
+	if self.snap != nil || self.readonly {
+		return nil
+	}
+	self.lockForCheckpoint()
+	defer self.mu.Unlock()
+	if self.wal != nil {
+		return self.checkpoint()
+	}
 	if self.file != nil {
-		errno := C.sync_mmap(self.mmap, C.int(self.file.Fd()))
+		errno := C.sync_mmap(self.mmap, C.int(self.file.Fd()), self.syncFlags())
 		if errno != 0 {
 			return errors.Errorf("sync_mmap failed, %d", errno)
 		}
 	}
 	return nil
 }
+
+// Sync only the given blocks to disk (only the dirty pages among them
+// are written). It follows the SyncMode like Sync does, so in the SYNC
+// mode the blocks are on disk when it returns. It does not checkpoint
+// the write ahead log, use Sync for that.
+func (self *BlockFile) SyncRange(offset, blocks uint64) error {
+	if self.snap != nil || self.readonly {
+		return nil
+	}
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if !self.opened {
+		return errors.Errorf("File is not open")
+	}
+	length := blocks * uint64(self.blksize)
+	if offset%uint64(self.blksize) != 0 {
+		return errors.Errorf("SyncRange offset %d is not block aligned", offset)
+	}
+	if (offset + length) > uint64(self.size) {
+		return errors.Errorf("SyncRange outside of the file, (%d) %d + %d > %d", offset+length, offset, length, self.size)
+	}
+	if self.file != nil {
+		errno := C.sync_range(self.mmap, C.int(self.file.Fd()), C.size_t(offset), C.size_t(length), self.syncFlags())
+		if errno != 0 {
+			return errors.Errorf("sync_range failed, %d", errno)
+		}
+	}
+	return nil
+}
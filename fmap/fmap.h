@@ -58,6 +58,20 @@ int create_anon_mmap(void **addr, size_t fd);
  */
 int create_mmap(void **addr, int fd);
 
+/* create_readonly_mmap(*addr, fd)
+ *
+ * same as create_mmap but the mapping is PROT_READ. Writes to the
+ * mapping will cause a SIGSEGV. The fd may be opened O_RDONLY.
+ */
+int create_readonly_mmap(void **addr, int fd);
+
+/* map_fd(*addr, fd, prot)
+ *
+ * creates a shared mapping of the whole file with the given protection
+ * flags. Used by create_mmap and create_readonly_mmap.
+ */
+int map_fd(void **addr, int fd, int prot);
+
 /* destroy_anon_map(addr, length)
  *
  * destroys the mapping. Caution: subsequent access will cause a
@@ -83,20 +97,42 @@ int destroy_anon_mmap(void *addr, size_t length);
  */
 int destroy_mmap(void *addr, int fd);
 
-/* sync_map(addr, length)
+/* sync_mmap(addr, fd, flags)
+ *
+ * syncs any changes in the whole mapping down to disk. See sync_range.
+ *
+ * (addr) the address of the mapping.
+ *
+ * (fd) is the file descriptor for this map.
+ *
+ * (flags) the msync flags.
+ *
+ * (returns) 0 on success and an errno value on failure.
+ */
+int sync_mmap(void *addr, int fd, int flags);
+
+/* sync_range(addr, fd, offset, length, flags)
  *
- * syncs any changes down to disk. This function is NON-BLOCKING. It
- * uses MS_ASYNC flags to msync such that this program will not block
- * on the sync. It also uses MS_INVALIDATE to invalidate any other
- * mappings.
+ * syncs any changes in [offset, offset + length) down to disk. Only
+ * the dirty pages in the range are written. With MS_ASYNC this function
+ * is NON-BLOCKING (msync schedules the writes and returns). With
+ * MS_SYNC this function BLOCKS, after the msync it also calls fdatasync
+ * on the file descriptor so when it returns the bytes are on disk.
+ * MS_INVALIDATE may be or'ed in to invalidate any other mappings.
  *
  * (addr) the address of the mapping.
  *
  * (fd) is the file descriptor for this map.
  *
+ * (offset) the offset into the mapping, must be page aligned.
+ *
+ * (length) the number of bytes to sync.
+ *
+ * (flags) the msync flags.
+ *
  * (returns) 0 on success and an errno value on failure.
  */
-int sync_mmap(void *addr, int fd);
+int sync_range(void *addr, int fd, size_t offset, size_t length, int flags);
 
 /* resize(addr, new_addr, fd, new_length)
  *
@@ -119,6 +155,16 @@ int sync_mmap(void *addr, int fd);
 int anon_resize(void *old_addr, void **new_addr, size_t old_length,
                 size_t new_length);
 
+/* remap(addr, new_addr, old_length, new_length)
+ *
+ * resizes the mapping only (not the file). Used by anon_resize and to
+ * follow a file which has been grown by another process.
+ *
+ * (returns) 0 on success and an errno value on failure.
+ */
+int remap(void *old_addr, void **new_addr, size_t old_length,
+          size_t new_length);
+
 /* resize(addr, new_addr, fd, new_length)
  *
  * this resizes both file and the mapping to the new length.
@@ -3,7 +3,12 @@ package fmap
 import "testing"
 
 import (
+	"bytes"
+	"io/ioutil"
+	"os"
 	"runtime/debug"
+	"sync/atomic"
+	"time"
 )
 
 var path string = "/tmp/__mmap_bf"
@@ -188,3 +193,784 @@ func TestFree(x *testing.T) {
 		return nil
 	}))
 }
+
+func TestFreeExtents(x *testing.T) {
+	t := (*T)(x)
+	bf := t.blkfile()
+	defer func() { t.cleanup(bf) }()
+	blocks := make([]uint64, 0, 16)
+	for i := 0; i < cap(blocks); i++ {
+		a, err := bf.Allocate()
+		t.assert(err)
+		blocks = append(blocks, a)
+	}
+	start, err := bf.Size()
+	t.assert(err)
+	// free 4..11 out of order, they should coalesce into one extent
+	for _, i := range []int{5, 4, 7, 11, 6, 9, 8, 10} {
+		t.assert(bf.Free(blocks[i]))
+	}
+	if err := bf.Free(blocks[6]); err == nil {
+		t.Error("expected a double free to fail")
+	}
+	free, err := bf.freeSpace()
+	t.assert(err)
+	found := false
+	for _, e := range free.exts {
+		if e.start == blocks[4] && e.blocks == 8 {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("the freed blocks did not coalesce %v", free.exts)
+	}
+	a, err := bf.AllocateBlocks(8)
+	t.assert(err)
+	size, err := bf.Size()
+	t.assert(err)
+	if a != blocks[4] || size != start {
+		t.Errorf("expected the freed blocks to be reused, got %d (size %d -> %d)", a, start, size)
+	}
+	// the free list in the file should match after reloading it
+	bf.free = nil
+	free, err = bf.freeSpace()
+	t.assert(err)
+	for _, e := range free.exts {
+		if e.start <= blocks[4] && bf.end(e) > blocks[4] {
+			t.Errorf("the allocated blocks are still free %v", free.exts)
+		}
+	}
+}
+
+func TestMigrateFreeList(x *testing.T) {
+	t := (*T)(x)
+	bf := t.blkfile()
+	defer func() { t.cleanup(bf) }()
+	start, err := bf.AllocateBlocks(10)
+	t.assert(err)
+	// build a version 1 (singly linked) free list of every other block
+	t.assert(bf.ctrl(func(ctrl *ctrlblk) error {
+		ctrl.header.version = 1
+		ctrl.meta.free_head = 0
+		ctrl.meta.free_len = 0
+		for i := uint64(0); i < 10; i += 2 {
+			a := start + i*BLOCKSIZE
+			head := ctrl.meta.free_head
+			t.assert(bf.Do(a, 1, func(bytes []byte) error {
+				loadFreeBlk(bytes).next = head
+				return nil
+			}))
+			ctrl.meta.free_head = a
+			ctrl.meta.free_len++
+		}
+		return nil
+	}))
+	t.assert(bf.Close())
+	bf, err = OpenBlockFile(path)
+	t.assert(err)
+	version, err := bf.Version()
+	t.assert(err)
+	if version != FORMAT_VERSION {
+		t.Errorf("version was %d expected %d", version, FORMAT_VERSION)
+	}
+	free, err := bf.freeBlocks()
+	t.assert(err)
+	if len(free) != 5 {
+		t.Errorf("expected 5 free blocks got %d", len(free))
+	}
+	for i := uint64(0); i < 10; i += 2 {
+		if !free[start+i*BLOCKSIZE] {
+			t.Errorf("block %d should be free", i)
+		}
+	}
+}
+
+func copyFile(t *T, from, to string) {
+	data, err := ioutil.ReadFile(from)
+	t.assert(err)
+	t.assert(ioutil.WriteFile(to, data, 0666))
+}
+
+func TestLogRecover(x *testing.T) {
+	t := (*T)(x)
+	crashed := path + "_crashed"
+	bf := t.blkfile()
+	defer t.cleanup(bf)
+	t.assert(bf.EnableLog())
+	off, err := bf.Allocate()
+	t.assert(err)
+	t.assert(bf.Do(off, 1, func(bytes []byte) error {
+		bytes[15] = 12
+		return nil
+	}))
+	t.assert(bf.Sync())
+	size, err := bf.Size()
+	t.assert(err)
+
+	// changes after the checkpoint which should be rolled back
+	t.assert(bf.Do(off, 1, func(bytes []byte) error {
+		bytes[15] = 13
+		bytes[16] = 14
+		return nil
+	}))
+	for i := 0; i < 300; i++ {
+		_, err := bf.Allocate()
+		t.assert(err)
+	}
+	t.assert(bf.SetControlDataNoSync([]byte{1, 2, 3}))
+
+	// "crash" by copying the file and the log out from under the open
+	// block file.
+	copyFile(t, bf.Path(), crashed)
+	copyFile(t, logPath(bf.Path()), logPath(crashed))
+
+	cbf, err := OpenBlockFile(crashed)
+	t.assert(err)
+	defer t.cleanup(cbf)
+	if !cbf.Logged() {
+		t.Errorf("expected the log to still be enabled")
+	}
+	csize, err := cbf.Size()
+	t.assert(err)
+	if csize != size {
+		t.Errorf("size was %v expected %v", csize, size)
+	}
+	t.assert(cbf.Do(off, 1, func(bytes []byte) error {
+		for i, b := range bytes {
+			if i == 15 && b != 12 {
+				t.Errorf("bytes[15] != 12")
+			} else if i != 15 && b != 0 {
+				t.Errorf("bytes[%d] != 0", i)
+			}
+		}
+		return nil
+	}))
+	data, err := cbf.ControlData()
+	t.assert(err)
+	if data[0] != 0 || data[1] != 0 || data[2] != 0 {
+		t.Errorf("control data was not rolled back %v", data[:3])
+	}
+}
+
+func TestLogCleanClose(x *testing.T) {
+	t := (*T)(x)
+	bf := t.blkfile()
+	t.assert(bf.EnableLog())
+	off, err := bf.Allocate()
+	t.assert(err)
+	t.assert(bf.Do(off, 1, func(bytes []byte) error {
+		bytes[15] = 12
+		return nil
+	}))
+	t.assert(bf.Close())
+	bf, err = OpenBlockFile(path)
+	t.assert(err)
+	defer t.cleanup(bf)
+	t.assert(bf.Do(off, 1, func(bytes []byte) error {
+		if bytes[15] != 12 {
+			t.Errorf("bytes[15] != 12")
+		}
+		return nil
+	}))
+	t.assert(bf.DisableLog())
+	if _, err := os.Stat(logPath(path)); !os.IsNotExist(err) {
+		t.Errorf("the log was not removed, %v", err)
+	}
+}
+
+func TestLogReadsAndCheckpoints(x *testing.T) {
+	t := (*T)(x)
+	bf := t.blkfile()
+	defer t.cleanup(bf)
+	off, err := bf.Allocate()
+	t.assert(err)
+	t.assert(bf.EnableLog())
+
+	// reads are not logged and do not hold up a checkpoint
+	t.assert(bf.DoRead(off, 1, func(bytes []byte) error {
+		return bf.Sync()
+	}))
+	if bf.wal.end != logHeaderSize {
+		t.Errorf("a read was logged")
+	}
+	// so are reads of the control block
+	bf.free = nil
+	t.assert(bf.DoRead(off, 1, func([]byte) error {
+		if _, err := bf.ControlData(); err != nil {
+			return err
+		}
+		if _, err := bf.Version(); err != nil {
+			return err
+		}
+		if _, err := bf.Features(); err != nil {
+			return err
+		}
+		if _, err := bf.isFree(off); err != nil {
+			return err
+		}
+		if n := atomic.LoadInt64(&bf.writers); n != 0 {
+			t.Errorf("reading the control block counted as %d writers", n)
+		}
+		return nil
+	}))
+	if bf.wal.end != logHeaderSize {
+		t.Errorf("a read of the control block was logged")
+	}
+	t.assert(bf.Pin())
+	t.assert(bf.SetControlData([]byte{1, 2, 3}))
+	t.assert(bf.Unpin())
+
+	// a write is logged and the checkpoint waits for it to be released
+	bytes, err := bf.Get(off, 1)
+	t.assert(err)
+	if bf.wal.end == logHeaderSize {
+		t.Errorf("a write was not logged")
+	}
+	synced := make(chan error)
+	go func() {
+		synced <- bf.Sync()
+	}()
+	select {
+	case err := <-synced:
+		t.Fatalf("the checkpoint did not wait for the writer, %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	bytes[15] = 12
+	t.assert(bf.Release(bytes))
+	t.assert(<-synced)
+	if bf.wal.end != logHeaderSize {
+		t.Errorf("the checkpoint did not empty the log")
+	}
+}
+
+func TestJournalRollback(x *testing.T) {
+	t := (*T)(x)
+	bf := t.blkfile()
+	defer t.cleanup(bf)
+	off, err := bf.Allocate()
+	t.assert(err)
+	size, err := bf.Size()
+	t.assert(err)
+	t.assert(bf.BeginJournal())
+	t.assert(bf.DoRead(off, 1, func(bytes []byte) error {
+		return nil
+	}))
+	if len(bf.journal.images) != 0 {
+		t.Errorf("a read was journaled")
+	}
+	t.assert(bf.Do(off, 1, func(bytes []byte) error {
+		bytes[15] = 12
+		return nil
+	}))
+	for i := 0; i < 300; i++ {
+		_, err := bf.Allocate()
+		t.assert(err)
+	}
+	t.assert(bf.RollbackJournal())
+	if bf.Journaling() {
+		t.Errorf("the journal should be done")
+	}
+	nsize, err := bf.Size()
+	t.assert(err)
+	if nsize != size {
+		t.Errorf("size was %v expected %v", nsize, size)
+	}
+	t.assert(bf.Do(off, 1, func(bytes []byte) error {
+		if bytes[15] != 0 {
+			t.Errorf("bytes[15] != 0")
+		}
+		return nil
+	}))
+	off2, err := bf.Allocate()
+	t.assert(err)
+	if off2 == off {
+		t.Errorf("allocated a block which was already allocated")
+	}
+}
+
+func TestSnapshot(x *testing.T) {
+	t := (*T)(x)
+	bf := t.blkfile()
+	defer t.cleanup(bf)
+	off, err := bf.Allocate()
+	t.assert(err)
+	t.assert(bf.Do(off, 1, func(bytes []byte) error {
+		bytes[15] = 12
+		return nil
+	}))
+	snap, err := bf.Snapshot()
+	t.assert(err)
+	t.assert(bf.Do(off, 1, func(bytes []byte) error {
+		bytes[15] = 13
+		return nil
+	}))
+	for i := 0; i < 300; i++ {
+		_, err := bf.Allocate()
+		t.assert(err)
+	}
+	t.assert(snap.Do(off, 1, func(bytes []byte) error {
+		if bytes[15] != 12 {
+			t.Errorf("bytes[15] != 12")
+		}
+		return nil
+	}))
+	t.assert(bf.Do(off, 1, func(bytes []byte) error {
+		if bytes[15] != 13 {
+			t.Errorf("bytes[15] != 13")
+		}
+		return nil
+	}))
+	if _, err := snap.Allocate(); err == nil {
+		t.Errorf("expected the snapshot to be read only")
+	}
+	if err := bf.Close(); err == nil {
+		t.Errorf("expected close to fail with an open snapshot")
+	}
+	t.assert(snap.Close())
+}
+
+func TestLocking(x *testing.T) {
+	t := (*T)(x)
+	bf := t.blkfile()
+	defer func() { t.cleanup(bf) }()
+	off, err := bf.Allocate()
+	t.assert(err)
+	t.assert(bf.Do(off, 1, func(bytes []byte) error {
+		bytes[15] = 12
+		return nil
+	}))
+	if _, err := OpenBlockFile(path); err == nil {
+		t.Fatal("expected a second writer to fail")
+	}
+	if _, err := CreateBlockFile(path); err == nil {
+		t.Fatal("expected creating over a writer to fail")
+	}
+	ro, err := OpenBlockFileReadOnly(path)
+	t.assert(err)
+	if !ro.ReadOnly() {
+		t.Errorf("expected a read only file")
+	}
+	t.assert(ro.Do(off, 1, func(bytes []byte) error {
+		if bytes[15] != 12 {
+			t.Errorf("bytes[15] != 12")
+		}
+		return nil
+	}))
+	if _, err := ro.Allocate(); err == nil {
+		t.Errorf("expected Allocate to fail on a read only file")
+	}
+	if err := ro.Free(off); err == nil {
+		t.Errorf("expected Free to fail on a read only file")
+	}
+	if err := ro.SetControlData([]byte{1}); err == nil {
+		t.Errorf("expected SetControlData to fail on a read only file")
+	}
+
+	// the reader follows the writer as it grows the file
+	var last uint64
+	for i := 0; i < 300; i++ {
+		last, err = bf.Allocate()
+		t.assert(err)
+	}
+	t.assert(bf.Do(last, 1, func(bytes []byte) error {
+		bytes[15] = 13
+		return nil
+	}))
+	t.assert(ro.Do(last, 1, func(bytes []byte) error {
+		if bytes[15] != 13 {
+			t.Errorf("bytes[15] != 13")
+		}
+		return nil
+	}))
+	t.assert(bf.Close())
+	if _, err := CreateBlockFile(path); err == nil {
+		t.Fatal("expected creating over a reader to fail")
+	}
+	t.assert(ro.Close())
+	bf, err = OpenBlockFile(path)
+	t.assert(err)
+}
+
+func TestSyncModes(x *testing.T) {
+	t := (*T)(x)
+	for _, mode := range []SyncMode{ASYNC, SYNC, FSYNC_ON_CLOSE} {
+		bf := t.blkfile()
+		t.assert(bf.SetSyncMode(mode))
+		off, err := bf.Allocate()
+		t.assert(err)
+		t.assert(bf.Do(off, 1, func(bytes []byte) error {
+			bytes[15] = 12
+			return nil
+		}))
+		t.assert(bf.SyncRange(off, 1))
+		t.assert(bf.SetControlData([]byte{1, 2, 3}))
+		t.assert(bf.Sync())
+		if err := bf.SyncRange(off+1, 1); err == nil {
+			t.Errorf("expected an unaligned SyncRange to fail")
+		}
+		size, err := bf.Size()
+		t.assert(err)
+		if err := bf.SyncRange(size, 1); err == nil {
+			t.Errorf("expected a SyncRange past the end to fail")
+		}
+		t.assert(bf.Close())
+		bf, err = OpenBlockFile(path)
+		t.assert(err)
+		t.assert(bf.Do(off, 1, func(bytes []byte) error {
+			if bytes[15] != 12 {
+				t.Errorf("bytes[15] != 12")
+			}
+			return nil
+		}))
+		t.cleanup(bf)
+	}
+	bf := t.blkfile()
+	defer t.cleanup(bf)
+	if err := bf.SetSyncMode(SyncMode(12)); err == nil {
+		t.Errorf("expected an unknown sync mode to fail")
+	}
+}
+
+func TestHeader(x *testing.T) {
+	t := (*T)(x)
+	// not a block file
+	junk := make([]byte, 2*BLOCKSIZE)
+	for i := range junk {
+		junk[i] = byte(i*7 + 3)
+	}
+	t.assert(ioutil.WriteFile(path, junk, 0666))
+	if _, err := OpenBlockFile(path); err == nil {
+		t.Fatal("expected opening a random file to fail")
+	}
+	t.assert(os.Remove(path))
+
+	// a file from a newer version
+	bf := t.blkfile()
+	t.assert(bf.ctrl(func(ctrl *ctrlblk) error {
+		ctrl.header.version = FORMAT_VERSION + 1
+		return nil
+	}))
+	t.assert(bf.Close())
+	if _, err := OpenBlockFile(path); err == nil {
+		t.Fatal("expected opening a newer file to fail")
+	}
+
+	// a file from before the header is migrated in place
+	bf = t.blkfile()
+	defer func() { t.cleanup(bf) }()
+	t.assert(bf.SetControlData([]byte{1, 2, 3}))
+	t.assert(bf.ctrl(func(ctrl *ctrlblk) error {
+		ctrl.header = header{}
+		return nil
+	}))
+	t.assert(bf.Close())
+	if _, err := OpenBlockFileReadOnly(path); err == nil {
+		t.Fatal("expected a read only open of an old file to fail")
+	}
+	if _, err := OpenBlockFile(path); err == nil {
+		t.Fatal("expected opening an old file without OpenLegacyBlockFile to fail")
+	}
+	builtin := migrations[0]
+	migrated := false
+	migrations[0] = func(bf *BlockFile) error {
+		migrated = true
+		return builtin(bf)
+	}
+	defer func() { migrations[0] = builtin }()
+	bf, err := OpenLegacyBlockFile(path)
+	t.assert(err)
+	if !migrated {
+		t.Error("expected the migration to run")
+	}
+	version, err := bf.Version()
+	t.assert(err)
+	if version != FORMAT_VERSION {
+		t.Errorf("version was %d expected %d", version, FORMAT_VERSION)
+	}
+	data, err := bf.ControlData()
+	t.assert(err)
+	if data[0] != 1 || data[1] != 2 || data[2] != 3 {
+		t.Error("the control data should have survived the migration")
+	}
+	t.assert(bf.AddFeatures(FEATURE_CHECKSUMS))
+	features, err := bf.Features()
+	t.assert(err)
+	if features != FEATURE_CHECKSUMS {
+		t.Errorf("features were %x", features)
+	}
+}
+
+func TestControlDataMigration(x *testing.T) {
+	t := (*T)(x)
+	bf := t.blkfile()
+	defer func() { t.cleanup(bf) }()
+	data := make([]byte, BLOCKSIZE-ctrldataSize)
+	for i := range data {
+		data[i] = byte(i*13 + 1)
+	}
+	// a version 0 file (of two blocks) has control data all the way to
+	// the end of the control block, over where the header is now
+	a, err := bf.Allocate()
+	t.assert(err)
+	t.assert(bf.ctrl(func(ctrl *ctrlblk) error {
+		ctrl.meta.free_head = 0
+		ctrl.meta.free_len = 0
+		return nil
+	}))
+	t.assert(bf.resize(a + BLOCKSIZE))
+	t.assert(bf.Do(0, 1, func(bytes []byte) error {
+		copy(bytes[ctrldataSize:BLOCKSIZE], data)
+		return nil
+	}))
+	t.assert(bf.Close())
+	bf, err = OpenLegacyBlockFile(path)
+	t.assert(err)
+	version, err := bf.Version()
+	t.assert(err)
+	if version != FORMAT_VERSION {
+		t.Errorf("version was %d expected %d", version, FORMAT_VERSION)
+	}
+	got, err := bf.ControlData()
+	t.assert(err)
+	if !bytes.Equal(got, data) {
+		t.Fatal("the control data did not survive the migration")
+	}
+	// and it survives being moved (into the freed block) by Compact
+	t.assert(bf.Free(a))
+	_, err = bf.Compact(func(from, to uint64) (bool, error) {
+		t.Errorf("unexpected relocation of %d", from)
+		return false, nil
+	})
+	t.assert(err)
+	t.assert(bf.Close())
+	bf, err = OpenBlockFile(path)
+	t.assert(err)
+	size, err := bf.Size()
+	t.assert(err)
+	if size != 2*BLOCKSIZE {
+		t.Errorf("size was %d expected %d", size, 2*BLOCKSIZE)
+	}
+	got, err = bf.ControlData()
+	t.assert(err)
+	if !bytes.Equal(got, data) {
+		t.Fatal("the control data did not survive being compacted")
+	}
+	data[len(data)-1] = 0
+	t.assert(bf.SetControlData(data))
+	got, err = bf.ControlData()
+	t.assert(err)
+	if !bytes.Equal(got, data) {
+		t.Fatal("the control data was not set")
+	}
+}
+
+func TestForeignFile(x *testing.T) {
+	t := (*T)(x)
+	defer os.Remove(path)
+	random := make([]byte, 3*BLOCKSIZE)
+	for i := range random {
+		random[i] = byte(i*31 + i/7)
+	}
+	// it starts like a version 0 file with a block size of 4096
+	legacyish := make([]byte, 2*BLOCKSIZE)
+	for i := range legacyish {
+		legacyish[i] = byte(i*7 + 3)
+	}
+	copy(legacyish, []byte{0x00, 0x10, 0x00, 0x00})
+	opens := map[string]func(string) (*BlockFile, error){
+		"OpenBlockFile":         OpenBlockFile,
+		"OpenLegacyBlockFile":   OpenLegacyBlockFile,
+		"OpenBlockFileReadOnly": OpenBlockFileReadOnly,
+	}
+	for _, data := range [][]byte{random, legacyish} {
+		for name, open := range opens {
+			t.assert(ioutil.WriteFile(path, data, 0666))
+			if bf, err := open(path); err == nil {
+				bf.Close()
+				t.Fatalf("expected %v of a foreign file to fail", name)
+			}
+			got, err := ioutil.ReadFile(path)
+			t.assert(err)
+			if !bytes.Equal(got, data) {
+				t.Fatalf("%v changed the foreign file (it is %d bytes, was %d)", name, len(got), len(data))
+			}
+		}
+	}
+}
+
+func TestCompact(x *testing.T) {
+	t := (*T)(x)
+	bf := t.blkfile()
+	defer func() { t.cleanup(bf) }()
+	blocks := make([]uint64, 0, 300)
+	for i := 0; i < cap(blocks); i++ {
+		a, err := bf.Allocate()
+		t.assert(err)
+		t.assert(bf.Do(a, 1, func(bytes []byte) error {
+			bytes[0] = byte(i)
+			bytes[1] = 1
+			return nil
+		}))
+		blocks = append(blocks, a)
+	}
+	start, err := bf.Size()
+	t.assert(err)
+	var last uint64
+	for _, a := range blocks {
+		if a > last {
+			last = a
+		}
+	}
+	t.assert(bf.Truncate())
+	size, err := bf.Size()
+	t.assert(err)
+	if size > start || size != last+BLOCKSIZE {
+		t.Fatalf("size was %d expected %d", size, last+BLOCKSIZE)
+	}
+	live := make(map[uint64]byte)
+	for i, a := range blocks {
+		if i%3 == 0 {
+			live[a] = byte(i)
+		} else {
+			t.assert(bf.Free(a))
+		}
+	}
+	// it would leave the reader mapped past the end of the file
+	ro, err := OpenBlockFileReadOnly(path)
+	t.assert(err)
+	if _, err := bf.Compact(func(from, to uint64) (bool, error) {
+		t.Fatalf("moved %d while the file was open read only", from)
+		return false, nil
+	}); err == nil {
+		t.Fatal("expected compacting a file which is open read only to fail")
+	}
+	if err := bf.Truncate(); err == nil {
+		t.Fatal("expected truncating a file which is open read only to fail")
+	}
+	t.assert(ro.Close())
+	moves := 0
+	reclaimed, err := bf.Compact(func(from, to uint64) (bool, error) {
+		if moves == 0 {
+			if ro, err := OpenBlockFileReadOnly(path); err == nil {
+				ro.Close()
+				t.Errorf("opened the file read only while it was compacted")
+			}
+		}
+		live[to] = live[from]
+		delete(live, from)
+		moves++
+		return true, nil
+	})
+	t.assert(err)
+	before := size
+	size, err = bf.Size()
+	t.assert(err)
+	if moves == 0 || size != uint64(len(live)+1)*BLOCKSIZE {
+		t.Fatalf("size was %d after %d moves expected %d", size, moves, (len(live)+1)*BLOCKSIZE)
+	}
+	if reclaimed != before-size {
+		t.Errorf("reclaimed %d expected %d", reclaimed, before-size)
+	}
+	ro, err = OpenBlockFileReadOnly(path)
+	t.assert(err)
+	t.assert(ro.Close())
+	for a, i := range live {
+		t.assert(bf.Do(a, 1, func(bytes []byte) error {
+			if bytes[0] != i || bytes[1] != 1 {
+				t.Errorf("block %d was not moved correctly", a)
+			}
+			return nil
+		}))
+	}
+	a, err := bf.Allocate()
+	t.assert(err)
+	if a != size {
+		t.Errorf("expected the next block to be at the end of the file")
+	}
+}
+
+func TestCompactUnmovable(x *testing.T) {
+	t := (*T)(x)
+	bf := t.blkfile()
+	defer func() { t.cleanup(bf) }()
+	blocks := make([]uint64, 0, 30)
+	for i := 0; i < cap(blocks); i++ {
+		a, err := bf.Allocate()
+		t.assert(err)
+		blocks = append(blocks, a)
+	}
+	// free the first half, the block at 20 cannot be moved
+	for _, a := range blocks[:15] {
+		t.assert(bf.Free(a))
+	}
+	stuck := blocks[20]
+	before, err := bf.Size()
+	t.assert(err)
+	moved := make(map[uint64]bool)
+	reclaimed, err := bf.Compact(func(from, to uint64) (bool, error) {
+		if from == stuck {
+			return false, nil
+		}
+		moved[from] = true
+		return true, nil
+	})
+	t.assert(err)
+	// the blocks before the stuck one are still moved
+	for _, a := range blocks[15:] {
+		if a != stuck && !moved[a] {
+			t.Errorf("block %d was not moved", a)
+		}
+	}
+	size, err := bf.Size()
+	t.assert(err)
+	if size != stuck+BLOCKSIZE {
+		t.Errorf("size was %d expected %d", size, stuck+BLOCKSIZE)
+	}
+	if reclaimed != before-size {
+		t.Errorf("reclaimed %d expected %d", reclaimed, before-size)
+	}
+	free, err := bf.freeBlocks()
+	t.assert(err)
+	if uint64(len(free)) != stuck/BLOCKSIZE-15 {
+		t.Errorf("%d free blocks expected %d", len(free), stuck/BLOCKSIZE-15)
+	}
+}
+
+func TestPin(x *testing.T) {
+	t := (*T)(x)
+	bf := t.blkfile()
+	defer t.cleanup(bf)
+	a, err := bf.Allocate()
+	t.assert(err)
+	var pinned []byte
+	t.assert(bf.Do(a, 1, func(bytes []byte) error {
+		bytes[0] = 7
+		pinned = bytes
+		return nil
+	}))
+	t.assert(bf.Pin())
+	if bf.Close() == nil {
+		t.Fatal("closed a pinned file")
+	}
+	size, err := bf.Size()
+	t.assert(err)
+	grown := make(chan error)
+	go func() {
+		// more blocks than the file has so it must grow
+		_, err := bf.AllocateBlocks(int(size/BLOCKSIZE) + 1)
+		grown <- err
+	}()
+	select {
+	case err := <-grown:
+		t.Fatalf("the file grew while it was pinned (%v)", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if pinned[0] != 7 {
+		t.Errorf("the pinned bytes changed")
+	}
+	t.assert(bf.Unpin())
+	t.assert(<-grown)
+	if bf.Unpin() == nil {
+		t.Errorf("unpinned an unpinned file")
+	}
+}
@@ -0,0 +1,364 @@
+package fmap
+
+import (
+	"sort"
+)
+
+import (
+	"github.com/timtadh/fs2/errors"
+	"github.com/timtadh/fs2/slice"
+)
+
+// Free space is kept as extents: runs of contiguous free blocks. The
+// first block of each extent holds a freeext and the extents are kept in
+// a doubly linked list starting at ctrl.meta.free_head (ctrl.meta.free_len
+// counts the free blocks). Freeing a block next to an existing extent
+// grows the extent (coalescing with the extent on the other side if the
+// block filled the gap) so AllocateBlocks can be satisfied from freed
+// space.
+//
+// The list in the file is unordered. An index of the extents ordered by
+// offset is built in memory the first time the allocator needs it, it is
+// what finds neighbours when freeing and the lowest extent which fits
+// when allocating (so the live blocks stay towards the front of the
+// file).
+type freeext struct {
+	prev   uint64
+	next   uint64
+	blocks uint64
+}
+
+func loadFreeExt(bytes []byte) *freeext {
+	back := slice.AsSlice(&bytes)
+	return (*freeext)(back.Array)
+}
+
+// The format version 1 free list was a singly linked list of blocks.
+type freeblk struct {
+	next uint64
+}
+
+func loadFreeBlk(bytes []byte) *freeblk {
+	free_s := slice.AsSlice(&bytes)
+	return (*freeblk)(free_s.Array)
+}
+
+type extent struct {
+	start  uint64
+	blocks uint64
+}
+
+type freeSpace struct {
+	exts []extent // ordered by start
+}
+
+func (self *BlockFile) end(e extent) uint64 {
+	return e.start + e.blocks*uint64(self.blksize)
+}
+
+// The in memory index of the free extents, loading it if needed.
+func (self *BlockFile) freeSpace() (*freeSpace, error) {
+	if self.free != nil {
+		return self.free, nil
+	}
+	free := &freeSpace{}
+	err := self.readCtrl(func(ctrl *ctrlblk) error {
+		var blocks uint64
+		maxExts := int(self.size / uint64(self.blksize))
+		for a := ctrl.meta.free_head; a != 0; {
+			if a >= self.size || len(free.exts) > maxExts {
+				return errors.Errorf("The free list is corrupt at %d", a)
+			}
+			err := self.DoRead(a, 1, func(bytes []byte) error {
+				f := loadFreeExt(bytes)
+				free.exts = append(free.exts, extent{start: a, blocks: f.blocks})
+				blocks += f.blocks
+				a = f.next
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if blocks != uint64(ctrl.meta.free_len) {
+			return errors.Errorf("The free list is corrupt, it has %d blocks expected %d", blocks, ctrl.meta.free_len)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(free.exts, func(i, j int) bool { return free.exts[i].start < free.exts[j].start })
+	self.free = free
+	return free, nil
+}
+
+// Is the block at offset free?
+func (self *BlockFile) isFree(offset uint64) (bool, error) {
+	free, err := self.freeSpace()
+	if err != nil {
+		return false, err
+	}
+	exts := free.exts
+	i := sort.Search(len(exts), func(i int) bool { return exts[i].start > offset })
+	return i > 0 && self.end(exts[i-1]) > offset, nil
+}
+
+// Put the extent at the head of the list in the file.
+func (self *BlockFile) linkExtent(ctrl *ctrlblk, e extent) error {
+	head := ctrl.meta.free_head
+	err := self.Do(e.start, 1, func(bytes []byte) error {
+		f := loadFreeExt(bytes)
+		f.prev = 0
+		f.next = head
+		f.blocks = e.blocks
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if head != 0 {
+		err = self.Do(head, 1, func(bytes []byte) error {
+			loadFreeExt(bytes).prev = e.start
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	ctrl.meta.free_head = e.start
+	return nil
+}
+
+// Take the extent starting at start out of the list in the file.
+func (self *BlockFile) unlinkExtent(ctrl *ctrlblk, start uint64) error {
+	var prev, next uint64
+	err := self.Do(start, 1, func(bytes []byte) error {
+		f := loadFreeExt(bytes)
+		prev, next = f.prev, f.next
+		f.prev, f.next, f.blocks = 0, 0, 0
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if prev != 0 {
+		err = self.Do(prev, 1, func(bytes []byte) error {
+			loadFreeExt(bytes).next = next
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		ctrl.meta.free_head = next
+	}
+	if next != 0 {
+		return self.Do(next, 1, func(bytes []byte) error {
+			loadFreeExt(bytes).prev = prev
+			return nil
+		})
+	}
+	return nil
+}
+
+func (self *BlockFile) setExtentBlocks(e extent) error {
+	return self.Do(e.start, 1, func(bytes []byte) error {
+		loadFreeExt(bytes).blocks = e.blocks
+		return nil
+	})
+}
+
+// Add the blocks starting at start to the free space, coalescing with
+// the neighbouring extents.
+func (self *BlockFile) freeBlocksAt(start, blocks uint64) error {
+	free, err := self.freeSpace()
+	if err != nil {
+		return err
+	}
+	e := extent{start: start, blocks: blocks}
+	exts := free.exts
+	i := sort.Search(len(exts), func(i int) bool { return exts[i].start > start })
+	if (i > 0 && self.end(exts[i-1]) > start) || (i < len(exts) && self.end(e) > exts[i].start) {
+		return errors.Errorf("Double free of %d", start)
+	}
+	mergePrev := i > 0 && self.end(exts[i-1]) == start
+	mergeNext := i < len(exts) && self.end(e) == exts[i].start
+	return self.ctrl(func(ctrl *ctrlblk) error {
+		switch {
+		case mergePrev && mergeNext:
+			exts[i-1].blocks += blocks + exts[i].blocks
+			if err := self.unlinkExtent(ctrl, exts[i].start); err != nil {
+				return err
+			}
+			if err := self.setExtentBlocks(exts[i-1]); err != nil {
+				return err
+			}
+			free.exts = append(exts[:i], exts[i+1:]...)
+		case mergePrev:
+			exts[i-1].blocks += blocks
+			if err := self.setExtentBlocks(exts[i-1]); err != nil {
+				return err
+			}
+		case mergeNext:
+			e.blocks += exts[i].blocks
+			if err := self.unlinkExtent(ctrl, exts[i].start); err != nil {
+				return err
+			}
+			if err := self.linkExtent(ctrl, e); err != nil {
+				return err
+			}
+			exts[i] = e
+		default:
+			if err := self.linkExtent(ctrl, e); err != nil {
+				return err
+			}
+			free.exts = append(exts, extent{})
+			copy(free.exts[i+1:], free.exts[i:])
+			free.exts[i] = e
+		}
+		ctrl.meta.free_len += uint32(blocks)
+		return nil
+	})
+}
+
+// Take n contiguous blocks from the lowest free extent which has room.
+func (self *BlockFile) takeBlocks(n uint64) (offset uint64, found bool, err error) {
+	free, err := self.freeSpace()
+	if err != nil {
+		return 0, false, err
+	}
+	i := 0
+	for ; i < len(free.exts); i++ {
+		if free.exts[i].blocks >= n {
+			break
+		}
+	}
+	if i >= len(free.exts) {
+		return 0, false, nil
+	}
+	e := free.exts[i]
+	err = self.ctrl(func(ctrl *ctrlblk) error {
+		if err := self.unlinkExtent(ctrl, e.start); err != nil {
+			return err
+		}
+		if e.blocks > n {
+			rest := extent{start: e.start + n*uint64(self.blksize), blocks: e.blocks - n}
+			if err := self.linkExtent(ctrl, rest); err != nil {
+				return err
+			}
+			free.exts[i] = rest
+		} else {
+			free.exts = append(free.exts[:i], free.exts[i+1:]...)
+		}
+		ctrl.meta.free_len -= uint32(n)
+		return nil
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	return e.start, true, nil
+}
+
+// The free extent ending at the end of the file (if there is one).
+func (self *BlockFile) lastExtent() (e extent, has bool, err error) {
+	free, err := self.freeSpace()
+	if err != nil {
+		return e, false, err
+	}
+	if len(free.exts) == 0 {
+		return e, false, nil
+	}
+	e = free.exts[len(free.exts)-1]
+	return e, self.end(e) == self.size, nil
+}
+
+// The offsets of the free blocks.
+func (self *BlockFile) freeBlocks() (map[uint64]bool, error) {
+	free, err := self.freeSpace()
+	if err != nil {
+		return nil, err
+	}
+	blocks := make(map[uint64]bool)
+	for _, e := range free.exts {
+		for a := e.start; a < self.end(e); a += uint64(self.blksize) {
+			blocks[a] = true
+		}
+	}
+	return blocks, nil
+}
+
+// Replace the free space with the blocks in free.
+func (self *BlockFile) setFreeList(free map[uint64]bool) error {
+	blocks := make([]uint64, 0, len(free))
+	for a := range free {
+		blocks = append(blocks, a)
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i] < blocks[j] })
+	space := &freeSpace{}
+	for _, a := range blocks {
+		n := len(space.exts)
+		if n > 0 && self.end(space.exts[n-1]) == a {
+			space.exts[n-1].blocks++
+		} else {
+			space.exts = append(space.exts, extent{start: a, blocks: 1})
+		}
+	}
+	self.free = nil
+	err := self.ctrl(func(ctrl *ctrlblk) error {
+		ctrl.meta.free_head = 0
+		ctrl.meta.free_len = 0
+		for _, e := range space.exts {
+			if err := self.linkExtent(ctrl, e); err != nil {
+				return err
+			}
+			ctrl.meta.free_len += uint32(e.blocks)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	self.free = space
+	return nil
+}
+
+// The blocks in the format version 1 (and 0) free list. It only reads
+// the file, so it also checks a file is a version 0 file before it is
+// migrated (see OpenLegacyBlockFile).
+func (self *BlockFile) legacyFreeList() (free map[uint64]bool, err error) {
+	free = make(map[uint64]bool)
+	err = self.readCtrl(func(ctrl *ctrlblk) error {
+		a := ctrl.meta.free_head
+		for i := uint32(0); i < ctrl.meta.free_len; i++ {
+			if a == 0 || a >= self.size || a%uint64(self.blksize) != 0 || free[a] {
+				return errors.Errorf("The free list is corrupt at %d", a)
+			}
+			free[a] = true
+			err := self.DoRead(a, 1, func(bytes []byte) error {
+				a = loadFreeBlk(bytes).next
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return free, nil
+}
+
+func init() {
+	// Version 1 files kept a singly linked list of free blocks. Convert it
+	// to extents.
+	RegisterMigration(1, func(bf *BlockFile) error {
+		free, err := bf.legacyFreeList()
+		if err != nil {
+			return err
+		}
+		return bf.setFreeList(free)
+	})
+}
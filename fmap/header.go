@@ -0,0 +1,218 @@
+package fmap
+
+import (
+	"reflect"
+)
+
+import (
+	"github.com/timtadh/fs2/errors"
+)
+
+// Every BlockFile carries a header at the end of its control block
+// (block 0) identifying it as an fs2 file and recording the version of
+// the on disk format, the block size and the features in use. It is
+// validated on open so opening a file which is not a BlockFile (or was
+// written by a newer fs2) fails cleanly instead of producing garbage.
+//
+// Files written before the header existed (version 0) have the end of
+// their control data where the header goes. Nothing identifies them as
+// fs2 files so they are only opened by OpenLegacyBlockFile, which checks
+// their control block and free list (without writing) and then upgrades
+// them in place with the registered migrations. The upgrade moves the
+// end of the control data into a block of its own (tail) so none of it
+// is lost, see ControlData.
+type header struct {
+	magic    [8]byte
+	version  uint32
+	blksize  uint32
+	features uint64
+	tail     uint64 // the block holding the end of the control data (or 0)
+}
+
+const headerSize = 32
+
+// The current version of the on disk format.
+const FORMAT_VERSION uint32 = 2
+
+// Feature flags stored in the header. A file with a feature this
+// version of fs2 does not know about cannot be opened.
+const (
+	// some structure in the file stores checksums in its blocks
+	FEATURE_CHECKSUMS uint64 = 1 << iota
+)
+
+const supportedFeatures = FEATURE_CHECKSUMS
+
+var fileMagic = [8]byte{'f', 's', '2', 'f', 'm', 'a', 'p', 0}
+
+// A Migration upgrades a file from one format version to the next. It
+// is run on an open (writable) BlockFile and must leave the file in the
+// next version's format. The version in the header is updated after it
+// returns successfully.
+type Migration func(bf *BlockFile) error
+
+var migrations = make(map[uint32]Migration)
+
+// Register the migration which upgrades files from format version from
+// to version from+1. Migrations are run in order when an older file is
+// opened with OpenBlockFile. It panics if a migration from that version
+// is already registered.
+func RegisterMigration(from uint32, m Migration) {
+	if _, has := migrations[from]; has {
+		panic(errors.Errorf("a migration from format version %d is already registered", from))
+	}
+	migrations[from] = m
+}
+
+func init() {
+	h := &header{}
+	if reflect.TypeOf(*h).Size() != headerSize {
+		panic("the header was an unexpected size")
+	}
+	// Version 0 files have no header. Move the control data where it
+	// goes to a new block at the end of the file and write one.
+	RegisterMigration(0, func(bf *BlockFile) error {
+		var tail [headerSize]byte
+		err := bf.Do(0, 1, func(bytes []byte) error {
+			copy(tail[:], bytes[BLOCKSIZE-headerSize:BLOCKSIZE])
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		var a uint64
+		if tail != [headerSize]byte{} {
+			a = bf.size
+			if err := bf.resize(bf.size + uint64(bf.blksize)); err != nil {
+				return err
+			}
+			err = bf.Do(a, 1, func(bytes []byte) error {
+				copy(bytes, tail[:])
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return bf.ctrl(func(ctrl *ctrlblk) error {
+			ctrl.header.Init(ctrl.meta.blksize)
+			ctrl.header.tail = a
+			return nil
+		})
+	})
+}
+
+func (h *header) Init(blksize uint32) {
+	h.magic = fileMagic
+	h.version = FORMAT_VERSION
+	h.blksize = blksize
+	h.features = 0
+	h.tail = 0
+}
+
+// Check the header (and the control block) of a newly mapped file,
+// setting the block size. Files from older versions are migrated (if
+// the file is writable). A file without a header is only taken to be a
+// version 0 file if legacy is set. Nothing is written until the file is
+// known to be a block file.
+func (self *BlockFile) loadHeader(legacy bool) error {
+	if self.size < BLOCKSIZE {
+		return errors.Errorf("%v is not an fs2 block file (it is too small)", self.path)
+	}
+	var h header
+	err := self.readCtrl(func(ctrl *ctrlblk) error {
+		h = ctrl.header
+		if h.magic != fileMagic {
+			if !legacy {
+				return errors.Errorf("%v is not an fs2 block file (it has no header), if it was written by a version of fs2 from before the header open it with OpenLegacyBlockFile", self.path)
+			}
+			// a file from before the header existed, the header is
+			// control data.
+			h = header{blksize: ctrl.meta.blksize}
+		} else if h.blksize != ctrl.meta.blksize {
+			return errors.Errorf("%v is corrupt, the block sizes in the control block disagree", self.path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if h.blksize == 0 || h.blksize%BLOCKSIZE != 0 || self.size%uint64(h.blksize) != 0 {
+		return errors.Errorf("%v is not an fs2 block file (bad block size %d)", self.path, h.blksize)
+	}
+	if h.tail != 0 && (h.tail%uint64(h.blksize) != 0 || h.tail >= self.size) {
+		return errors.Errorf("%v is corrupt, the end of its control data is not in the file", self.path)
+	}
+	if h.version > FORMAT_VERSION {
+		return errors.Errorf("%v was written by a newer fs2 (format version %d, this supports %d)", self.path, h.version, FORMAT_VERSION)
+	}
+	if h.features&^supportedFeatures != 0 {
+		return errors.Errorf("%v uses unsupported features (%x)", self.path, h.features&^supportedFeatures)
+	}
+	self.blksize = int(h.blksize)
+	if h.version == 0 {
+		if _, err := self.legacyFreeList(); err != nil {
+			return errors.Errorf("%v is not an fs2 block file, %v", self.path, err)
+		}
+	}
+	if h.version < FORMAT_VERSION {
+		if self.readonly {
+			return errors.Errorf("%v is in an old format (version %d), open it with OpenBlockFile to upgrade it first", self.path, h.version)
+		}
+		return self.migrate(h.version)
+	}
+	return nil
+}
+
+func (self *BlockFile) migrate(from uint32) error {
+	for v := from; v < FORMAT_VERSION; v++ {
+		m, has := migrations[v]
+		if !has {
+			return errors.Errorf("there is no migration from format version %d", v)
+		}
+		if err := m(self); err != nil {
+			return err
+		}
+		err := self.ctrl(func(ctrl *ctrlblk) error {
+			ctrl.header.version = v + 1
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return self.Sync()
+}
+
+// The format version of the file.
+func (self *BlockFile) Version() (version uint32, err error) {
+	err = self.readCtrl(func(ctrl *ctrlblk) error {
+		version = ctrl.header.version
+		return nil
+	})
+	return version, err
+}
+
+// The feature flags set in the header of the file.
+func (self *BlockFile) Features() (features uint64, err error) {
+	err = self.readCtrl(func(ctrl *ctrlblk) error {
+		features = ctrl.header.features
+		return nil
+	})
+	return features, err
+}
+
+// Mark the file as using the given features (see FEATURE_CHECKSUMS).
+// Older versions of fs2 will refuse to open it.
+func (self *BlockFile) AddFeatures(features uint64) error {
+	if err := self.writable(); err != nil {
+		return err
+	}
+	if features&^supportedFeatures != 0 {
+		return errors.Errorf("unsupported features (%x)", features&^supportedFeatures)
+	}
+	return self.ctrl(func(ctrl *ctrlblk) error {
+		ctrl.header.features |= features
+		return nil
+	})
+}
@@ -0,0 +1,118 @@
+package fmap
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+import (
+	"github.com/timtadh/fs2/errors"
+	"github.com/timtadh/fs2/slice"
+)
+
+// The journal is an in memory undo log. While it is active the first
+// Get() (or Do()) of each block (which existed when the journal began)
+// copies the block's contents into the journal, blocks which are only
+// read (with DoRead()) are not copied. RollbackJournal() copies those
+// pre-images back and shrinks the file back to its size when the
+// journal began, undoing every change made in between (including
+// allocations and frees). CommitJournal() simply drops the pre-images.
+//
+// The journal is what the structures built on top of fmap use to
+// implement transactions. It does not make the changes durable, that is
+// still the job of Sync() (and the write ahead log, see EnableLog).
+type journal struct {
+	size   uint64
+	images map[uint64][]byte
+}
+
+// Start journaling changes to the file. Only one journal may be active
+// at a time.
+func (self *BlockFile) BeginJournal() error {
+	if err := self.writable(); err != nil {
+		return err
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.journal != nil {
+		return errors.Errorf("A journal is already active")
+	}
+	self.journal = &journal{
+		size:   self.size,
+		images: make(map[uint64][]byte),
+	}
+	return nil
+}
+
+// Keep all of the changes made since BeginJournal() and stop
+// journaling.
+func (self *BlockFile) CommitJournal() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.journal == nil {
+		return errors.Errorf("No journal is active")
+	}
+	self.journal = nil
+	return nil
+}
+
+// Undo all of the changes made since BeginJournal() and stop
+// journaling. There must be no outstanding pointers.
+func (self *BlockFile) RollbackJournal() error {
+	self.mu.Lock()
+	if self.journal == nil {
+		self.mu.Unlock()
+		return errors.Errorf("No journal is active")
+	}
+	if atomic.LoadInt64(&self.outstanding) > 0 {
+		self.mu.Unlock()
+		return errors.Errorf("cannot rollback the journal while there are outstanding pointers")
+	}
+	j := self.journal
+	self.journal = nil
+	// the rollback rewrites the free list, reload it when it is next used
+	self.free = nil
+	self.mu.Unlock()
+	if self.size != j.size {
+		if err := self.resize(j.size); err != nil {
+			return err
+		}
+	}
+	for offset, image := range j.images {
+		err := self.Do(offset, 1, func(block []byte) error {
+			copy(block, image)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Is there an active journal?
+func (self *BlockFile) Journaling() bool {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	return self.journal != nil
+}
+
+func (self *BlockFile) journalBlocks(offset, length uint64) {
+	blksize := uint64(self.blksize)
+	for a := offset; a < offset+length; a += blksize {
+		if a >= self.journal.size {
+			continue
+		}
+		if _, has := self.journal.images[a]; has {
+			continue
+		}
+		block := &slice.Slice{
+			Array: unsafe.Pointer(uintptr(self.mmap) + uintptr(a)),
+			Len:   int(blksize),
+			Cap:   int(blksize),
+		}
+		image := make([]byte, blksize)
+		copy(image, *block.AsBytes())
+		self.journal.images[a] = image
+	}
+}
@@ -0,0 +1,203 @@
+package fmap
+
+import (
+	"os"
+	"syscall"
+)
+
+import (
+	"github.com/timtadh/fs2/errors"
+)
+
+// Block files are protected from other processes with open file
+// description locks (fcntl F_OFD_SETLK). Unlike classic POSIX record
+// locks they belong to the open file (not the process) so two opens in
+// the same process exclude each other as well, and they are released
+// when the file is closed (or the process dies).
+//
+// Two bytes of the file are used as locks:
+//
+//	writerLock: held exclusively by the (single) read/write BlockFile
+//	readerLock: held shared by every read only BlockFile
+//
+// Readers and the writer do not exclude each other, so a read only
+// process can follow a file while another process writes it. Creating
+// (truncating) a file requires both bytes to be free and the writer
+// holds readerLock exclusively while it shrinks the file (see Compact).
+const (
+	_F_OFD_GETLK = 36
+	_F_OFD_SETLK = 37
+)
+
+const (
+	writerLock = 0
+	readerLock = 1
+)
+
+func fcntlLock(f *os.File, cmd int, typ int16, start int64) (*syscall.Flock_t, error) {
+	lk := &syscall.Flock_t{
+		Type:   typ,
+		Whence: 0,
+		Start:  start,
+		Len:    1,
+	}
+	err := syscall.FcntlFlock(f.Fd(), cmd, lk)
+	if err != nil {
+		return nil, err
+	}
+	return lk, nil
+}
+
+func tryLock(f *os.File, typ int16, start int64) (bool, error) {
+	_, err := fcntlLock(f, _F_OFD_SETLK, typ, start)
+	if err == syscall.EAGAIN || err == syscall.EACCES {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Is the lock held (in a way conflicting with typ) by another open file?
+func isLocked(f *os.File, typ int16, start int64) (bool, error) {
+	lk, err := fcntlLock(f, _F_OFD_GETLK, typ, start)
+	if err != nil {
+		return false, err
+	}
+	return lk.Type != syscall.F_UNLCK, nil
+}
+
+// Take the writer lock. If creating also ensure there are no readers.
+func lockWriter(f *os.File, creating bool) error {
+	ok, err := tryLock(f, syscall.F_WRLCK, writerLock)
+	if err != nil {
+		return err
+	} else if !ok {
+		return errors.Errorf("%v is already open for writing (by another process or BlockFile)", f.Name())
+	}
+	if creating {
+		readers, err := isLocked(f, syscall.F_WRLCK, readerLock)
+		if err != nil {
+			return err
+		} else if readers {
+			return errors.Errorf("%v cannot be recreated while it is open read only", f.Name())
+		}
+	}
+	return nil
+}
+
+func lockReader(f *os.File) error {
+	ok, err := tryLock(f, syscall.F_RDLCK, readerLock)
+	if err != nil {
+		return err
+	} else if !ok {
+		return errors.Errorf("%v could not be locked for reading", f.Name())
+	}
+	return nil
+}
+
+// Take the reader lock exclusively so no read only BlockFile has the file
+// open (or opens it) while it shrinks, their mappings would reach past
+// the end of the file.
+func lockShrink(f *os.File) error {
+	ok, err := tryLock(f, syscall.F_WRLCK, readerLock)
+	if err != nil {
+		return err
+	} else if !ok {
+		return errors.Errorf("%v cannot be shrunk while it is open read only", f.Name())
+	}
+	return nil
+}
+
+func unlockShrink(f *os.File) error {
+	_, err := fcntlLock(f, _F_OFD_SETLK, syscall.F_UNLCK, readerLock)
+	return err
+}
+
+// Open a previously created BlockFile read only. The file is mapped
+// PROT_READ and the functions which modify the file (Allocate,
+// AllocateBlocks, Free, SetControlData, EnableLog, BeginJournal,
+// Snapshot) return errors. Any number of read only BlockFiles may be
+// open alongside a single writer (see OpenBlockFile) in other
+// processes. When the writer grows the file the read only mapping
+// follows it on the next Get past the old end.
+//
+// The reader sees the writer's changes as they are made with no
+// coordination, so a reader racing the writer can observe a structure
+// in the middle of an update. Read while the writer is quiescent (for
+// instance between batches, after the writer calls Sync) and reopen the
+// structures on top of the file to pick up the writer's changes.
+//
+// If the file has a write ahead log with changes in it and there is no
+// writer the writer crashed. The file must be opened with OpenBlockFile
+// (which recovers it) before it can be opened read only.
+func OpenBlockFileReadOnly(path string) (*BlockFile, error) {
+	f, err := do_open(path, os.O_RDONLY|syscall.O_NOATIME)
+	if err != nil {
+		return nil, err
+	}
+	bf, err := openReadOnly(path, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return bf, nil
+}
+
+func openReadOnly(path string, f *os.File) (*BlockFile, error) {
+	err := lockReader(f)
+	if err != nil {
+		return nil, err
+	}
+	dirty, err := dirtyLog(path)
+	if err != nil {
+		return nil, err
+	}
+	if dirty {
+		writer, err := isLocked(f, syscall.F_WRLCK, writerLock)
+		if err != nil {
+			return nil, err
+		} else if !writer {
+			return nil, errors.Errorf("%v needs recovery, open it with OpenBlockFile first", path)
+		}
+	}
+	mmap, err := do_readonly_map(f)
+	if err != nil {
+		return nil, err
+	}
+	bf := &BlockFile{
+		path:     path,
+		file:     f,
+		mmap:     mmap,
+		opened:   true,
+		readonly: true,
+		blksize:  BLOCKSIZE, // set the initial block size to a safe size
+	}
+	bf.size, err = bf.fileSize()
+	if err != nil {
+		bf.Close()
+		return nil, err
+	}
+	err = bf.loadHeader(false)
+	if err != nil {
+		bf.Close()
+		return nil, err
+	}
+	return bf, nil
+}
+
+// Does the log at path have any records in it?
+func dirtyLog(path string) (bool, error) {
+	fi, err := os.Stat(logPath(path))
+	if err != nil && os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return fi.Size() > logHeaderSize, nil
+}
+
+// Was the file opened with OpenBlockFileReadOnly?
+func (self *BlockFile) ReadOnly() bool {
+	return self.readonly
+}
@@ -0,0 +1,60 @@
+package fmap
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+import (
+	"github.com/timtadh/fs2/errors"
+)
+
+// Pin the mapping so slices of it stay valid after they are released.
+// Until Unpin is called the file is not resized: Allocate (or anything
+// else which grows or shrinks the file) waits for the last pin to be
+// released rather than moving the mapping out from under the pinned
+// slices. A pin counts as an outstanding pointer so the file cannot be
+// closed (or compacted, or have its journal rolled back) while pinned.
+//
+// A goroutine must not grow the file while it holds a pin, it would
+// wait on itself.
+func (self *BlockFile) Pin() error {
+	self.pinMu.Lock()
+	defer self.pinMu.Unlock()
+	self.mu.RLock()
+	opened := self.opened
+	self.mu.RUnlock()
+	if !opened {
+		return errors.Errorf("File is not open")
+	}
+	self.pins++
+	atomic.AddInt64(&self.outstanding, 1)
+	return nil
+}
+
+// Release a pin taken with Pin.
+func (self *BlockFile) Unpin() error {
+	self.pinMu.Lock()
+	defer self.pinMu.Unlock()
+	if self.pins <= 0 {
+		return errors.Errorf("Unpin called without a matching Pin")
+	}
+	self.pins--
+	atomic.AddInt64(&self.outstanding, -1)
+	if self.pins == 0 && self.unpinned != nil {
+		self.unpinned.Broadcast()
+	}
+	return nil
+}
+
+// Wait for every pin to be released. The caller holds pinMu (and keeps
+// holding it until it is done with the mapping so no pin is taken in
+// the meantime).
+func (self *BlockFile) waitUnpinned() {
+	if self.unpinned == nil {
+		self.unpinned = sync.NewCond(&self.pinMu)
+	}
+	for self.pins > 0 {
+		self.unpinned.Wait()
+	}
+}
@@ -0,0 +1,145 @@
+package fmap
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+import (
+	"github.com/timtadh/fs2/errors"
+	"github.com/timtadh/fs2/slice"
+)
+
+// A snapshot is a read only view of a BlockFile frozen at the moment
+// Snapshot() was called. It is copy-on-write at the block level: while
+// a snapshot is open the first Get() of each block from the live file
+// copies the block (its pre-image) into every open snapshot which does
+// not yet have a copy of it. Reads through the snapshot return the copy
+// if there is one and otherwise the (unchanged) live block. The copies
+// are shared between snapshots and are dropped when the snapshot is
+// closed so the cost of a snapshot is proportional to how much of the
+// file is touched while it is open.
+type snapshot struct {
+	parent *BlockFile
+	images map[uint64][]byte
+}
+
+// Take a read only snapshot of the file. The returned BlockFile can be
+// used with Do/Get/Release (and ControlData) like any other. However,
+// the bytes returned must not be modified and the allocation functions
+// return errors. Close() the snapshot when done with it, the file
+// cannot be closed while there are open snapshots.
+func (self *BlockFile) Snapshot() (*BlockFile, error) {
+	if self.snap != nil {
+		return nil, errors.Errorf("Cannot snapshot a snapshot")
+	}
+	if err := self.writable(); err != nil {
+		return nil, err
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	view := &BlockFile{
+		opened:  true,
+		size:    self.size,
+		blksize: self.blksize,
+		snap: &snapshot{
+			parent: self,
+			images: make(map[uint64][]byte),
+		},
+	}
+	self.snapshots = append(self.snapshots, view)
+	return view, nil
+}
+
+// Is this BlockFile a snapshot view?
+func (self *BlockFile) IsSnapshot() bool {
+	return self.snap != nil
+}
+
+func (self *BlockFile) closeSnapshot() error {
+	parent := self.snap.parent
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
+	if !self.opened {
+		return errors.Errorf("File is not open")
+	}
+	if n := atomic.LoadInt64(&self.outstanding); n > 0 {
+		return errors.Errorf("Tried to close snapshot when there were outstanding pointers (%d)", n)
+	}
+	for i, s := range parent.snapshots {
+		if s == self {
+			copy(parent.snapshots[i:], parent.snapshots[i+1:])
+			parent.snapshots[len(parent.snapshots)-1] = nil
+			parent.snapshots = parent.snapshots[:len(parent.snapshots)-1]
+			break
+		}
+	}
+	self.snap.images = nil
+	self.opened = false
+	return nil
+}
+
+// Copy the blocks in the live file into the snapshots which need them.
+// Called (holding the hooks latch) before the live bytes are handed out.
+func (self *BlockFile) snapshotBlocks(offset, length uint64) {
+	blksize := uint64(self.blksize)
+	for a := offset; a < offset+length; a += blksize {
+		var image []byte
+		for _, view := range self.snapshots {
+			if a >= view.size {
+				continue
+			}
+			if _, has := view.snap.images[a]; has {
+				continue
+			}
+			if image == nil {
+				block := &slice.Slice{
+					Array: unsafe.Pointer(uintptr(self.mmap) + uintptr(a)),
+					Len:   int(blksize),
+					Cap:   int(blksize),
+				}
+				image = make([]byte, blksize)
+				copy(image, *block.AsBytes())
+			}
+			view.snap.images[a] = image
+		}
+	}
+}
+
+// Reads through a snapshot always copy. The live block may be written
+// as soon as the latches are released so handing out the live bytes is
+// not safe.
+func (self *BlockFile) snapshotGet(offset, blocks uint64) ([]byte, error) {
+	parent := self.snap.parent
+	parent.mu.RLock()
+	defer parent.mu.RUnlock()
+	if !self.opened {
+		return nil, errors.Errorf("Snapshot is not open")
+	}
+	if !parent.opened {
+		return nil, errors.Errorf("The snapshotted file is not open")
+	}
+	blksize := uint64(self.blksize)
+	length := blocks * blksize
+	if (offset + length) > uint64(self.size) {
+		return nil, errors.Errorf("Get outside of the file, (%d) %d + %d > %d", offset+length, offset, length, self.size)
+	}
+	parent.hooks.Lock()
+	defer parent.hooks.Unlock()
+	bytes := make([]byte, length)
+	for a := offset; a < offset+length; a += blksize {
+		dst := bytes[a-offset : a-offset+blksize]
+		if image, has := self.snap.images[a]; has {
+			copy(dst, image)
+		} else {
+			src := &slice.Slice{
+				Array: unsafe.Pointer(uintptr(parent.mmap) + uintptr(a)),
+				Len:   int(blksize),
+				Cap:   int(blksize),
+			}
+			copy(dst, *src.AsBytes())
+		}
+	}
+	atomic.AddInt64(&self.outstanding, 1)
+	return bytes, nil
+}
@@ -0,0 +1,290 @@
+package fmap
+
+/*
+#include "fmap.h"
+*/
+import "C"
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+import (
+	"github.com/timtadh/fs2/errors"
+	"github.com/timtadh/fs2/slice"
+)
+
+// The write ahead log is an undo log which lives next to the block file
+// (at Path() + LOGSUFFIX). Before a block is handed out by Get() (or
+// Do()) for the first time after a checkpoint its current contents (its
+// "pre-image") are appended to the log and the log is fsync'ed. Blocks
+// which are only read (with DoRead()) are not logged. Sync() checkpoints the
+// file: the mapping is flushed to disk with MS_SYNC and then the log is
+// emptied. If the program crashes between checkpoints the next call to
+// OpenBlockFile() finds a non-empty log and copies the pre-images back
+// into the file (and truncates away any blocks allocated since the
+// checkpoint). So the file always opens in the state it was in at the
+// last successful call to Sync().
+//
+// Log layout
+//
+//	header: magic (8 bytes) | file size at checkpoint (8) | crc32 (4)
+//	record: offset (8) | length (4) | crc32 of offset, length, data (4) | data
+//
+// Records which fail their checksum mark the end of the log. They can
+// only be found at the tail and the block they describe was never
+// modified (the record is synced before Get() returns).
+const LOGSUFFIX = ".wal"
+
+var logMagic = [8]byte{'f', 's', '2', 'w', 'a', 'l', 0, 1}
+
+const logHeaderSize = 20
+
+const logRecordHeaderSize = 16
+
+type wal struct {
+	file   *os.File
+	size   uint64          // the size of the block file at the last checkpoint
+	end    int64           // the offset of the end of the log
+	logged map[uint64]bool // blocks logged since the last checkpoint
+}
+
+func logPath(path string) string {
+	return path + LOGSUFFIX
+}
+
+func openLog(path string) (*wal, error) {
+	f, err := os.OpenFile(logPath(path), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &wal{
+		file:   f,
+		logged: make(map[uint64]bool),
+	}, nil
+}
+
+// Write a fresh header into the log discarding all of the records. The
+// block file must be on disk before this is called.
+func (w *wal) reset(size uint64) error {
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	header := make([]byte, logHeaderSize)
+	copy(header[0:8], logMagic[:])
+	binary.LittleEndian.PutUint64(header[8:16], size)
+	binary.LittleEndian.PutUint32(header[16:20], crc32.ChecksumIEEE(header[:16]))
+	if _, err := w.file.WriteAt(header, 0); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.size = size
+	w.end = logHeaderSize
+	w.logged = make(map[uint64]bool)
+	return nil
+}
+
+// Append the pre-image of the block at offset. The caller must call
+// w.file.Sync() before modifying the block.
+func (w *wal) record(offset uint64, block []byte) error {
+	rec := make([]byte, logRecordHeaderSize+len(block))
+	binary.LittleEndian.PutUint64(rec[0:8], offset)
+	binary.LittleEndian.PutUint32(rec[8:12], uint32(len(block)))
+	copy(rec[logRecordHeaderSize:], block)
+	crc := crc32.ChecksumIEEE(rec[0:12])
+	crc = crc32.Update(crc, crc32.IEEETable, rec[logRecordHeaderSize:])
+	binary.LittleEndian.PutUint32(rec[12:16], crc)
+	if _, err := w.file.WriteAt(rec, w.end); err != nil {
+		return err
+	}
+	w.end += int64(len(rec))
+	w.logged[offset] = true
+	return nil
+}
+
+func (w *wal) close() error {
+	return w.file.Close()
+}
+
+// Copy the pre-images in the log at path back into the file f. Returns
+// true if the file was changed.
+func recoverLog(path string, f *os.File) (recovered bool, err error) {
+	lf, err := os.OpenFile(logPath(path), os.O_RDONLY, 0666)
+	if err != nil && os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer lf.Close()
+	header := make([]byte, logHeaderSize)
+	if _, err := io.ReadFull(lf, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+		// the log was empty or the checkpoint which wrote it crashed
+		// after the file was synced. Either way there is nothing to undo.
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if crc32.ChecksumIEEE(header[:16]) != binary.LittleEndian.Uint32(header[16:20]) {
+		return false, nil
+	}
+	var magic [8]byte
+	copy(magic[:], header[0:8])
+	if magic != logMagic {
+		return false, errors.Errorf("%v is not a block file log", logPath(path))
+	}
+	size := binary.LittleEndian.Uint64(header[8:16])
+	recHeader := make([]byte, logRecordHeaderSize)
+	for {
+		if _, err := io.ReadFull(lf, recHeader); err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return false, err
+		}
+		offset := binary.LittleEndian.Uint64(recHeader[0:8])
+		length := binary.LittleEndian.Uint32(recHeader[8:12])
+		data := make([]byte, length)
+		if _, err := io.ReadFull(lf, data); err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return false, err
+		}
+		crc := crc32.ChecksumIEEE(recHeader[0:12])
+		crc = crc32.Update(crc, crc32.IEEETable, data)
+		if crc != binary.LittleEndian.Uint32(recHeader[12:16]) {
+			break
+		}
+		if _, err := f.WriteAt(data, int64(offset)); err != nil {
+			return false, err
+		}
+		recovered = true
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if uint64(fi.Size()) != size {
+		if err := f.Truncate(int64(size)); err != nil {
+			return false, err
+		}
+		recovered = true
+	}
+	if err := f.Sync(); err != nil {
+		return false, err
+	}
+	return recovered, nil
+}
+
+// Turn on the write ahead log for this file. This checkpoints the file
+// so the state of the file when this returns is the state it will be
+// recovered to if the program crashes before the next Sync(). Once
+// enabled the log stays enabled (including across OpenBlockFile calls)
+// until DisableLog() is called.
+func (self *BlockFile) EnableLog() error {
+	if err := self.writable(); err != nil {
+		return err
+	}
+	if self.file == nil {
+		return errors.Errorf("Cannot log an anonymous map")
+	}
+	self.mu.Lock()
+	if self.wal != nil {
+		self.mu.Unlock()
+		return nil
+	}
+	w, err := openLog(self.path)
+	if err != nil {
+		self.mu.Unlock()
+		return err
+	}
+	self.wal = w
+	self.mu.Unlock()
+	return self.Sync()
+}
+
+// Checkpoint the file and then remove the write ahead log.
+func (self *BlockFile) DisableLog() error {
+	self.lockForCheckpoint()
+	defer self.mu.Unlock()
+	if self.wal == nil {
+		return nil
+	}
+	if err := self.checkpoint(); err != nil {
+		return err
+	}
+	if err := self.wal.close(); err != nil {
+		return err
+	}
+	self.wal = nil
+	return os.Remove(logPath(self.path))
+}
+
+// Is the write ahead log turned on?
+func (self *BlockFile) Logged() bool {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	return self.wal != nil
+}
+
+func (self *BlockFile) logBlocks(offset, length uint64) error {
+	blksize := uint64(self.blksize)
+	wrote := false
+	for a := offset; a < offset+length; a += blksize {
+		if a >= self.wal.size || self.wal.logged[a] {
+			continue
+		}
+		block := &slice.Slice{
+			Array: unsafe.Pointer(uintptr(self.mmap) + uintptr(a)),
+			Len:   int(blksize),
+			Cap:   int(blksize),
+		}
+		if err := self.wal.record(a, *block.AsBytes()); err != nil {
+			return err
+		}
+		wrote = true
+	}
+	if wrote {
+		return self.wal.file.Sync()
+	}
+	return nil
+}
+
+// Take self.mu exclusively once the pointers handed out for writing
+// have been released, so a checkpoint never captures a block half way
+// through being written. Pointers for reading (and pins) are left alone,
+// the blocks they point at do not change.
+func (self *BlockFile) lockForCheckpoint() {
+	for {
+		self.mu.Lock()
+		if self.wal == nil || atomic.LoadInt64(&self.writers) == 0 {
+			return
+		}
+		self.mu.Unlock()
+		self.relMu.Lock()
+		if self.released == nil {
+			self.released = sync.NewCond(&self.relMu)
+		}
+		for atomic.LoadInt64(&self.writers) > 0 {
+			self.released.Wait()
+		}
+		self.relMu.Unlock()
+	}
+}
+
+// Must hold self.mu exclusively (see lockForCheckpoint).
+func (self *BlockFile) checkpoint() error {
+	if atomic.LoadInt64(&self.writers) > 0 {
+		return errors.Errorf("cannot checkpoint the file while blocks are being written")
+	}
+	if errno := C.sync_mmap(self.mmap, C.int(self.file.Fd()), C.MS_SYNC); errno != 0 {
+		return errors.Errorf("sync_mmap failed, %d", errno)
+	}
+	return self.wal.reset(self.size)
+}
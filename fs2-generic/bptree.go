@@ -8,6 +8,7 @@ import (
 )
 
 import (
+	"github.com/timtadh/fs2/bptree"
 	"github.com/timtadh/getopt"
 )
 
@@ -38,7 +39,15 @@ func parseFunc(imports map[string]bool, fqfn string) string {
 	return funcname
 }
 
-func BpTree(fout io.Writer, packageName string, args []string) {
+func importList(paths map[string]bool) []string {
+	imports := make([]string, 0, len(paths))
+	for k := range paths {
+		imports = append(imports, k)
+	}
+	return imports
+}
+
+func BpTree(fout, seqout io.Writer, packageName string, args []string) {
 	_, optargs, err := getopt.GetOpt(
 		args,
 		"h",
@@ -51,6 +60,8 @@ func BpTree(fout io.Writer, packageName string, args []string) {
 			"key-type=",
 			"key-serializer=",
 			"key-deserializer=",
+			"key-comparator=",
+			"key-compare=",
 			"value-size=",
 			"value-empty=",
 			"value-type=",
@@ -69,12 +80,15 @@ func BpTree(fout io.Writer, packageName string, args []string) {
 	keyType := ""
 	keySerializer := ""
 	keyDeserializer := ""
+	keyComparator := ""
+	keyCompare := ""
 	valueSize := -1
 	valueEmpty := "nil"
 	valueType := ""
 	valueSerializer := ""
 	valueDeserializer := ""
 	paths := make(map[string]bool)
+	typePaths := make(map[string]bool)
 	for _, oa := range optargs {
 		switch oa.Opt() {
 		case "-h", "--help":
@@ -86,17 +100,21 @@ func BpTree(fout io.Writer, packageName string, args []string) {
 		case "--key-empty":
 			keyEmpty = oa.Arg()
 		case "--key-type":
-			keyType = parseType(paths, oa.Arg())
+			keyType = parseType(typePaths, oa.Arg())
 		case "--key-serializer":
 			keySerializer = parseFunc(paths, oa.Arg())
 		case "--key-deserializer":
 			keyDeserializer = parseFunc(paths, oa.Arg())
+		case "--key-comparator":
+			keyComparator = oa.Arg()
+		case "--key-compare":
+			keyCompare = parseFunc(paths, oa.Arg())
 		case "--value-size":
 			valueSize = ParseInt(oa.Arg())
 		case "--value-empty":
 			valueEmpty = oa.Arg()
 		case "--value-type":
-			valueType = parseType(paths, oa.Arg())
+			valueType = parseType(typePaths, oa.Arg())
 		case "--value-serializer":
 			valueSerializer = parseFunc(paths, oa.Arg())
 		case "--value-deserializer":
@@ -149,6 +167,18 @@ func BpTree(fout io.Writer, packageName string, args []string) {
 		Usage(ErrorCodes["opts"])
 	}
 
+	if keyCompare != "" && parameters {
+		fmt.Fprintln(os.Stderr, "Cannot supply a key-compare func and use serialization through constructor parameters")
+		Usage(ErrorCodes["opts"])
+	} else if keyCompare != "" && keyComparator == "" {
+		keyComparator = packageName + ".key"
+	}
+
+	if len(keyComparator) > bptree.MaxComparatorName {
+		fmt.Fprintf(os.Stderr, "The key-comparator name %q is longer than %d bytes\n", keyComparator, bptree.MaxComparatorName)
+		Usage(ErrorCodes["opts"])
+	}
+
 	if parameters {
 		keySerializer = "b.serializeKey"
 		valueSerializer = "b.serializeValue"
@@ -156,15 +186,18 @@ func BpTree(fout io.Writer, packageName string, args []string) {
 		valueDeserializer = "b.deserializeValue"
 	}
 
-	imports := make([]string, 0, len(paths))
-	for k := range paths {
-		imports = append(imports, k)
+	// the _seq.go file only refers to the types
+	typeImports := importList(typePaths)
+	for k := range typePaths {
+		paths[k] = true
 	}
+	imports := importList(paths)
 
-	err = bptreeTmpl.Execute(fout, map[string]interface{}{
+	data := map[string]interface{}{
 		"argv":             strings.Join(os.Args, " \\\n*     "),
 		"packageName":      packageName,
 		"imports":          imports,
+		"typeImports":      typeImports,
 		"useParameters":    parameters,
 		"keySize":          keySize,
 		"valueSize":        valueSize,
@@ -176,7 +209,13 @@ func BpTree(fout io.Writer, packageName string, args []string) {
 		"serializeValue":   valueSerializer,
 		"deserializeKey":   keyDeserializer,
 		"deserializeValue": valueDeserializer,
-	})
+		"keyComparator":    keyComparator,
+		"keyCompare":       keyCompare,
+	}
+	err = bptreeTmpl.Execute(fout, data)
+	if err == nil && seqout != nil {
+		err = bptreeSeqTmpl.Execute(seqout, data)
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Template error \n%v\v", err)
 		Usage(ErrorCodes["template"])
@@ -0,0 +1,63 @@
+package main
+
+import "text/template"
+
+var bptreeSeqTmpl = template.Must(template.New("tmpl").Parse(
+	`//go:build go1.23
+
+package {{.packageName}}
+
+/*
+* This file is machine generated by fs2-generic along with the BpTree
+* wrapper in this package. See the wrapper for the command used to
+* generate it and for the licensing information.
+*/
+
+import (
+	"iter"
+){{if .typeImports}}
+
+import ({{range $imp := .typeImports}}
+	"{{$imp}}"{{end}}
+){{end}}
+
+
+// Adapt the iterator run makes to a range-over-func iterator. The
+// returned func gives the error which ended the last loop over the
+// sequence (see fs2.Seq).
+func Seq(run func() (Iterator, error)) (iter.Seq2[{{.keyType}}, {{.valueType}}], func() error) {
+	var err error
+	seq := func(yield func(key {{.keyType}}, value {{.valueType}}) bool) {
+		var kvi Iterator
+		kvi, err = run()
+		if err != nil {
+			return
+		}
+		var key {{.keyType}}
+		var value {{.valueType}}
+		for key, value, err, kvi = kvi(); kvi != nil; key, value, err, kvi = kvi() {
+			if !yield(key, value) {
+				return
+			}
+		}
+	}
+	return seq, func() error { return err }
+}
+
+func (b *BpTree) FindSeq(key {{.keyType}}) (iter.Seq2[{{.keyType}}, {{.valueType}}], func() error) {
+	return Seq(func()(Iterator, error) { return b.Find(key) })
+}
+
+// Range over all of the pairs, see fs2.Seq for usage details.
+func (b *BpTree) All() (iter.Seq2[{{.keyType}}, {{.valueType}}], func() error) {
+	return Seq(b.Iterate)
+}
+
+func (b *BpTree) RangeSeq(from, to {{.keyType}}) (iter.Seq2[{{.keyType}}, {{.valueType}}], func() error) {
+	return Seq(func()(Iterator, error) { return b.Range(from, to) })
+}
+
+func (b *BpTree) BackwardSeq() (iter.Seq2[{{.keyType}}, {{.valueType}}], func() error) {
+	return Seq(b.Backward)
+}
+`))
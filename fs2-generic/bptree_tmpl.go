@@ -40,7 +40,10 @@ var bptreeTmpl = template.Must(template.New("tmpl").Parse(
 *   USA
 */
 
-import (
+import ({{if .keyCompare}}
+	"bytes"{{end}}
+	"context"
+	"errors"
 	"sync"
 )
 
@@ -55,15 +58,31 @@ import ({{range $imp := .imports}}
 ){{end}}
 
 
-type MultiMap interface {
+{{if .keyCompare}}// The name the key order is registered under (see
+// bptree.RegisterComparator). Keys which {{.keyCompare}} says are the
+// same are ordered by their serialized bytes.
+const KeyComparator = "{{.keyComparator}}"
+
+func init() {
+	bptree.RegisterComparator(KeyComparator, func(a, b []byte) int {
+		if c := {{.keyCompare}}({{.deserializeKey}}(a), {{.deserializeKey}}(b)); c != 0 {
+			return c
+		}
+		return bytes.Compare(a, b)
+	})
+}
+
+{{end}}type MultiMap interface {
 	Keys() (KeyIterator, error)
 	Values() (ValueIterator, error)
 	Iterate() (Iterator, error)
 	Backward() (Iterator, error)
 	Find(key {{.keyType}}) (Iterator, error)
 	DoFind(key {{.keyType}}, do func({{.keyType}}, {{.valueType}}) error) error
+	DoFindCtx(ctx context.Context, key {{.keyType}}, do func({{.keyType}}, {{.valueType}}) error) error
 	Range(from, to {{.keyType}}) (Iterator, error)
 	DoRange(from, to {{.keyType}}, do func({{.keyType}}, {{.valueType}}) error) error
+	DoRangeCtx(ctx context.Context, from, to {{.keyType}}, do func({{.keyType}}, {{.valueType}}) error) error
 	Has(key {{.keyType}}) (bool, error)
 	Count(key {{.keyType}}) (int, error)
 	Add(key {{.keyType}}, value {{.valueType}}) error
@@ -77,7 +96,15 @@ type Iterator func() ({{.keyType}}, {{.valueType}}, error, Iterator)
 type KeyIterator func() ({{.keyType}}, error, KeyIterator)
 type ValueIterator func() ({{.valueType}}, error, ValueIterator)
 
+// Call do for every key/value pair from the iterator run makes. If do
+// returns fs2.ErrStop (or wraps it) the iteration ends and Do returns
+// nil.
 func Do(run func() (Iterator, error), do func(key {{.keyType}}, value {{.valueType}}) error) error {
+	return DoCtx(context.Background(), run, do)
+}
+
+// Do which also stops (returning ctx.Err()) when the context is done.
+func DoCtx(ctx context.Context, run func() (Iterator, error), do func(key {{.keyType}}, value {{.valueType}}) error) error {
 	kvi, err := run()
 	if err != nil {
 		return err
@@ -85,38 +112,65 @@ func Do(run func() (Iterator, error), do func(key {{.keyType}}, value {{.valueTy
 	var key {{.keyType}}
 	var value {{.valueType}}
 	for key, value, err, kvi = kvi(); kvi != nil; key, value, err, kvi = kvi() {
+		if e := ctx.Err(); e != nil {
+			return e
+		}
 		e := do(key, value)
-		if e != nil {
+		if errors.Is(e, fs2.ErrStop) {
+			return nil
+		} else if e != nil {
 			return e
 		}
 	}
 	return err
 }
 
+// See Do.
 func DoKey(run func() (KeyIterator, error), do func({{.keyType}}) error) error {
+	return DoKeyCtx(context.Background(), run, do)
+}
+
+// See DoCtx.
+func DoKeyCtx(ctx context.Context, run func() (KeyIterator, error), do func({{.keyType}}) error) error {
 	it, err := run()
 	if err != nil {
 		return err
 	}
 	var item {{.keyType}}
 	for item, err, it = it(); it != nil; item, err, it = it() {
+		if e := ctx.Err(); e != nil {
+			return e
+		}
 		e := do(item)
-		if e != nil {
+		if errors.Is(e, fs2.ErrStop) {
+			return nil
+		} else if e != nil {
 			return e
 		}
 	}
 	return err
 }
 
+// See Do.
 func DoValue(run func() (ValueIterator, error), do func({{.valueType}}) error) error {
+	return DoValueCtx(context.Background(), run, do)
+}
+
+// See DoCtx.
+func DoValueCtx(ctx context.Context, run func() (ValueIterator, error), do func({{.valueType}}) error) error {
 	it, err := run()
 	if err != nil {
 		return err
 	}
 	var item {{.valueType}}
 	for item, err, it = it(); it != nil; item, err, it = it() {
+		if e := ctx.Err(); e != nil {
+			return e
+		}
 		e := do(item)
-		if e != nil {
+		if errors.Is(e, fs2.ErrStop) {
+			return nil
+		} else if e != nil {
 			return e
 		}
 	}
@@ -126,7 +180,7 @@ func DoValue(run func() (ValueIterator, error), do func({{.valueType}}) error) e
 type BpTree struct {
 	bf *fmap.BlockFile
 	bpt *bptree.BpTree
-	mutex sync.Mutex{{if .useParameters}}
+	mutex sync.RWMutex{{if .useParameters}}
 	serializeKey func({{.keyType}}) []byte
 	serializeValue func({{.valueType}}) []byte
 	deserializeKey func([]byte) {{.keyType}}
@@ -193,7 +247,7 @@ type BpTree struct {
 	deserializeKey func([]byte) {{.keyType}},
 	deserializeValue func([]byte) {{.valueType}},
 ) (*BpTree, error) { {{else}}func newBpTree(bf *fmap.BlockFile) (*BpTree, error) { {{end}}
-	bpt, err := bptree.New(bf, {{.keySize}}, {{.valueSize}})
+	bpt, err := bptree.New(bf, {{.keySize}}, {{.valueSize}}{{if .keyComparator}}, bptree.CompareWith("{{.keyComparator}}"){{end}})
 	if err != nil {
 		return nil, err
 	}
@@ -226,8 +280,8 @@ func (b *BpTree) Delete() error {
 }
 
 func (b *BpTree) Size() int {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
 	return b.bpt.Size()
 }
 
@@ -238,21 +292,21 @@ func (b *BpTree) Add(key {{.keyType}}, val {{.valueType}}) error {
 }
 
 func (b *BpTree) Count(key {{.keyType}}) (int, error) {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
 	return b.bpt.Count({{.serializeKey}}(key))
 }
 
 func (b *BpTree) Has(key {{.keyType}}) (bool, error) {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
 	return b.bpt.Has({{.serializeKey}}(key))
 }
 
 func (b *BpTree) kvIter(kvi fs2.Iterator) (it Iterator) {
 	it = func() (key {{.keyType}}, value {{.valueType}}, err error, _ Iterator) {
-		b.mutex.Lock()
-		defer b.mutex.Unlock()
+		b.mutex.RLock()
+		defer b.mutex.RUnlock()
 		var k, v []byte
 		k, v, err, kvi = kvi()
 		if err != nil {
@@ -270,8 +324,8 @@ func (b *BpTree) kvIter(kvi fs2.Iterator) (it Iterator) {
 
 func (b *BpTree) keyIter(raw fs2.ItemIterator) (it KeyIterator) {
 	it = func() (key {{.keyType}}, err error, _ KeyIterator) {
-		b.mutex.Lock()
-		defer b.mutex.Unlock()
+		b.mutex.RLock()
+		defer b.mutex.RUnlock()
 		var i []byte
 		i, err, raw = raw()
 		if err != nil {
@@ -288,8 +342,8 @@ func (b *BpTree) keyIter(raw fs2.ItemIterator) (it KeyIterator) {
 
 func (b *BpTree) valueIter(raw fs2.ItemIterator) (it ValueIterator) {
 	it = func() (value {{.valueType}}, err error, _ ValueIterator) {
-		b.mutex.Lock()
-		defer b.mutex.Unlock()
+		b.mutex.RLock()
+		defer b.mutex.RUnlock()
 		var i []byte
 		i, err, raw = raw()
 		if err != nil {
@@ -305,8 +359,8 @@ func (b *BpTree) valueIter(raw fs2.ItemIterator) (it ValueIterator) {
 }
 
 func (b *BpTree) Keys() (it KeyIterator, err error) {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
 	raw, err := b.bpt.Keys()
 	if err != nil {
 		return nil, err
@@ -315,8 +369,8 @@ func (b *BpTree) Keys() (it KeyIterator, err error) {
 }
 
 func (b *BpTree) Values() (it ValueIterator, err error) {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
 	raw, err := b.bpt.Values()
 	if err != nil {
 		return nil, err
@@ -325,8 +379,8 @@ func (b *BpTree) Values() (it ValueIterator, err error) {
 }
 
 func (b *BpTree) Find(key {{.keyType}}) (it Iterator, err error) {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
 	raw, err := b.bpt.Find({{.serializeKey}}(key))
 	if err != nil {
 		return nil, err
@@ -338,9 +392,13 @@ func (b *BpTree) DoFind(key {{.keyType}}, do func({{.keyType}}, {{.valueType}})
 	return Do(func()(Iterator, error) { return b.Find(key) }, do)
 }
 
+func (b *BpTree) DoFindCtx(ctx context.Context, key {{.keyType}}, do func({{.keyType}}, {{.valueType}}) error) error {
+	return DoCtx(ctx, func()(Iterator, error) { return b.Find(key) }, do)
+}
+
 func (b *BpTree) Iterate() (it Iterator, err error) {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
 	raw, err := b.bpt.Iterate()
 	if err != nil {
 		return nil, err
@@ -349,8 +407,8 @@ func (b *BpTree) Iterate() (it Iterator, err error) {
 }
 
 func (b *BpTree) Range(from, to {{.keyType}}) (it Iterator, err error) {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
 	raw, err := b.bpt.Range({{.serializeKey}}(from), {{.serializeKey}}(to))
 	if err != nil {
 		return nil, err
@@ -362,9 +420,13 @@ func (b *BpTree) DoRange(from, to {{.keyType}}, do func({{.keyType}}, {{.valueTy
 	return Do(func()(Iterator, error) { return b.Range(from, to) }, do)
 }
 
+func (b *BpTree) DoRangeCtx(ctx context.Context, from, to {{.keyType}}, do func({{.keyType}}, {{.valueType}}) error) error {
+	return DoCtx(ctx, func()(Iterator, error) { return b.Range(from, to) }, do)
+}
+
 func (b *BpTree) Backward() (it Iterator, err error) {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
 	raw, err := b.bpt.Backward()
 	if err != nil {
 		return nil, err
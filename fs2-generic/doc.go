@@ -14,6 +14,12 @@ Assuming you already have the code downloaded and in your GOPATH just run:
 
     $ go install github.com/timtadh/fs2/fs2-generic
 
+The range-over-func iterators of the generated wrappers (`All`, `RangeSeq`,
+...) are put in a second file next to the output, `file_seq.go` for
+`--output=file.go`, which has a `go1.23` build constraint. The wrapper itself
+builds with older versions of Go. The iterators are not generated when the
+output goes to stdout.
+
 How to generate a wrapper for the B+ Tree
 
     $ fs2-generic \
@@ -78,6 +84,18 @@ How to generate a wrapper for the B+ Tree
                 --value-serializer=SerializeFloat64 \
                 --value-deserializer=DeserializeFloat64
 
+    By default the keys are ordered by their serialized bytes. To order them
+    by the Go type supply a compare func, `func(a, b T) int` returning <0, 0
+    or >0. The generated file registers it (see bptree.RegisterComparator)
+    under the name given by --key-comparator (default `<package-name>.key`):
+
+        --key-compare=my/package/name/Func
+
+    or use a comparator which is already registered (eg. the built in `int`,
+    `float` or `reverse`):
+
+        --key-comparator=int
+
 The fs2-generic command can be used on conjunction with `go generate`. To do so
 simply create a `.go` file in the package where the generated code should live.
 For example, let's pretend that we want to create a B+Tree with 3 dimension
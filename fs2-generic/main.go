@@ -29,6 +29,7 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"strings"
 )
 
 import (
@@ -56,6 +57,9 @@ Global Options
   -h, --help                view this message
   --types                   query what types are supported
   -o, --output=<path>       where to put the output (default stdout)
+                            the range-over-func iterators go into
+                            <path>_seq.go (without the .go of <path>)
+                            and are not generated for stdout
 
 bptree
 
@@ -88,6 +92,13 @@ bptree
     --key-type=<type>
     --key-serializer=<func>
     --key-deserializer=<func>
+    --key-comparator=<name>            order the keys with the comparator
+                                       registered under name (see
+                                       bptree.RegisterComparator)
+                                       default: bytes
+    --key-compare=<func>               order the keys with a func(T, T) int
+                                       (registered as --key-comparator,
+                                       default: <package-name>.key)
     --value-size=<int>                 default: variably sized
     --value-empty=<string>             empty value, default:nil
     --value-type=<type>
@@ -170,7 +181,7 @@ func main() {
 		Usage(ErrorCodes["opts"])
 	}
 
-	types := map[string]func(io.Writer, string, []string){
+	types := map[string]func(io.Writer, io.Writer, string, []string){
 		"bptree": BpTree,
 		"mmlist": MMList,
 	}
@@ -214,6 +225,7 @@ func main() {
 	}
 
 	var fout io.WriteCloser
+	var seqout io.Writer
 	if outputPath == "" {
 		fout = os.Stdout
 	} else {
@@ -222,8 +234,16 @@ func main() {
 			fmt.Fprintf(os.Stderr, "%v\n", err)
 			Usage(ErrorCodes["opts"])
 		}
+		seqPath := AssertFile(strings.TrimSuffix(outputPath, ".go") + "_seq.go")
+		seqfile, err := os.Create(seqPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			Usage(ErrorCodes["opts"])
+		}
+		defer seqfile.Close()
+		seqout = seqfile
 	}
 	defer fout.Close()
 
-	typefunc(fout, packageName, args[1:])
+	typefunc(fout, seqout, packageName, args[1:])
 }
@@ -0,0 +1,118 @@
+package main
+
+import "testing"
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+const ints = `package ints
+
+import "encoding/binary"
+
+func SerInt(i int64) []byte {
+	bytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(bytes, uint64(i))
+	return bytes
+}
+
+func DeserInt(bytes []byte) int64 {
+	return int64(binary.BigEndian.Uint64(bytes))
+}
+
+func CmpInt(a, b int64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+`
+
+func write(t *testing.T, path, contents string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(contents), 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func generate(t *testing.T, dir, name string, gen func(io.Writer, io.Writer, string, []string), args ...string) {
+	path := filepath.Join(dir, name, name+".go")
+	write(t, path, "")
+	fout, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fout.Close()
+	seqout, err := os.Create(filepath.Join(dir, name, name+"_seq.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seqout.Close()
+	gen(fout, seqout, name, args)
+}
+
+func build(t *testing.T, gocmd, dir string) {
+	cmd := exec.Command(gocmd, "vet", "./...")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOTOOLCHAIN=local", "GOWORK=off")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+}
+
+// The wrappers use the user's funcs while their _seq.go files only use
+// the types, so both have to build with the funcs in another package.
+func TestGeneratedBuilds(t *testing.T) {
+	gocmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("the go command is needed to build the generated code")
+	}
+	root, err := filepath.Abs("..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum, err := ioutil.ReadFile(filepath.Join(root, "go.sum"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "fs2-generic-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write(t, filepath.Join(dir, "go.mod"),
+		"module gen\n\ngo 1.23\n\nrequire github.com/timtadh/fs2 v0.0.0\n\nreplace github.com/timtadh/fs2 => "+root+"\n")
+	write(t, filepath.Join(dir, "go.sum"), string(sum))
+	write(t, filepath.Join(dir, "ints", "ints.go"), ints)
+	generate(t, dir, "tree", BpTree,
+		"--key-type=int64", "--key-size=8", "--key-empty=0",
+		"--key-serializer=gen/ints/SerInt",
+		"--key-deserializer=gen/ints/DeserInt",
+		"--key-compare=gen/ints/CmpInt",
+		"--value-type=int64", "--value-size=8", "--value-empty=0",
+		"--value-serializer=gen/ints/SerInt",
+		"--value-deserializer=gen/ints/DeserInt",
+	)
+	generate(t, dir, "list", MMList,
+		"--item-type=int64", "--item-empty=0",
+		"--item-serializer=gen/ints/SerInt",
+		"--item-deserializer=gen/ints/DeserInt",
+	)
+	build(t, gocmd, dir)
+	// and the wrappers do not need their iterators
+	for _, name := range []string{"tree", "list"} {
+		if err := os.Remove(filepath.Join(dir, name, name+"_seq.go")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	build(t, gocmd, dir)
+}
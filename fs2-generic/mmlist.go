@@ -11,7 +11,7 @@ import (
 	"github.com/timtadh/getopt"
 )
 
-func MMList(fout io.Writer, packageName string, args []string) {
+func MMList(fout, seqout io.Writer, packageName string, args []string) {
 	_, optargs, err := getopt.GetOpt(
 		args,
 		"h",
@@ -35,6 +35,7 @@ func MMList(fout io.Writer, packageName string, args []string) {
 	itemSerializer := ""
 	itemDeserializer := ""
 	paths := make(map[string]bool)
+	typePaths := make(map[string]bool)
 	for _, oa := range optargs {
 		switch oa.Opt() {
 		case "-h", "--help":
@@ -44,7 +45,7 @@ func MMList(fout io.Writer, packageName string, args []string) {
 		case "--item-empty":
 			itemEmpty = oa.Arg()
 		case "--item-type":
-			itemType = parseType(paths, oa.Arg())
+			itemType = parseType(typePaths, oa.Arg())
 		case "--item-serializer":
 			itemSerializer = parseFunc(paths, oa.Arg())
 		case "--item-deserializer":
@@ -81,21 +82,28 @@ func MMList(fout io.Writer, packageName string, args []string) {
 		itemDeserializer = "m.deserializeItem"
 	}
 
-	imports := make([]string, 0, len(paths))
-	for k := range paths {
-		imports = append(imports, k)
+	// the _seq.go file only refers to the types
+	typeImports := importList(typePaths)
+	for k := range typePaths {
+		paths[k] = true
 	}
+	imports := importList(paths)
 
-	err = mmlistTmpl.Execute(fout, map[string]interface{}{
+	data := map[string]interface{}{
 		"argv":            strings.Join(os.Args, " \\\n*     "),
 		"packageName":     packageName,
 		"imports":         imports,
+		"typeImports":     typeImports,
 		"useParameters":   parameters,
 		"itemEmpty":       itemEmpty,
 		"itemType":        itemType,
 		"serializeItem":   itemSerializer,
 		"deserializeItem": itemDeserializer,
-	})
+	}
+	err = mmlistTmpl.Execute(fout, data)
+	if err == nil && seqout != nil {
+		err = mmlistSeqTmpl.Execute(seqout, data)
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Template error \n%v\v", err)
 		Usage(ErrorCodes["template"])
@@ -0,0 +1,41 @@
+package main
+
+import "text/template"
+
+var mmlistSeqTmpl = template.Must(template.New("tmpl").Parse(
+	`//go:build go1.23
+
+package {{.packageName}}
+
+/*
+* This file is machine generated by fs2-generic along with the MMList
+* wrapper in this package. See the wrapper for the command used to
+* generate it and for the licensing information.
+*/
+
+import (
+	"iter"
+){{if .typeImports}}
+
+import ({{range $imp := .typeImports}}
+	"{{$imp}}"{{end}}
+){{end}}
+
+
+// Range over the index and item of everything in the list, see
+// mmlist.List.All.
+func (m *MMList) All() (iter.Seq2[uint64, {{.itemType}}], func() error) {
+	var err error
+	seq := func(yield func(i uint64, item {{.itemType}}) bool) {
+		err = nil
+		for i := uint64(0); i < m.Size(); i++ {
+			var item {{.itemType}}
+			item, err = m.Get(i)
+			if err != nil || !yield(i, item) {
+				return
+			}
+		}
+	}
+	return seq, func() error { return err }
+}
+`))
@@ -69,7 +69,7 @@ type List interface {
 type MMList struct {
 	bf *fmap.BlockFile
 	list *mmlist.List
-	mutex sync.Mutex{{if .useParameters}}
+	mutex sync.RWMutex{{if .useParameters}}
 	serializeItem func({{.itemType}}) []byte
 	deserializeItem func([]byte) {{.itemType}}{{end}}
 }
@@ -77,7 +77,7 @@ type MMList struct {
 {{if .useParameters}}func AnonList(
 	serializeItem func({{.itemType}}) []byte,
 	deserializeItem func([]byte) {{.itemType}},
-) (*MMList, error) { {{else}}func AnonList() (*List, error) { {{end}}
+) (*MMList, error) { {{else}}func AnonList() (*MMList, error) { {{end}}
 	bf, err := fmap.Anonymous(fmap.BLOCKSIZE)
 	if err != nil {
 		return nil, err
@@ -155,8 +155,8 @@ func (m *MMList) Delete() error {
 }
 
 func (m *MMList) Size() uint64 {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
 	return m.list.Size()
 }
 
@@ -167,8 +167,8 @@ func (m *MMList) Append(item {{.itemType}}) (i uint64, err error) {
 }
 
 func (m *MMList) Get(i uint64) (item {{.itemType}}, err error) {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
 	bytes, err := m.list.Get(i)
 	if err != nil {
 		return {{.itemEmpty}}, err
@@ -29,6 +29,7 @@ import (
 
 import (
 	"github.com/timtadh/fs2/bptree"
+	"github.com/timtadh/fs2/checksum"
 	"github.com/timtadh/fs2/consts"
 	"github.com/timtadh/fs2/errors"
 	"github.com/timtadh/fs2/fmap"
@@ -36,11 +37,13 @@ import (
 )
 
 type List struct {
-	bf      *fmap.BlockFile
-	varchar *bptree.Varchar
-	idxTree *bptree.BpTree
-	a       uint64
-	count   uint64
+	bf        *fmap.BlockFile
+	varchar   *bptree.Varchar
+	idxTree   *bptree.BpTree
+	a         uint64
+	count     uint64
+	checksums bool
+	idxs      checksum.Tracker
 }
 
 type ctrlBlk struct {
@@ -55,9 +58,10 @@ const ctrlBlkSize = 32
 const itemsPerIdx = (consts.BLOCKSIZE / 8) - 1
 
 type idxBlk struct {
-	flags consts.Flag
-	count uint16
-	items [itemsPerIdx]uint64
+	flags    consts.Flag
+	count    uint16
+	checksum uint32
+	items    [itemsPerIdx]uint64
 }
 
 const idxBlkSize = consts.BLOCKSIZE
@@ -81,16 +85,17 @@ func assert_len(bytes []byte, length int) {
 	}
 }
 
-func (c *ctrlBlk) Init(varchar, idxTree uint64) {
-	c.flags = consts.LIST_CTRL
+func (c *ctrlBlk) Init(flags consts.Flag, varchar, idxTree uint64) {
+	c.flags = consts.LIST_CTRL | flags
 	c.varchar = varchar
 	c.idxTree = idxTree
 	c.count = 0
 }
 
-func (b *idxBlk) Init() {
-	b.flags = consts.LIST_IDX
+func (b *idxBlk) Init(flags consts.Flag) {
+	b.flags = consts.LIST_IDX | flags
 	b.count = 0
+	b.checksum = 0
 	for i := range b.items {
 		b.items[i] = 0
 	}
@@ -130,7 +135,10 @@ func (b *idxBlk) Set(i uint16, a uint64) error {
 	return nil
 }
 
-func New(bf *fmap.BlockFile) (*List, error) {
+// Create a new list in the BlockFile. The only option which applies to
+// a List is bptree.Checksums which also checksums the index blocks of
+// the list.
+func New(bf *fmap.BlockFile, opts ...bptree.Option) (*List, error) {
 	ctrl_a, err := bf.Allocate()
 	if err != nil {
 		return nil, err
@@ -142,10 +150,10 @@ func New(bf *fmap.BlockFile) (*List, error) {
 	if err != nil {
 		return nil, err
 	}
-	return NewAt(bf, ctrl_a)
+	return NewAt(bf, ctrl_a, opts...)
 }
 
-func NewAt(bf *fmap.BlockFile, ctrl_a uint64) (*List, error) {
+func NewAt(bf *fmap.BlockFile, ctrl_a uint64, opts ...bptree.Option) (*List, error) {
 	vc_a, err := bf.Allocate()
 	if err != nil {
 		return nil, err
@@ -154,24 +162,29 @@ func NewAt(bf *fmap.BlockFile, ctrl_a uint64) (*List, error) {
 	if err != nil {
 		return nil, err
 	}
-	v, err := bptree.NewVarchar(bf, vc_a)
+	v, err := bptree.NewVarchar(bf, vc_a, opts...)
 	if err != nil {
 		return nil, err
 	}
-	it, err := bptree.NewAt(bf, it_a, 8, 8)
+	var itOpts []bptree.Option
+	if v.Checksums() {
+		itOpts = append(itOpts, bptree.Checksums())
+	}
+	it, err := bptree.NewAt(bf, it_a, 8, 8, itOpts...)
 	if err != nil {
 		return nil, err
 	}
 	l := &List{
-		bf:      bf,
-		varchar: v,
-		idxTree: it,
-		a:       ctrl_a,
-		count:   0,
+		bf:        bf,
+		varchar:   v,
+		idxTree:   it,
+		a:         ctrl_a,
+		count:     0,
+		checksums: v.Checksums(),
 	}
 	err = l.bf.Do(ctrl_a, 1, func(bytes []byte) error {
 		c := l.asCtrl(bytes)
-		c.Init(vc_a, it_a)
+		c.Init(l.flags(), vc_a, it_a)
 		return nil
 	})
 	if err != nil {
@@ -201,6 +214,7 @@ func OpenAt(bf *fmap.BlockFile, ctrl_a uint64) (*List, error) {
 			return err
 		}
 		l.count = ctrl.count
+		l.checksums = ctrl.flags&consts.CHECKSUMS != 0
 		return nil
 	})
 	if err != nil {
@@ -372,6 +386,28 @@ func (l *List) SwapDelete(i uint64) (item []byte, err error) {
 	return l.Pop()
 }
 
+// Compact the BlockFile the list is in, moving the index blocks of the
+// list (and the nodes of the trees it uses) from the end of the file
+// into free blocks and shrinking the file. Only use this if the list is
+// the only structure in the BlockFile. It returns the number of bytes
+// the file shrank by.
+func (l *List) Compact() (reclaimed uint64, err error) {
+	r := bptree.NewRelocator()
+	err = r.AddTree(l.idxTree)
+	if err != nil {
+		return 0, err
+	}
+	err = r.AddPointers(l.idxTree)
+	if err != nil {
+		return 0, err
+	}
+	err = r.AddVarchar(l.varchar)
+	if err != nil {
+		return 0, err
+	}
+	return l.bf.Compact(r.Relocate)
+}
+
 func (l *List) idxKey(i uint64) (key []byte) {
 	idx := i / itemsPerIdx
 	key = make([]byte, 8)
@@ -423,7 +459,8 @@ func (l *List) newBlk(key []byte) (uint64, error) {
 	}
 	err = l.bf.Do(a, 1, func(bytes []byte) error {
 		blk := l.asIdx(bytes)
-		blk.Init()
+		blk.Init(l.flags())
+		sealIdx(bytes)
 		return nil
 	})
 	if err != nil {
@@ -463,8 +500,10 @@ func (l *List) do(
 ) error {
 	return l.bf.Do(a, 1, func(bytes []byte) error {
 		flags := consts.AsFlag(bytes)
-		if flags == consts.LIST_CTRL {
+		if flags&^consts.CHECKSUMS == consts.LIST_CTRL {
 			return doCtrl(l.asCtrl(bytes))
+		} else if flags == consts.LIST_IDX|consts.CHECKSUMS {
+			return l.checkedIdx(a, bytes, doIdx)
 		} else if flags == consts.LIST_IDX {
 			return doIdx(l.asIdx(bytes))
 		} else {
@@ -472,3 +511,43 @@ func (l *List) do(
 		}
 	})
 }
+
+func (l *List) flags() consts.Flag {
+	if l.checksums {
+		return consts.CHECKSUMS
+	}
+	return 0
+}
+
+// The checksum of an idxBlk covers the whole block except for the
+// checksum field.
+func idxChecksum(bytes []byte) (sum uint32, stored []byte) {
+	return checksum.Sum(bytes[:4], bytes[8:]), bytes[4:8]
+}
+
+func sealIdx(bytes []byte) {
+	if consts.AsFlag(bytes) != consts.LIST_IDX|consts.CHECKSUMS {
+		return
+	}
+	sum, stored := idxChecksum(bytes)
+	if binary.LittleEndian.Uint32(stored) != sum {
+		binary.LittleEndian.PutUint32(stored, sum)
+	}
+}
+
+// Verify the checksum of the idxBlk on the outermost access and update
+// it on the outermost exit.
+func (l *List) checkedIdx(a uint64, bytes []byte, do func(*idxBlk) error) error {
+	if l.idxs.Enter(a) {
+		sum, stored := idxChecksum(bytes)
+		if expected := binary.LittleEndian.Uint32(stored); sum != expected {
+			l.idxs.Exit(a)
+			return errors.Corruption(a, expected, sum)
+		}
+	}
+	err := do(l.asIdx(bytes))
+	if l.idxs.Exit(a) {
+		sealIdx(bytes)
+	}
+	return err
+}
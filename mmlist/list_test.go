@@ -12,7 +12,10 @@ import (
 )
 
 import (
+	"github.com/timtadh/fs2/bptree"
+	"github.com/timtadh/fs2/errors"
 	"github.com/timtadh/fs2/fmap"
+	"github.com/timtadh/fs2/slice"
 )
 
 type T testing.T
@@ -250,3 +253,92 @@ func TestAppendPopCycle(x *testing.T) {
 	}
 	t.assert("size == 0", l.Size() == 0)
 }
+
+func TestChecksums(x *testing.T) {
+	t := (*T)(x)
+	bf, clean := t.blkfile()
+	defer clean()
+	l, err := New(bf, bptree.Checksums())
+	t.assert_nil(err)
+	items := make([][]byte, 0, 1500)
+	for i := 0; i < cap(items); i++ {
+		item := t.rand_bytes(rand.Intn(100) + 1)
+		items = append(items, item)
+		_, err := l.Append(item)
+		t.assert_nil(err)
+	}
+	t.assert_nil(l.Swap(3, 1400))
+	items[3], items[1400] = items[1400], items[3]
+	l, err = Open(bf)
+	t.assert_nil(err)
+	for i, item := range items {
+		d, err := l.Get(uint64(i))
+		t.assert_nil(err)
+		t.assert("item should be the same", bytes.Equal(d, item))
+	}
+	var a uint64
+	t.assert_nil(l.idxTree.DoFind(l.idxKey(0), func(_, value []byte) error {
+		a = *slice.AsUint64(&value)
+		return nil
+	}))
+	t.assert_nil(bf.Do(a, 1, func(bytes []byte) error {
+		bytes[100] ^= 0xff
+		return nil
+	}))
+	_, err = l.Get(0)
+	cerr, ok := err.(*errors.CorruptionError)
+	t.assert("expected a corruption error", ok)
+	t.assert("the error should name the block", cerr.Offset == a)
+}
+
+func TestCompact(x *testing.T) {
+	t := (*T)(x)
+	bf, err := fmap.CreateBlockFile("/tmp/__mmlist_compact")
+	t.assert_nil(err)
+	defer func() {
+		t.assert_nil(bf.Close())
+		t.assert_nil(bf.Remove())
+	}()
+	l, err := New(bf)
+	t.assert_nil(err)
+	items := make([][]byte, 0, 5000)
+	for i := 0; i < cap(items); i++ {
+		item := t.rand_bytes(8)
+		items = append(items, item)
+		_, err := l.Append(item)
+		t.assert_nil(err)
+	}
+	// free some blocks in the middle of the file so there is something
+	// to move into.
+	holes := make([]uint64, 0, 200)
+	for i := 0; i < cap(holes); i++ {
+		a, err := bf.Allocate()
+		t.assert_nil(err)
+		holes = append(holes, a)
+	}
+	for i := 0; i < 5000; i++ {
+		item := t.rand_bytes(8)
+		items = append(items, item)
+		_, err := l.Append(item)
+		t.assert_nil(err)
+	}
+	for _, a := range holes {
+		t.assert_nil(bf.Free(a))
+	}
+	before, err := bf.Size()
+	t.assert_nil(err)
+	_, err = l.Compact()
+	t.assert_nil(err)
+	after, err := bf.Size()
+	t.assert_nil(err)
+	// the varchar storage cannot be moved so how much the file shrinks
+	// depends on where it ended up.
+	t.assert(fmt.Sprintf("the file should not grow %d -> %d", before, after), after <= before)
+	l, err = Open(bf)
+	t.assert_nil(err)
+	for i, item := range items {
+		d, err := l.Get(uint64(i))
+		t.assert_nil(err)
+		t.assert("item should be the same", bytes.Equal(d, item))
+	}
+}
@@ -0,0 +1,36 @@
+//go:build go1.23
+
+package mmlist
+
+import (
+	"iter"
+)
+
+// Range over the index and item of everything in the list, in order
+//
+//	items, errf := l.All()
+//	for i, item := range items {
+//		// do something with the item
+//	}
+//	if err := errf(); err != nil {
+//		// handle error
+//	}
+//
+// The func returned with the sequence gives the error which ended the
+// last loop over it. The items are copies and may escape the loop. The
+// size of the list is read before each item so items appended during
+// the loop are visited.
+func (l *List) All() (iter.Seq2[uint64, []byte], func() error) {
+	var err error
+	seq := func(yield func(i uint64, item []byte) bool) {
+		err = nil
+		for i := uint64(0); i < l.Size(); i++ {
+			var item []byte
+			item, err = l.Get(i)
+			if err != nil || !yield(i, item) {
+				return
+			}
+		}
+	}
+	return seq, func() error { return err }
+}
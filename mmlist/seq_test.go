@@ -0,0 +1,37 @@
+//go:build go1.23
+
+package mmlist
+
+import "testing"
+
+import (
+	"bytes"
+	"fmt"
+)
+
+func TestAll(x *testing.T) {
+	t := (*T)(x)
+	l, clean := t.mmlist()
+	defer clean()
+	items := make([][]byte, 0, 1000)
+	for i := 0; i < cap(items); i++ {
+		item := t.rand_bytes(1 + i%50)
+		items = append(items, item)
+		_, err := l.Append(item)
+		t.assert_nil(err)
+	}
+	seq, err := l.All()
+	count := 0
+	for i, item := range seq {
+		t.assert(fmt.Sprintf("item %v", i), i == uint64(count) && bytes.Equal(item, items[i]))
+		count++
+	}
+	t.assert_nil(err())
+	t.assert(fmt.Sprintf("ranged over %v items", count), count == len(items))
+	for i := range seq {
+		if i == 5 {
+			break
+		}
+	}
+	t.assert_nil(err())
+}
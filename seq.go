@@ -0,0 +1,58 @@
+//go:build go1.23
+
+package fs2
+
+import (
+	"iter"
+)
+
+// Adapt the iterator run makes to a range-over-func iterator. The
+// returned func gives the error (from run or the iterator) which ended
+// the last loop over the sequence, nil if it ran to the end or the loop
+// was broken out of.
+//
+//	pairs, errf := fs2.Seq(func() (fs2.Iterator, error) { return bpt.Iterate() })
+//	for key, value := range pairs {
+//		// do something with the key and value
+//	}
+//	if err := errf(); err != nil {
+//		// handle error
+//	}
+func Seq(run func() (Iterator, error)) (iter.Seq2[[]byte, []byte], func() error) {
+	var err error
+	seq := func(yield func(key, value []byte) bool) {
+		var kvi Iterator
+		kvi, err = run()
+		if err != nil {
+			return
+		}
+		var key []byte
+		var value []byte
+		for key, value, err, kvi = kvi(); kvi != nil; key, value, err, kvi = kvi() {
+			if !yield(key, value) {
+				return
+			}
+		}
+	}
+	return seq, func() error { return err }
+}
+
+// Adapt the item iterator run makes to a range-over-func iterator, see
+// Seq.
+func ItemSeq(run func() (ItemIterator, error)) (iter.Seq[[]byte], func() error) {
+	var err error
+	seq := func(yield func(item []byte) bool) {
+		var it ItemIterator
+		it, err = run()
+		if err != nil {
+			return
+		}
+		var item []byte
+		for item, err, it = it(); it != nil; item, err, it = it() {
+			if !yield(item) {
+				return
+			}
+		}
+	}
+	return seq, func() error { return err }
+}
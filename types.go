@@ -1,5 +1,10 @@
 package fs2
 
+import (
+	"context"
+	"errors"
+)
+
 type MultiMap interface {
 	Keys() (ItemIterator, error)
 	Values() (ItemIterator, error)
@@ -19,7 +24,21 @@ type MultiMap interface {
 type Iterator func() ([]byte, []byte, error, Iterator)
 type ItemIterator func() ([]byte, error, ItemIterator)
 
+// Return ErrStop (or an error wrapping it) from the function given to Do
+// (or any of the Do* iterators) to stop iterating early. Do returns nil
+// rather than ErrStop.
+var ErrStop = errors.New("stop iterating")
+
+// Call do for every key/value pair from the iterator run makes. Stops
+// at the first error (from the iterator or do). If do returns ErrStop
+// (or wraps it) the iteration ends and Do returns nil.
 func Do(run func() (Iterator, error), do func(key []byte, value []byte) error) error {
+	return DoCtx(context.Background(), run, do)
+}
+
+// Do which also stops (returning ctx.Err()) when the context is done.
+// The context is checked before each pair.
+func DoCtx(ctx context.Context, run func() (Iterator, error), do func(key []byte, value []byte) error) error {
 	kvi, err := run()
 	if err != nil {
 		return err
@@ -27,23 +46,40 @@ func Do(run func() (Iterator, error), do func(key []byte, value []byte) error) e
 	var key []byte
 	var value []byte
 	for key, value, err, kvi = kvi(); kvi != nil; key, value, err, kvi = kvi() {
+		if e := ctx.Err(); e != nil {
+			return e
+		}
 		e := do(key, value)
-		if e != nil {
+		if errors.Is(e, ErrStop) {
+			return nil
+		} else if e != nil {
 			return e
 		}
 	}
 	return err
 }
 
+// Call do for every item from the iterator run makes, see Do.
 func DoItem(run func() (ItemIterator, error), do func([]byte) error) error {
+	return DoItemCtx(context.Background(), run, do)
+}
+
+// DoItem which also stops (returning ctx.Err()) when the context is
+// done, see DoCtx.
+func DoItemCtx(ctx context.Context, run func() (ItemIterator, error), do func([]byte) error) error {
 	it, err := run()
 	if err != nil {
 		return err
 	}
 	var item []byte
 	for item, err, it = it(); it != nil; item, err, it = it() {
+		if e := ctx.Err(); e != nil {
+			return e
+		}
 		e := do(item)
-		if e != nil {
+		if errors.Is(e, ErrStop) {
+			return nil
+		} else if e != nil {
 			return e
 		}
 	}